@@ -37,22 +37,31 @@ func Insert(tree **Node, data KV) {
 		(*tree).Size++
 	} else {
 		(*tree).Data.Value = data.Value
-		(*tree).Data.Tombstone = false
+		(*tree).Data.Tombstone = data.Tombstone
+		(*tree).Data.Merge = data.Merge
+		(*tree).Data.Operands = data.Operands
+		(*tree).Data.Version = data.Version
 	}
 }
 
-func Delete(tree **Node, key string) {
-	if tree == nil {
+// Merge stacks operand on the record of key, folding it into the operand
+// before it when the operator allows.
+func Merge(tree **Node, key string, operand Operand) {
+	pair, err := (*tree).Find(key)
+	if err != nil {
+		Insert(tree, KV{Key: key, Merge: true, Operands: []Operand{operand}})
 		return
-	} else if key < (*tree).Data.Key {
-		Delete(&((*tree).Left), key)
-		(*tree).Size++
-	} else if key > (*tree).Data.Key {
-		Delete(&((*tree).Right), key)
-		(*tree).Size++
-	} else {
-		(*tree).Data.Tombstone = true
 	}
+
+	operands := append(append([]Operand(nil), pair.Operands...), operand)
+	pair.Operands = foldOperands(key, operands)
+	Insert(tree, pair)
+}
+
+// Delete records a tombstone for key so that older values living in the
+// disk files are shadowed until compaction drops them.
+func Delete(tree **Node, key string) {
+	Insert(tree, KV{Key: key, Tombstone: true})
 }
 
 func (tree *Node) Find(key string) (KV, error) {
@@ -127,5 +136,8 @@ func (tree *Node) JustGreater(key string) (KV, error) {
 }
 
 func (tree *Node) GetSize() int {
+	if tree == nil {
+		return 0
+	}
 	return tree.Size
 }
@@ -18,6 +18,7 @@ type DiskFile struct {
 	index            *Node
 	buffer           bytes.Buffer
 	NumberOfElements int
+	Meta             TableMeta
 }
 
 func (d DiskFile) Empty() bool {
@@ -188,12 +189,30 @@ func (d *DiskFile) All() []KV {
 		searchBuffer := bytes.NewBuffer(d.buffer.Bytes()[StartIndex:EndIndex])
 
 		DecodedSearchBuffer := gob.NewDecoder(searchBuffer)
-		var curr KV
 
-		for DecodedSearchBuffer.Decode(&curr) == nil {
+		for {
+			// gob leaves zero valued fields untouched, so every element
+			// needs a fresh KV or a tombstone would leak into the next one.
+			var curr KV
+			if DecodedSearchBuffer.Decode(&curr) != nil {
+				break
+			}
 			list = append(list, curr)
 		}
 	}
 	return list
 
 }
+
+// Each calls fn with the pairs of d in key order, decoding one block at a
+// time rather than all of them like All, and stops at the first error fn
+// returns.
+func (d *DiskFile) Each(fn func(KV) error) error {
+	for c := newTableCursor(d); c.valid(); c.next() {
+		err := fn(c.pair())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package lsmtree
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// bottomLevel holds the ingested tables that overlapped no other table.
+// They are older than every other table, so compaction, which merges the
+// newest tables, reaches them last.
+const bottomLevel = 2
+
+var ErrOverlappingTables = errors.New("ingested sstables overlap each other")
+
+// LoadExternalTable reads a table built by SSTableWriter and checks it
+// before Ingest: its checksum, that its keys are strictly increasing and
+// that it holds no merge operands.
+func LoadExternalTable(fs vfs.FS, path string) (DiskFile, error) {
+	diskFile, err := LoadTable(fs, path)
+	if err != nil {
+		return DiskFile{}, err
+	}
+
+	var meta TableMeta
+	err = diskFile.Each(func(pair KV) error {
+		if meta.Elements > 0 && pair.Key <= meta.Largest {
+			return ErrUnsortedTable
+		}
+		if pair.Merge || len(pair.Operands) > 0 {
+			return ErrCorruptTable
+		}
+		if meta.Elements == 0 {
+			meta.Smallest = pair.Key
+		}
+		meta.Largest = pair.Key
+		meta.Elements++
+		return nil
+	})
+	if err != nil {
+		return DiskFile{}, err
+	}
+	if meta.Elements != diskFile.NumberOfElements {
+		return DiskFile{}, ErrCorruptTable
+	}
+
+	if meta.Elements > 0 {
+		diskFile.Meta = meta
+	}
+	return diskFile, nil
+}
+
+// CheckOverlap fails with ErrOverlappingTables when two of the tables hold
+// keys in the same range.
+func CheckOverlap(tables []DiskFile) error {
+	var sorted []DiskFile
+	for _, table := range tables {
+		if !table.Empty() {
+			sorted = append(sorted, table)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Meta.Smallest < sorted[j].Meta.Smallest
+	})
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Meta.Smallest <= sorted[i-1].Meta.Largest {
+			return ErrOverlappingTables
+		}
+	}
+	return nil
+}
+
+// Ingest adds tables loaded by LoadExternalTable to the tree with a single
+// manifest edit, without going through the memtable. A table that overlaps
+// no disk file goes to the bottom level, under every other table; the
+// others go on top as the newest tables. Memtable records of keys a table
+// holds are replaced by the table's, which is the newer write.
+func (lsmTree *LSMTree) Ingest(tables []DiskFile) error {
+	var ingested []DiskFile
+	for _, table := range tables {
+		if !table.Empty() {
+			ingested = append(ingested, table)
+		}
+	}
+	err := CheckOverlap(ingested)
+	if err != nil || len(ingested) == 0 {
+		return err
+	}
+
+	// a memtable that is being flushed cannot be changed, wait for it
+	for {
+		lsmTree.treeRWLock.Lock()
+		if lsmTree.secondaryTree == nil {
+			break
+		}
+		lsmTree.treeRWLock.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	defer lsmTree.treeRWLock.Unlock()
+
+	lsmTree.diskRWLock.Lock()
+	defer lsmTree.diskRWLock.Unlock()
+
+	var bottom, top []DiskFile
+	var edit VersionEdit
+	for _, table := range ingested {
+		level := bottomLevel
+		for i := range lsmTree.diskFiles {
+			smallest, largest := lsmTree.diskFiles[i].bounds()
+			if smallest <= table.Meta.Largest && table.Meta.Smallest <= largest {
+				level = 0
+				break
+			}
+		}
+
+		err = lsmTree.writeTable(&table, level)
+		if err != nil {
+			lsmTree.removeTables(edit.Added)
+			return err
+		}
+		if lsmTree.manifest != nil {
+			edit.Added = append(edit.Added, table.Meta)
+		}
+
+		if level == bottomLevel {
+			bottom = append(bottom, table)
+		} else {
+			top = append(top, table)
+		}
+	}
+
+	if lsmTree.manifest != nil {
+		err := lsmTree.manifest.LogEdit(edit)
+		if err != nil {
+			lsmTree.removeTables(edit.Added)
+			return err
+		}
+	}
+
+	for _, table := range ingested {
+		table.Each(func(pair KV) error {
+			lsmTree.BloomFilter.Add(pair.Key)
+			return nil
+		})
+	}
+
+	for _, pair := range lsmTree.tree.All() {
+		for i := range ingested {
+			if pair.Key < ingested[i].Meta.Smallest || pair.Key > ingested[i].Meta.Largest {
+				continue
+			}
+			record, err := ingested[i].Search(pair.Key)
+			if err == nil {
+				Insert(&lsmTree.tree, record)
+			}
+		}
+	}
+
+	lsmTree.diskFiles = append(append(bottom, lsmTree.diskFiles...), top...)
+	return nil
+}
+
+// removeTables deletes the files of tables that were written but never
+// recorded in the manifest.
+func (lsmTree *LSMTree) removeTables(tables []TableMeta) {
+	for _, meta := range tables {
+		lsmTree.manifest.fs.Remove(lsmTree.manifest.TablePath(meta.Number))
+	}
+}
+
+// bounds returns the smallest and the largest key of d.
+func (d *DiskFile) bounds() (string, string) {
+	if d.Meta.Smallest != "" {
+		return d.Meta.Smallest, d.Meta.Largest
+	}
+
+	pairs := d.All()
+	if len(pairs) == 0 {
+		return "", ""
+	}
+	return pairs[0].Key, pairs[len(pairs)-1].Key
+}
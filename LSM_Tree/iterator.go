@@ -0,0 +1,207 @@
+package lsmtree
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"strconv"
+)
+
+// Iterator walks a point in time view of the live pairs of the tree in
+// increasing key order. Tombstones and shadowed values are already resolved.
+// It merges the memtables and the tables as it goes, so only one block of
+// every table is decoded at a time.
+type Iterator struct {
+	// sources are ordered from the newest to the oldest
+	sources []cursor
+	current KV
+	// versioned makes the tombstones with a version show up as well
+	versioned bool
+}
+
+func (lsmTree *LSMTree) NewIterator() *Iterator {
+	return lsmTree.newIterator(false)
+}
+
+// NewRecordIterator is NewIterator for the records of the keys, which also
+// walks the tombstones with a version, see KV.
+func (lsmTree *LSMTree) NewRecordIterator() *Iterator {
+	return lsmTree.newIterator(true)
+}
+
+func (lsmTree *LSMTree) newIterator(versioned bool) *Iterator {
+	var sources []cursor
+
+	// as in Get, a flush must not move a memtable between the two reads.
+	// The memtables change in place and are copied, the tables never do.
+	lsmTree.treeRWLock.RLock()
+	lsmTree.diskRWLock.RLock()
+	sources = append(sources, &memCursor{pairs: lsmTree.tree.All()})
+	if lsmTree.secondaryTree != lsmTree.flushed {
+		sources = append(sources, &memCursor{pairs: lsmTree.secondaryTree.All()})
+	}
+	for i := len(lsmTree.diskFiles) - 1; i >= 0; i-- {
+		sources = append(sources, newTableCursor(&lsmTree.diskFiles[i]))
+	}
+	lsmTree.diskRWLock.RUnlock()
+	lsmTree.treeRWLock.RUnlock()
+
+	return &Iterator{sources: sources, versioned: versioned}
+}
+
+// Next advances to the next pair and reports whether there is one. The
+// records of the smallest key left are taken from every source, newer ones
+// winning on the older ones or stacking their merge operands on them.
+func (it *Iterator) Next() bool {
+	for {
+		key, found := "", false
+		for _, source := range it.sources {
+			if source.valid() && (!found || source.pair().Key < key) {
+				key, found = source.pair().Key, true
+			}
+		}
+		if !found {
+			it.current = KV{}
+			return false
+		}
+
+		var records []KV
+		for _, source := range it.sources {
+			if source.valid() && source.pair().Key == key {
+				records = append(records, source.pair())
+				source.next()
+			}
+		}
+
+		pair := resolve(key, records, true)
+		if _, exists := value(pair); exists || it.versioned && pair.Tombstone && pair.Version.Time != 0 {
+			it.current = pair
+			return true
+		}
+	}
+}
+
+// Seek positions the iterator so that the following Next lands on the first
+// key greater than or equal to key.
+func (it *Iterator) Seek(key string) {
+	for _, source := range it.sources {
+		source.seek(key)
+	}
+}
+
+func (it *Iterator) Key() string {
+	return it.current.Key
+}
+
+func (it *Iterator) Value() string {
+	return it.current.Value
+}
+
+// Record returns the resolved record of the current key.
+func (it *Iterator) Record() KV {
+	return it.current
+}
+
+// cursor walks the sorted records of one memtable or table.
+type cursor interface {
+	valid() bool
+	pair() KV
+	next()
+	// seek moves to the first record with a key greater than or equal to key
+	seek(key string)
+}
+
+// memCursor walks a copy of a memtable.
+type memCursor struct {
+	pairs []KV
+	pos   int
+}
+
+func (c *memCursor) valid() bool {
+	return c.pos < len(c.pairs)
+}
+
+func (c *memCursor) pair() KV {
+	return c.pairs[c.pos]
+}
+
+func (c *memCursor) next() {
+	c.pos++
+}
+
+func (c *memCursor) seek(key string) {
+	c.pos = sort.Search(len(c.pairs), func(i int) bool {
+		return c.pairs[i].Key >= key
+	})
+}
+
+// tableCursor walks a table block by block, a block being the records
+// between two entries of its sparse index.
+type tableCursor struct {
+	data  []byte
+	index []KV
+	// block is the index of the block decoded into pairs
+	block int
+	pairs []KV
+	pos   int
+}
+
+func newTableCursor(d *DiskFile) *tableCursor {
+	c := &tableCursor{data: d.buffer.Bytes(), index: d.index.All(), block: -1}
+	c.load(0)
+	return c
+}
+
+// load decodes block, skipping the empty ones after it, and moves to its
+// first record.
+func (c *tableCursor) load(block int) {
+	c.pairs, c.pos = nil, 0
+	for c.block = block; c.block < len(c.index) && len(c.pairs) == 0; c.block++ {
+		start, _ := strconv.Atoi(c.index[c.block].Value)
+		end := len(c.data)
+		if c.block+1 < len(c.index) {
+			end, _ = strconv.Atoi(c.index[c.block+1].Value)
+		}
+
+		decoder := gob.NewDecoder(bytes.NewReader(c.data[start:end]))
+		for {
+			// a fresh KV for every record, see DiskFile.All
+			var pair KV
+			if decoder.Decode(&pair) != nil {
+				break
+			}
+			c.pairs = append(c.pairs, pair)
+		}
+	}
+	c.block--
+}
+
+func (c *tableCursor) valid() bool {
+	return c.pos < len(c.pairs)
+}
+
+func (c *tableCursor) pair() KV {
+	return c.pairs[c.pos]
+}
+
+func (c *tableCursor) next() {
+	c.pos++
+	if c.pos == len(c.pairs) && c.block+1 < len(c.index) {
+		c.load(c.block + 1)
+	}
+}
+
+func (c *tableCursor) seek(key string) {
+	// the last block starting at or before key, or the first one
+	block := sort.Search(len(c.index), func(i int) bool {
+		return c.index[i].Key > key
+	}) - 1
+	if block < 0 {
+		block = 0
+	}
+
+	c.load(block)
+	for c.valid() && c.pair().Key < key {
+		c.next()
+	}
+}
@@ -1,8 +1,11 @@
 package lsmtree
 
 import (
+	"log"
 	"sync"
 	"time"
+
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
 )
 
 const (
@@ -12,70 +15,216 @@ const (
 	BloomFilterCapacity = 1000000
 )
 
+// KV is the record of a key. Operands are merges applied on top of Value,
+// or of a missing value for a tombstone. A record with Merge set holds only
+// operands and applies them to whatever older record the key has. Version
+// stamps the writes of a multi-leader node, a tombstone with a version is
+// kept by compaction until it is deleted once more.
 type KV struct {
 	Key       string
 	Value     string
 	Tombstone bool
+	Merge     bool
+	Operands  []Operand
+	Version   Version
+}
+
+// Version is the hybrid logical clock timestamp Time of a write, the ID of
+// the Node it was made on and the timestamp Prev of the version it
+// replaced there. The zero Version is the one of unversioned writes.
+type Version struct {
+	Time uint64
+	Node string
+	Prev uint64
 }
 
 type LSMTree struct {
-	treeRWLock     sync.RWMutex
-	diskRWLock     sync.RWMutex
-	tree           *Node
-	secondaryTree  *Node
-	diskFiles      []DiskFile
+	treeRWLock    sync.RWMutex
+	diskRWLock    sync.RWMutex
+	tree          *Node
+	secondaryTree *Node
+	diskFiles     []DiskFile
+	// flushed is the memtable Flush last added to diskFiles, which stays the
+	// secondary memtable until Flush clears it
+	flushed        *Node
 	flushThreshold int
 	BloomFilter    *CustomBloomFilter
+	manifest       *Manifest
+	// flushFailed is set once a memtable could not be written as a table
+	flushFailed bool
+	stop        chan struct{}
+	background  sync.WaitGroup
 }
 
+// LSMTreeOptions configures the tree. When Directory is empty the disk files
+// only live in memory, otherwise they are written there as SSTables and
+// tracked by a MANIFEST. FS defaults to vfs.Default.
 type LSMTreeOptions struct {
 	MaximumElement     int
 	CompactionPeriod   int
+	Directory          string
+	FS                 vfs.FS
 	BloomFilterOptions CustomBloomFilterOptions
 }
 
-func InitLsmTree(options LSMTreeOptions) *LSMTree {
+func InitLsmTree(options LSMTreeOptions) (*LSMTree, error) {
 	lsmTree := &LSMTree{
-		tree:           &Node{},
-		secondaryTree:  &Node{},
 		diskFiles:      []DiskFile{},
 		flushThreshold: options.MaximumElement,
 		BloomFilter:    NewCustomBloomFilter(options.BloomFilterOptions),
+		stop:           make(chan struct{}),
+	}
+
+	if options.FS == nil {
+		options.FS = vfs.Default
+	}
+
+	if options.Directory != "" {
+		err := lsmTree.loadTables(options.FS, options.Directory)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	go lsmTree.PeriodicCompaction(options.CompactionPeriod)
-	return lsmTree
+	lsmTree.background.Add(1)
+	go func() {
+		defer lsmTree.background.Done()
+		lsmTree.PeriodicCompaction(options.CompactionPeriod)
+	}()
+	return lsmTree, nil
 }
 
-func (lsmTree *LSMTree) PeriodicCompaction(CompactionPeriod int) {
+// Close stops the compaction loop, waits for pending flushes, flushes the
+// active memtable and closes the manifest. The tree must not be used after.
+func (lsmTree *LSMTree) Close() error {
+	return lsmTree.CloseAt(0)
+}
 
-	for {
-		time.Sleep(time.Duration(CompactionPeriod) * time.Millisecond)
+// CloseAt closes the tree like Close and, when every memtable made it to a
+// table, records in the manifest that the tables hold every write up to
+// lsn, which the next open reports through SyncedLSN.
+func (lsmTree *LSMTree) CloseAt(lsn uint64) error {
+	close(lsmTree.stop)
+	lsmTree.background.Wait()
 
-		var db1, db2 DiskFile
+	lsmTree.treeRWLock.Lock()
+	pending := lsmTree.tree != nil
+	if pending {
+		lsmTree.secondaryTree = lsmTree.tree
+		lsmTree.tree = nil
+	}
+	lsmTree.treeRWLock.Unlock()
 
-		lsmTree.diskRWLock.RLock()
+	if pending {
+		lsmTree.Flush()
+	}
+
+	if lsmTree.manifest == nil {
+		return nil
+	}
+	var err error
+	if lsn != 0 && !lsmTree.flushFailed {
+		err = lsmTree.manifest.LogEdit(VersionEdit{Synced: lsn})
+	}
+	if closeErr := lsmTree.manifest.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// SyncedLSN returns the LSN the tables held every write up to when the tree
+// was last closed with CloseAt, or 0 when it was not closed cleanly since or
+// has no directory.
+func (lsmTree *LSMTree) SyncedLSN() uint64 {
+	if lsmTree.manifest == nil {
+		return 0
+	}
+	return lsmTree.manifest.Synced()
+}
+
+// loadTables rebuilds the table set recorded in the manifest of dir.
+func (lsmTree *LSMTree) loadTables(fs vfs.FS, dir string) error {
+	manifest, err := OpenManifest(fs, dir)
+	if err != nil {
+		return err
+	}
 
-		if len(lsmTree.diskFiles) >= 2 {
-			db1 = lsmTree.diskFiles[len(lsmTree.diskFiles)-1]
-			db2 = lsmTree.diskFiles[len(lsmTree.diskFiles)-2]
+	for _, meta := range manifest.Tables() {
+		diskFile, err := LoadTable(fs, manifest.TablePath(meta.Number))
+		if err != nil {
+			manifest.Close()
+			return err
 		}
+		diskFile.Meta = meta
 
-		if db1.Empty() || db2.Empty() {
+		for _, pair := range diskFile.All() {
+			lsmTree.BloomFilter.Add(pair.Key)
+		}
+		lsmTree.diskFiles = append(lsmTree.diskFiles, diskFile)
+	}
 
+	lsmTree.manifest = manifest
+	return nil
+}
+
+// Checkpoint writes the tables of the tree to dir, see Manifest.Checkpoint.
+// Compactions wait until it returns, so no table goes away under it. A tree
+// without a directory has nothing to write.
+func (lsmTree *LSMTree) Checkpoint(dir string) error {
+	if lsmTree.manifest == nil {
+		return nil
+	}
+
+	lsmTree.diskRWLock.RLock()
+	defer lsmTree.diskRWLock.RUnlock()
+	return lsmTree.manifest.Checkpoint(dir)
+}
+
+// PeriodicCompaction compacts the disk files every CompactionPeriod
+// milliseconds until the tree is closed.
+func (lsmTree *LSMTree) PeriodicCompaction(CompactionPeriod int) {
+
+	for {
+		select {
+		case <-lsmTree.stop:
+			return
+		case <-time.After(time.Duration(CompactionPeriod) * time.Millisecond):
+		}
+
+		lsmTree.diskRWLock.Lock()
+
+		if len(lsmTree.diskFiles) < 2 {
+			lsmTree.diskRWLock.Unlock()
 			continue
 		}
 
-		newDiskBlock := compact(db1, db2)
+		db1 := lsmTree.diskFiles[len(lsmTree.diskFiles)-1]
+		db2 := lsmTree.diskFiles[len(lsmTree.diskFiles)-2]
+
+		// Tombstones only need to outlive the compaction when older files
+		// may still hold a value for their key.
+		newDiskBlock := compact(db1, db2, len(lsmTree.diskFiles) == 2)
+
+		err := lsmTree.replaceTables(db1, db2, &newDiskBlock)
+		if err != nil {
+			log.Printf("compaction failed: %v", err)
+			lsmTree.diskRWLock.Unlock()
+			continue
+		}
 
 		lsmTree.diskFiles = lsmTree.diskFiles[0 : len(lsmTree.diskFiles)-2]
-		lsmTree.diskFiles = append(lsmTree.diskFiles, newDiskBlock)
-		lsmTree.diskRWLock.RUnlock()
+		if !newDiskBlock.Empty() {
+			lsmTree.diskFiles = append(lsmTree.diskFiles, newDiskBlock)
+		}
+		lsmTree.diskRWLock.Unlock()
 
 	}
 }
 
-func compact(db1 DiskFile, db2 DiskFile) DiskFile {
+// compact merges db1 into db2, db1 being the newer of the two so its pairs
+// win on equal keys. Merge operands are folded into the value under them,
+// and into a missing one when the output is the oldest file.
+func compact(db1 DiskFile, db2 DiskFile, dropTombstones bool) DiskFile {
 	pairs1 := db1.All()
 	pairs2 := db2.All()
 
@@ -83,23 +232,35 @@ func compact(db1 DiskFile, db2 DiskFile) DiskFile {
 	i, j := 0, 0
 	var newPairs []KV
 
+	add := func(pairs ...KV) {
+		pair := resolve(pairs[0].Key, pairs, dropTombstones)
+		if dropTombstones && pair.Tombstone && len(pair.Operands) == 0 && pair.Version.Time == 0 {
+			return
+		}
+		newPairs = append(newPairs, pair)
+	}
+
 	for i < len(pairs1) && j < len(pairs2) {
 		if pairs1[i].Key < pairs2[j].Key {
-			newPairs = append(newPairs, pairs1[i])
+			add(pairs1[i])
 			i++
+		} else if pairs1[i].Key > pairs2[j].Key {
+			add(pairs2[j])
+			j++
 		} else {
-			newPairs = append(newPairs, pairs2[j])
+			add(pairs1[i], pairs2[j])
+			i++
 			j++
 		}
 	}
 
 	for i < len(pairs1) {
-		newPairs = append(newPairs, pairs1[i])
+		add(pairs1[i])
 		i++
 	}
 
 	for j < len(pairs2) {
-		newPairs = append(newPairs, pairs2[j])
+		add(pairs2[j])
 		j++
 	}
 
@@ -107,55 +268,115 @@ func compact(db1 DiskFile, db2 DiskFile) DiskFile {
 
 }
 
-func (lsmTree *LSMTree) Get(key string) (string, bool) {
+// writeTable persists diskFile as a new SSTable at level. It is a no-op for
+// trees that are not backed by a directory.
+func (lsmTree *LSMTree) writeTable(diskFile *DiskFile, level int) error {
+	diskFile.Meta.Level = level
+	if lsmTree.manifest == nil || diskFile.Empty() {
+		return nil
+	}
 
-	lsmTree.treeRWLock.RLock()
+	pairs := diskFile.All()
+	diskFile.Meta = TableMeta{
+		Number:   lsmTree.manifest.NewFileNumber(),
+		Level:    level,
+		Smallest: pairs[0].Key,
+		Largest:  pairs[len(pairs)-1].Key,
+		Elements: diskFile.NumberOfElements,
+	}
 
-	pair, err := lsmTree.tree.Find(key)
+	return diskFile.WriteTable(lsmTree.manifest.fs, lsmTree.manifest.TablePath(diskFile.Meta.Number))
+}
 
-	if err == nil {
+// replaceTables records the compaction of db1 and db2 into output with a
+// single manifest edit and only then removes the input files.
+func (lsmTree *LSMTree) replaceTables(db1 DiskFile, db2 DiskFile, output *DiskFile) error {
+	err := lsmTree.writeTable(output, 1)
+	if err != nil || lsmTree.manifest == nil {
+		return err
+	}
 
-		lsmTree.treeRWLock.RUnlock()
-		if pair.Tombstone {
-			return "", false
-		}
+	edit := VersionEdit{Deleted: []uint64{db1.Meta.Number, db2.Meta.Number}}
+	if !output.Empty() {
+		edit.Added = []TableMeta{output.Meta}
+	}
 
-		return pair.Value, true
+	err = lsmTree.manifest.LogEdit(edit)
+	if err != nil {
+		lsmTree.manifest.fs.Remove(lsmTree.manifest.TablePath(output.Meta.Number))
+		return err
 	}
 
-	pair, err = lsmTree.secondaryTree.Find(key)
+	for _, number := range edit.Deleted {
+		lsmTree.manifest.fs.Remove(lsmTree.manifest.TablePath(number))
+	}
+	return nil
+}
 
-	if err == nil {
+// Get looks the key up from the newest record to the oldest, stopping at
+// the first one that is not a merge, and resolves the operands on the way.
+func (lsmTree *LSMTree) Get(key string) (string, bool) {
+	pair, found := lsmTree.Record(key)
+	if !found {
+		return "", false
+	}
+	return value(pair)
+}
 
-		lsmTree.treeRWLock.RUnlock()
-		if pair.Tombstone {
-			return "", false
-		}
-		return pair.Value, true
+// Record returns the resolved record of key, which can be a tombstone, and
+// whether the tree holds one.
+func (lsmTree *LSMTree) Record(key string) (KV, bool) {
+	var pairs []KV
+	found := func(pair KV) bool {
+		pairs = append(pairs, pair)
+		return !pair.Merge
 	}
 
-	isPresent := lsmTree.BloomFilter.Contains(key)
+	// the memtables stay locked while the disk files are searched, a flush
+	// in between would let the same operands be read twice
+	lsmTree.treeRWLock.RLock()
+	defer lsmTree.treeRWLock.RUnlock()
 
-	if !isPresent {
-		return "", false
+	pair, err := lsmTree.tree.Find(key)
+	if err == nil && found(pair) {
+		return resolve(key, pairs, true), true
 	}
 
-	lsmTree.treeRWLock.RUnlock()
 	lsmTree.diskRWLock.RLock()
 	defer lsmTree.diskRWLock.RUnlock()
 
-	for _, diskBlock := range lsmTree.diskFiles {
-		pair, err = diskBlock.GetDataFromDisk(key)
-		if err == nil {
+	// a secondary memtable already in the disk files is read from them
+	if lsmTree.secondaryTree != lsmTree.flushed {
+		pair, err = lsmTree.secondaryTree.Find(key)
+		if err == nil && found(pair) {
+			return resolve(key, pairs, true), true
+		}
+	}
+
+	if len(pairs) == 0 && !lsmTree.BloomFilter.Contains(key) {
+		return KV{}, false
+	}
 
-			if pair.Tombstone {
-				continue
-			}
-			return pair.Value, true
+	// newer files shadow older ones, so search from the end
+	for i := len(lsmTree.diskFiles) - 1; i >= 0; i-- {
+		pair, err = lsmTree.diskFiles[i].Search(key)
+		if err == nil && found(pair) {
+			break
 		}
 	}
 
-	return "", false
+	if len(pairs) == 0 {
+		return KV{}, false
+	}
+	return resolve(key, pairs, true), true
+}
+
+// value returns the value of a resolved record and whether the key exists.
+func value(pair KV) (string, bool) {
+	if pair.Tombstone || pair.Merge {
+		return "", false
+	}
+	return pair.Value, true
 }
 
 func (lsmTree *LSMTree) Put(key string, value string) {
@@ -163,16 +384,50 @@ func (lsmTree *LSMTree) Put(key string, value string) {
 	lsmTree.treeRWLock.Lock()
 	defer lsmTree.treeRWLock.Unlock()
 
-	Insert(&(lsmTree.tree), KV{key, value, false})
+	Insert(&(lsmTree.tree), KV{Key: key, Value: value})
 
-	go lsmTree.BloomFilter.Add(key)
+	lsmTree.BloomFilter.Add(key)
 
-	if lsmTree.tree.GetSize() >= lsmTree.flushThreshold && lsmTree.secondaryTree == nil {
+	lsmTree.maybeFlush()
+}
 
-		lsmTree.secondaryTree = lsmTree.tree
-		lsmTree.tree = nil
-		go lsmTree.Flush()
-	}
+// PutVersion writes value to key as the write stamped with version.
+func (lsmTree *LSMTree) PutVersion(key string, value string, version Version) {
+	lsmTree.treeRWLock.Lock()
+	defer lsmTree.treeRWLock.Unlock()
+
+	Insert(&(lsmTree.tree), KV{Key: key, Value: value, Version: version})
+
+	lsmTree.BloomFilter.Add(key)
+
+	lsmTree.maybeFlush()
+}
+
+// DelVersion records the delete of key stamped with version. Its tombstone
+// is kept until Del drops it, and is added to the bloom filter so that
+// Record finds it even for a key never written here.
+func (lsmTree *LSMTree) DelVersion(key string, version Version) {
+	lsmTree.treeRWLock.Lock()
+	defer lsmTree.treeRWLock.Unlock()
+
+	Insert(&(lsmTree.tree), KV{Key: key, Tombstone: true, Version: version})
+
+	lsmTree.BloomFilter.Add(key)
+
+	lsmTree.maybeFlush()
+}
+
+// Merge adds operand to key, to be resolved by the merge operator named
+// operator when the key is read.
+func (lsmTree *LSMTree) Merge(key string, operator string, operand string) {
+	lsmTree.treeRWLock.Lock()
+	defer lsmTree.treeRWLock.Unlock()
+
+	Merge(&(lsmTree.tree), key, Operand{Operator: operator, Value: operand})
+
+	lsmTree.BloomFilter.Add(key)
+
+	lsmTree.maybeFlush()
 }
 
 func (lsmTree *LSMTree) Del(key string) {
@@ -180,15 +435,44 @@ func (lsmTree *LSMTree) Del(key string) {
 	defer lsmTree.treeRWLock.Unlock()
 
 	Delete(&(lsmTree.tree), key)
-	Delete(&(lsmTree.secondaryTree), key)
 
+	lsmTree.maybeFlush()
+}
+
+// maybeFlush hands the memtable over to a background flush once it is full.
+// The caller must hold treeRWLock.
+func (lsmTree *LSMTree) maybeFlush() {
+	if lsmTree.tree.GetSize() >= lsmTree.flushThreshold && lsmTree.secondaryTree == nil {
+
+		lsmTree.secondaryTree = lsmTree.tree
+		lsmTree.tree = nil
+		lsmTree.background.Add(1)
+		go func() {
+			defer lsmTree.background.Done()
+			lsmTree.Flush()
+		}()
+	}
 }
 
 func (LSMTree *LSMTree) Flush() {
-	newDiskBlocks := []DiskFile{NewDiskFile(LSMTree.secondaryTree.All())}
+	pairs := LSMTree.secondaryTree.All()
+	for i, pair := range pairs {
+		pairs[i] = resolve(pair.Key, []KV{pair}, false)
+	}
+	newDiskBlock := NewDiskFile(pairs)
 
 	LSMTree.diskRWLock.Lock()
-	LSMTree.diskFiles = append(LSMTree.diskFiles, newDiskBlocks...)
+	err := LSMTree.writeTable(&newDiskBlock, 0)
+	if err == nil && LSMTree.manifest != nil {
+		err = LSMTree.manifest.LogEdit(VersionEdit{Added: []TableMeta{newDiskBlock.Meta}})
+	}
+	if err != nil {
+		// keep serving the table from memory, the WAL still holds its data
+		log.Printf("flushing memtable failed: %v", err)
+		LSMTree.flushFailed = true
+	}
+	LSMTree.diskFiles = append(LSMTree.diskFiles, newDiskBlock)
+	LSMTree.flushed = LSMTree.secondaryTree
 	LSMTree.diskRWLock.Unlock()
 
 	LSMTree.treeRWLock.Lock()
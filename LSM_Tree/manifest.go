@@ -0,0 +1,351 @@
+package lsmtree
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+const (
+	currentFileName = "CURRENT"
+	lockFileName    = "LOCK"
+	manifestPrefix  = "MANIFEST-"
+	tableSuffix     = ".sst"
+	tempSuffix      = ".tmp"
+)
+
+// TableMeta describes one live SSTable as recorded in the manifest.
+type TableMeta struct {
+	Number   uint64 `json:"n"`
+	Level    int    `json:"l"`
+	Smallest string `json:"s"`
+	Largest  string `json:"g"`
+	Elements int    `json:"e"`
+}
+
+// VersionEdit is a single atomic change to the live table set. A flush adds
+// one table, a compaction adds its output and deletes its inputs in the same
+// edit so that a crash can never leave half of it applied. Synced is only
+// set by the last edit of a clean close, see LSMTree.CloseAt.
+type VersionEdit struct {
+	NextFileNumber uint64      `json:"next,omitempty"`
+	Added          []TableMeta `json:"add,omitempty"`
+	Deleted        []uint64    `json:"del,omitempty"`
+	Synced         uint64      `json:"synced,omitempty"`
+}
+
+// Manifest is the append-only log of version edits. CURRENT names the
+// manifest file that is in use.
+type Manifest struct {
+	fs             vfs.FS
+	dir            string
+	lock           sync.Mutex
+	dirLock        io.Closer
+	file           vfs.File
+	number         uint64
+	nextFileNumber uint64
+	tables         map[uint64]TableMeta
+	// synced is the Synced of the last edit
+	synced uint64
+}
+
+// OpenManifest replays the manifest named by CURRENT in dir, writes a fresh
+// manifest holding a snapshot of the live set and removes every file that is
+// not part of it, such as the output of an interrupted compaction. The
+// directory stays locked until Close.
+func OpenManifest(fs vfs.FS, dir string) (*Manifest, error) {
+	err := fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	dirLock, err := fs.Lock(filepath.Join(dir, lockFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{
+		fs:             fs,
+		dir:            dir,
+		dirLock:        dirLock,
+		nextFileNumber: 1,
+		tables:         make(map[uint64]TableMeta),
+	}
+
+	current, err := vfs.ReadFile(fs, filepath.Join(dir, currentFileName))
+	if err == nil {
+		err = m.replay(filepath.Join(dir, strings.TrimSpace(string(current))))
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+
+	if err == nil {
+		err = m.rotate()
+	}
+
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	err = m.removeObsoleteFiles()
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *Manifest) replay(path string) error {
+	file, err := m.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+
+	for scanner.Scan() {
+		edit, ok := decodeEdit(scanner.Text())
+		if !ok {
+			// A torn record can only be the tail of the log, written by a
+			// crash before its fsync returned.
+			break
+		}
+		m.apply(edit)
+	}
+
+	return scanner.Err()
+}
+
+func (m *Manifest) apply(edit VersionEdit) {
+	m.synced = edit.Synced
+	if edit.NextFileNumber > m.nextFileNumber {
+		m.nextFileNumber = edit.NextFileNumber
+	}
+	for _, number := range edit.Deleted {
+		delete(m.tables, number)
+	}
+	for _, table := range edit.Added {
+		m.tables[table.Number] = table
+		if table.Number >= m.nextFileNumber {
+			m.nextFileNumber = table.Number + 1
+		}
+	}
+}
+
+// rotate starts a new manifest whose first record is the whole live set and
+// points CURRENT at it.
+func (m *Manifest) rotate() error {
+	number := m.nextFileNumber
+	m.nextFileNumber++
+
+	name := fmt.Sprintf("%s%06d", manifestPrefix, number)
+	file, err := m.fs.Create(filepath.Join(m.dir, name))
+	if err != nil {
+		return err
+	}
+
+	snapshot := VersionEdit{NextFileNumber: m.nextFileNumber, Added: m.Tables()}
+	err = writeEdit(file, snapshot)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = vfs.WriteFileAtomic(m.fs, filepath.Join(m.dir, currentFileName), []byte(name+"\n"))
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if m.file != nil {
+		m.file.Close()
+	}
+	m.file = file
+	m.number = number
+	return nil
+}
+
+func (m *Manifest) removeObsoleteFiles() error {
+	names, err := m.fs.ReadDir(m.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		obsolete := false
+
+		switch {
+		case strings.HasSuffix(name, tempSuffix):
+			obsolete = true
+		case strings.HasPrefix(name, manifestPrefix):
+			number, err := strconv.ParseUint(strings.TrimPrefix(name, manifestPrefix), 10, 64)
+			obsolete = err == nil && number != m.number
+		case strings.HasSuffix(name, tableSuffix):
+			number, err := strconv.ParseUint(strings.TrimSuffix(name, tableSuffix), 10, 64)
+			_, live := m.tables[number]
+			obsolete = err == nil && !live
+		}
+
+		if obsolete {
+			err = m.fs.Remove(filepath.Join(m.dir, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Synced returns the LSN the live tables held every write up to when the
+// manifest was last closed cleanly, and 0 once any other edit followed. The
+// fresh manifest OpenManifest writes does not carry it, so that a crash of
+// this run does not leave it behind.
+func (m *Manifest) Synced() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.synced
+}
+
+// NewFileNumber reserves a number for a table that is about to be written.
+func (m *Manifest) NewFileNumber() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	number := m.nextFileNumber
+	m.nextFileNumber++
+	return number
+}
+
+// LogEdit durably appends edit to the manifest and applies it to the live set.
+func (m *Manifest) LogEdit(edit VersionEdit) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	edit.NextFileNumber = m.nextFileNumber
+	err := writeEdit(m.file, edit)
+	if err != nil {
+		return err
+	}
+
+	m.apply(edit)
+	return nil
+}
+
+// Tables returns the live set ordered from the oldest to the newest table.
+// Tables at the bottom level come first, they were ingested under the rest.
+func (m *Manifest) Tables() []TableMeta {
+	tables := make([]TableMeta, 0, len(m.tables))
+	for _, table := range m.tables {
+		tables = append(tables, table)
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		bottomI, bottomJ := tables[i].Level == bottomLevel, tables[j].Level == bottomLevel
+		if bottomI != bottomJ {
+			return bottomI
+		}
+		return tables[i].Number < tables[j].Number
+	})
+	return tables
+}
+
+// Checkpoint hard links the live tables into dir and writes a manifest
+// holding them, so that dir opens as a manifest of its own. The caller must
+// keep the tables from being deleted until it returns.
+func (m *Manifest) Checkpoint(dir string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	err := m.fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tables := m.Tables()
+	for _, table := range tables {
+		name := filepath.Base(m.TablePath(table.Number))
+		err = vfs.LinkOrCopy(m.fs, m.TablePath(table.Number), filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	name := fmt.Sprintf("%s%06d", manifestPrefix, m.nextFileNumber)
+	file, err := m.fs.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+
+	err = writeEdit(file, VersionEdit{NextFileNumber: m.nextFileNumber + 1, Added: tables})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return vfs.WriteFileAtomic(m.fs, filepath.Join(dir, currentFileName), []byte(name+"\n"))
+}
+
+func (m *Manifest) TablePath(number uint64) string {
+	return filepath.Join(m.dir, fmt.Sprintf("%06d%s", number, tableSuffix))
+}
+
+func (m *Manifest) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var err error
+	if m.file != nil {
+		err = m.file.Close()
+		m.file = nil
+	}
+	if m.dirLock != nil {
+		m.dirLock.Close()
+		m.dirLock = nil
+	}
+	return err
+}
+
+func writeEdit(file vfs.File, edit VersionEdit) error {
+	data, err := json.Marshal(edit)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(file, "%08x %s\n", crc32.ChecksumIEEE(data), data)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func decodeEdit(line string) (VersionEdit, bool) {
+	var edit VersionEdit
+
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		return edit, false
+	}
+
+	checksum, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil || uint32(checksum) != crc32.ChecksumIEEE([]byte(parts[1])) {
+		return edit, false
+	}
+
+	err = json.Unmarshal([]byte(parts[1]), &edit)
+	return edit, err == nil
+}
@@ -0,0 +1,270 @@
+package lsmtree
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+)
+
+// Names of the built-in merge operators.
+const (
+	AddOperator    = "add"
+	AppendOperator = "append"
+	MaxOperator    = "max"
+)
+
+var (
+	ErrUnknownOperator = errors.New("unknown merge operator")
+	ErrInvalidOperand  = errors.New("operand is not valid for the merge operator")
+	ErrNotInteger      = errors.New("value is not an integer")
+	ErrOverflow        = errors.New("integer overflow")
+)
+
+// MergeOperator folds the operands written with Merge into the value of a
+// key. Operands are stored as they are written and only resolved when the
+// key is read, or ahead of time by compaction.
+type MergeOperator interface {
+	// FullMerge applies operands, oldest first, to existing. exists is false
+	// when the key has no value.
+	FullMerge(key string, existing string, exists bool, operands []string) (string, error)
+	// PartialMerge combines two adjacent operands, left being the older one,
+	// and reports false when that needs the value they apply to.
+	PartialMerge(key string, left string, right string) (string, bool)
+}
+
+// Operand is one merge written to a key and the operator that resolves it.
+type Operand struct {
+	Operator string
+	Value    string
+}
+
+var (
+	operatorsLock sync.RWMutex
+	operators     = map[string]MergeOperator{
+		AddOperator:    addOperator{},
+		AppendOperator: appendOperator{},
+		MaxOperator:    maxOperator{},
+	}
+)
+
+// RegisterMergeOperator makes op available under name. Operands keep the
+// name of their operator on disk, so it must be registered before a tree
+// holding them is opened. It panics if name is taken.
+func RegisterMergeOperator(name string, op MergeOperator) {
+	operatorsLock.Lock()
+	defer operatorsLock.Unlock()
+
+	if _, ok := operators[name]; ok {
+		panic("lsmtree: merge operator " + name + " registered twice")
+	}
+	operators[name] = op
+}
+
+func lookupOperator(name string) (MergeOperator, error) {
+	operatorsLock.RLock()
+	defer operatorsLock.RUnlock()
+
+	op, ok := operators[name]
+	if !ok {
+		return nil, ErrUnknownOperator
+	}
+	return op, nil
+}
+
+// CheckOperand reports whether operand can be resolved by operator, so that
+// a bad operand is refused when it is written rather than when it is read.
+func CheckOperand(operator string, operand string) error {
+	op, err := lookupOperator(operator)
+	if err != nil {
+		return err
+	}
+	_, err = op.FullMerge("", "", false, []string{operand})
+	return err
+}
+
+// ApplyOperands resolves operands, oldest first, on top of value.
+func ApplyOperands(key string, value string, exists bool, operands []Operand) (string, error) {
+	for i := 0; i < len(operands); {
+		op, err := lookupOperator(operands[i].Operator)
+		if err != nil {
+			return "", err
+		}
+
+		var values []string
+		j := i
+		for ; j < len(operands) && operands[j].Operator == operands[i].Operator; j++ {
+			values = append(values, operands[j].Value)
+		}
+
+		value, err = op.FullMerge(key, value, exists, values)
+		if err != nil {
+			return "", err
+		}
+		exists = true
+		i = j
+	}
+	return value, nil
+}
+
+// foldOperands partially merges the adjacent operands of the same operator.
+func foldOperands(key string, operands []Operand) []Operand {
+	folded := make([]Operand, 0, len(operands))
+	for _, operand := range operands {
+		last := len(folded) - 1
+		if last >= 0 && folded[last].Operator == operand.Operator {
+			op, err := lookupOperator(operand.Operator)
+			if err == nil {
+				value, ok := op.PartialMerge(key, folded[last].Value, operand.Value)
+				if ok {
+					folded[last].Value = value
+					continue
+				}
+			}
+		}
+		folded = append(folded, operand)
+	}
+	return folded
+}
+
+// resolve combines the records of one key, newest first, into one. The
+// operands stacked on a value or tombstone are applied to it; operands with
+// nothing under them are applied to a missing value when bottom is set, as
+// no older record can exist, and are only folded otherwise. An operand that
+// fails to resolve leaves the record unresolved.
+func resolve(key string, pairs []KV, bottom bool) KV {
+	var operands []Operand
+	base := -1
+	for i, pair := range pairs {
+		if !pair.Merge {
+			base = i
+			break
+		}
+	}
+
+	last := len(pairs) - 1
+	if base >= 0 {
+		last = base
+	}
+	for i := last; i >= 0; i-- {
+		operands = append(operands, pairs[i].Operands...)
+	}
+
+	if base >= 0 && len(operands) == 0 {
+		return pairs[base]
+	}
+	if base < 0 && !bottom {
+		return KV{Key: key, Merge: true, Operands: foldOperands(key, operands)}
+	}
+
+	var value string
+	var exists bool
+	if base >= 0 {
+		value, exists = pairs[base].Value, !pairs[base].Tombstone
+	}
+
+	merged, err := ApplyOperands(key, value, exists, operands)
+	if err != nil {
+		log.Printf("resolving merge operands of %s failed: %v", key, err)
+		return KV{Key: key, Value: value, Tombstone: !exists, Merge: base < 0, Operands: operands}
+	}
+	return KV{Key: key, Value: merged}
+}
+
+// addOperator adds int64 operands to the value, or to 0 for a missing one.
+// It fails with ErrNotInteger on a value that is not an integer and with
+// ErrOverflow when the sum does not fit.
+type addOperator struct{}
+
+func (addOperator) FullMerge(key string, existing string, exists bool, operands []string) (string, error) {
+	var sum int64
+	if exists {
+		var err error
+		sum, err = strconv.ParseInt(existing, 10, 64)
+		if err != nil {
+			return "", ErrNotInteger
+		}
+	}
+	for _, operand := range operands {
+		n, err := strconv.ParseInt(operand, 10, 64)
+		if err != nil {
+			return "", ErrInvalidOperand
+		}
+		var ok bool
+		sum, ok = addInt64(sum, n)
+		if !ok {
+			return "", ErrOverflow
+		}
+	}
+	return strconv.FormatInt(sum, 10), nil
+}
+
+func (addOperator) PartialMerge(key string, left string, right string) (string, bool) {
+	l, err := strconv.ParseInt(left, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	r, err := strconv.ParseInt(right, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	sum, ok := addInt64(l, r)
+	if !ok {
+		return "", false
+	}
+	return strconv.FormatInt(sum, 10), true
+}
+
+// addInt64 returns a+b and whether it did not overflow.
+func addInt64(a int64, b int64) (int64, bool) {
+	sum := a + b
+	return sum, (sum > a) == (b > 0)
+}
+
+// appendOperator appends operands to the value.
+type appendOperator struct{}
+
+func (appendOperator) FullMerge(key string, existing string, exists bool, operands []string) (string, error) {
+	for _, operand := range operands {
+		existing += operand
+	}
+	return existing, nil
+}
+
+func (appendOperator) PartialMerge(key string, left string, right string) (string, bool) {
+	return left + right, true
+}
+
+// maxOperator keeps the largest int64. A value that is not an integer is
+// replaced by the operands.
+type maxOperator struct{}
+
+func (maxOperator) FullMerge(key string, existing string, exists bool, operands []string) (string, error) {
+	max, err := strconv.ParseInt(existing, 10, 64)
+	set := exists && err == nil
+	for _, operand := range operands {
+		n, err := strconv.ParseInt(operand, 10, 64)
+		if err != nil {
+			return "", ErrInvalidOperand
+		}
+		if !set || n > max {
+			max, set = n, true
+		}
+	}
+	return strconv.FormatInt(max, 10), nil
+}
+
+func (maxOperator) PartialMerge(key string, left string, right string) (string, bool) {
+	l, err := strconv.ParseInt(left, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	r, err := strconv.ParseInt(right, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	if r > l {
+		return right, true
+	}
+	return left, true
+}
@@ -0,0 +1,207 @@
+package lsmtree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strconv"
+
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// An SSTable file holds the encoded blocks of a DiskFile followed by its
+// gob encoded sparse index and a fixed size footer:
+//
+//	[blocks][index][blocks length: 8][elements: 8][crc32 of everything before: 4]
+const footerSize = 20
+
+var (
+	ErrCorruptTable  = errors.New("sstable is corrupt")
+	ErrUnsortedTable = errors.New("sstable keys are not in increasing order")
+)
+
+// WriteTable writes d to path and syncs it before returning.
+func (d *DiskFile) WriteTable(fs vfs.FS, path string) error {
+	var content bytes.Buffer
+	content.Write(d.buffer.Bytes())
+
+	err := gob.NewEncoder(&content).Encode(d.index.All())
+	if err != nil {
+		return err
+	}
+
+	var footer [footerSize]byte
+	binary.BigEndian.PutUint64(footer[0:8], uint64(d.buffer.Len()))
+	binary.BigEndian.PutUint64(footer[8:16], uint64(d.NumberOfElements))
+	content.Write(footer[:16])
+	binary.BigEndian.PutUint32(footer[16:], crc32.ChecksumIEEE(content.Bytes()))
+	content.Write(footer[16:])
+
+	return vfs.WriteFileAtomic(fs, path, content.Bytes())
+}
+
+// LoadTable reads back a table written by WriteTable.
+func LoadTable(fs vfs.FS, path string) (DiskFile, error) {
+	data, err := vfs.ReadFile(fs, path)
+	if err != nil {
+		return DiskFile{}, err
+	}
+
+	if len(data) < footerSize {
+		return DiskFile{}, ErrCorruptTable
+	}
+
+	body := data[:len(data)-4]
+	if binary.BigEndian.Uint32(data[len(data)-4:]) != crc32.ChecksumIEEE(body) {
+		return DiskFile{}, ErrCorruptTable
+	}
+
+	footer := data[len(data)-footerSize:]
+	blocksLen := binary.BigEndian.Uint64(footer[0:8])
+	elements := binary.BigEndian.Uint64(footer[8:16])
+	if blocksLen > uint64(len(data)-footerSize) {
+		return DiskFile{}, ErrCorruptTable
+	}
+
+	var index []KV
+	err = gob.NewDecoder(bytes.NewReader(data[blocksLen : len(data)-footerSize])).Decode(&index)
+	if err != nil {
+		return DiskFile{}, err
+	}
+
+	diskFile := DiskFile{
+		index:            NewTree(index),
+		NumberOfElements: int(elements),
+	}
+	diskFile.buffer.Write(data[:blocksLen])
+	return diskFile, nil
+}
+
+// SSTableWriter builds an SSTable outside of any tree, to bulk load it with
+// Ingest. Pairs are streamed to a temporary file next to path, in the format
+// WriteTable uses, and Finish renames it into place.
+type SSTableWriter struct {
+	fs       vfs.FS
+	path     string
+	file     vfs.File
+	out      *bufio.Writer
+	table    *tableOutput
+	encoder  *gob.Encoder
+	index    []KV
+	elements int
+	last     string
+}
+
+// tableOutput counts and checksums the bytes written to a table.
+type tableOutput struct {
+	w   io.Writer
+	crc hash.Hash32
+	n   int64
+}
+
+func (t *tableOutput) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	t.crc.Write(p[:n])
+	t.n += int64(n)
+	return n, err
+}
+
+// NewSSTableWriter starts a table that Finish writes to path. FS defaults to
+// vfs.Default.
+func NewSSTableWriter(fs vfs.FS, path string) (*SSTableWriter, error) {
+	if fs == nil {
+		fs = vfs.Default
+	}
+
+	file, err := fs.Create(path + tempSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	out := bufio.NewWriter(file)
+	return &SSTableWriter{
+		fs:    fs,
+		path:  path,
+		file:  file,
+		out:   out,
+		table: &tableOutput{w: out, crc: crc32.NewIEEE()},
+		index: []KV{},
+	}, nil
+}
+
+// Put adds a pair. Keys must be added in strictly increasing order.
+func (w *SSTableWriter) Put(key string, value string) error {
+	return w.add(KV{Key: key, Value: value})
+}
+
+// Delete adds a tombstone for key, shadowing the values older tables hold.
+func (w *SSTableWriter) Delete(key string) error {
+	return w.add(KV{Key: key, Tombstone: true})
+}
+
+func (w *SSTableWriter) add(pair KV) error {
+	if w.elements > 0 && pair.Key <= w.last {
+		return ErrUnsortedTable
+	}
+
+	if w.elements%indexSparseRatio == 0 {
+		w.index = append(w.index, KV{Key: pair.Key, Value: strconv.FormatInt(w.table.n, 10)})
+		w.encoder = gob.NewEncoder(w.table)
+	}
+
+	err := w.encoder.Encode(pair)
+	if err != nil {
+		return err
+	}
+	w.elements++
+	w.last = pair.Key
+	return nil
+}
+
+// Finish writes the index and footer, syncs the table and renames it to the
+// path given to NewSSTableWriter.
+func (w *SSTableWriter) Finish() error {
+	blocks := w.table.n
+	err := gob.NewEncoder(w.table).Encode(w.index)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+
+	var footer [footerSize]byte
+	binary.BigEndian.PutUint64(footer[0:8], uint64(blocks))
+	binary.BigEndian.PutUint64(footer[8:16], uint64(w.elements))
+	w.table.Write(footer[:16])
+	binary.BigEndian.PutUint32(footer[16:], w.table.crc.Sum32())
+	w.out.Write(footer[16:])
+
+	err = w.out.Flush()
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		w.fs.Remove(w.path + tempSuffix)
+		return err
+	}
+
+	err = w.fs.Rename(w.path+tempSuffix, w.path)
+	if err != nil {
+		return err
+	}
+	return w.fs.SyncDir(filepath.Dir(w.path))
+}
+
+// Abort discards the table.
+func (w *SSTableWriter) Abort() {
+	w.file.Close()
+	w.fs.Remove(w.path + tempSuffix)
+}
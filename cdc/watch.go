@@ -0,0 +1,131 @@
+// Package cdc streams the committed writes of an engine to clients, for
+// the WATCH command. A client that sent "WATCH [<prefix>] [FROM <seq>]" gets
+// "OK <seq>" and then one line per write of the default column family to a
+// key starting with prefix, in commit order:
+//
+//	<seq> PUT <key> <value>
+//	<seq> DEL <key>
+//	<seq> MERGE <key> <operator> <operand>
+//
+// The sequence number is the LSN of the WAL record holding the write, the
+// writes of a batch share one. A client that saw every write up to seq
+// resumes with "FROM <seq>".
+//
+// A write is only streamed once the WAL synced it to disk, so it can lag the
+// reply to the client that made it by up to a persist cycle. WATCH leaves out
+// the writes of every other column family, and ingested tables, which
+// bypass the WAL.
+package cdc
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+// Watch serves a client that sent WATCH prefix FROM from: it writes the
+// writes logged after from to w, and returns once the client closes the
+// connection, which it reads from requests, or the stream fails.
+//
+// Writers never wait for a client. When a client reads slower than the
+// writes are made its feed fills up and is dropped, and the stream picks up
+// again from the records retained in the WAL and its archive, at the pace
+// the client reads them.
+func Watch(w *bufio.Writer, requests *bufio.Scanner, source dbengine.Watcher, prefix string, from uint64) error {
+	feed, err := source.Changes(from)
+	if err != nil {
+		return err
+	}
+	defer func() { feed.Close() }()
+
+	w.WriteString(fmt.Sprintf("OK %d\n", from))
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	// the client has nothing to send, a failed read means that it left or
+	// that the server is shutting down
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for requests.Scan() {
+		}
+	}()
+
+	for {
+		for _, record := range feed.Backlog {
+			from, err = write(w, record, prefix, from)
+			if err != nil {
+				return err
+			}
+		}
+		err = w.Flush()
+		if err != nil {
+			return err
+		}
+
+	stream:
+		for {
+			select {
+			case record, ok := <-feed.Records():
+				if !ok {
+					break stream
+				}
+				from, err = write(w, record, prefix, from)
+				if err != nil {
+					return err
+				}
+				if len(feed.Records()) > 0 {
+					continue
+				}
+			case <-gone:
+				return nil
+			}
+
+			err = w.Flush()
+			if err != nil {
+				return err
+			}
+		}
+
+		// the feed was dropped, because the client fell behind or because
+		// the engine closed
+		feed.Close()
+		feed, err = source.Changes(from)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// write writes the writes of record that match prefix and returns the
+// sequence number the client saw every write up to, which is last for a
+// record without writes or one the client already saw.
+func write(w *bufio.Writer, record string, prefix string, last uint64) (uint64, error) {
+	lsn, entries, err := wal.ParseRecord(record)
+	if err != nil {
+		return 0, err
+	}
+	if entries == nil || lsn <= last {
+		return last, nil
+	}
+
+	for _, entry := range entries {
+		if entry.Family != "" || !strings.HasPrefix(entry.Key, prefix) {
+			continue
+		}
+		switch {
+		case entry.Delete:
+			w.WriteString(fmt.Sprintf("%d DEL %s\n", lsn, entry.Key))
+		case entry.Merge != "":
+			w.WriteString(fmt.Sprintf("%d MERGE %s %s %s\n", lsn, entry.Key, entry.Merge, entry.Value))
+		default:
+			w.WriteString(fmt.Sprintf("%d PUT %s %s\n", lsn, entry.Key, entry.Value))
+		}
+	}
+	return lsn, nil
+}
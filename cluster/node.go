@@ -0,0 +1,611 @@
+package cluster
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+const (
+	DefaultDirectory      = "cluster"
+	DefaultGossipInterval = 1000
+	DefaultRequestTimeout = 5000
+
+	// stateFile holds the slot table of the node in its Dir.
+	stateFile = "CLUSTER"
+
+	// migrateBatch is the number of pairs sent in one IMPORT.
+	migrateBatch = 256
+)
+
+var (
+	ErrUnassigned  = errors.New("slot is not assigned to a node")
+	ErrNotOwner    = errors.New("slot is not owned by this node")
+	ErrUnknownNode = errors.New("node is not a member of the cluster")
+	ErrMigrating   = errors.New("a migration is already running")
+	ErrNodeExists  = errors.New("node is already a member with another address")
+	ErrNotImported = errors.New("pair is not a plain write to a slot being imported")
+)
+
+// MovedError is returned for a key of a slot owned by another node, Addr
+// is the address of that node.
+type MovedError struct {
+	Slot int
+	Addr string
+}
+
+func (e *MovedError) Error() string {
+	return fmt.Sprintf("slot %d is served by %s", e.Slot, e.Addr)
+}
+
+// Config describes a node. Nodes maps the ID of every node of a new
+// cluster, this one included, to its host:port, and the slots are split
+// evenly among them. A node that Joins an existing cluster starts without
+// slots and learns the table from the nodes listed in Nodes, which then
+// learn about it. Once a table is stored in Dir it is used instead.
+// Secret is shared by the nodes of the cluster, which send it before their
+// requests, and is needed as soon as the cluster has more than one node.
+// GossipInterval is the period in milliseconds of the table exchanges and
+// RequestTimeout bounds the requests sent to other nodes.
+type Config struct {
+	ID             string
+	Nodes          map[string]string
+	Join           bool
+	Secret         string
+	Dir            string
+	FS             vfs.FS
+	GossipInterval int
+	RequestTimeout int
+}
+
+// Node is an engine that serves the keys of the slots it owns and
+// redirects the others with a MovedError. Iterate walks the keys this node
+// holds.
+type Node struct {
+	cfg    Config
+	engine dbengine.Engine
+
+	// lock guards table, writes hold it shared so that the handoff of a
+	// migration can stop them
+	lock      sync.RWMutex
+	table     *table
+	migration *migration
+
+	// importing holds the slots another node announced with WIPE that it
+	// moves to this one, until this node owns them
+	importing map[int]bool
+
+	peerLock sync.Mutex
+	peers    map[string]*peer
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// migration tracks the keys written to the slots being moved while they
+// are copied, which are sent again at the handoff.
+type migration struct {
+	slots map[int]bool
+
+	lock  sync.Mutex
+	dirty map[string]bool
+}
+
+// Start serves engine as the node described by cfg. The node owns engine
+// and closes it.
+func Start(engine dbengine.Engine, cfg Config) (*Node, error) {
+	if cfg.FS == nil {
+		cfg.FS = vfs.Default
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = DefaultDirectory
+	}
+	if cfg.GossipInterval == 0 {
+		cfg.GossipInterval = DefaultGossipInterval
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = DefaultRequestTimeout
+	}
+	if _, ok := cfg.Nodes[cfg.ID]; !ok {
+		return nil, fmt.Errorf("cluster nodes do not list %q", cfg.ID)
+	}
+	if cfg.Secret == "" && len(cfg.Nodes) > 1 {
+		return nil, errors.New("cluster nodes need a secret")
+	}
+
+	n := &Node{
+		cfg:       cfg,
+		engine:    engine,
+		peers:     make(map[string]*peer),
+		importing: make(map[int]bool),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	err := cfg.FS.MkdirAll(cfg.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := vfs.ReadFile(cfg.FS, filepath.Join(cfg.Dir, stateFile))
+	switch {
+	case err == nil:
+		var s State
+		err = json.Unmarshal(data, &s)
+		if err != nil {
+			return nil, err
+		}
+		n.table = &table{nodes: make(map[string]string)}
+		n.table.merge(s)
+	case !os.IsNotExist(err):
+		return nil, err
+	case cfg.Join:
+		n.table = &table{nodes: make(map[string]string)}
+		n.table.merge(State{Nodes: cfg.Nodes})
+	default:
+		n.table = newTable(cfg.Nodes)
+	}
+
+	err = n.save()
+	if err != nil {
+		return nil, err
+	}
+
+	go n.gossip()
+	return n, nil
+}
+
+// Close stops gossiping and closes the engine.
+func (n *Node) Close() error {
+	close(n.stop)
+	<-n.done
+
+	n.peerLock.Lock()
+	for _, p := range n.peers {
+		p.close()
+	}
+	n.peerLock.Unlock()
+
+	return n.engine.Close()
+}
+
+// save stores the table, the caller holds lock.
+func (n *Node) save() error {
+	data, err := json.Marshal(n.table.state())
+	if err != nil {
+		return err
+	}
+	return vfs.WriteFileAtomic(n.cfg.FS, filepath.Join(n.cfg.Dir, stateFile), data)
+}
+
+// check returns the error for key when this node does not own its slot,
+// the caller holds lock.
+func (n *Node) check(key string) error {
+	slot := SlotOf(key)
+	o := n.table.slots[slot]
+	switch o.node {
+	case n.cfg.ID:
+		return nil
+	case "":
+		return ErrUnassigned
+	default:
+		return &MovedError{Slot: slot, Addr: n.table.nodes[o.node]}
+	}
+}
+
+// write runs fn when this node owns every key, noting the keys of slots
+// being migrated.
+func (n *Node) write(keys []string, fn func() error) error {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	for _, key := range keys {
+		err := n.check(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m := n.migration; m != nil {
+		m.lock.Lock()
+		for _, key := range keys {
+			if m.slots[SlotOf(key)] {
+				m.dirty[key] = true
+			}
+		}
+		m.lock.Unlock()
+	}
+	return fn()
+}
+
+func (n *Node) Get(key string) (string, bool, error) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	err := n.check(key)
+	if err != nil {
+		return "", false, err
+	}
+	return n.engine.Get(key)
+}
+
+func (n *Node) Put(key string, value string) error {
+	return n.write([]string{key}, func() error {
+		return n.engine.Put(key, value)
+	})
+}
+
+func (n *Node) Delete(key string) error {
+	return n.write([]string{key}, func() error {
+		return n.engine.Delete(key)
+	})
+}
+
+func (n *Node) Merge(key string, operator string, operand string) error {
+	return n.write([]string{key}, func() error {
+		return n.engine.Merge(key, operator, operand)
+	})
+}
+
+// Batch writes ops when this node owns all of their keys. Keys that share
+// a "{tag}" are always in the same slot.
+func (n *Node) Batch(ops []dbengine.Op) error {
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+	return n.write(keys, func() error {
+		return n.engine.Batch(ops)
+	})
+}
+
+func (n *Node) Iterate(start string, fn func(key string, value string) bool) error {
+	return n.engine.Iterate(start, fn)
+}
+
+// keysIn returns the keys this node holds in slots.
+func (n *Node) keysIn(slots map[int]bool) ([]string, error) {
+	var keys []string
+	err := n.engine.Iterate("", func(key string, value string) bool {
+		if slots[SlotOf(key)] {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+// wipe deletes the keys this node holds in slots.
+func (n *Node) wipe(slots map[int]bool) error {
+	keys, err := n.keysIn(slots)
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		size := len(keys)
+		if size > migrateBatch {
+			size = migrateBatch
+		}
+
+		ops := make([]dbengine.Op, size)
+		for i, key := range keys[:size] {
+			ops[i] = dbengine.Op{Key: key, Delete: true}
+		}
+		err = n.engine.Batch(ops)
+		if err != nil {
+			return err
+		}
+		keys = keys[size:]
+	}
+	return nil
+}
+
+// copyKeys sends the current pairs of keys to p, deleting there the keys
+// that are gone here.
+func (n *Node) copyKeys(p *peer, keys []string) error {
+	for len(keys) > 0 {
+		size := len(keys)
+		if size > migrateBatch {
+			size = migrateBatch
+		}
+
+		ops := make([]dbengine.Op, 0, size)
+		for _, key := range keys[:size] {
+			value, ok, err := n.engine.Get(key)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, dbengine.Op{Key: key, Value: value, Delete: !ok})
+		}
+
+		_, err := p.call("IMPORT", ops, n.timeout())
+		if err != nil {
+			return err
+		}
+		keys = keys[size:]
+	}
+	return nil
+}
+
+// Migrate moves the slots first to last, which this node owns, to the node
+// target and returns the number of keys moved. The pairs are copied while
+// the slots keep being served here, then writes to this node pause while
+// the keys written in the meantime are sent again and target takes over
+// the slots. The keys are then deleted here.
+func (n *Node) Migrate(first int, last int, target string) (int, error) {
+	if first < 0 || last >= Slots || first > last {
+		return 0, ErrNotOwner
+	}
+
+	n.lock.Lock()
+	if n.migration != nil {
+		n.lock.Unlock()
+		return 0, ErrMigrating
+	}
+	if _, ok := n.table.nodes[target]; !ok || target == n.cfg.ID {
+		n.lock.Unlock()
+		return 0, ErrUnknownNode
+	}
+	m := &migration{slots: make(map[int]bool), dirty: make(map[string]bool)}
+	for slot := first; slot <= last; slot++ {
+		if n.table.slots[slot].node != n.cfg.ID {
+			n.lock.Unlock()
+			return 0, ErrNotOwner
+		}
+		m.slots[slot] = true
+	}
+	n.migration = m
+	p := n.peer(target)
+	n.lock.Unlock()
+
+	keys, err := n.migrate(m, p, first, last, target)
+
+	n.lock.Lock()
+	n.migration = nil
+	n.lock.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	return keys, n.wipe(m.slots)
+}
+
+func (n *Node) migrate(m *migration, p *peer, first int, last int, target string) (int, error) {
+	// target may hold leftovers of an earlier migration that failed
+	_, err := p.call("WIPE", []int{first, last}, n.timeout())
+	if err != nil {
+		return 0, err
+	}
+
+	keys, err := n.keysIn(m.slots)
+	if err != nil {
+		return 0, err
+	}
+	err = n.copyKeys(p, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	dirty := make([]string, 0, len(m.dirty))
+	for key := range m.dirty {
+		dirty = append(dirty, key)
+	}
+	sort.Strings(dirty)
+	err = n.copyKeys(p, dirty)
+	if err != nil {
+		return 0, err
+	}
+
+	slots := make([]int, 0, len(m.slots))
+	for slot := first; slot <= last; slot++ {
+		slots = append(slots, slot)
+	}
+	handoff := &table{nodes: n.table.nodes, slots: n.table.slots, epoch: n.table.epoch}
+	handoff.assign(slots, target)
+
+	// target owns the slots before this node sends clients to it
+	_, err = p.call("GOSSIP", handoff.state(), n.timeout())
+	if err != nil && !n.adopted(p, handoff, slots) {
+		return 0, err
+	}
+	n.table.merge(handoff.state())
+
+	err = n.save()
+	if err != nil {
+		fmt.Printf("Error saving the cluster table: %v\n", err)
+	}
+	return len(keys) + len(dirty), nil
+}
+
+// adopted reads the table of the target of a handoff whose reply was lost
+// and reports whether it took slots over anyway, in which case this node
+// must give them up too rather than have both serve them. A target that
+// cannot be reached is taken to have not. The caller holds lock.
+func (n *Node) adopted(p *peer, handoff *table, slots []int) bool {
+	reply, err := p.call("GOSSIP", n.table.state(), n.timeout())
+	if err != nil {
+		return false
+	}
+
+	var s State
+	err = json.Unmarshal([]byte(reply), &s)
+	if err != nil {
+		return false
+	}
+	theirs := &table{nodes: make(map[string]string)}
+	theirs.merge(s)
+	for _, slot := range slots {
+		if handoff.slots[slot].newer(theirs.slots[slot]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *Node) timeout() time.Duration {
+	return time.Duration(n.cfg.RequestTimeout) * time.Millisecond
+}
+
+// peer returns the connection to node id, the caller holds lock.
+func (n *Node) peer(id string) *peer {
+	n.peerLock.Lock()
+	defer n.peerLock.Unlock()
+
+	addr := n.table.nodes[id]
+	p, ok := n.peers[id]
+	if !ok || p.addr != addr {
+		if ok {
+			p.close()
+		}
+		p = &peer{addr: addr, secret: n.cfg.Secret}
+		n.peers[id] = p
+	}
+	return p
+}
+
+// gossip exchanges the table with a random node every GossipInterval.
+func (n *Node) gossip() {
+	defer close(n.done)
+
+	ticker := time.NewTicker(time.Duration(n.cfg.GossipInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n.lock.RLock()
+		var ids []string
+		for id := range n.table.nodes {
+			if id != n.cfg.ID {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			n.lock.RUnlock()
+			continue
+		}
+		sort.Strings(ids)
+		p := n.peer(ids[rand.Intn(len(ids))])
+		state := n.table.state()
+		n.lock.RUnlock()
+
+		reply, err := p.call("GOSSIP", state, n.timeout())
+		if err != nil {
+			continue
+		}
+
+		var s State
+		err = json.Unmarshal([]byte(reply), &s)
+		if err != nil {
+			continue
+		}
+		n.adopt(s)
+	}
+}
+
+// adopt merges s into the table and stores the result when it changed.
+func (n *Node) adopt(s State) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if !n.table.merge(s) {
+		return
+	}
+	for slot := range n.importing {
+		if n.table.slots[slot].node == n.cfg.ID {
+			delete(n.importing, slot)
+		}
+	}
+	err := n.save()
+	if err != nil {
+		fmt.Printf("Error saving the cluster table: %v\n", err)
+	}
+}
+
+// Meet adds node id at addr to the table without slots, for an operator to
+// introduce a node before it joins. The others learn about it by gossip.
+func (n *Node) Meet(id string, addr string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if known, ok := n.table.nodes[id]; ok {
+		if known != addr {
+			return ErrNodeExists
+		}
+		return nil
+	}
+	n.table.merge(State{Nodes: map[string]string{id: addr}})
+	return n.save()
+}
+
+// Authenticate reports whether secret is the one of the cluster, which the
+// nodes send with "CLUSTER AUTH" before their requests. It fails while the
+// node has no secret.
+func (n *Node) Authenticate(secret string) bool {
+	if n.cfg.Secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(n.cfg.Secret)) == 1
+}
+
+// Slot returns the slot of key and the address of the node that owns it,
+// empty when the slot is not assigned.
+func (n *Node) Slot(key string) (int, string) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	slot := SlotOf(key)
+	return slot, n.table.nodes[n.table.slots[slot].node]
+}
+
+// State returns the slot table of this node.
+func (n *Node) State() State {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.table.state()
+}
+
+// Info describes a node for CLUSTER INFO.
+type Info struct {
+	ID        string
+	Epoch     uint64
+	Slots     int
+	Nodes     int
+	Migrating bool
+}
+
+func (i Info) String() string {
+	return fmt.Sprintf("id=%s epoch=%d slots=%d nodes=%d migrating=%t",
+		i.ID, i.Epoch, i.Slots, i.Nodes, i.Migrating)
+}
+
+func (n *Node) Info() Info {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return Info{
+		ID:        n.cfg.ID,
+		Epoch:     n.table.epoch,
+		Slots:     n.table.owned(n.cfg.ID),
+		Nodes:     len(n.table.nodes),
+		Migrating: n.migration != nil,
+	}
+}
@@ -0,0 +1,173 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+)
+
+// HandleRPC answers "CLUSTER <kind> <payload>" sent by another node and
+// returns the reply line. A connection starts with "CLUSTER AUTH <secret>",
+// answered "OK", before the requests:
+//
+//	GOSSIP <State>      merges the table of the sender, replies with the result
+//	WIPE [first,last]   deletes the pairs of slots about to be imported
+//	IMPORT [Op...]      writes pairs of the slots WIPE announced to this node
+func (n *Node) HandleRPC(kind string, payload string) string {
+	switch kind {
+	case "GOSSIP":
+		var s State
+		err := json.Unmarshal([]byte(payload), &s)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+		n.adopt(s)
+
+		data, err := json.Marshal(n.State())
+		if err != nil {
+			return "Error " + err.Error()
+		}
+		return string(data)
+	case "WIPE":
+		var r [2]int
+		err := json.Unmarshal([]byte(payload), &r)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+
+		slots := make(map[int]bool)
+		n.lock.Lock()
+		for slot := r[0]; slot <= r[1] && slot < Slots; slot++ {
+			if slot >= 0 && n.table.slots[slot].node != n.cfg.ID {
+				slots[slot] = true
+				n.importing[slot] = true
+			}
+		}
+		n.lock.Unlock()
+
+		err = n.wipe(slots)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+		return "OK"
+	case "IMPORT":
+		var ops []dbengine.Op
+		err := json.Unmarshal([]byte(payload), &ops)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+
+		err = n.checkImport(ops)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+		err = n.engine.Batch(ops)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+		return "OK"
+	default:
+		return "Invalid command"
+	}
+}
+
+// checkImport refuses ops that are not plain puts or deletes of the default
+// family, the pairs copyKeys sends, or whose keys are not in a slot being
+// imported.
+func (n *Node) checkImport(ops []dbengine.Op) error {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	for _, op := range ops {
+		if op.Family != "" || op.Merge != "" || op.Version != (lsmtree.Version{}) {
+			return ErrNotImported
+		}
+		slot := SlotOf(op.Key)
+		if !n.importing[slot] || n.table.slots[slot].node == n.cfg.ID {
+			return ErrNotImported
+		}
+	}
+	return nil
+}
+
+// peer is the connection to another node, opened on the first call and
+// again after a failure.
+type peer struct {
+	addr   string
+	secret string
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// call sends req as JSON and returns the reply, which is "OK" or JSON.
+func (p *peer) call(kind string, req interface{}, timeout time.Duration) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", p.addr, timeout)
+		if err != nil {
+			return "", err
+		}
+		p.conn = conn
+		p.reader = bufio.NewReader(conn)
+
+		_, err = p.roundTrip("AUTH", []byte(p.secret), timeout)
+		if err != nil {
+			p.closeLocked()
+			return "", err
+		}
+	}
+
+	reply, err := p.roundTrip(kind, data, timeout)
+	if err != nil {
+		p.closeLocked()
+	}
+	return reply, err
+}
+
+func (p *peer) roundTrip(kind string, data []byte, timeout time.Duration) (string, error) {
+	p.conn.SetDeadline(time.Now().Add(timeout))
+
+	_, err := p.conn.Write([]byte("CLUSTER " + kind + " " + string(data) + "\n"))
+	if err != nil {
+		return "", err
+	}
+
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if line != "OK" && !strings.HasPrefix(line, "{") {
+		return "", errors.New(line)
+	}
+	return line, nil
+}
+
+func (p *peer) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closeLocked()
+}
+
+func (p *peer) closeLocked() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
@@ -0,0 +1,156 @@
+// Package cluster spreads the keyspace over several nodes. Keys hash to a
+// fixed number of slots, like the partitions of the disk store, and every
+// slot is owned by one node. Each node stores the slot table and gossips it
+// to the others, and answers the keys of slots it does not own with a
+// redirect to their owner. Slots move between nodes online.
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// Slots is the number of hash slots.
+const Slots = 16384
+
+// SlotOf returns the slot of key: fnv32a of the key modulo Slots. When the
+// key holds a non empty "{tag}" only the tag is hashed, so that keys that
+// share a tag share a slot and can be written in one batch.
+func SlotOf(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % Slots)
+}
+
+// owner is the node a slot belongs to, as of epoch. A slot handed to
+// another node gets an epoch above every one its old owner knew, so that
+// the newer claim wins wherever the two meet.
+type owner struct {
+	node  string
+	epoch uint64
+}
+
+func (o owner) newer(than owner) bool {
+	if o.epoch != than.epoch {
+		return o.epoch > than.epoch
+	}
+	return o.node > than.node
+}
+
+// SlotRange is a run of slots with the same owner and epoch, the form the
+// table is stored and gossiped in.
+type SlotRange struct {
+	First int    `json:"first"`
+	Last  int    `json:"last"`
+	Node  string `json:"node"`
+	Epoch uint64 `json:"epoch"`
+}
+
+// State is the slot table of a node with the addresses of the nodes.
+type State struct {
+	Nodes map[string]string `json:"nodes"`
+	Slots []SlotRange       `json:"slots"`
+}
+
+// table is the slot table in memory.
+type table struct {
+	nodes map[string]string
+	slots [Slots]owner
+	epoch uint64
+}
+
+// newTable splits the slots evenly over nodes in the order of their IDs,
+// so that every node of a new cluster starts out with the same table.
+func newTable(nodes map[string]string) *table {
+	t := &table{nodes: make(map[string]string)}
+	ids := make([]string, 0, len(nodes))
+	for id, addr := range nodes {
+		t.nodes[id] = addr
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for i, id := range ids {
+		first, last := i*Slots/len(ids), (i+1)*Slots/len(ids)
+		for slot := first; slot < last; slot++ {
+			t.slots[slot] = owner{node: id}
+		}
+	}
+	return t
+}
+
+func (t *table) state() State {
+	s := State{Nodes: make(map[string]string, len(t.nodes))}
+	for id, addr := range t.nodes {
+		s.Nodes[id] = addr
+	}
+
+	for slot := 0; slot < Slots; slot++ {
+		o := t.slots[slot]
+		last := len(s.Slots) - 1
+		if last >= 0 && s.Slots[last].Node == o.node && s.Slots[last].Epoch == o.epoch && s.Slots[last].Last == slot-1 {
+			s.Slots[last].Last = slot
+			continue
+		}
+		if o.node != "" {
+			s.Slots = append(s.Slots, SlotRange{First: slot, Last: slot, Node: o.node, Epoch: o.epoch})
+		}
+	}
+	return s
+}
+
+// merge takes the nodes t does not know and the slot claims newer than its
+// own from s, and reports whether t changed. Merging is commutative, so
+// tables that gossip converge whatever the order.
+func (t *table) merge(s State) bool {
+	changed := false
+	for id, addr := range s.Nodes {
+		if _, ok := t.nodes[id]; !ok {
+			t.nodes[id] = addr
+			changed = true
+		}
+	}
+
+	for _, r := range s.Slots {
+		if r.First < 0 || r.Last >= Slots {
+			continue
+		}
+		claim := owner{node: r.Node, epoch: r.Epoch}
+		for slot := r.First; slot <= r.Last; slot++ {
+			if claim.newer(t.slots[slot]) {
+				t.slots[slot] = claim
+				changed = true
+			}
+		}
+		if r.Epoch > t.epoch {
+			t.epoch = r.Epoch
+		}
+	}
+	return changed
+}
+
+// assign hands slots to node with an epoch above every one t knows.
+func (t *table) assign(slots []int, node string) {
+	t.epoch++
+	for _, slot := range slots {
+		t.slots[slot] = owner{node: node, epoch: t.epoch}
+	}
+}
+
+// owned counts the slots of node.
+func (t *table) owned(node string) int {
+	count := 0
+	for _, o := range t.slots {
+		if o.node == node {
+			count++
+		}
+	}
+	return count
+}
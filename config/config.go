@@ -12,22 +12,32 @@ type ServerConfig struct {
 	Host          string `yaml:"host"`
 	UDPPort       string `yaml:"udpport"`
 	UDPBufferSize int    `yaml:"udpbuffersize"`
+	ReplicaOf     string `yaml:"replica_of"`
+	PeerSecret    string `yaml:"peer_secret"`
 }
 
 type DiskConfig struct {
 	NumOfPartitions int    `yaml:"num_Of_Partitions"`
 	Directory       string `yaml:"directory"`
+	MaxSegmentSize  int64  `yaml:"max_segment_size"`
+	MergeThreshold  int    `yaml:"merge_threshold"`
+	PersistInterval int    `yaml:"persist_interval"`
+	PersistWorkers  int    `yaml:"persist_workers"`
+	WALSizeTrigger  int64  `yaml:"wal_size_trigger"`
 }
 
 type DBEngineConfig struct {
+	Engine            string            `yaml:"engine"`
 	LSMTreeConfig     LSMTreeConfig     `yaml:"lsmTree,inline"`
 	BloomFilterConfig BloomFilterConfig `yaml:"bloom_filter_config,inline"`
 	WalPath           string            `yaml:"walpath"`
+	WALArchive        string            `yaml:"wal_archive"`
 }
 
 type LSMTreeConfig struct {
-	MaximumElement      int `yaml:"maximum_element"`
-	CompactionFrequency int `yaml:"compaction_frequency"`
+	MaximumElement      int    `yaml:"maximum_element"`
+	CompactionFrequency int    `yaml:"compaction_frequency"`
+	Directory           string `yaml:"sstable_directory"`
 }
 
 type BloomFilterConfig struct {
@@ -35,10 +45,55 @@ type BloomFilterConfig struct {
 	ErrorRate float64 `yaml:"bloom_error_rate"`
 }
 
+type RaftConfig struct {
+	ID        string            `yaml:"raft_id"`
+	Peers     map[string]string `yaml:"raft_peers"`
+	Join      bool              `yaml:"raft_join"`
+	Directory string            `yaml:"raft_directory"`
+}
+
+type ClusterConfig struct {
+	ID        string            `yaml:"cluster_id"`
+	Nodes     map[string]string `yaml:"cluster_nodes"`
+	Join      bool              `yaml:"cluster_join"`
+	Directory string            `yaml:"cluster_directory"`
+}
+
+type DynamoConfig struct {
+	ID          string            `yaml:"dynamo_id"`
+	Nodes       map[string]string `yaml:"dynamo_nodes"`
+	N           int               `yaml:"dynamo_n"`
+	R           int               `yaml:"dynamo_r"`
+	W           int               `yaml:"dynamo_w"`
+	Resolution  string            `yaml:"dynamo_resolution"`
+	AntiEntropy int               `yaml:"dynamo_anti_entropy"`
+}
+
+type MultiLeaderConfig struct {
+	ID                 string            `yaml:"multileader_id"`
+	Nodes              map[string]string `yaml:"multileader_nodes"`
+	Directory          string            `yaml:"multileader_directory"`
+	TombstoneRetention int               `yaml:"multileader_tombstone_retention"`
+}
+
+type MembershipConfig struct {
+	ID               string   `yaml:"membership_id"`
+	Addr             string   `yaml:"membership_addr"`
+	Seeds            []string `yaml:"membership_seeds"`
+	ProbeInterval    int      `yaml:"membership_probe_interval"`
+	ProbeTimeout     int      `yaml:"membership_probe_timeout"`
+	SuspicionTimeout int      `yaml:"membership_suspicion_timeout"`
+}
+
 type Config struct {
-	ServerConfig   ServerConfig   `yaml:"server_config,inline"`
-	DBEngineConfig DBEngineConfig `yaml:"db_engine_config,inline"`
-	DiskConfig     DiskConfig     `yaml:"disk_config,inline"`
+	ServerConfig      ServerConfig      `yaml:"server_config,inline"`
+	DBEngineConfig    DBEngineConfig    `yaml:"db_engine_config,inline"`
+	DiskConfig        DiskConfig        `yaml:"disk_config,inline"`
+	RaftConfig        RaftConfig        `yaml:"raft_config,inline"`
+	ClusterConfig     ClusterConfig     `yaml:"cluster_config,inline"`
+	DynamoConfig      DynamoConfig      `yaml:"dynamo_config,inline"`
+	MultiLeaderConfig MultiLeaderConfig `yaml:"multileader_config,inline"`
+	MembershipConfig  MembershipConfig  `yaml:"membership_config,inline"`
 }
 
 func Parse(filename string) (Config, error) {
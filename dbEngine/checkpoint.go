@@ -0,0 +1,117 @@
+package dbengine
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// A checkpoint directory holds the WAL, the disk store and, when the engine
+// keeps SSTables, the tables of every family, in the layout the embedded
+// kryptondb package opens. CHECKPOINT is written last and records the LSN the
+// copy was cut at.
+const (
+	CheckpointWAL      = "wal.aof"
+	CheckpointStore    = "data"
+	CheckpointSSTables = "sstables"
+	checkpointFile     = "CHECKPOINT"
+)
+
+var ErrCheckpointExists = errors.New("checkpoint directory is not empty")
+
+// Checkpointer is implemented by engines that can write a consistent copy of
+// themselves to a directory while they keep serving requests.
+type Checkpointer interface {
+	Checkpoint(dir string) error
+}
+
+type checkpointManifest struct {
+	LSN      uint64    `json:"lsn"`
+	Time     time.Time `json:"time"`
+	WAL      string    `json:"wal"`
+	Store    string    `json:"store"`
+	SSTables string    `json:"sstables,omitempty"`
+}
+
+// Checkpoint writes a copy of the engine as of one LSN to dir, which must be
+// empty or missing. Writes only wait while the LSN is taken and the tables
+// are linked; the disk store copies its files with its lock held, so that
+// no persist cycle applies or discards anything until it is done, and the
+// WAL is copied up to the LSN.
+func (db *DBEngine) Checkpoint(dir string) error {
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	names, err := db.opts.FS.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(names) > 0 {
+		return ErrCheckpointExists
+	}
+
+	db.writeLock.Lock()
+	writing := true
+	defer func() {
+		if writing {
+			db.writeLock.Unlock()
+		}
+	}()
+
+	db.familyLock.RLock()
+	defer db.familyLock.RUnlock()
+
+	manifest := checkpointManifest{WAL: CheckpointWAL, Store: CheckpointStore}
+	if db.opts.LSMTree.Directory != "" {
+		manifest.SSTables = CheckpointSSTables
+	}
+
+	err = db.Store.Checkpoint(filepath.Join(dir, CheckpointStore), func() error {
+		manifest.LSN = db.WAL.LastLSN()
+		manifest.Time = time.Now()
+
+		if manifest.SSTables != "" {
+			tables := filepath.Join(dir, CheckpointSSTables)
+			err := db.Lsmtree.Checkpoint(tables)
+			if err != nil {
+				return err
+			}
+			for name, family := range db.families {
+				err = family.tree.Checkpoint(filepath.Join(tables, "families", name))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// everything up to the LSN is in the WAL or the tables now
+		db.writeLock.Unlock()
+		writing = false
+
+		return db.WAL.CopyThrough(filepath.Join(dir, CheckpointWAL), manifest.LSN)
+	})
+	if err != nil {
+		return err
+	}
+
+	families, err := vfs.ReadFile(db.opts.FS, db.familiesPath())
+	if err == nil {
+		err = vfs.WriteFileAtomic(db.opts.FS, filepath.Join(dir, CheckpointStore, familiesFile), families)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return vfs.WriteFileAtomic(db.opts.FS, filepath.Join(dir, checkpointFile), data)
+}
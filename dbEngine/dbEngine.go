@@ -1,17 +1,596 @@
 package dbengine
 
 import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+
 	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
 	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
 	"github.com/jiteshchawla1511/KryptonDB/wal"
 )
 
+var (
+	ErrClosed       = errors.New("engine is closed")
+	ErrInvalidKey   = errors.New("key must be non empty and must not contain '|' or newlines")
+	ErrInvalidValue = errors.New("value must not contain '|' or newlines")
+)
+
+// DBEngine is the LSM engine: writes go to the WAL and the LSM tree, and the
+// WAL is persisted into the disk store in the background.
 type DBEngine struct {
 	Lsmtree *lsmtree.LSMTree
 	WAL     *wal.WAL
 	Store   *diskstore.DiskStore
+
+	opts       Options
+	familyLock sync.RWMutex
+	families   map[string]*columnFamily
+
+	// writeLock is held for reading by every write and for writing while
+	// Ingest links its tables, which must not interleave with them, and by
+	// merges, which are resolved against the value they apply to before
+	// they are logged. ingestLock is held by Ingest and for reading by
+	// merges, so that none is resolved against a value an ingest replaces.
+	writeLock  sync.RWMutex
+	ingestLock sync.RWMutex
+
+	gate
+	feeds
+}
+
+// Options holds everything needed to build an engine. FS is used for the
+// WAL, the disk store and the SSTables and defaults to vfs.Default. Engine
+// is only read by New. When WALArchive is set the WAL records persisted to
+// the store are moved there rather than dropped, see Restore.
+type Options struct {
+	Engine     string
+	LSMTree    lsmtree.LSMTreeOptions
+	Store      diskstore.DiskStoreOpts
+	WalPath    string
+	WALArchive string
+	FS         vfs.FS
+}
+
+// Open builds the LSM tree, WAL and disk store described by opts, loads the
+// persisted data into the tree and starts persisting the WAL to disk.
+func Open(opts Options) (*DBEngine, error) {
+	if opts.FS == nil {
+		opts.FS = vfs.Default
+	}
+	opts.LSMTree.FS = opts.FS
+	opts.Store.FS = opts.FS
+
+	err := opts.FS.MkdirAll(filepath.Dir(opts.WalPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	lsmTree, err := lsmtree.InitLsmTree(opts.LSMTree)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := diskstore.NewDisk(opts.Store)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DBEngine{
+		Lsmtree: lsmTree,
+		WAL:     wal.InitWal(opts.FS, opts.WalPath),
+		Store:   store,
+		opts:    opts,
+	}
+
+	if opts.WALArchive != "" {
+		err = db.WAL.SetArchive(opts.WALArchive)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = db.openFamilies()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.load()
+	if err != nil {
+		return nil, err
+	}
+	db.WAL.SetRecordHook(db.publish)
+	db.WAL.SetSyncHook(db.publishSynced)
+
+	startPersistCycle := make(chan bool, 1)
+	startPersistCycle <- true
+	go db.Store.PersistToDisk(db.WAL, startPersistCycle)
+
+	return db, nil
 }
 
 func (db *DBEngine) LoadFromDisk(lsmTree *lsmtree.LSMTree, wal *wal.WAL) error {
 	return db.Store.LoadFromDisk(lsmTree, wal)
 }
+
+// load fills the tree of every family with what the disk store holds and
+// replays the WAL on top of it. The families created or dropped by the WAL
+// records are made first, in case a crash came before. Records of dropped
+// families are skipped, and so are the ones already applied to the store, as
+// replaying a merge twice would apply its operand twice. A tree whose tables
+// held every write when the engine was closed cleanly is left as it is, it
+// is only given the records logged after that.
+func (db *DBEngine) load() error {
+	changes, err := db.WAL.FamilyChanges()
+	if err != nil {
+		return err
+	}
+	err = db.applyFamilyChanges(changes)
+	if err != nil {
+		return err
+	}
+
+	// based holds the keys whose value the tree was given, per family, and
+	// synced the LSN the tables of a tree left as it is hold every write up to
+	based := make(map[string]map[string]bool)
+	synced := make(map[string]uint64)
+	fill := func(name string, tree *lsmtree.LSMTree) {
+		based[name] = make(map[string]bool)
+		if lsn := tree.SyncedLSN(); lsn != 0 && db.Store.AppliedLSN() <= lsn {
+			synced[name] = lsn
+			return
+		}
+		for _, entry := range db.Store.Contents(name) {
+			wal.Apply(tree, entry)
+			based[name][entry.Key] = true
+		}
+	}
+	fill("", db.Lsmtree)
+	for name, family := range db.families {
+		fill(name, family.tree)
+	}
+
+	// a WAL that was lost or replaced must not hand out applied LSNs again
+	db.WAL.AdvanceLSN(db.Store.AppliedLSN())
+
+	for _, entry := range db.WAL.ReadEntries() {
+		tree, err := db.tree(entry.Family)
+		if err != nil {
+			continue
+		}
+		if entry.Family != "" && entry.LSN <= db.families[entry.Family].Since {
+			continue
+		}
+		if entry.LSN <= db.Store.KeyApplied(entry.Family, entry.Key) || entry.LSN <= synced[entry.Family] {
+			continue
+		}
+
+		// the operands of a key the store does not hold must not stack on
+		// the ones an SSTable kept, which the WAL holds as well
+		if entry.Merge != "" && !based[entry.Family][entry.Key] && synced[entry.Family] == 0 {
+			tree.Del(entry.Key)
+		}
+		based[entry.Family][entry.Key] = true
+
+		wal.Apply(tree, entry)
+	}
+	return nil
+}
+
+// Close waits for in-flight requests, stops the background loops, persists
+// the WAL into the disk store, flushes the memtable and closes every file.
+// Requests made after Close fail with ErrClosed.
+func (db *DBEngine) Close() error {
+	err := db.shut()
+	if err != nil {
+		return err
+	}
+	db.closeFeeds()
+
+	// the trees hold every logged write, the next open need not load them
+	lsn := db.WAL.LastLSN()
+	err = db.Store.Close(db.WAL)
+	if treeErr := db.Lsmtree.CloseAt(lsn); err == nil {
+		err = treeErr
+	}
+	for _, family := range db.families {
+		if treeErr := family.tree.CloseAt(lsn); err == nil {
+			err = treeErr
+		}
+	}
+	if walErr := db.WAL.Close(); err == nil {
+		err = walErr
+	}
+	return err
+}
+
+// Get persists the WAL before reading, like the GET command always did, so
+// that an acknowledged read never observes a write that could still be lost.
+func (db *DBEngine) Get(key string) (string, bool, error) {
+	err := db.begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer db.end()
+
+	err = db.WAL.Persist()
+	if err != nil {
+		return "", false, err
+	}
+
+	val, exist := db.Lsmtree.Get(key)
+	return val, exist, nil
+}
+
+// Record is Get for the record of key, which also finds a tombstone with a
+// version.
+func (db *DBEngine) Record(key string) (lsmtree.KV, bool, error) {
+	err := db.begin()
+	if err != nil {
+		return lsmtree.KV{}, false, err
+	}
+	defer db.end()
+
+	err = db.WAL.Persist()
+	if err != nil {
+		return lsmtree.KV{}, false, err
+	}
+
+	record, found := db.Lsmtree.Record(key)
+	if !found || record.Merge || record.Tombstone && record.Version.Time == 0 {
+		return lsmtree.KV{}, false, nil
+	}
+	return record, true, nil
+}
+
+func (db *DBEngine) Put(key string, value string) error {
+	if !validField(key) || key == "" {
+		return ErrInvalidKey
+	}
+	if !validField(value) {
+		return ErrInvalidValue
+	}
+
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	db.writeLock.RLock()
+	defer db.writeLock.RUnlock()
+
+	err = db.WAL.Write([]byte("+"), []byte(key), []byte(value))
+	if err != nil {
+		return err
+	}
+
+	db.Lsmtree.Put(key, value)
+	return nil
+}
+
+func (db *DBEngine) Delete(key string) error {
+	if !validField(key) || key == "" {
+		return ErrInvalidKey
+	}
+
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	db.writeLock.RLock()
+	defer db.writeLock.RUnlock()
+
+	err = db.WAL.Write([]byte("-"), []byte(key))
+	if err != nil {
+		return err
+	}
+
+	db.Lsmtree.Del(key)
+	return nil
+}
+
+// Merge logs operand and stacks it on key in the tree, where it is resolved
+// when the key is read or compacted.
+func (db *DBEngine) Merge(key string, operator string, operand string) error {
+	if !validField(key) || key == "" {
+		return ErrInvalidKey
+	}
+	if !validField(operator) || !validField(operand) {
+		return ErrInvalidValue
+	}
+	err := checkMerge(Op{Key: key, Value: operand, Merge: operator})
+	if err != nil {
+		return err
+	}
+
+	err = db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	db.ingestLock.RLock()
+	defer db.ingestLock.RUnlock()
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	err = resolveMerges([]Op{{Key: key, Value: operand, Merge: operator}}, []*lsmtree.LSMTree{db.Lsmtree})
+	if err != nil {
+		return err
+	}
+
+	err = db.WAL.Write([]byte("&"), []byte(key), []byte(operator), []byte(operand))
+	if err != nil {
+		return err
+	}
+
+	db.Lsmtree.Merge(key, operator, operand)
+	return nil
+}
+
+// Iterate walks a snapshot of the tree taken when it is called.
+func (db *DBEngine) Iterate(start string, fn func(key string, value string) bool) error {
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	it := db.Lsmtree.NewIterator()
+	for it.Seek(start); it.Next(); {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return nil
+}
+
+// IterateRecords is Iterate for the records of the keys, which also walks
+// the tombstones with a version.
+func (db *DBEngine) IterateRecords(start string, fn func(record lsmtree.KV) bool) error {
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	it := db.Lsmtree.NewRecordIterator()
+	for it.Seek(start); it.Next(); {
+		if !fn(it.Record()) {
+			break
+		}
+	}
+	return nil
+}
+
+// Batch logs ops as a single WAL record, so that after a crash either all of
+// them or none of them are recovered, and then applies them to the trees of
+// their families.
+func (db *DBEngine) Batch(ops []Op) error {
+	return db.batch(ops, nil)
+}
+
+// batch is Batch for a view, which must still be live while the ops are
+// applied, or for the engine itself when view is nil.
+func (db *DBEngine) batch(ops []Op, view *familyView) error {
+	entries := make([]wal.Entry, len(ops))
+	merges := false
+	for i, op := range ops {
+		if !validField(op.Key) || op.Key == "" {
+			return ErrInvalidKey
+		}
+		if !op.Delete && !validField(op.Value) || !validField(op.Merge) || !validField(op.Version.Node) {
+			return ErrInvalidValue
+		}
+		err := checkMerge(op)
+		if err != nil {
+			return err
+		}
+
+		family := op.Family
+		if family == DefaultFamily {
+			family = ""
+		}
+		entries[i] = wal.Entry{Key: op.Key, Value: op.Value, Delete: op.Delete, Family: family, Merge: op.Merge, Version: op.Version}
+		merges = merges || op.Merge != ""
+	}
+
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	if merges {
+		db.ingestLock.RLock()
+		defer db.ingestLock.RUnlock()
+		db.writeLock.Lock()
+		defer db.writeLock.Unlock()
+	} else {
+		db.writeLock.RLock()
+		defer db.writeLock.RUnlock()
+	}
+
+	db.familyLock.RLock()
+	defer db.familyLock.RUnlock()
+
+	if view != nil && !view.live() {
+		return ErrFamilyNotFound
+	}
+
+	trees := make([]*lsmtree.LSMTree, len(ops))
+	for i, op := range ops {
+		trees[i], err = db.tree(op.Family)
+		if err != nil {
+			return err
+		}
+	}
+
+	if merges {
+		err = resolveMerges(ops, trees)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = db.WAL.WriteBatch(entries)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		wal.Apply(trees[i], entry)
+	}
+	return nil
+}
+
+// resolveMerges resolves the merges of ops, written to trees, on top of the
+// values they apply to and fails with the error of the first one that does
+// not resolve, such as an add to a value that is not an integer. A merge
+// is only logged once it is known to resolve, as the disk store fails on
+// one that does not. The caller must hold writeLock for writing.
+func resolveMerges(ops []Op, trees []*lsmtree.LSMTree) error {
+	type slot struct {
+		tree *lsmtree.LSMTree
+		key  string
+	}
+	type state struct {
+		value  string
+		exists bool
+	}
+
+	// the values the earlier ops of the batch left
+	written := make(map[slot]state)
+	for i, op := range ops {
+		at := slot{trees[i], op.Key}
+		switch {
+		case op.Delete:
+			written[at] = state{}
+		case op.Merge == "":
+			written[at] = state{op.Value, true}
+		default:
+			current, ok := written[at]
+			if !ok {
+				current.value, current.exists = trees[i].Get(op.Key)
+			}
+			merged, err := lsmtree.ApplyOperands(op.Key, current.value, current.exists, []lsmtree.Operand{{Operator: op.Merge, Value: op.Value}})
+			if err != nil {
+				return err
+			}
+			written[at] = state{merged, true}
+		}
+	}
+	return nil
+}
+
+// Ingest bulk loads the SSTables at paths into the default family.
+func (db *DBEngine) Ingest(paths ...string) error {
+	return db.ingest(paths, nil)
+}
+
+// ingest checks the tables at paths and links them into the tree of the
+// view's family, the default one when view is nil. The disk store reads
+// their pairs under one reserved LSN, nothing is logged to the WAL, and
+// writes only wait while the tables are linked: the ones logged after the
+// LSN are applied again on top of the tables then. Merges wait for the
+// whole ingest, as they are checked against the value they apply to.
+func (db *DBEngine) ingest(paths []string, view *familyView) error {
+	tables := make([]lsmtree.DiskFile, 0, len(paths))
+	for _, path := range paths {
+		table, err := lsmtree.LoadExternalTable(db.opts.FS, path)
+		if err != nil {
+			return err
+		}
+
+		err = table.Each(func(pair lsmtree.KV) error {
+			return CheckPair(pair.Key, pair.Value)
+		})
+		if err != nil {
+			return err
+		}
+		tables = append(tables, table)
+	}
+
+	err := lsmtree.CheckOverlap(tables)
+	if err != nil {
+		return err
+	}
+
+	err = db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	db.ingestLock.Lock()
+	defer db.ingestLock.Unlock()
+
+	family := ""
+	if view != nil {
+		family = view.name()
+	}
+
+	return db.Store.Ingest(db.WAL, family, tables, func(lsn uint64) error {
+		db.writeLock.Lock()
+		defer db.writeLock.Unlock()
+
+		db.familyLock.RLock()
+		defer db.familyLock.RUnlock()
+
+		if view != nil && !view.live() {
+			return ErrFamilyNotFound
+		}
+		tree, err := db.tree(family)
+		if err != nil {
+			return err
+		}
+
+		err = tree.Ingest(tables)
+		if err != nil {
+			return err
+		}
+		err = db.WAL.Persist()
+		if err != nil {
+			return err
+		}
+		for _, entry := range db.WAL.ReadEntries() {
+			if entry.LSN > lsn && entry.Family == family && covers(tables, entry.Key) {
+				wal.Apply(tree, entry)
+			}
+		}
+		return nil
+	})
+}
+
+// covers reports whether key is in the range of one of tables.
+func covers(tables []lsmtree.DiskFile, key string) bool {
+	for _, table := range tables {
+		if !table.Empty() && table.Meta.Smallest <= key && key <= table.Meta.Largest {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPair reports whether key and value can be written, with
+// ErrInvalidKey or ErrInvalidValue, so that bulk writers can drop a bad pair
+// rather than fail the batch holding it.
+func CheckPair(key string, value string) error {
+	if !validField(key) || key == "" {
+		return ErrInvalidKey
+	}
+	if !validField(value) {
+		return ErrInvalidValue
+	}
+	return nil
+}
+
+// validField reports whether s can be stored in a WAL record.
+func validField(s string) bool {
+	return !strings.ContainsAny(s, "|\r\n")
+}
@@ -0,0 +1,153 @@
+package dbengine
+
+import (
+	"sort"
+
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// DiskStoreEngine serves every request straight from the hash partitioned
+// disk store. Writes are appended to the partition logs without a WAL and
+// reads are answered from the in-memory keydir of each partition.
+type DiskStoreEngine struct {
+	Store *diskstore.DiskStore
+
+	gate
+}
+
+// OpenDiskStore opens the store described by opts.Store, the LSM and WAL
+// options are not used.
+func OpenDiskStore(opts Options) (*DiskStoreEngine, error) {
+	if opts.FS == nil {
+		opts.FS = vfs.Default
+	}
+	opts.Store.FS = opts.FS
+
+	store, err := diskstore.NewDisk(opts.Store)
+	if err != nil {
+		return nil, err
+	}
+
+	// without a WAL the cycle only syncs and merges the partitions
+	startPersistCycle := make(chan bool, 1)
+	startPersistCycle <- true
+	go store.PersistToDisk(nil, startPersistCycle)
+
+	return &DiskStoreEngine{Store: store}, nil
+}
+
+// Get syncs the partition of key before reading, for the same reason the
+// LSM engine persists its WAL.
+func (db *DiskStoreEngine) Get(key string) (string, bool, error) {
+	err := db.begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer db.end()
+
+	partition := db.Store.PartitionOf(key)
+	err = db.Store.SyncPartition(partition)
+	if err != nil {
+		return "", false, err
+	}
+
+	val, err := db.Store.ReadValue(key, partition)
+	if err == diskstore.ErrKeyNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(val), true, nil
+}
+
+func (db *DiskStoreEngine) Put(key string, value string) error {
+	return db.Batch([]Op{{Key: key, Value: value}})
+}
+
+func (db *DiskStoreEngine) Delete(key string) error {
+	return db.Batch([]Op{{Key: key, Delete: true}})
+}
+
+func (db *DiskStoreEngine) Merge(key string, operator string, operand string) error {
+	return db.Batch([]Op{{Key: key, Value: operand, Merge: operator}})
+}
+
+// Iterate reads every partition when it is called and walks the pairs in
+// key order.
+func (db *DiskStoreEngine) Iterate(start string, fn func(key string, value string) bool) error {
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	var pairs []Op
+	for i := 0; i < db.Store.NumOfPartitions(); i++ {
+		for _, entry := range db.Store.GetFileContents(i) {
+			if entry.Key >= start {
+				pairs = append(pairs, Op{Key: entry.Key, Value: entry.Value})
+			}
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+	for _, pair := range pairs {
+		if !fn(pair.Key, pair.Value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Batch appends ops in order. The partitions are logged separately, so a
+// crash can keep a prefix of the batch. Merges are resolved against the
+// stored value under the lock of its partition.
+func (db *DiskStoreEngine) Batch(ops []Op) error {
+	for _, op := range ops {
+		if op.Key == "" {
+			return ErrInvalidKey
+		}
+		if op.Family != "" && op.Family != DefaultFamily {
+			return ErrFamilyNotFound
+		}
+		err := checkMerge(op)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	for _, op := range ops {
+		partition := db.Store.PartitionOf(op.Key)
+		if op.Delete {
+			err = db.Store.DeleteFromDisk(op.Key, partition)
+		} else if op.Merge != "" {
+			err = db.Store.MergeValue(op.Key, op.Merge, op.Value, partition)
+		} else {
+			err = db.Store.WriteValue(op.Key, []byte(op.Value), partition)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close waits for in-flight requests, stops the background loop and syncs
+// and closes the partitions.
+func (db *DiskStoreEngine) Close() error {
+	err := db.shut()
+	if err != nil {
+		return err
+	}
+	return db.Store.Close(nil)
+}
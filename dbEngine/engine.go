@@ -0,0 +1,120 @@
+package dbengine
+
+import (
+	"fmt"
+	"sync"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+)
+
+// Names of the engines New can build, selected with engine: in the config.
+const (
+	EngineLSM       = "lsm"
+	EngineMemory    = "memory"
+	EngineDiskStore = "diskstore"
+
+	DefaultEngine = EngineLSM
+)
+
+// Engine is the storage the server talks to. Get reports whether key exists,
+// Iterate calls fn for every live pair with a key greater than or equal to
+// start in key order until fn returns false, and Batch applies ops in order.
+// Merge hands operand to the merge operator named operator, which folds it
+// into the value of key without the caller reading it first. Every method
+// fails with ErrClosed once Close has started.
+type Engine interface {
+	Get(key string) (string, bool, error)
+	Put(key string, value string) error
+	Delete(key string) error
+	Merge(key string, operator string, operand string) error
+	Iterate(start string, fn func(key string, value string) bool) error
+	Batch(ops []Op) error
+	Close() error
+}
+
+// Ingester is implemented by engines that can bulk load SSTables built with
+// lsmtree.SSTableWriter without logging their pairs.
+type Ingester interface {
+	Ingest(paths ...string) error
+}
+
+// Op is one write of a batch, Value is ignored for deletes. Family names
+// the column family of the write, empty for the default one, and is only
+// accepted by engines that implement ColumnFamilies. Merge names the merge
+// operator of a merge, whose operand is Value. Version stamps a put or
+// delete of a multi-leader node and is only kept by the LSM engine, see
+// lsmtree.KV.
+type Op struct {
+	Key     string
+	Value   string
+	Delete  bool
+	Family  string
+	Merge   string
+	Version lsmtree.Version
+}
+
+// checkMerge refuses a merge whose operator is unknown or whose operand the
+// operator cannot resolve.
+func checkMerge(op Op) error {
+	if op.Merge == "" {
+		return nil
+	}
+	if op.Delete || op.Version.Time != 0 {
+		return lsmtree.ErrInvalidOperand
+	}
+	return lsmtree.CheckOperand(op.Merge, op.Value)
+}
+
+// New builds the engine named by opts.Engine, the LSM engine by default.
+func New(opts Options) (Engine, error) {
+	switch opts.Engine {
+	case "", EngineLSM:
+		return Open(opts)
+	case EngineMemory:
+		return NewMemory(), nil
+	case EngineDiskStore:
+		return OpenDiskStore(opts)
+	default:
+		return nil, fmt.Errorf("unknown engine %q", opts.Engine)
+	}
+}
+
+// gate lets Close wait for the requests that are already running and turns
+// away the ones that come after it.
+type gate struct {
+	lock     sync.RWMutex
+	closed   bool
+	inFlight sync.WaitGroup
+}
+
+// begin registers a request, failing once Close has started. A successful
+// begin must be paired with end.
+func (g *gate) begin() error {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	if g.closed {
+		return ErrClosed
+	}
+	g.inFlight.Add(1)
+	return nil
+}
+
+func (g *gate) end() {
+	g.inFlight.Done()
+}
+
+// shut turns away new requests and waits for the running ones. It fails
+// with ErrClosed if the gate was already shut.
+func (g *gate) shut() error {
+	g.lock.Lock()
+	if g.closed {
+		g.lock.Unlock()
+		return ErrClosed
+	}
+	g.closed = true
+	g.lock.Unlock()
+
+	g.inFlight.Wait()
+	return nil
+}
@@ -0,0 +1,474 @@
+package dbengine
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+// DefaultFamily names the column family that always exists and that the
+// engine's own Get, Put and Delete use.
+const DefaultFamily = "default"
+
+// familiesFile lists the column families in the disk store directory.
+const familiesFile = "FAMILIES"
+
+var (
+	ErrFamilyExists   = errors.New("column family already exists")
+	ErrFamilyNotFound = errors.New("column family not found")
+	ErrInvalidFamily  = errors.New("column family names are made of letters, digits, '_' and '-'")
+)
+
+// ColumnFamilies is implemented by engines that keep several independent
+// keyspaces. Family returns an Engine bound to one of them, its Close does
+// nothing and it fails with ErrFamilyNotFound once the family is dropped.
+type ColumnFamilies interface {
+	CreateFamily(name string, opts FamilyOptions) error
+	DropFamily(name string) error
+	Family(name string) (Engine, error)
+}
+
+// FamilyOptions are the LSM settings of a column family, zero values take
+// the ones of the default family.
+type FamilyOptions struct {
+	MaximumElement   int     `json:"maximum_element,omitempty"`
+	CompactionPeriod int     `json:"compaction_frequency,omitempty"`
+	BloomCapacity    int     `json:"bloom_capacity,omitempty"`
+	BloomErrorRate   float64 `json:"bloom_error_rate,omitempty"`
+}
+
+// columnFamily is a family other than the default one. Records of the
+// shared WAL logged at or before since belong to an earlier family with the
+// same name.
+type columnFamily struct {
+	Name    string        `json:"name"`
+	Since   uint64        `json:"since"`
+	Options FamilyOptions `json:"options"`
+
+	tree *lsmtree.LSMTree
+}
+
+func validFamily(name string) bool {
+	if name == "" || name == DefaultFamily {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (db *DBEngine) familiesPath() string {
+	return filepath.Join(db.opts.Store.Directory, familiesFile)
+}
+
+// familyTreeOptions returns the tree options of a family: its own settings
+// over the default family's, and its own SSTable directory.
+func (db *DBEngine) familyTreeOptions(family *columnFamily) lsmtree.LSMTreeOptions {
+	opts := db.opts.LSMTree
+	if family.Options.MaximumElement != 0 {
+		opts.MaximumElement = family.Options.MaximumElement
+	}
+	if family.Options.CompactionPeriod != 0 {
+		opts.CompactionPeriod = family.Options.CompactionPeriod
+	}
+	if family.Options.BloomCapacity != 0 {
+		opts.BloomFilterOptions.Capacity = family.Options.BloomCapacity
+	}
+	if family.Options.BloomErrorRate != 0 {
+		opts.BloomFilterOptions.ErrorRate = family.Options.BloomErrorRate
+	}
+	if opts.Directory != "" {
+		opts.Directory = db.familyTreeDir(family.Name)
+	}
+	return opts
+}
+
+func (db *DBEngine) familyTreeDir(name string) string {
+	return filepath.Join(db.opts.LSMTree.Directory, "families", name)
+}
+
+// openFamilies opens the families listed in the FAMILIES file and removes
+// what a crash in the middle of DropFamily or CreateFamily left behind.
+func (db *DBEngine) openFamilies() error {
+	db.families = make(map[string]*columnFamily)
+
+	data, err := vfs.ReadFile(db.opts.FS, db.familiesPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var families []*columnFamily
+	if err == nil {
+		err = json.Unmarshal(data, &families)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, family := range families {
+		family.tree, err = lsmtree.InitLsmTree(db.familyTreeOptions(family))
+		if err != nil {
+			return err
+		}
+		db.families[family.Name] = family
+
+		err = db.Store.CreateFamily(family.Name, family.Since)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range db.Store.Families() {
+		if _, ok := db.families[name]; !ok {
+			err = db.Store.DropFamily(name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if db.opts.LSMTree.Directory == "" {
+		return nil
+	}
+	names, err := db.opts.FS.ReadDir(filepath.Join(db.opts.LSMTree.Directory, "families"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := db.families[name]; !ok {
+			err = vfs.RemoveAll(db.opts.FS, db.familyTreeDir(name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeFamilies replaces the FAMILIES file. The caller must hold
+// db.familyLock.
+func (db *DBEngine) writeFamilies() error {
+	families := make([]*columnFamily, 0, len(db.families))
+	for _, family := range db.families {
+		families = append(families, family)
+	}
+
+	data, err := json.Marshal(families)
+	if err != nil {
+		return err
+	}
+	return vfs.WriteFileAtomic(db.opts.FS, db.familiesPath(), data)
+}
+
+// CreateFamily adds a column family. Its data is kept apart from the other
+// families, in its own memtable, SSTables and disk store partitions, while
+// its writes share the WAL so that a Batch can span families atomically.
+// The family is logged and synced before it is made, so that followers and
+// recovery make it before any write to it, see applyFamilyChanges.
+func (db *DBEngine) CreateFamily(name string, opts FamilyOptions) error {
+	if !validFamily(name) {
+		return ErrInvalidFamily
+	}
+
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	db.writeLock.RLock()
+	defer db.writeLock.RUnlock()
+
+	db.familyLock.Lock()
+	defer db.familyLock.Unlock()
+
+	if _, ok := db.families[name]; ok {
+		return ErrFamilyExists
+	}
+
+	options, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	lsn, err := db.WAL.WriteFamilyChanges([]wal.FamilyChange{{Name: name, Options: string(options)}})
+	if err == nil {
+		err = db.WAL.Persist()
+	}
+	if err == nil {
+		err = db.addFamily(&columnFamily{Name: name, Since: lsn - 1, Options: opts})
+	}
+	if err != nil && lsn != 0 {
+		// followers and recovery must not make it either
+		db.WAL.WriteFamilyChanges([]wal.FamilyChange{{Name: name, Drop: true}})
+	}
+	return err
+}
+
+// DropFamily removes a column family and deletes its files, without reading
+// or rewriting any of them. Like CreateFamily it logs the drop first.
+func (db *DBEngine) DropFamily(name string) error {
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	db.writeLock.RLock()
+	defer db.writeLock.RUnlock()
+
+	db.familyLock.Lock()
+	defer db.familyLock.Unlock()
+
+	family, ok := db.families[name]
+	if !ok {
+		return ErrFamilyNotFound
+	}
+
+	_, err = db.WAL.WriteFamilyChanges([]wal.FamilyChange{{Name: name, Drop: true}})
+	if err == nil {
+		err = db.WAL.Persist()
+	}
+	if err != nil {
+		return err
+	}
+	return db.removeFamily(family)
+}
+
+// addFamily opens the tree and disk store partitions of a new family and
+// lists it in the FAMILIES file. The caller must hold db.familyLock.
+func (db *DBEngine) addFamily(family *columnFamily) error {
+	var err error
+	family.tree, err = lsmtree.InitLsmTree(db.familyTreeOptions(family))
+	if err != nil {
+		return err
+	}
+
+	err = db.Store.CreateFamily(family.Name, family.Since)
+	if err == nil {
+		db.families[family.Name] = family
+		err = db.writeFamilies()
+	}
+	if err != nil {
+		delete(db.families, family.Name)
+		family.tree.Close()
+		db.Store.DropFamily(family.Name)
+		return err
+	}
+	return nil
+}
+
+// removeFamily unlists a family and deletes its files. It runs with
+// db.familyLock held, which the caller must, so that a family created again
+// under the same name never meets them.
+func (db *DBEngine) removeFamily(family *columnFamily) error {
+	delete(db.families, family.Name)
+	err := db.writeFamilies()
+	if err != nil {
+		db.families[family.Name] = family
+		return err
+	}
+
+	family.tree.Close()
+	if db.opts.LSMTree.Directory != "" {
+		err = vfs.RemoveAll(db.opts.FS, db.familyTreeDir(family.Name))
+		if err != nil {
+			return err
+		}
+	}
+	return db.Store.DropFamily(family.Name)
+}
+
+// applyFamilyChanges makes the changes of a record shipped by a leader or
+// read back from the WAL by recovery. The ones already made are skipped: a
+// family created by the record at some LSN has a Since one below it, so a
+// family with a Since at or above that is the one the record created or a
+// later one. The caller must hold db.familyLock.
+func (db *DBEngine) applyFamilyChanges(changes []wal.FamilyChange) error {
+	for _, change := range changes {
+		if !validFamily(change.Name) {
+			return ErrInvalidFamily
+		}
+
+		family, ok := db.families[change.Name]
+		if ok && family.Since >= change.LSN-1 {
+			continue
+		}
+		if ok {
+			err := db.removeFamily(family)
+			if err != nil {
+				return err
+			}
+		}
+		if change.Drop {
+			continue
+		}
+
+		var opts FamilyOptions
+		err := json.Unmarshal([]byte(change.Options), &opts)
+		if err != nil {
+			return err
+		}
+		err = db.addFamily(&columnFamily{Name: change.Name, Since: change.LSN - 1, Options: opts})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Family returns an Engine over one column family, DefaultFamily included.
+func (db *DBEngine) Family(name string) (Engine, error) {
+	if name == DefaultFamily {
+		return &familyView{db: db}, nil
+	}
+
+	db.familyLock.RLock()
+	defer db.familyLock.RUnlock()
+
+	family, ok := db.families[name]
+	if !ok {
+		return nil, ErrFamilyNotFound
+	}
+	return &familyView{db: db, family: family}, nil
+}
+
+// tree returns the tree of a family, the default one when name is empty or
+// DefaultFamily. The caller must hold db.familyLock.
+func (db *DBEngine) tree(name string) (*lsmtree.LSMTree, error) {
+	if name == "" || name == DefaultFamily {
+		return db.Lsmtree, nil
+	}
+
+	family, ok := db.families[name]
+	if !ok {
+		return nil, ErrFamilyNotFound
+	}
+	return family.tree, nil
+}
+
+// familyView is the Engine returned by Family. A nil family is the default
+// one.
+type familyView struct {
+	db     *DBEngine
+	family *columnFamily
+}
+
+func (v *familyView) name() string {
+	if v.family == nil {
+		return ""
+	}
+	return v.family.Name
+}
+
+// live reports whether the family still exists, a family dropped and then
+// created again is a different one. The caller must hold db.familyLock.
+func (v *familyView) live() bool {
+	return v.family == nil || v.db.families[v.family.Name] == v.family
+}
+
+func (v *familyView) Get(key string) (string, bool, error) {
+	if v.family == nil {
+		return v.db.Get(key)
+	}
+
+	err := v.db.begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer v.db.end()
+
+	v.db.familyLock.RLock()
+	defer v.db.familyLock.RUnlock()
+
+	if !v.live() {
+		return "", false, ErrFamilyNotFound
+	}
+
+	err = v.db.WAL.Persist()
+	if err != nil {
+		return "", false, err
+	}
+
+	val, exist := v.family.tree.Get(key)
+	return val, exist, nil
+}
+
+func (v *familyView) Put(key string, value string) error {
+	if v.family == nil {
+		return v.db.Put(key, value)
+	}
+	return v.Batch([]Op{{Key: key, Value: value}})
+}
+
+func (v *familyView) Delete(key string) error {
+	if v.family == nil {
+		return v.db.Delete(key)
+	}
+	return v.Batch([]Op{{Key: key, Delete: true}})
+}
+
+func (v *familyView) Merge(key string, operator string, operand string) error {
+	if v.family == nil {
+		return v.db.Merge(key, operator, operand)
+	}
+	return v.Batch([]Op{{Key: key, Value: operand, Merge: operator}})
+}
+
+func (v *familyView) Iterate(start string, fn func(key string, value string) bool) error {
+	if v.family == nil {
+		return v.db.Iterate(start, fn)
+	}
+
+	err := v.db.begin()
+	if err != nil {
+		return err
+	}
+	defer v.db.end()
+
+	v.db.familyLock.RLock()
+	if !v.live() {
+		v.db.familyLock.RUnlock()
+		return ErrFamilyNotFound
+	}
+	it := v.family.tree.NewIterator()
+	v.db.familyLock.RUnlock()
+
+	for it.Seek(start); it.Next(); {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return nil
+}
+
+// Batch applies ops to the family of the view unless they name another.
+func (v *familyView) Batch(ops []Op) error {
+	bound := make([]Op, len(ops))
+	for i, op := range ops {
+		if op.Family == "" {
+			op.Family = v.name()
+		}
+		bound[i] = op
+	}
+
+	return v.db.batch(bound, v)
+}
+
+func (v *familyView) Ingest(paths ...string) error {
+	return v.db.ingest(paths, v)
+}
+
+func (v *familyView) Close() error {
+	return nil
+}
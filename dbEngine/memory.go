@@ -0,0 +1,149 @@
+package dbengine
+
+import (
+	"sort"
+	"sync"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+)
+
+// MemoryEngine keeps every pair in a map and nothing on disk, the data is
+// gone once it is closed.
+type MemoryEngine struct {
+	lock  sync.RWMutex
+	pairs map[string]string
+
+	gate
+}
+
+func NewMemory() *MemoryEngine {
+	return &MemoryEngine{pairs: make(map[string]string)}
+}
+
+func (m *MemoryEngine) Get(key string) (string, bool, error) {
+	err := m.begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer m.end()
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	val, exist := m.pairs[key]
+	return val, exist, nil
+}
+
+func (m *MemoryEngine) Put(key string, value string) error {
+	return m.Batch([]Op{{Key: key, Value: value}})
+}
+
+func (m *MemoryEngine) Delete(key string) error {
+	return m.Batch([]Op{{Key: key, Delete: true}})
+}
+
+func (m *MemoryEngine) Merge(key string, operator string, operand string) error {
+	return m.Batch([]Op{{Key: key, Value: operand, Merge: operator}})
+}
+
+// Iterate walks a copy of the pairs taken when it is called, so fn may
+// write to the engine.
+func (m *MemoryEngine) Iterate(start string, fn func(key string, value string) bool) error {
+	err := m.begin()
+	if err != nil {
+		return err
+	}
+	defer m.end()
+
+	m.lock.RLock()
+	keys := make([]string, 0, len(m.pairs))
+	for key := range m.pairs {
+		if key >= start {
+			keys = append(keys, key)
+		}
+	}
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		values[key] = m.pairs[key]
+	}
+	m.lock.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, values[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Batch applies ops under one lock, readers see all of them or none. Merges
+// are resolved right away, there is nothing to defer them to, and one that
+// fails leaves every pair as it was.
+func (m *MemoryEngine) Batch(ops []Op) error {
+	for _, op := range ops {
+		if op.Key == "" {
+			return ErrInvalidKey
+		}
+		if op.Family != "" && op.Family != DefaultFamily {
+			return ErrFamilyNotFound
+		}
+		err := checkMerge(op)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := m.begin()
+	if err != nil {
+		return err
+	}
+	defer m.end()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	type pair struct {
+		value  string
+		exists bool
+	}
+	written := make(map[string]pair, len(ops))
+	for _, op := range ops {
+		if op.Delete {
+			written[op.Key] = pair{}
+		} else if op.Merge != "" {
+			current, ok := written[op.Key]
+			if !ok {
+				current.value, current.exists = m.pairs[op.Key]
+			}
+			merged, err := lsmtree.ApplyOperands(op.Key, current.value, current.exists, []lsmtree.Operand{{Operator: op.Merge, Value: op.Value}})
+			if err != nil {
+				return err
+			}
+			written[op.Key] = pair{merged, true}
+		} else {
+			written[op.Key] = pair{op.Value, true}
+		}
+	}
+
+	for key, p := range written {
+		if p.exists {
+			m.pairs[key] = p.value
+		} else {
+			delete(m.pairs, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryEngine) Close() error {
+	err := m.shut()
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	m.pairs = nil
+	m.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,373 @@
+package dbengine
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+// feedBuffer is the number of records a feed holds for a follower that
+// falls behind. The feed is dropped once it is full, and the follower has
+// to come back for a backlog or a snapshot.
+const feedBuffer = 4096
+
+// Replicator is implemented by engines whose writes can be followed by a
+// replica, see Follow.
+type Replicator interface {
+	Follow(from uint64) (*Feed, error)
+	Feeds() []*Feed
+	LastLSN() uint64
+}
+
+// Feed is what a follower that applied every record up to LSN needs to
+// catch up. When the WAL still holds the records after LSN they are in
+// Backlog. Otherwise Snapshot walks the records of the default family as of
+// LSN, which is moved up to the last record logged, see
+// lsmtree.NewRecordIterator, and Families the other families. Records then
+// receives every record logged after the backlog or snapshot, in LSN order,
+// until the feed is closed or dropped.
+type Feed struct {
+	LSN      uint64
+	Snapshot *lsmtree.Iterator
+	Families []FamilySnapshot
+	Backlog  []string
+
+	records chan string
+	acked   uint64
+	db      *DBEngine
+
+	// watch is set on the feeds of Changes, which Feeds leaves out
+	watch bool
+}
+
+// FamilySnapshot is a column family in the snapshot of a Feed, Snapshot
+// walks its records.
+type FamilySnapshot struct {
+	Name     string
+	Options  FamilyOptions
+	Snapshot *lsmtree.Iterator
+}
+
+// Records is closed when the feed is closed, when the follower fell too far
+// behind, and when the engine closes.
+func (f *Feed) Records() <-chan string {
+	return f.records
+}
+
+// Head returns the LSN of the last record the leader logged.
+func (f *Feed) Head() uint64 {
+	return f.db.LastLSN()
+}
+
+// Ack records the last LSN the follower reported as applied.
+func (f *Feed) Ack(lsn uint64) {
+	atomic.StoreUint64(&f.acked, lsn)
+}
+
+// Acked returns the last LSN given to Ack, the one given to Follow until
+// then.
+func (f *Feed) Acked() uint64 {
+	return atomic.LoadUint64(&f.acked)
+}
+
+// Close stops the feed, it can be called more than once.
+func (f *Feed) Close() {
+	f.db.feedLock.Lock()
+	defer f.db.feedLock.Unlock()
+	f.db.dropFeed(f)
+}
+
+// feeds are the open feeds of an engine, fed by the WAL record hook.
+type feeds struct {
+	feedLock sync.Mutex
+	open     map[*Feed]struct{}
+}
+
+// dropFeed closes the records of f. The caller must hold feedLock.
+func (db *DBEngine) dropFeed(f *Feed) {
+	if _, ok := db.open[f]; ok {
+		delete(db.open, f)
+		close(f.records)
+	}
+}
+
+// publish hands a record just logged to every feed of a follower, and
+// publishSynced one just synced to every feed of Changes. They run with the
+// WAL locked, so a feed that is full is dropped rather than waited for.
+func (db *DBEngine) publish(record string) {
+	db.publishTo(record, false)
+}
+
+func (db *DBEngine) publishSynced(record string) {
+	db.publishTo(record, true)
+}
+
+func (db *DBEngine) publishTo(record string, watch bool) {
+	db.feedLock.Lock()
+	defer db.feedLock.Unlock()
+
+	for f := range db.open {
+		if f.watch != watch {
+			continue
+		}
+		select {
+		case f.records <- record:
+		default:
+			db.dropFeed(f)
+		}
+	}
+}
+
+// closeFeeds drops every feed, for Close.
+func (db *DBEngine) closeFeeds() {
+	db.feedLock.Lock()
+	defer db.feedLock.Unlock()
+
+	for f := range db.open {
+		db.dropFeed(f)
+	}
+}
+
+// Follow opens a feed for a follower that applied every record up to from.
+// Writes only wait while the feed is registered, so that its records pick
+// up exactly where its backlog or snapshot ends. The backlog is read after,
+// and the snapshot walks the tree as it was then.
+func (db *DBEngine) Follow(from uint64) (*Feed, error) {
+	err := db.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer db.end()
+
+	for {
+		f, end := db.openFeed(from, func(f *Feed) {
+			if !db.WAL.Retains(from) {
+				f.LSN = db.WAL.LastLSN()
+				f.Snapshot = db.Lsmtree.NewRecordIterator()
+				f.Families = db.familySnapshots()
+			}
+		})
+		if f.Snapshot != nil {
+			return f, nil
+		}
+
+		backlog, ok := db.WAL.RecordsBetween(from, end)
+		if ok {
+			f.Backlog = backlog
+			return f, nil
+		}
+		// the records were discarded meanwhile, the next try takes a
+		// snapshot
+		f.Close()
+	}
+}
+
+// familySnapshots walks the records of every family other than the
+// default one, by name. It runs with writes held back.
+func (db *DBEngine) familySnapshots() []FamilySnapshot {
+	db.familyLock.RLock()
+	defer db.familyLock.RUnlock()
+
+	snapshots := make([]FamilySnapshot, 0, len(db.families))
+	for name, family := range db.families {
+		snapshots = append(snapshots, FamilySnapshot{Name: name, Options: family.Options, Snapshot: family.tree.NewRecordIterator()})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+	return snapshots
+}
+
+// openFeed registers a feed starting after from and returns it with the
+// LSN of the last record logged before it, the ones after go to the feed.
+// prepare runs with writes held back as well.
+func (db *DBEngine) openFeed(from uint64, prepare func(f *Feed)) (*Feed, uint64) {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	f := &Feed{LSN: from, acked: from, records: make(chan string, feedBuffer), db: db}
+	prepare(f)
+	// read before taking feedLock, the WAL hooks take it with the log
+	// locked
+	last := db.WAL.LastLSN()
+
+	db.feedLock.Lock()
+	defer db.feedLock.Unlock()
+
+	if db.open == nil {
+		db.open = make(map[*Feed]struct{})
+	}
+	db.open[f] = struct{}{}
+	return f, last
+}
+
+// LastLSN returns the LSN of the last record logged.
+func (db *DBEngine) LastLSN() uint64 {
+	return db.WAL.LastLSN()
+}
+
+// Feeds returns the open feeds of followers.
+func (db *DBEngine) Feeds() []*Feed {
+	db.feedLock.Lock()
+	defer db.feedLock.Unlock()
+
+	open := make([]*Feed, 0, len(db.open))
+	for f := range db.open {
+		if !f.watch {
+			open = append(open, f)
+		}
+	}
+	return open
+}
+
+// Replay logs a record shipped from a leader's feed under the leader's LSN
+// and applies it like WAL.InitDB does, making the families it creates or
+// drops first. A record already logged is skipped. It fails with
+// ErrFamilyNotFound, before logging the record, when it writes to a family
+// the engine does not have.
+func (db *DBEngine) Replay(record string) error {
+	lsn, entries, err := wal.ParseRecord(record)
+	if err != nil {
+		return err
+	}
+	changes := wal.ParseFamilyChanges(record)
+
+	err = db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	db.writeLock.RLock()
+	defer db.writeLock.RUnlock()
+
+	if len(changes) > 0 {
+		db.familyLock.Lock()
+		defer db.familyLock.Unlock()
+	} else {
+		db.familyLock.RLock()
+		defer db.familyLock.RUnlock()
+	}
+
+	if lsn <= db.WAL.LastLSN() {
+		return nil
+	}
+	// a crash before the record is synced makes the leader ship it again,
+	// the changes already made are then skipped
+	err = db.applyFamilyChanges(changes)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		_, err := db.tree(entry.Family)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err = db.WAL.AppendRecord(record)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		tree, _ := db.tree(entry.Family)
+		if entry.Family != "" && entry.LSN <= db.families[entry.Family].Since {
+			continue
+		}
+		wal.Apply(tree, entry)
+	}
+	return nil
+}
+
+// InstallSnapshot makes the engine hold exactly pairs, as of the leader's
+// lsn, by logging one batch at that LSN that drops every family other than
+// the default one, creates the ones of families, writes pairs and deletes
+// every other key of the default family. Pairs can be deletes that carry a
+// version, see Op, and belong to the family they name. It fails with
+// wal.ErrStaleLSN when the engine already logged lsn, as happens when the
+// leader lost records in a crash that were shipped before.
+func (db *DBEngine) InstallSnapshot(lsn uint64, pairs []Op, families map[string]FamilyOptions) error {
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer db.end()
+
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	db.familyLock.Lock()
+	defer db.familyLock.Unlock()
+
+	var changes []wal.FamilyChange
+	for name := range db.families {
+		changes = append(changes, wal.FamilyChange{Name: name, Drop: true})
+	}
+	for name, opts := range families {
+		if !validFamily(name) {
+			return ErrInvalidFamily
+		}
+		options, err := json.Marshal(opts)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, wal.FamilyChange{Name: name, Options: string(options)})
+	}
+	// drops first, then creates, each by name
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Drop != changes[j].Drop {
+			return changes[i].Drop
+		}
+		return changes[i].Name < changes[j].Name
+	})
+
+	keep := make(map[string]bool, len(pairs))
+	entries := make([]wal.Entry, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair.Family == DefaultFamily {
+			pair.Family = ""
+		}
+		err := CheckPair(pair.Key, pair.Value)
+		if err == nil && (!validField(pair.Version.Node) || pair.Delete && pair.Version.Time == 0) {
+			err = ErrInvalidValue
+		}
+		if _, ok := families[pair.Family]; err == nil && pair.Family != "" && !ok {
+			err = ErrFamilyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if pair.Family == "" {
+			keep[pair.Key] = true
+		}
+		entries = append(entries, wal.Entry{Key: pair.Key, Value: pair.Value, Delete: pair.Delete, Family: pair.Family, Version: pair.Version})
+	}
+
+	it := db.Lsmtree.NewRecordIterator()
+	for it.Next() {
+		if !keep[it.Key()] {
+			entries = append(entries, wal.Entry{Key: it.Key(), Delete: true})
+		}
+	}
+
+	err = db.WAL.WriteBatchAt(lsn, changes, entries)
+	if err != nil {
+		return err
+	}
+	for i := range changes {
+		changes[i].LSN = lsn
+	}
+	err = db.applyFamilyChanges(changes)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		tree, _ := db.tree(entry.Family)
+		wal.Apply(tree, entry)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package dbengine
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+var (
+	ErrNotCheckpoint          = errors.New("directory holds no complete checkpoint")
+	ErrRestoreExists          = errors.New("restore destination already holds data")
+	ErrTargetBeforeCheckpoint = errors.New("restore target is older than the checkpoint")
+)
+
+// Restore rebuilds the database described by opts from the checkpoint in
+// from and the WAL archive in opts.WALArchive, if it has one, replaying the
+// archived records up to target. The WAL, store and SSTable locations of
+// opts must not hold anything yet. The result is verified by opening it,
+// which also applies the replayed records to the store, before Restore
+// returns the LSN it was restored to.
+//
+// A restored database starts a new history: it should archive to a
+// directory of its own, as its LSNs repeat the ones of the original.
+func Restore(opts Options, from string, target wal.Target) (uint64, error) {
+	if opts.FS == nil {
+		opts.FS = vfs.Default
+	}
+
+	data, err := vfs.ReadFile(opts.FS, filepath.Join(from, checkpointFile))
+	if os.IsNotExist(err) {
+		return 0, ErrNotCheckpoint
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var manifest checkpointManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return 0, err
+	}
+	if target.LSN != 0 && target.LSN < manifest.LSN || !target.Time.IsZero() && target.Time.Before(manifest.Time) {
+		return 0, ErrTargetBeforeCheckpoint
+	}
+
+	for _, dir := range []string{opts.Store.Directory, opts.LSMTree.Directory} {
+		names, err := opts.FS.ReadDir(dir)
+		if dir != "" && len(names) > 0 {
+			return 0, ErrRestoreExists
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	if _, err := opts.FS.Stat(opts.WalPath); err == nil {
+		return 0, ErrRestoreExists
+	}
+
+	err = copyDir(opts.FS, filepath.Join(from, manifest.Store), opts.Store.Directory, false)
+	if err != nil {
+		return 0, err
+	}
+	if manifest.SSTables != "" && opts.LSMTree.Directory != "" {
+		// tables never change once written and are shared with the checkpoint
+		err = copyDir(opts.FS, filepath.Join(from, manifest.SSTables), opts.LSMTree.Directory, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = opts.FS.MkdirAll(filepath.Dir(opts.WalPath), 0755)
+	if err == nil {
+		err = vfs.CopyFile(opts.FS, filepath.Join(from, manifest.WAL), opts.WalPath, -1)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	lsn := manifest.LSN
+	if opts.WALArchive != "" {
+		lsn, err = wal.AppendArchived(opts.FS, opts.WALArchive, opts.WalPath, manifest.LSN, target)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// the check must not archive the replayed records over the originals
+	opts.WALArchive = ""
+	db, err := Open(opts)
+	if err != nil {
+		return 0, err
+	}
+	return lsn, db.Close()
+}
+
+// copyDir copies the files below src to dst, hard linking them when link is
+// set, and syncs every directory it fills.
+func copyDir(fs vfs.FS, src string, dst string, link bool) error {
+	names, err := fs.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	err = fs.MkdirAll(dst, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		from, to := filepath.Join(src, name), filepath.Join(dst, name)
+		info, err := fs.Stat(from)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			err = copyDir(fs, from, to, link)
+		case strings.HasSuffix(name, ".tmp"):
+		case link:
+			err = vfs.LinkOrCopy(fs, from, to)
+		default:
+			err = vfs.CopyFile(fs, from, to, -1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fs.SyncDir(dst)
+}
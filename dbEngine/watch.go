@@ -0,0 +1,68 @@
+package dbengine
+
+import (
+	"errors"
+
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+var ErrNotRetained = errors.New("records after the sequence are no longer retained")
+
+// Watcher is implemented by engines whose committed writes can be streamed
+// to clients, see Changes.
+type Watcher interface {
+	Changes(from uint64) (*Feed, error)
+	LastLSN() uint64
+}
+
+// Changes opens a feed of the records logged after from for a client
+// watching the writes. Unlike Follow it never falls back to a snapshot: the
+// backlog is read from the WAL and, for the records already discarded from
+// it, from the WAL archive. It fails with ErrNotRetained when neither holds
+// them all. As in Follow, writes only wait while the feed is registered.
+//
+// A record only reaches the feed once the WAL synced it, so that a client
+// never sees a write a crash could still lose. The backlog thus ends at the
+// last synced record, the ones after it are handed to Records by the WAL
+// sync hook, along with some already in the backlog for the reader to skip.
+// The feed carries the records of every column family, as followers get
+// them; it is up to the reader to pick the ones it streams.
+func (db *DBEngine) Changes(from uint64) (*Feed, error) {
+	err := db.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer db.end()
+
+	f, last := db.openFeed(from, func(f *Feed) { f.watch = true })
+	if from > last {
+		f.Close()
+		return nil, ErrNotRetained
+	}
+	// read once the feed is registered: the records synced later go to it
+	end := db.WAL.SyncedLSN()
+
+	backlog, ok := db.WAL.RecordsBetween(from, end)
+	// records persisted between reading the archive and the WAL are only
+	// in the archive on the second try
+	for try := 0; !ok && try < 2 && db.opts.WALArchive != ""; try++ {
+		archived, last, err := wal.ReadArchived(db.opts.FS, db.opts.WALArchive, from, wal.Target{LSN: end})
+		if err != nil {
+			break
+		}
+		var rest []string
+		if last < end {
+			rest, ok = db.WAL.RecordsBetween(last, end)
+		} else {
+			ok = true
+		}
+		backlog = append(archived, rest...)
+	}
+	if !ok {
+		f.Close()
+		return nil, ErrNotRetained
+	}
+
+	f.Backlog = backlog
+	return f, nil
+}
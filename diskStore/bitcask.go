@@ -0,0 +1,992 @@
+package diskstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+// A partition is a Bitcask style log: a directory of append-only segment
+// files of which only the newest, the active one, is written to. The keydir
+// maps every live key to the record holding its value, so a write is one
+// append and a read is one ReadAt.
+//
+// Every record is
+//
+//	[crc32: 4][kind: 1][key length: 4][value length: 4][key][value]
+//
+// with the checksum covering everything after it.
+const (
+	recordHeaderSize = 13
+
+	kindPut       byte = 0
+	kindTombstone byte = 1
+	// kindMerged is the first record of a segment written by a merge. It
+	// marks every lower numbered segment of the partition as superseded and
+	// its value holds the applied LSN of the partition.
+	kindMerged byte = 2
+	// kindBatch wraps the records applied from the WAL in one cycle. Its
+	// value is the highest LSN among them followed by the records, so that a
+	// torn batch is dropped as a whole and its LSN is known to be applied
+	// exactly when its records are.
+	kindBatch byte = 3
+	// kindVersioned is a write stamped with a version, see lsmtree.KV, whose
+	// value is encoded by encodeVersioned. It stays in the keydir when it is
+	// a delete, as the tombstone must outlive older writes.
+	kindVersioned byte = 4
+	lsnSize            = 8
+
+	segmentSuffix = ".data"
+	hintSuffix    = ".hint"
+)
+
+var ErrCorruptRecord = errors.New("corrupt record")
+
+type keyEntry struct {
+	segment uint64
+	offset  int64
+	size    uint32
+}
+
+// hintEntry is what a hint file stores for each record of its segment, which
+// is enough to rebuild the keydir without reading the values. LSN is the
+// applied LSN the record carries, a Checkpoint entry only carries that.
+type hintEntry struct {
+	Key        string
+	Offset     int64
+	Size       uint32
+	Tombstone  bool
+	LSN        uint64
+	Checkpoint bool
+}
+
+type segment struct {
+	number uint64
+	file   vfs.File
+	size   int64
+}
+
+type partitionLog struct {
+	fs             vfs.FS
+	dir            string
+	lock           sync.RWMutex
+	segments       map[uint64]*segment
+	active         *segment
+	keydir         map[string]keyEntry
+	maxSegmentSize int64
+	// applied is the highest WAL LSN written to the partition.
+	applied uint64
+}
+
+func encodeRecord(kind byte, key string, value []byte) []byte {
+	record := make([]byte, recordHeaderSize+len(key)+len(value))
+	record[4] = kind
+	binary.BigEndian.PutUint32(record[5:9], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(value)))
+	copy(record[recordHeaderSize:], key)
+	copy(record[recordHeaderSize+len(key):], value)
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// decodeRecord decodes the record at the start of data and returns its
+// total length.
+func decodeRecord(data []byte) (byte, string, []byte, int, error) {
+	if len(data) < recordHeaderSize {
+		return 0, "", nil, 0, ErrCorruptRecord
+	}
+
+	keyLen := int(binary.BigEndian.Uint32(data[5:9]))
+	valueLen := int(binary.BigEndian.Uint32(data[9:13]))
+	size := recordHeaderSize + keyLen + valueLen
+	if keyLen < 0 || valueLen < 0 || size > len(data) || size < recordHeaderSize {
+		return 0, "", nil, 0, ErrCorruptRecord
+	}
+
+	if binary.BigEndian.Uint32(data[0:4]) != crc32.ChecksumIEEE(data[4:size]) {
+		return 0, "", nil, 0, ErrCorruptRecord
+	}
+
+	key := string(data[recordHeaderSize : recordHeaderSize+keyLen])
+	value := data[recordHeaderSize+keyLen : size]
+	return data[4], key, value, size, nil
+}
+
+// encodeVersioned encodes a versioned write as
+//
+//	[time: 8][prev: 8][delete: 1][node length: 4][node][value]
+func encodeVersioned(entry wal.Entry) []byte {
+	data := make([]byte, 21+len(entry.Version.Node)+len(entry.Value))
+	binary.BigEndian.PutUint64(data[0:8], entry.Version.Time)
+	binary.BigEndian.PutUint64(data[8:16], entry.Version.Prev)
+	if entry.Delete {
+		data[16] = 1
+	}
+	binary.BigEndian.PutUint32(data[17:21], uint32(len(entry.Version.Node)))
+	copy(data[21:], entry.Version.Node)
+	copy(data[21+len(entry.Version.Node):], entry.Value)
+	return data
+}
+
+// decodeVersioned decodes the value of a kindVersioned record, without its
+// key.
+func decodeVersioned(data []byte) (wal.Entry, error) {
+	if len(data) < 21 {
+		return wal.Entry{}, ErrCorruptRecord
+	}
+	nodeLen := int(binary.BigEndian.Uint32(data[17:21]))
+	if nodeLen < 0 || 21+nodeLen > len(data) {
+		return wal.Entry{}, ErrCorruptRecord
+	}
+
+	return wal.Entry{
+		Value:  string(data[21+nodeLen:]),
+		Delete: data[16] == 1,
+		Version: lsmtree.Version{
+			Time: binary.BigEndian.Uint64(data[0:8]),
+			Prev: binary.BigEndian.Uint64(data[8:16]),
+			Node: string(data[21 : 21+nodeLen]),
+		},
+	}, nil
+}
+
+func (p *partitionLog) segmentPath(number uint64) string {
+	return filepath.Join(p.dir, fmt.Sprintf("%06d%s", number, segmentSuffix))
+}
+
+func (p *partitionLog) hintPath(number uint64) string {
+	return filepath.Join(p.dir, fmt.Sprintf("%06d%s", number, hintSuffix))
+}
+
+// openPartitionLog rebuilds the keydir of the partition in dir, using hint
+// files where they exist, and opens a segment to append to.
+func openPartitionLog(fs vfs.FS, dir string, maxSegmentSize int64) (*partitionLog, error) {
+	err := fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &partitionLog{
+		fs:             fs,
+		dir:            dir,
+		segments:       make(map[uint64]*segment),
+		keydir:         make(map[string]keyEntry),
+		maxSegmentSize: maxSegmentSize,
+	}
+
+	numbers, err := p.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	numbers, err = p.dropSuperseded(numbers)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, number := range numbers {
+		err = p.loadSegment(number)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+	}
+
+	// an empty newest segment is reused, anything else is left immutable
+	last := len(numbers) - 1
+	if last >= 0 && p.segments[numbers[last]].size == 0 {
+		p.segments[numbers[last]].file.Close()
+		delete(p.segments, numbers[last])
+		numbers = numbers[:last]
+	}
+
+	next := uint64(1)
+	if len(numbers) > 0 {
+		next = numbers[len(numbers)-1] + 1
+	}
+
+	err = p.openActive(next)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// listSegments removes leftovers of interrupted merges and hint writes and
+// returns the segment numbers in increasing order.
+func (p *partitionLog) listSegments() ([]uint64, error) {
+	names, err := p.fs.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var numbers []uint64
+	for _, name := range names {
+		if strings.HasSuffix(name, tempSuffix) {
+			err = p.fs.Remove(filepath.Join(p.dir, name))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		number, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err == nil {
+			numbers = append(numbers, number)
+		}
+	}
+
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+// dropSuperseded removes the segments that the newest merged segment already
+// covers. They only survive when a crash interrupted the merge cleanup.
+func (p *partitionLog) dropSuperseded(numbers []uint64) ([]uint64, error) {
+	for i := len(numbers) - 1; i > 0; i-- {
+		merged, err := p.isMerged(numbers[i])
+		if err != nil {
+			return nil, err
+		}
+		if !merged {
+			continue
+		}
+
+		for _, number := range numbers[:i] {
+			err = p.removeSegmentFiles(number)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return numbers[i:], p.fs.SyncDir(p.dir)
+	}
+	return numbers, nil
+}
+
+func (p *partitionLog) isMerged(number uint64) (bool, error) {
+	file, err := p.fs.Open(p.segmentPath(number))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, recordHeaderSize+lsnSize)
+	_, err = io.ReadFull(file, header)
+	if err != nil {
+		return false, nil
+	}
+
+	kind, _, _, _, err := decodeRecord(header)
+	return err == nil && kind == kindMerged, nil
+}
+
+func (p *partitionLog) removeSegmentFiles(number uint64) error {
+	err := p.fs.Remove(p.segmentPath(number))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = p.fs.Remove(p.hintPath(number))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (p *partitionLog) loadSegment(number uint64) error {
+	file, err := p.fs.Open(p.segmentPath(number))
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	p.segments[number] = &segment{number: number, file: file, size: info.Size()}
+
+	hints, err := p.readHints(number)
+	if err != nil {
+		hints, err = p.scanSegment(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, hint := range hints {
+		if hint.LSN > p.applied {
+			p.applied = hint.LSN
+		}
+
+		switch {
+		case hint.Checkpoint:
+		case hint.Tombstone:
+			delete(p.keydir, hint.Key)
+		default:
+			p.keydir[hint.Key] = keyEntry{segment: number, offset: hint.Offset, size: hint.Size}
+		}
+	}
+	return nil
+}
+
+func (p *partitionLog) readHints(number uint64) ([]hintEntry, error) {
+	data, err := vfs.ReadFile(p.fs, p.hintPath(number))
+	if err != nil {
+		return nil, err
+	}
+
+	var hints []hintEntry
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&hints)
+	return hints, err
+}
+
+// scanSegment reads every record of a segment. Reading stops at the first
+// corrupt record, which can only be a tail torn by a crash.
+func (p *partitionLog) scanSegment(file vfs.File) ([]hintEntry, error) {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var hints []hintEntry
+	offset := 0
+	for offset < len(data) {
+		kind, key, value, size, err := decodeRecord(data[offset:])
+		if err != nil {
+			break
+		}
+
+		switch kind {
+		case kindMerged:
+			if len(value) == lsnSize {
+				hints = append(hints, hintEntry{Checkpoint: true, LSN: binary.BigEndian.Uint64(value)})
+			}
+		case kindBatch:
+			hints = append(hints, batchHints(offset+size-len(value), value)...)
+		default:
+			hints = append(hints, hintEntry{
+				Key:       key,
+				Offset:    int64(offset),
+				Size:      uint32(size),
+				Tombstone: kind == kindTombstone,
+			})
+		}
+		offset += size
+	}
+	return hints, nil
+}
+
+// batchHints returns the hints of the records wrapped in the value of a
+// batch record that starts at offset in its segment.
+func batchHints(offset int, value []byte) []hintEntry {
+	if len(value) < lsnSize {
+		return nil
+	}
+	lsn := binary.BigEndian.Uint64(value)
+
+	hints := []hintEntry{{Checkpoint: true, LSN: lsn}}
+	for inner := lsnSize; inner < len(value); {
+		kind, key, _, size, err := decodeRecord(value[inner:])
+		if err != nil {
+			break
+		}
+
+		hints = append(hints, hintEntry{
+			Key:       key,
+			Offset:    int64(offset + inner),
+			Size:      uint32(size),
+			Tombstone: kind == kindTombstone,
+			LSN:       lsn,
+		})
+		inner += size
+	}
+	return hints
+}
+
+func (p *partitionLog) openActive(number uint64) error {
+	file, err := p.fs.OpenFile(p.segmentPath(number), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = p.fs.SyncDir(p.dir)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	p.active = &segment{number: number, file: file}
+	p.segments[number] = p.active
+	return nil
+}
+
+// append writes a record to the active segment, rotating it first when it
+// is full. The caller must hold p.lock.
+func (p *partitionLog) append(kind byte, key string, value []byte) (keyEntry, error) {
+	if p.active.size >= p.maxSegmentSize {
+		err := p.rotate()
+		if err != nil {
+			return keyEntry{}, err
+		}
+	}
+
+	record := encodeRecord(kind, key, value)
+	_, err := p.active.file.Seek(p.active.size, io.SeekStart)
+	if err != nil {
+		return keyEntry{}, err
+	}
+
+	_, err = p.active.file.Write(record)
+	if err != nil {
+		return keyEntry{}, err
+	}
+
+	entry := keyEntry{segment: p.active.number, offset: p.active.size, size: uint32(len(record))}
+	p.active.size += int64(len(record))
+	return entry, nil
+}
+
+// rotate seals the active segment with a hint file and starts a new one.
+func (p *partitionLog) rotate() error {
+	err := p.active.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	hints, err := p.scanSegment(p.active.file)
+	if err != nil {
+		return err
+	}
+
+	err = p.writeHints(p.active.number, hints)
+	if err != nil {
+		return err
+	}
+
+	return p.openActive(p.active.number + 1)
+}
+
+func (p *partitionLog) writeHints(number uint64, hints []hintEntry) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(hints)
+	if err != nil {
+		return err
+	}
+	return vfs.WriteFileAtomic(p.fs, p.hintPath(number), buf.Bytes())
+}
+
+func (p *partitionLog) Put(key string, value []byte) error {
+	return p.PutRecord(kindPut, key, value)
+}
+
+// PutRecord stores a record of kind for key, as Record returned it.
+func (p *partitionLog) PutRecord(kind byte, key string, value []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	entry, err := p.append(kind, key, value)
+	if err != nil {
+		return err
+	}
+	p.keydir[key] = entry
+	return nil
+}
+
+func (p *partitionLog) Delete(key string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.keydir[key]; !ok {
+		return nil
+	}
+
+	_, err := p.append(kindTombstone, key, nil)
+	if err != nil {
+		return err
+	}
+	delete(p.keydir, key)
+	return nil
+}
+
+// Apply appends the entries logged after the applied LSN of the partition
+// as one batch record, holding only the last value of every key. Merges are
+// folded into the write before them or into the stored value, and deletes of
+// keys the partition does not hold are dropped. The batch carries the
+// highest LSN of entries, so entries that were already applied before a
+// crash are skipped when the WAL is replayed. A merge that does not resolve
+// fails the whole batch, the engine refuses such merges before logging them.
+func (p *partitionLog) Apply(entries []wal.Entry) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.active.size >= p.maxSegmentSize {
+		err := p.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	var lsn uint64
+	var order []string
+	latest := make(map[string]wal.Entry)
+	for _, entry := range entries {
+		if entry.LSN <= p.applied {
+			continue
+		}
+		if entry.LSN > lsn {
+			lsn = entry.LSN
+		}
+
+		prev, seen := latest[entry.Key]
+		if entry.Merge != "" {
+			merged, err := p.merge(entry, prev, seen)
+			if err != nil {
+				return fmt.Errorf("merge of %s: %w", entry.Key, err)
+			}
+			entry = merged
+		}
+
+		if !seen {
+			order = append(order, entry.Key)
+		}
+		latest[entry.Key] = entry
+	}
+
+	if lsn == 0 {
+		return nil
+	}
+
+	var records bytes.Buffer
+	records.Write(make([]byte, lsnSize))
+	binary.BigEndian.PutUint64(records.Bytes(), lsn)
+
+	offsets := make(map[string]int64, len(order))
+	sizes := make(map[string]uint32, len(order))
+	for _, key := range order {
+		entry := latest[key]
+
+		var record []byte
+		if entry.Version.Time != 0 {
+			record = encodeRecord(kindVersioned, key, encodeVersioned(entry))
+		} else if entry.Delete {
+			if _, ok := p.keydir[key]; !ok {
+				continue
+			}
+			record = encodeRecord(kindTombstone, key, nil)
+		} else {
+			record = encodeRecord(kindPut, key, []byte(entry.Value))
+		}
+
+		offsets[key] = int64(records.Len())
+		sizes[key] = uint32(len(record))
+		records.Write(record)
+	}
+
+	batch := encodeRecord(kindBatch, "", records.Bytes())
+	_, err := p.active.file.Seek(p.active.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = p.active.file.Write(batch)
+	if err != nil {
+		return err
+	}
+
+	// the wrapped records start after the header of the batch
+	start := p.active.size + recordHeaderSize
+	p.active.size += int64(len(batch))
+	p.applied = lsn
+
+	for _, key := range order {
+		switch {
+		case sizes[key] == 0:
+		case latest[key].Delete && latest[key].Version.Time == 0:
+			delete(p.keydir, key)
+		default:
+			p.keydir[key] = keyEntry{segment: p.active.number, offset: start + offsets[key], size: sizes[key]}
+		}
+	}
+	return nil
+}
+
+// merge resolves the merge entry on top of prev, the earlier write of the
+// key in the same batch, or on top of the stored value when there is none.
+// The caller must hold p.lock.
+func (p *partitionLog) merge(entry wal.Entry, prev wal.Entry, seen bool) (wal.Entry, error) {
+	value, exists := prev.Value, seen && !prev.Delete
+	if !seen {
+		stored, err := p.get(entry.Key)
+		if err != nil && err != ErrKeyNotFound {
+			return wal.Entry{}, err
+		}
+		value, exists = string(stored), err == nil
+	}
+
+	merged, err := lsmtree.ApplyOperands(entry.Key, value, exists, []lsmtree.Operand{{Operator: entry.Merge, Value: entry.Value}})
+	if err != nil {
+		return wal.Entry{}, err
+	}
+	return wal.Entry{Key: entry.Key, Value: merged, LSN: entry.LSN}, nil
+}
+
+// MergeValue resolves operand against the value of key and stores the
+// result, in one step under the partition lock.
+func (p *partitionLog) MergeValue(key string, operator string, operand string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	merged, err := p.merge(wal.Entry{Key: key, Value: operand, Merge: operator}, wal.Entry{}, false)
+	if err != nil {
+		return err
+	}
+
+	entry, err := p.append(kindPut, key, []byte(merged.Value))
+	if err != nil {
+		return err
+	}
+	p.keydir[key] = entry
+	return nil
+}
+
+// Raise records lsn as applied when the partition has not applied it yet,
+// for keys moved in from a partition that applied more of the WAL. The
+// record is an empty batch and only durable once the partition is synced.
+func (p *partitionLog) Raise(lsn uint64) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if lsn <= p.applied {
+		return nil
+	}
+
+	value := make([]byte, lsnSize)
+	binary.BigEndian.PutUint64(value, lsn)
+	_, err := p.append(kindBatch, "", value)
+	if err != nil {
+		return err
+	}
+	p.applied = lsn
+	return nil
+}
+
+// Applied returns the highest WAL LSN written to the partition.
+func (p *partitionLog) Applied() uint64 {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.applied
+}
+
+func (p *partitionLog) Get(key string) ([]byte, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.get(key)
+}
+
+// get is Get for a caller that holds p.lock. A versioned delete reads as a
+// missing key.
+func (p *partitionLog) get(key string) ([]byte, error) {
+	entry, err := p.entry(key)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Delete {
+		return nil, ErrKeyNotFound
+	}
+	return []byte(entry.Value), nil
+}
+
+// Entry returns the write stored for key, which is a delete for a versioned
+// tombstone.
+func (p *partitionLog) Entry(key string) (wal.Entry, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.entry(key)
+}
+
+// entry is Entry for a caller that holds p.lock.
+func (p *partitionLog) entry(key string) (wal.Entry, error) {
+	kind, value, err := p.record(key)
+	if err != nil {
+		return wal.Entry{}, err
+	}
+	if kind != kindVersioned {
+		return wal.Entry{Key: key, Value: string(value)}, nil
+	}
+
+	entry, err := decodeVersioned(value)
+	entry.Key = key
+	return entry, err
+}
+
+// Record returns the kind and value of the record stored for key.
+func (p *partitionLog) Record(key string) (byte, []byte, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.record(key)
+}
+
+// record is Record for a caller that holds p.lock.
+func (p *partitionLog) record(key string) (byte, []byte, error) {
+	entry, ok := p.keydir[key]
+	if !ok {
+		return 0, nil, ErrKeyNotFound
+	}
+	return p.read(entry)
+}
+
+// read returns the kind and value of the record at entry. The caller must
+// hold p.lock.
+func (p *partitionLog) read(entry keyEntry) (byte, []byte, error) {
+	record := make([]byte, entry.size)
+	_, err := p.segments[entry.segment].file.ReadAt(record, entry.offset)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	kind, _, value, _, err := decodeRecord(record)
+	return kind, value, err
+}
+
+// Keys returns the live keys of the partition.
+func (p *partitionLog) Keys() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	keys := make([]string, 0, len(p.keydir))
+	for key := range p.keydir {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Sync makes every append so far durable.
+func (p *partitionLog) Sync() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.active.file.Sync()
+}
+
+// checkpoint writes a copy of the partition to dir. Sealed segments and
+// their hints never change again and are hard linked, the active segment is
+// copied up to its current size.
+func (p *partitionLog) checkpoint(dir string) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	err := p.fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for number, segment := range p.segments {
+		name := filepath.Base(p.segmentPath(number))
+		if segment == p.active {
+			err = vfs.CopyFile(p.fs, p.segmentPath(number), filepath.Join(dir, name), segment.size)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = vfs.LinkOrCopy(p.fs, p.segmentPath(number), filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+
+		hint := p.hintPath(number)
+		err = vfs.LinkOrCopy(p.fs, hint, filepath.Join(dir, filepath.Base(hint)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return p.fs.SyncDir(dir)
+}
+
+// immutableSegments returns the number of sealed segments.
+func (p *partitionLog) immutableSegments() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return len(p.segments) - 1
+}
+
+// Merge rewrites the live records of every sealed segment into one segment
+// that takes the number of the newest of them, then drops the others. The
+// merged segment starts with a kindMerged record, so if a crash hits before
+// the old segments are gone they are dropped on the next open.
+func (p *partitionLog) Merge() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var sealed []uint64
+	for number := range p.segments {
+		if number != p.active.number {
+			sealed = append(sealed, number)
+		}
+	}
+	if len(sealed) == 0 {
+		return nil
+	}
+	sort.Slice(sealed, func(i, j int) bool { return sealed[i] < sealed[j] })
+	target := sealed[len(sealed)-1]
+
+	var keys []string
+	for key, entry := range p.keydir {
+		if entry.segment <= target {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	applied := make([]byte, lsnSize)
+	binary.BigEndian.PutUint64(applied, p.applied)
+
+	var buf bytes.Buffer
+	buf.Write(encodeRecord(kindMerged, "", applied))
+
+	hints := make([]hintEntry, 0, len(keys)+1)
+	hints = append(hints, hintEntry{Checkpoint: true, LSN: p.applied})
+	for _, key := range keys {
+		kind, value, err := p.read(p.keydir[key])
+		if err != nil {
+			return err
+		}
+
+		record := encodeRecord(kind, key, value)
+		hints = append(hints, hintEntry{Key: key, Offset: int64(buf.Len()), Size: uint32(len(record))})
+		buf.Write(record)
+	}
+
+	// the hint of the segment being replaced must not outlive it
+	err := p.fs.Remove(p.hintPath(target))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = vfs.WriteFileAtomic(p.fs, p.segmentPath(target), buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	err = p.writeHints(target, hints)
+	if err != nil {
+		return err
+	}
+
+	file, err := p.fs.Open(p.segmentPath(target))
+	if err != nil {
+		return err
+	}
+
+	for _, number := range sealed {
+		p.segments[number].file.Close()
+		delete(p.segments, number)
+		if number != target {
+			err = p.removeSegmentFiles(number)
+			if err != nil {
+				file.Close()
+				return err
+			}
+		}
+	}
+
+	p.segments[target] = &segment{number: target, file: file, size: int64(buf.Len())}
+	for _, hint := range hints[1:] {
+		p.keydir[hint.Key] = keyEntry{segment: target, offset: hint.Offset, size: hint.Size}
+	}
+
+	return p.fs.SyncDir(p.dir)
+}
+
+func (p *partitionLog) close() error {
+	var err error
+	for _, segment := range p.segments {
+		if segment == p.active {
+			if syncErr := segment.file.Sync(); err == nil {
+				err = syncErr
+			}
+		}
+		if closeErr := segment.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (p *partitionLog) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.close()
+}
+
+// destroy closes the partition and removes its files, oldest segment first,
+// so that a crash part way through never keeps a put without the tombstone
+// that followed it.
+func (p *partitionLog) destroy() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	err := p.close()
+	if err != nil {
+		return err
+	}
+
+	numbers, err := p.listSegments()
+	if err != nil {
+		return err
+	}
+
+	for _, number := range numbers {
+		err = p.removeSegmentFiles(number)
+		if err == nil {
+			err = p.fs.SyncDir(p.dir)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// hints whose segment was already gone
+	names, err := p.fs.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = p.fs.Remove(filepath.Join(p.dir, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = p.fs.Remove(p.dir)
+	if err != nil {
+		return err
+	}
+	return p.fs.SyncDir(filepath.Dir(p.dir))
+}
@@ -2,251 +2,776 @@ package diskstore
 
 import (
 	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
-	"hash/fnv"
-	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
 	"github.com/jiteshchawla1511/KryptonDB/wal"
 )
 
 var (
-	ErrKeyNotFound = errors.New("key not found")
-	ErrCAS         = errors.New("compare and swap issue")
+	ErrKeyNotFound    = errors.New("key not found")
+	ErrCAS            = errors.New("compare and swap issue")
+	ErrClosed         = errors.New("disk store is closed")
+	ErrFamilyNotFound = errors.New("column family has no partitions")
 )
 
 const (
+	tempSuffix       = ".tmp"
+	partitionsDir    = "partitions"
+	familiesDir      = "families"
+	legacyPartPrefix = "partition_"
+
 	DefaultNumOfPartitions = 10
 	DefaultDirectory       = "/Users/jiteshchawla/KDB/KryptonDB/data"
+	DefaultMaxSegmentSize  = 64 << 20
+	DefaultMergeThreshold  = 4
+	DefaultPersistInterval = 5000
+	DefaultPersistWorkers  = 4
+	DefaultWALSizeTrigger  = 4 << 20
 )
 
+// DiskStoreOpts configures the store, FS defaults to vfs.Default. A
+// partition seals its active segment once it reaches MaxSegmentSize bytes
+// and merges its sealed segments once there are MergeThreshold of them.
+// PersistToDisk runs every PersistInterval milliseconds, or sooner once the
+// WAL holds WALSizeTrigger bytes, and applies the partitions with at most
+// PersistWorkers goroutines.
 type DiskStoreOpts struct {
 	Directory       string
 	NumOfPartitions int
+	MaxSegmentSize  int64
+	MergeThreshold  int
+	PersistInterval int
+	PersistWorkers  int
+	WALSizeTrigger  int64
+	FS              vfs.FS
 }
 
+// DiskStore keeps the data persisted from the WAL, hashed over partitions
+// that live in Directory/partitions/N. Every column family other than the
+// default one has its own partitions in Directory/families/name/N.
 type DiskStore struct {
-	files []*os.File
-	dir   string
-	Locks []*sync.RWMutex
-	Lock  sync.Mutex
+	fs             vfs.FS
+	dir            string
+	partitions     []*partitionLog
+	ring           *ring
+	maxSegmentSize int64
+	familyLock     sync.RWMutex
+	families       map[string]*familyLogs
+	mergeThreshold int
+	interval       time.Duration
+	workers        int
+	walSizeTrigger int64
+	Lock           sync.Mutex
+	closed         bool
+	running        bool
+	stop           chan struct{}
+	done           chan struct{}
+
+	// held counts the ingests linking their tables, persist cycles wait
+	held int
 }
 
-func NewDisk(opts DiskStoreOpts) *DiskStore {
+func NewDisk(opts DiskStoreOpts) (*DiskStore, error) {
 
 	dir := opts.Directory
 	if !strings.HasSuffix(dir, "/") {
 		dir = dir + "/"
 	}
 
+	fs := opts.FS
+	if fs == nil {
+		fs = vfs.Default
+	}
+
+	if opts.MaxSegmentSize == 0 {
+		opts.MaxSegmentSize = DefaultMaxSegmentSize
+	}
+
+	if opts.MergeThreshold == 0 {
+		opts.MergeThreshold = DefaultMergeThreshold
+	}
+
+	if opts.PersistInterval == 0 {
+		opts.PersistInterval = DefaultPersistInterval
+	}
+
+	if opts.PersistWorkers == 0 {
+		opts.PersistWorkers = DefaultPersistWorkers
+	}
+
+	if opts.WALSizeTrigger == 0 {
+		opts.WALSizeTrigger = DefaultWALSizeTrigger
+	}
+
 	numOfPartitions := opts.NumOfPartitions
-	err := os.Mkdir(dir, 0755)
+	err := fs.MkdirAll(dir, 0755)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
 	disk := &DiskStore{
-		dir:   dir,
-		files: make([]*os.File, numOfPartitions),
-		Locks: make([]*sync.RWMutex, numOfPartitions),
-		Lock:  sync.Mutex{},
+		fs:             fs,
+		dir:            dir,
+		ring:           newRing(numOfPartitions),
+		maxSegmentSize: opts.MaxSegmentSize,
+		families:       make(map[string]*familyLogs),
+		mergeThreshold: opts.MergeThreshold,
+		interval:       time.Duration(opts.PersistInterval) * time.Millisecond,
+		workers:        opts.PersistWorkers,
+		walSizeTrigger: opts.WALSizeTrigger,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
 	}
 
-	for i := 0; i < numOfPartitions; i++ {
-		filename := fmt.Sprintf("%s/partition_%d", dir, i)
-		file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	want := layout{Partitions: numOfPartitions, Hash: hashRing}
+	current, err := disk.readLayout(want)
+	if err != nil {
+		return nil, err
+	}
+
+	disk.partitions, err = disk.openPartitions(filepath.Join(dir, partitionsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := fs.ReadDir(filepath.Join(dir, familiesDir))
+	if err != nil && !os.IsNotExist(err) {
+		disk.closePartitions()
+		return nil, err
+	}
+	for _, name := range names {
+		partitions, err := disk.openPartitions(disk.familyDir(name))
 		if err != nil {
+			disk.closePartitions()
+			return nil, err
+		}
+		disk.families[name] = &familyLogs{partitions: partitions}
+	}
 
-			for j := 0; j < i; j++ {
-				disk.files[j].Close()
-				os.Remove(disk.files[j].Name())
-			}
-			return nil
+	leftover := len(disk.partitions) > numOfPartitions
+	for _, family := range disk.families {
+		leftover = leftover || len(family.partitions) > numOfPartitions
+	}
+
+	if current != want || leftover {
+		fmt.Printf("Repartitioning %s from %d to %d partitions\n", dir, current.Partitions, numOfPartitions)
+		err = disk.repartition(want)
+		if err != nil {
+			disk.closePartitions()
+			return nil, err
 		}
-		disk.files[i] = file
-		disk.Locks[i] = &sync.RWMutex{}
 	}
 
-	return disk
+	err = disk.importLegacyPartitions()
+	if err != nil {
+		disk.closePartitions()
+		return nil, err
+	}
+
+	return disk, nil
 }
 
-func partition(key string, numPartition int) int {
-	hash := fnv.New32a()
-	hash.Write([]byte(key))
-	return int(hash.Sum32() % uint32(numPartition))
+// familyLogs are the partitions of a column family. Entries logged at or
+// before since belong to an earlier family of the same name and are ignored.
+type familyLogs struct {
+	partitions []*partitionLog
+	since      uint64
 }
 
-func (disk *DiskStore) PersistToDisk(wl *wal.WAL, start <-chan bool) {
-	<-start
-	fmt.Println("starting the cycle")
-	for {
-		disk.Lock.Lock()
-		var wg sync.WaitGroup
-		entries := wl.ReadEntries()
-		wg.Add(len(entries))
-
-		for _, entry := range entries {
-			go func(entry wal.Entry, wg *sync.WaitGroup) {
-				partition := partition(entry.Key, len(disk.files))
-				file := disk.files[partition]
-
-				defer (*wg).Done()
-
-				existingValue, err := disk.ReadValue(file, entry.Key, partition)
-				if err != nil {
-					fmt.Println(err)
-					existingValue = nil
-				}
-
-				if entry.Delete {
-					err = disk.DeleteFromDisk(file, entry.Key, partition)
-					if err != nil {
-						fmt.Printf("%s", err.Error())
-					}
-					return
-				}
-
-				err = disk.WriteValue(file, entry.Key, []byte(entry.Value), existingValue, partition)
-				if err != nil {
-					fmt.Printf("%s", err.Error())
-				}
-			}(entry, &wg)
+// openPartitions opens the partitions in base. Partitions left over from a
+// larger layout are opened too, so that their keys can be moved before they
+// are removed.
+func (disk *DiskStore) openPartitions(base string) ([]*partitionLog, error) {
+	existing, err := disk.partitionDirs(base)
+	if err != nil {
+		return nil, err
+	}
+
+	count := disk.ring.partitions
+	if existing > count {
+		count = existing
+	}
+
+	partitions := make([]*partitionLog, count)
+	for i := range partitions {
+		p, err := openPartitionLog(disk.fs, filepath.Join(base, fmt.Sprint(i)), disk.maxSegmentSize)
+		if err != nil {
+
+			for j := 0; j < i; j++ {
+				partitions[j].Close()
+			}
+			return nil, err
 		}
+		partitions[i] = p
+	}
+	return partitions, nil
+}
 
-		wg.Wait()
-		wl.Truncate()
-		disk.Lock.Unlock()
+func (disk *DiskStore) familyDir(name string) string {
+	return filepath.Join(disk.dir, familiesDir, name)
+}
 
-		time.Sleep(5 * time.Second)
+// familyPartitions returns the partitions of a column family, the default
+// one when name is empty, or nil when there is no such family.
+func (disk *DiskStore) familyPartitions(name string) []*partitionLog {
+	if name == "" {
+		return disk.partitions
 	}
+
+	disk.familyLock.RLock()
+	defer disk.familyLock.RUnlock()
+
+	family, ok := disk.families[name]
+	if !ok {
+		return nil
+	}
+	return family.partitions
 }
 
-func (disk *DiskStore) ReadValue(file *os.File, key string, partition int) ([]byte, error) {
-	disk.Locks[partition].Lock()
-	defer disk.Locks[partition].Unlock()
+// allPartitions returns the partitions of every column family.
+func (disk *DiskStore) allPartitions() []*partitionLog {
+	disk.familyLock.RLock()
+	defer disk.familyLock.RUnlock()
+
+	all := append([]*partitionLog{}, disk.partitions...)
+	for _, family := range disk.families {
+		all = append(all, family.partitions...)
+	}
+	return all
+}
 
-	_, err := file.Seek(0, io.SeekStart)
+// CreateFamily opens the partitions of a column family, creating them if
+// needed. Entries of the family logged at or before since are ignored.
+func (disk *DiskStore) CreateFamily(name string, since uint64) error {
+	disk.familyLock.Lock()
+	defer disk.familyLock.Unlock()
+
+	if family, ok := disk.families[name]; ok {
+		family.since = since
+		return nil
+	}
+
+	partitions, err := disk.openPartitions(disk.familyDir(name))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		if parts[0] == key {
-			return []byte(parts[1]), nil
+	disk.families[name] = &familyLogs{partitions: partitions, since: since}
+	return disk.fs.SyncDir(filepath.Join(disk.dir, familiesDir))
+}
+
+// DropFamily closes the partitions of a column family and removes its
+// directory, which costs one removal per file whatever the family holds.
+func (disk *DiskStore) DropFamily(name string) error {
+	disk.Lock.Lock()
+	defer disk.Lock.Unlock()
+
+	disk.familyLock.Lock()
+	family, ok := disk.families[name]
+	delete(disk.families, name)
+	disk.familyLock.Unlock()
+
+	if ok {
+		for _, p := range family.partitions {
+			p.Close()
 		}
 	}
-	return nil, nil
+	return vfs.RemoveAll(disk.fs, disk.familyDir(name))
 }
 
-func (disk *DiskStore) WriteValue(file *os.File, key string, value []byte, existingValue []byte, parition int) error {
-	disk.Locks[parition].RLock()
-	defer disk.Locks[parition].RUnlock()
+// Families returns the names of the column families with partitions.
+func (disk *DiskStore) Families() []string {
+	disk.familyLock.RLock()
+	defer disk.familyLock.RUnlock()
+
+	names := make([]string, 0, len(disk.families))
+	for name := range disk.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Contents returns every live pair of a column family, the default one when
+// family is empty, and the versioned deletes it keeps.
+func (disk *DiskStore) Contents(family string) []wal.Entry {
+	var entries []wal.Entry
+	for _, p := range disk.familyPartitions(family) {
+		entries = append(entries, partitionContents(p, true)...)
+	}
+	return entries
+}
 
-	_, err := file.Seek(0, io.SeekStart)
+// importLegacyPartitions moves the records of the key:value text files used
+// before the segment logs into the logs and removes the text files. A crash
+// part way through imports them again on the next start.
+func (disk *DiskStore) importLegacyPartitions() error {
+	names, err := disk.fs.ReadDir(disk.dir)
 	if err != nil {
 		return err
 	}
 
-	var buf bytes.Buffer
-	buf.WriteString(fmt.Sprintf("%s:%s\n", key, value))
+	var imported []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, legacyPartPrefix) {
+			continue
+		}
+
+		path := disk.dir + name
+		if strings.HasSuffix(name, tempSuffix) {
+			err = disk.fs.Remove(path)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		file, err := disk.fs.Open(path)
+		if err != nil {
+			return err
+		}
 
-	if existingValue != nil {
 		scanner := bufio.NewScanner(file)
 		for scanner.Scan() {
-			line := scanner.Text()
-			parts := strings.Split(line, ":")
-			if parts[0] == key {
+			parts := strings.SplitN(scanner.Text(), ":", 2)
+			if len(parts) != 2 {
 				continue
 			}
-			buf.WriteString(line + "\n")
+
+			err = disk.WriteValue(parts[0], []byte(parts[1]), disk.PartitionOf(parts[0]))
+			if err != nil {
+				file.Close()
+				return err
+			}
+		}
+		file.Close()
+
+		if scanner.Err() != nil {
+			return scanner.Err()
 		}
+		imported = append(imported, path)
+	}
+
+	if len(imported) == 0 {
+		return nil
 	}
 
-	_, err = file.Seek(0, io.SeekEnd)
+	err = disk.Sync()
 	if err != nil {
 		return err
 	}
 
-	_, err = file.Write(buf.Bytes())
+	for _, path := range imported {
+		err = disk.fs.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return disk.fs.SyncDir(disk.dir)
+}
+
+func (disk *DiskStore) NumOfPartitions() int {
+	return len(disk.partitions)
+}
+
+// PartitionOf returns the partition that holds key.
+func (disk *DiskStore) PartitionOf(key string) int {
+	return disk.ring.owner(key)
+}
+
+// PersistToDisk applies the WAL to the partition files every interval, or
+// as soon as the WAL outgrows the size trigger, once start fires and until
+// the store is closed. A store written to directly passes a nil WAL and the
+// loop only syncs and merges the partitions.
+func (disk *DiskStore) PersistToDisk(wl *wal.WAL, start <-chan bool) {
+	select {
+	case <-start:
+	case <-disk.stop:
+		return
+	}
+
+	disk.Lock.Lock()
+	if disk.closed {
+		disk.Lock.Unlock()
+		return
+	}
+	disk.running = true
+	disk.Lock.Unlock()
+	defer close(disk.done)
+
+	// a nil channel never fires
+	var full <-chan struct{}
+	if wl != nil {
+		wl.SetSizeLimit(disk.walSizeTrigger)
+		full = wl.Full()
+	}
+
+	fmt.Println("starting the cycle")
+	for {
+		disk.Lock.Lock()
+		if disk.held == 0 {
+			err := disk.persistCycle(wl)
+			if err != nil {
+				fmt.Printf("Error persisting the WAL: %v\n", err)
+			}
+			disk.mergePartitions()
+		}
+		disk.Lock.Unlock()
+
+		select {
+		case <-disk.stop:
+			return
+		case <-full:
+		case <-time.After(disk.interval):
+		}
+	}
+}
+
+// persistCycle flushes the WAL, applies the entries each partition has not
+// applied yet, syncs the partitions and only then discards the applied
+// records from the WAL. Records logged while the cycle runs have higher LSNs
+// and are kept for the next one. The caller must hold disk.Lock.
+func (disk *DiskStore) persistCycle(wl *wal.WAL) error {
+	if wl == nil {
+		return disk.Sync()
+	}
+
+	err := wl.Persist()
 	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func (disk *DiskStore) DeleteFromDisk(file *os.File, key string, partition int) error {
-	disk.Locks[partition].RLock()
-	defer disk.Locks[partition].RUnlock()
+	entries := wl.ReadEntries()
+	if len(entries) == 0 {
+		return disk.Sync()
+	}
+	batches := disk.groupByPartition(entries)
+
+	targets := make([]target, 0, len(batches))
+	for t := range batches {
+		targets = append(targets, t)
+	}
+
+	jobs := make(chan target)
+	errs := make(chan error, len(batches))
+	var wg sync.WaitGroup
+
+	workers := disk.workers
+	if workers > len(batches) {
+		workers = len(batches)
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				errs <- disk.familyPartitions(t.family)[t.partition].Apply(batches[t])
+			}
+		}()
+	}
+
+	for _, t := range targets {
+		jobs <- t
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
 
-	_, err := file.Seek(0, io.SeekStart)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 
+	err = disk.Sync()
 	if err != nil {
 		return err
 	}
 
-	var buf bytes.Buffer
-	scanner := bufio.NewScanner(file)
+	return wl.DiscardThrough(entries[len(entries)-1].LSN)
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		if parts[0] == key {
-			continue
+// Ingest writes the pairs of bulk loaded tables of family straight to its
+// partitions, reading them a block at a time, under one LSN reserved from
+// wl. The WAL is persisted first, so that no record logged before the
+// ingest is left behind the reserved LSN. link is then called with the LSN
+// and disk.Lock released, but no persist cycle runs until it returns: the
+// records logged meanwhile stay in the WAL.
+func (disk *DiskStore) Ingest(wl *wal.WAL, family string, tables []lsmtree.DiskFile, link func(lsn uint64) error) error {
+	disk.Lock.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			disk.Lock.Unlock()
 		}
-		buf.WriteString(line + "\n")
+	}()
+
+	if disk.closed {
+		return ErrClosed
+	}
+
+	partitions := disk.familyPartitions(family)
+	if partitions == nil {
+		return ErrFamilyNotFound
 	}
 
-	if err := file.Truncate(0); err != nil {
+	lsn := wl.ReserveLSN()
+	err := disk.persistCycle(wl)
+	if err != nil {
 		return err
 	}
 
-	_, err = file.Seek(0, io.SeekEnd)
+	for _, table := range tables {
+		err = table.Each(func(pair lsmtree.KV) error {
+			partition := partitions[disk.PartitionOf(pair.Key)]
+			if pair.Tombstone {
+				return partition.Delete(pair.Key)
+			}
+			return partition.Put(pair.Key, []byte(pair.Value))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, partition := range partitions {
+		err = partition.Raise(lsn)
+		if err != nil {
+			return err
+		}
+	}
+	err = disk.Sync()
 	if err != nil {
 		return err
 	}
 
-	_, err = file.Write(buf.Bytes())
+	disk.held++
+	disk.Lock.Unlock()
+	locked = false
+	defer func() {
+		disk.Lock.Lock()
+		disk.held--
+		disk.Lock.Unlock()
+	}()
+
+	return link(lsn)
+}
+
+// Checkpoint writes a copy of the store to dir that opens as a store of its
+// own. cut is called first, with disk.Lock held, so nothing is applied to
+// the partitions or merged away from under the copy: the copy holds what
+// the store held when cut ran.
+func (disk *DiskStore) Checkpoint(dir string, cut func() error) error {
+	disk.Lock.Lock()
+	defer disk.Lock.Unlock()
 
+	if disk.closed {
+		return ErrClosed
+	}
+
+	err := disk.fs.MkdirAll(dir, 0755)
 	if err != nil {
 		return err
 	}
 
+	if cut != nil {
+		err = cut()
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := vfs.ReadFile(disk.fs, disk.layoutPath())
+	if err == nil {
+		err = vfs.WriteFileAtomic(disk.fs, filepath.Join(dir, layoutFile), data)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, p := range disk.allPartitions() {
+		rel, err := filepath.Rel(disk.dir, p.dir)
+		if err != nil {
+			return err
+		}
+
+		err = p.checkpoint(filepath.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (disk *DiskStore) GetFileContents(i int) []wal.Entry {
-	disk.Locks[i].RLock()
-	defer disk.Locks[i].RUnlock()
+// target is a partition of a column family.
+type target struct {
+	family    string
+	partition int
+}
 
-	_, err := disk.files[i].Seek(0, io.SeekStart)
-	if err != nil {
-		return nil
+// groupByPartition splits entries by partition, keeping their order.
+// Entries of families that were dropped are left out.
+func (disk *DiskStore) groupByPartition(entries []wal.Entry) map[target][]wal.Entry {
+	batches := make(map[target][]wal.Entry)
+
+	disk.familyLock.RLock()
+	defer disk.familyLock.RUnlock()
+
+	for _, entry := range entries {
+		if entry.Family != "" {
+			family, ok := disk.families[entry.Family]
+			if !ok || entry.LSN <= family.since {
+				continue
+			}
+		}
+
+		t := target{family: entry.Family, partition: disk.PartitionOf(entry.Key)}
+		batches[t] = append(batches[t], entry)
 	}
+	return batches
+}
 
-	scanner := bufio.NewScanner(disk.files[i])
-	var entries []wal.Entry
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		entries = append(entries, wal.Entry{
-			Key:   parts[0],
-			Value: parts[1],
-		})
+// mergePartitions merges the partitions that collected enough sealed
+// segments. The caller must hold disk.Lock.
+func (disk *DiskStore) mergePartitions() {
+	for i, p := range disk.allPartitions() {
+		if p.immutableSegments() < disk.mergeThreshold {
+			continue
+		}
+
+		err := p.Merge()
+		if err != nil {
+			fmt.Printf("Error merging partition %d: %v\n", i, err)
+		}
+	}
+}
+
+// Sync makes every write to the partitions durable.
+func (disk *DiskStore) Sync() error {
+	for _, p := range disk.allPartitions() {
+		err := p.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppliedLSN returns the highest WAL LSN written to any partition.
+func (disk *DiskStore) AppliedLSN() uint64 {
+	var lsn uint64
+	for _, p := range disk.allPartitions() {
+		if applied := p.Applied(); applied > lsn {
+			lsn = applied
+		}
+	}
+	return lsn
+}
+
+// KeyApplied returns the applied LSN of the partition that holds key in
+// family. WAL entries of key at or below it are already in the store.
+func (disk *DiskStore) KeyApplied(family string, key string) uint64 {
+	partitions := disk.familyPartitions(family)
+	if partitions == nil {
+		return 0
+	}
+	return partitions[disk.PartitionOf(key)].Applied()
+}
+
+// SyncPartition makes the writes to one partition durable.
+func (disk *DiskStore) SyncPartition(partition int) error {
+	return disk.partitions[partition].Sync()
+}
+
+func (disk *DiskStore) closePartitions() error {
+	var err error
+	for _, p := range disk.allPartitions() {
+		if closeErr := p.Close(); err == nil {
+			err = closeErr
+		}
 	}
+	return err
+}
+
+// Close stops PersistToDisk, applies what is left in the WAL, if there is
+// one, and syncs and closes the partitions.
+func (disk *DiskStore) Close(wl *wal.WAL) error {
+	disk.Lock.Lock()
+	disk.closed = true
+	running := disk.running
+	disk.Lock.Unlock()
+
+	close(disk.stop)
+	if running {
+		<-disk.done
+	}
+
+	disk.Lock.Lock()
+	defer disk.Lock.Unlock()
+
+	err := disk.persistCycle(wl)
+
+	if closeErr := disk.closePartitions(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (disk *DiskStore) ReadValue(key string, partition int) ([]byte, error) {
+	return disk.partitions[partition].Get(key)
+}
+
+func (disk *DiskStore) WriteValue(key string, value []byte, partition int) error {
+	return disk.partitions[partition].Put(key, value)
+}
+
+func (disk *DiskStore) DeleteFromDisk(key string, partition int) error {
+	return disk.partitions[partition].Delete(key)
+}
+
+// MergeValue folds a merge operand into the stored value of key.
+func (disk *DiskStore) MergeValue(key string, operator string, operand string, partition int) error {
+	return disk.partitions[partition].MergeValue(key, operator, operand)
+}
+
+// Merge merges the sealed segments of every partition right away.
+func (disk *DiskStore) Merge() error {
+	for _, p := range disk.allPartitions() {
+		err := p.Merge()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+func (disk *DiskStore) GetFileContents(i int) []wal.Entry {
+	return partitionContents(disk.partitions[i], false)
+}
+
+// partitionContents returns the live pairs of p, and its versioned deletes
+// when deletes is set.
+func partitionContents(p *partitionLog, deletes bool) []wal.Entry {
+	var entries []wal.Entry
+	for _, key := range p.Keys() {
+		entry, err := p.Entry(key)
+		if err != nil || entry.Delete && !deletes {
+			continue
+		}
+		entries = append(entries, entry)
+	}
 	return entries
 }
 
 func (disk *DiskStore) LoadFromDisk(lsmtree *lsmtree.LSMTree, wal *wal.WAL) error {
-	for i := 0; i < len(disk.files); i++ {
+	for i := 0; i < len(disk.partitions); i++ {
 		entry := disk.GetFileContents(i)
 
 		for _, e := range entry {
@@ -254,6 +779,9 @@ func (disk *DiskStore) LoadFromDisk(lsmtree *lsmtree.LSMTree, wal *wal.WAL) erro
 		}
 	}
 
+	// a WAL that was lost or replaced must not hand out applied LSNs again
+	wal.AdvanceLSN(disk.AppliedLSN())
+
 	err := wal.InitDB(lsmtree)
 
 	if err != nil {
@@ -0,0 +1,228 @@
+package diskstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+const (
+	layoutFile = "LAYOUT"
+
+	// hashModulo is the fnv32a(key) % partitions layout used before the
+	// ring, hashRing places keys on a consistent hash ring.
+	hashModulo = "modulo"
+	hashRing   = "ring"
+
+	// ringReplicas is the number of points each partition owns on the ring.
+	ringReplicas = 64
+)
+
+// layout is what the LAYOUT file records about the partitions of a store.
+// Migrating is set while the keys are being moved to Partitions partitions
+// and cleared once they all are.
+type layout struct {
+	Partitions int    `json:"partitions"`
+	Hash       string `json:"hash"`
+	Migrating  bool   `json:"migrating"`
+}
+
+// ring maps keys to partitions so that going from n to m partitions only
+// moves the keys of the points that changed owner, about |m-n|/max(m, n) of
+// them.
+type ring struct {
+	partitions int
+	points     []uint64
+	owners     map[uint64]int
+}
+
+func newRing(partitions int) *ring {
+	r := &ring{partitions: partitions, owners: make(map[uint64]int, partitions*ringReplicas)}
+	for p := 0; p < partitions; p++ {
+		for i := 0; i < ringReplicas; i++ {
+			point := hashKey(fmt.Sprintf("partition-%d-%d", p, i))
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+			r.owners[point] = p
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// owner returns the partition of the first point at or after the hash of key.
+func (r *ring) owner(key string) int {
+	hash := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// hashKey is fnv64a followed by the splitmix64 finalizer, fnv alone leaves
+// names that only differ in their last bytes close together on the ring.
+func hashKey(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+
+	h := hash.Sum64()
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
+
+func (disk *DiskStore) layoutPath() string {
+	return filepath.Join(disk.dir, layoutFile)
+}
+
+// readLayout returns the recorded layout. A store written before the LAYOUT
+// file existed used the modulo hash over every partition directory it has,
+// a new store starts out with want.
+func (disk *DiskStore) readLayout(want layout) (layout, error) {
+	data, err := vfs.ReadFile(disk.fs, disk.layoutPath())
+	if err == nil {
+		var current layout
+		err = json.Unmarshal(data, &current)
+		return current, err
+	}
+	if !os.IsNotExist(err) {
+		return layout{}, err
+	}
+
+	existing, err := disk.partitionDirs(filepath.Join(disk.dir, partitionsDir))
+	if err != nil {
+		return layout{}, err
+	}
+	if existing == 0 {
+		return want, disk.writeLayout(want)
+	}
+	return layout{Partitions: existing, Hash: hashModulo}, nil
+}
+
+func (disk *DiskStore) writeLayout(l layout) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return vfs.WriteFileAtomic(disk.fs, disk.layoutPath(), data)
+}
+
+// partitionDirs returns one more than the highest numbered partition
+// directory in base, or 0 when there is none.
+func (disk *DiskStore) partitionDirs(base string) (int, error) {
+	names, err := disk.fs.ReadDir(base)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, name := range names {
+		n, err := strconv.Atoi(name)
+		if err == nil && n+1 > count {
+			count = n + 1
+		}
+	}
+	return count, nil
+}
+
+// repartition moves the keys of the default partitions and of those of
+// every column family to the partitions the ring places them in.
+func (disk *DiskStore) repartition(want layout) error {
+	err := disk.writeLayout(layout{Partitions: want.Partitions, Hash: want.Hash, Migrating: true})
+	if err != nil {
+		return err
+	}
+
+	disk.partitions, err = disk.repartitionSet(disk.partitions, want.Partitions)
+	if err != nil {
+		return err
+	}
+
+	for _, family := range disk.families {
+		family.partitions, err = disk.repartitionSet(family.partitions, want.Partitions)
+		if err != nil {
+			return err
+		}
+	}
+
+	return disk.writeLayout(want)
+}
+
+// repartitionSet moves every key of partitions that the ring places
+// elsewhere to its owner, removes the partitions past want and returns the
+// ones left. Keys are copied and synced before they are deleted from their
+// old partition, so a crash leaves every key in at least one partition with
+// its latest value and the next start simply runs the migration again. The
+// partitions given keys are raised to the applied LSN of the one they came
+// from, or the WAL records already folded into a moved value, such as merge
+// operands, would be replayed on top of it.
+func (disk *DiskStore) repartitionSet(partitions []*partitionLog, want int) ([]*partitionLog, error) {
+	total := len(partitions)
+	for i, p := range partitions {
+		var moved []string
+		given := make(map[int]bool)
+		for _, key := range p.Keys() {
+			owner := disk.ring.owner(key)
+			if owner == i {
+				continue
+			}
+
+			kind, value, err := p.Record(key)
+			if err != nil {
+				return nil, err
+			}
+			err = partitions[owner].PutRecord(kind, key, value)
+			if err != nil {
+				return nil, err
+			}
+			moved = append(moved, key)
+			given[owner] = true
+		}
+
+		for owner := range given {
+			err := partitions[owner].Raise(p.Applied())
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, other := range partitions {
+			err := other.Sync()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, key := range moved {
+			err := p.Delete(key)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err := p.Sync()
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Printf("Repartitioning: partition %d of %d done, %d keys moved\n", i+1, total, len(moved))
+	}
+
+	for i := want; i < total; i++ {
+		err := partitions[i].destroy()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return partitions[:want], nil
+}
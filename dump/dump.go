@@ -0,0 +1,247 @@
+// Package dump writes the live pairs of an engine as text other tools can
+// read, one pair per line, and loads such text back through batched writes.
+package dump
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+)
+
+// Formats of a dump. A JSONL line is {"key":"k","value":"v"} and a CSV line
+// is k,v, after a key,value,encoding header. A value that is not printable
+// UTF-8 is base64 encoded, which "encoding":"base64" or the third column
+// records.
+const (
+	JSONL = "jsonl"
+	CSV   = "csv"
+
+	base64Encoding = "base64"
+)
+
+var (
+	ErrUnknownFormat = errors.New("dump format must be jsonl or csv")
+	ErrBadLine       = errors.New("line is not a dumped pair")
+)
+
+var csvHeader = []string{"key", "value", "encoding"}
+
+// Range selects the pairs to dump: keys from Start, inclusive, to End,
+// exclusive, that start with Prefix. Zero fields do not restrict it.
+type Range struct {
+	Start  string
+	End    string
+	Prefix string
+}
+
+// First returns the first key the range can hold.
+func (r Range) First() string {
+	if r.Prefix > r.Start {
+		return r.Prefix
+	}
+	return r.Start
+}
+
+// Contains reports whether key is in the range, and past reports whether
+// no later key can be.
+func (r Range) Contains(key string) (in bool, past bool) {
+	if r.End != "" && key >= r.End {
+		return false, true
+	}
+	if !strings.HasPrefix(key, r.Prefix) {
+		return false, key > r.Prefix
+	}
+	return true, false
+}
+
+type pair struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+	// Delete and Version are only written by EncodeOp
+	Delete  bool     `json:"delete,omitempty"`
+	Version *version `json:"version,omitempty"`
+}
+
+type version struct {
+	Time uint64 `json:"time"`
+	Node string `json:"node"`
+	Prev uint64 `json:"prev,omitempty"`
+}
+
+// CheckFormat fails with ErrUnknownFormat for anything but JSONL and CSV.
+func CheckFormat(format string) error {
+	if format != JSONL && format != CSV {
+		return ErrUnknownFormat
+	}
+	return nil
+}
+
+func binary(value string) bool {
+	if !utf8.ValidString(value) {
+		return true
+	}
+	return strings.IndexFunc(value, func(r rune) bool {
+		return unicode.IsControl(r) && r != '\t'
+	}) >= 0
+}
+
+// Header returns the line a dump in format starts with, if it has one.
+func Header(format string) (string, bool) {
+	if format != CSV {
+		return "", false
+	}
+	return encodeCSV(csvHeader), true
+}
+
+// Encode returns the line of one pair, without its newline.
+func Encode(format string, key string, value string) (string, error) {
+	return encode(format, newPair(key, value))
+}
+
+// EncodeOp returns the JSONL line of a put or delete, keeping its version.
+// Replication snapshots are written with it, so that the records of a
+// multi-leader node are shipped as they are stored.
+func EncodeOp(op dbengine.Op) (string, error) {
+	p := newPair(op.Key, op.Value)
+	p.Delete = op.Delete
+	if op.Version.Time != 0 {
+		p.Version = &version{Time: op.Version.Time, Node: op.Version.Node, Prev: op.Version.Prev}
+	}
+	return encode(JSONL, p)
+}
+
+func newPair(key string, value string) pair {
+	p := pair{Key: key, Value: value}
+	if binary(value) {
+		p.Value = base64.StdEncoding.EncodeToString([]byte(value))
+		p.Encoding = base64Encoding
+	}
+	return p
+}
+
+func encode(format string, p pair) (string, error) {
+	switch format {
+	case JSONL:
+		data, err := json.Marshal(p)
+		return string(data), err
+	case CSV:
+		return encodeCSV([]string{p.Key, p.Value, p.Encoding}), nil
+	default:
+		return "", ErrUnknownFormat
+	}
+}
+
+func encodeCSV(fields []string) string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(fields)
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// Decode parses one line written by Encode. It fails with ErrBadLine for a
+// line that holds no pair, such as the CSV header.
+func Decode(format string, line string) (string, string, error) {
+	p, err := decode(format, line)
+	return p.Key, p.Value, err
+}
+
+// DecodeOp parses one line written by EncodeOp, or by Encode in JSONL.
+func DecodeOp(line string) (dbengine.Op, error) {
+	p, err := decode(JSONL, line)
+	if err != nil {
+		return dbengine.Op{}, err
+	}
+
+	op := dbengine.Op{Key: p.Key, Value: p.Value, Delete: p.Delete}
+	if p.Version != nil {
+		op.Version = lsmtree.Version{Time: p.Version.Time, Node: p.Version.Node, Prev: p.Version.Prev}
+	}
+	return op, nil
+}
+
+func decode(format string, line string) (pair, error) {
+	var p pair
+
+	switch format {
+	case JSONL:
+		if json.Unmarshal([]byte(line), &p) != nil {
+			return pair{}, ErrBadLine
+		}
+	case CSV:
+		r := csv.NewReader(strings.NewReader(line))
+		r.FieldsPerRecord = -1
+		fields, err := r.Read()
+		if err != nil || len(fields) < 2 || len(fields) > 3 || fields[0] == csvHeader[0] && fields[1] == csvHeader[1] {
+			return pair{}, ErrBadLine
+		}
+		p.Key, p.Value = fields[0], fields[1]
+		if len(fields) == 3 {
+			p.Encoding = fields[2]
+		}
+	default:
+		return pair{}, ErrUnknownFormat
+	}
+
+	switch p.Encoding {
+	case "":
+	case base64Encoding:
+		value, err := base64.StdEncoding.DecodeString(p.Value)
+		if err != nil {
+			return pair{}, ErrBadLine
+		}
+		p.Value = string(value)
+	default:
+		return pair{}, ErrBadLine
+	}
+	return p, nil
+}
+
+// Dump writes the pairs of engine in r to w in format, one per line in key
+// order, and returns how many it wrote.
+func Dump(engine dbengine.Engine, w io.Writer, format string, r Range) (int, error) {
+	err := CheckFormat(format)
+	if err != nil {
+		return 0, err
+	}
+
+	if header, ok := Header(format); ok {
+		_, err = io.WriteString(w, header+"\n")
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	iterErr := engine.Iterate(r.First(), func(key string, value string) bool {
+		in, past := r.Contains(key)
+		if !in {
+			return !past
+		}
+
+		var line string
+		line, err = Encode(format, key, value)
+		if err == nil {
+			_, err = io.WriteString(w, line+"\n")
+		}
+		if err != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if err == nil {
+		err = iterErr
+	}
+	return count, err
+}
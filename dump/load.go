@@ -0,0 +1,119 @@
+package dump
+
+import (
+	"bufio"
+	"io"
+
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+)
+
+// DefaultBatchSize is the number of pairs a Loader writes per batch.
+const DefaultBatchSize = 1000
+
+// Stats counts the lines a Loader has seen: Loaded pairs were written and
+// Rejected lines held no pair, or one the engine cannot store.
+type Stats struct {
+	Loaded   int
+	Rejected int
+}
+
+// LoadOptions configures a Loader. BatchSize defaults to DefaultBatchSize
+// and Progress, when set, is called after every batch is written.
+type LoadOptions struct {
+	Format    string
+	BatchSize int
+	Progress  func(Stats)
+}
+
+// Loader writes the lines of a dump to an engine in batches. Lines are
+// given one at a time with Add, so that they can come from a file as well
+// as from a connection.
+type Loader struct {
+	engine dbengine.Engine
+	opts   LoadOptions
+	ops    []dbengine.Op
+	stats  Stats
+}
+
+func NewLoader(engine dbengine.Engine, opts LoadOptions) (*Loader, error) {
+	err := CheckFormat(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	return &Loader{engine: engine, opts: opts}, nil
+}
+
+// Add decodes line and queues its pair, writing the batch once it is full.
+// A bad line is counted and skipped, only a failed write is returned. Blank
+// lines and the header of a CSV dump are skipped without being counted.
+func (l *Loader) Add(line string) error {
+	if line == "" {
+		return nil
+	}
+	if header, ok := Header(l.opts.Format); ok && line == header {
+		return nil
+	}
+
+	key, value, err := Decode(l.opts.Format, line)
+	if err == nil {
+		err = dbengine.CheckPair(key, value)
+	}
+	if err != nil {
+		l.stats.Rejected++
+		return nil
+	}
+
+	l.ops = append(l.ops, dbengine.Op{Key: key, Value: value})
+	if len(l.ops) < l.opts.BatchSize {
+		return nil
+	}
+	return l.flush()
+}
+
+func (l *Loader) flush() error {
+	if len(l.ops) == 0 {
+		return nil
+	}
+
+	err := l.engine.Batch(l.ops)
+	if err != nil {
+		return err
+	}
+
+	l.stats.Loaded += len(l.ops)
+	l.ops = l.ops[:0]
+	if l.opts.Progress != nil {
+		l.opts.Progress(l.stats)
+	}
+	return nil
+}
+
+// Finish writes the pairs still queued and returns the final counts.
+func (l *Loader) Finish() (Stats, error) {
+	err := l.flush()
+	return l.stats, err
+}
+
+// Load writes every line of r to engine, see Loader.
+func Load(engine dbengine.Engine, r io.Reader, opts LoadOptions) (Stats, error) {
+	loader, err := NewLoader(engine, opts)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		err = loader.Add(scanner.Text())
+		if err != nil {
+			return loader.stats, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return loader.stats, err
+	}
+	return loader.Finish()
+}
@@ -0,0 +1,281 @@
+package dynamo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	"github.com/jiteshchawla1511/KryptonDB/dump"
+)
+
+const (
+	DefaultAntiEntropyInterval = 60000
+
+	// treeDepth is the depth of the Merkle trees, whose leaves split the
+	// hash space of the ring into 1<<treeDepth ranges.
+	treeDepth  = 10
+	treeLeaves = 1 << treeDepth
+)
+
+var ErrUnknownNode = errors.New("node is not in the ring")
+
+// merkle is the Merkle tree of the keys a node shares with a peer. A leaf
+// holds the XOR of the hashes of its pairs, so that writes update it
+// without reading the other pairs, and inner nodes are only hashed when
+// the tree is compared.
+type merkle struct {
+	leaves [treeLeaves]uint64
+}
+
+// leafOf returns the leaf of key, the range of the ring its hash is in.
+func leafOf(key string) int {
+	return int(hashKey(key) >> (64 - treeDepth))
+}
+
+// toggle adds the pair to its leaf, or removes it when it is already there.
+func (m *merkle) toggle(key string, rec record) {
+	m.leaves[leafOf(key)] ^= hashKey(key + "\x00" + rec.encode())
+}
+
+// nodes returns the hashes of the tree in heap order: the root at 1, the
+// children of i at 2i and 2i+1 and the leaves from treeLeaves on.
+func (m *merkle) nodes() []uint64 {
+	nodes := make([]uint64, 2*treeLeaves)
+	copy(nodes[treeLeaves:], m.leaves[:])
+
+	var buf [16]byte
+	for i := treeLeaves - 1; i >= 1; i-- {
+		binary.BigEndian.PutUint64(buf[:8], nodes[2*i])
+		binary.BigEndian.PutUint64(buf[8:], nodes[2*i+1])
+		hash := fnv.New64a()
+		hash.Write(buf[:])
+		nodes[i] = hash.Sum64()
+	}
+	return nodes
+}
+
+// shares reports whether this node and peer are both replicas of key.
+func (n *Node) shares(key string, peer string) bool {
+	self, other := false, false
+	for _, id := range n.ring.preference(key, n.cfg.N) {
+		self = self || id == n.cfg.ID
+		other = other || id == peer
+	}
+	return self && other
+}
+
+// track updates the trees of the peers that replicate key when its record
+// goes from old, if found, to rec.
+func (n *Node) track(key string, old record, found bool, rec record) {
+	n.treeLock.Lock()
+	defer n.treeLock.Unlock()
+
+	for _, id := range n.ring.preference(key, n.cfg.N) {
+		tree, ok := n.trees[id]
+		if !ok {
+			continue
+		}
+		if found {
+			tree.toggle(key, old)
+		}
+		tree.toggle(key, rec)
+	}
+}
+
+// buildTrees hashes the pairs this node holds into the tree of every peer
+// that replicates them.
+func (n *Node) buildTrees() error {
+	for id := range n.cfg.Nodes {
+		if id != n.cfg.ID {
+			n.trees[id] = &merkle{}
+		}
+	}
+
+	return n.engine.Iterate("", func(key string, data string) bool {
+		if n.shares(key, n.cfg.ID) {
+			n.track(key, record{}, false, decode(data))
+		}
+		return true
+	})
+}
+
+// scan calls fn with the pairs in r this node shares with peer.
+func (n *Node) scan(peer string, r dump.Range, fn func(key string, rec record)) error {
+	return n.engine.Iterate(r.First(), func(key string, data string) bool {
+		in, past := r.Contains(key)
+		if in && n.shares(key, peer) {
+			fn(key, decode(data))
+		}
+		return !past
+	})
+}
+
+// tree returns the hashes of the tree this node keeps for peer, or of one
+// built for the pairs in r when r restricts the keys.
+func (n *Node) tree(peer string, r dump.Range) ([]uint64, error) {
+	if r == (dump.Range{}) {
+		n.treeLock.Lock()
+		defer n.treeLock.Unlock()
+
+		tree, ok := n.trees[peer]
+		if !ok {
+			return nil, ErrUnknownNode
+		}
+		return tree.nodes(), nil
+	}
+
+	tree := &merkle{}
+	err := n.scan(peer, r, tree.toggle)
+	if err != nil {
+		return nil, err
+	}
+	return tree.nodes(), nil
+}
+
+// pairsIn returns the pairs in r and leaves this node shares with peer.
+func (n *Node) pairsIn(peer string, r dump.Range, leaves []int) (map[string]record, error) {
+	wanted := make(map[int]bool, len(leaves))
+	for _, leaf := range leaves {
+		wanted[leaf] = true
+	}
+
+	pairs := make(map[string]record)
+	err := n.scan(peer, r, func(key string, rec record) {
+		if wanted[leafOf(key)] {
+			pairs[key] = rec
+		}
+	})
+	return pairs, err
+}
+
+// RepairStats counts what a repair found: the leaves whose hashes differed,
+// the pairs this node took from the peer and the ones it sent.
+type RepairStats struct {
+	Leaves int
+	Pulled int
+	Pushed int
+}
+
+func (s RepairStats) String() string {
+	return fmt.Sprintf("leaves=%d pulled=%d pushed=%d", s.Leaves, s.Pulled, s.Pushed)
+}
+
+// Repair brings the keys in r this node and peer both replicate to the
+// newest version either of them holds. The trees of the two nodes are
+// compared from the root down, level by level, and only the pairs of the
+// leaves that differ are exchanged.
+func (n *Node) Repair(peer string, r dump.Range) (RepairStats, error) {
+	var stats RepairStats
+	if _, ok := n.cfg.Nodes[peer]; !ok || peer == n.cfg.ID {
+		return stats, ErrUnknownNode
+	}
+
+	local, err := n.tree(peer, r)
+	if err != nil {
+		return stats, err
+	}
+
+	p := n.peer(peer)
+	var leaves []int
+	for differ := []int{1}; len(differ) > 0; {
+		var reply treeReply
+		err = p.call("TREE", treeRequest{Peer: n.cfg.ID, Range: r, Nodes: differ}, &reply, n.timeout())
+		if err != nil {
+			return stats, err
+		}
+		if len(reply.Hashes) != len(differ) {
+			return stats, fmt.Errorf("%s answered %d hashes for %d nodes", peer, len(reply.Hashes), len(differ))
+		}
+
+		var next []int
+		for i, node := range differ {
+			switch {
+			case reply.Hashes[i] == local[node]:
+			case node >= treeLeaves:
+				leaves = append(leaves, node-treeLeaves)
+			default:
+				next = append(next, 2*node, 2*node+1)
+			}
+		}
+		differ = next
+	}
+	stats.Leaves = len(leaves)
+	if len(leaves) == 0 {
+		return stats, nil
+	}
+
+	var reply pairsReply
+	err = p.call("PAIRS", pairsRequest{Peer: n.cfg.ID, Range: r, Leaves: leaves}, &reply, n.timeout())
+	if err != nil {
+		return stats, err
+	}
+	mine, err := n.pairsIn(peer, r, leaves)
+	if err != nil {
+		return stats, err
+	}
+
+	theirs := make(map[string]record, len(reply.Pairs))
+	for _, pair := range reply.Pairs {
+		theirs[pair.Key] = pair.Record
+		rec, ok := mine[pair.Key]
+		if ok && compare(pair.Record.Version, rec.Version, n.cfg.Resolution) <= 0 {
+			continue
+		}
+
+		err = n.storeLocal(pair.Key, pair.Record)
+		if err != nil {
+			return stats, err
+		}
+		stats.Pulled++
+	}
+
+	for key, rec := range mine {
+		other, ok := theirs[key]
+		if ok && compare(rec.Version, other.Version, n.cfg.Resolution) <= 0 {
+			continue
+		}
+
+		err = n.store(peer, key, rec)
+		if err != nil {
+			return stats, err
+		}
+		stats.Pushed++
+	}
+	return stats, nil
+}
+
+// antiEntropy repairs the keys shared with a random peer every
+// AntiEntropyInterval.
+func (n *Node) antiEntropy() {
+	defer close(n.done)
+
+	var peers []string
+	for id := range n.cfg.Nodes {
+		if id != n.cfg.ID {
+			peers = append(peers, id)
+		}
+	}
+	if len(peers) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(n.cfg.AntiEntropyInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		peer := peers[rand.Intn(len(peers))]
+		stats, err := n.Repair(peer, dump.Range{})
+		if err == nil && stats.Pulled+stats.Pushed > 0 {
+			fmt.Printf("Anti-entropy with %s: %s\n", peer, stats)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+// Package dynamo replicates keys without a leader. Every key is stored on
+// N nodes picked by a consistent hash ring, and the node a client talks to
+// coordinates the request: it sends it to the N replicas and answers once
+// R of them returned the key or W of them stored it. Versions are ordered
+// by timestamp or vector clock, and replicas found stale by a read are
+// repaired in the background. Each node also keeps a Merkle tree of the
+// keys it shares with every other node, which anti-entropy compares to
+// find and exchange the pairs replicas disagree on.
+package dynamo
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+)
+
+const (
+	DefaultReplicas       = 3
+	DefaultRequestTimeout = 5000
+)
+
+var (
+	ErrQuorum            = errors.New("not enough replicas answered")
+	ErrInvalidQuorum     = errors.New("quorums must be between 1 and the number of replicas")
+	ErrInvalidResolution = errors.New("unknown version resolution")
+)
+
+// Config describes a node. Nodes maps the ID of every node, this one
+// included, to its host:port. N is the number of replicas of a key, capped
+// to the number of nodes, and R and W are the replicas a read and a write
+// wait for, a majority of N by default. Resolution is ResolveTimestamp,
+// the default, or ResolveVectorClock. RequestTimeout bounds the requests
+// sent to other nodes and AntiEntropyInterval is the period of the repairs
+// with a random peer, both in milliseconds. Secret is shared by the nodes,
+// which send it before their requests, and is needed as soon as there is
+// more than one.
+type Config struct {
+	ID                  string
+	Nodes               map[string]string
+	Secret              string
+	N                   int
+	R                   int
+	W                   int
+	Resolution          string
+	RequestTimeout      int
+	AntiEntropyInterval int
+}
+
+// Node coordinates the requests it receives and serves as a replica for
+// the other coordinators. Iterate walks the keys this node holds.
+type Node struct {
+	cfg    Config
+	engine dbengine.Engine
+	ring   *ring
+
+	// storeLock orders the compare and store of the replica
+	storeLock sync.Mutex
+
+	// counter is the last write this node counted in a vector clock
+	clockLock sync.Mutex
+	counter   uint64
+
+	peerLock sync.Mutex
+	peers    map[string]*peer
+
+	// trees maps the other nodes to the Merkle tree of the keys shared with
+	// them
+	treeLock sync.Mutex
+	trees    map[string]*merkle
+
+	stop chan struct{}
+	done chan struct{}
+
+	// pending counts the requests to replicas still running, repairs and
+	// writes past the quorum included
+	pending sync.WaitGroup
+}
+
+// reply is the answer of one replica to a read.
+type reply struct {
+	id    string
+	rec   record
+	found bool
+	err   error
+}
+
+// Start serves engine as the node described by cfg. The node owns engine
+// and closes it.
+func Start(engine dbengine.Engine, cfg Config) (*Node, error) {
+	if _, ok := cfg.Nodes[cfg.ID]; !ok {
+		return nil, fmt.Errorf("dynamo nodes do not list %q", cfg.ID)
+	}
+	if cfg.Secret == "" && len(cfg.Nodes) > 1 {
+		return nil, errors.New("dynamo nodes need a secret")
+	}
+	if cfg.N == 0 {
+		cfg.N = DefaultReplicas
+	}
+	if cfg.N > len(cfg.Nodes) {
+		cfg.N = len(cfg.Nodes)
+	}
+	if cfg.R == 0 {
+		cfg.R = cfg.N/2 + 1
+	}
+	if cfg.W == 0 {
+		cfg.W = cfg.N/2 + 1
+	}
+	if cfg.R < 1 || cfg.R > cfg.N || cfg.W < 1 || cfg.W > cfg.N {
+		return nil, ErrInvalidQuorum
+	}
+	if cfg.Resolution == "" {
+		cfg.Resolution = ResolveTimestamp
+	}
+	if cfg.Resolution != ResolveTimestamp && cfg.Resolution != ResolveVectorClock {
+		return nil, ErrInvalidResolution
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = DefaultRequestTimeout
+	}
+	if cfg.AntiEntropyInterval == 0 {
+		cfg.AntiEntropyInterval = DefaultAntiEntropyInterval
+	}
+
+	ids := make([]string, 0, len(cfg.Nodes))
+	for id := range cfg.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	n := &Node{
+		cfg:    cfg,
+		engine: engine,
+		ring:   newRing(ids),
+		peers:  make(map[string]*peer),
+		trees:  make(map[string]*merkle),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	err := n.buildTrees()
+	if err != nil {
+		return nil, err
+	}
+
+	go n.antiEntropy()
+	return n, nil
+}
+
+// Close stops anti-entropy, waits for the requests to replicas still
+// running and closes the engine.
+func (n *Node) Close() error {
+	close(n.stop)
+	<-n.done
+	n.pending.Wait()
+
+	n.peerLock.Lock()
+	for _, p := range n.peers {
+		p.close()
+	}
+	n.peerLock.Unlock()
+
+	return n.engine.Close()
+}
+
+func (n *Node) timeout() time.Duration {
+	return time.Duration(n.cfg.RequestTimeout) * time.Millisecond
+}
+
+func (n *Node) peer(id string) *peer {
+	n.peerLock.Lock()
+	defer n.peerLock.Unlock()
+
+	p, ok := n.peers[id]
+	if !ok {
+		p = &peer{addr: n.cfg.Nodes[id], secret: n.cfg.Secret}
+		n.peers[id] = p
+	}
+	return p
+}
+
+// local returns the record this node holds for key.
+func (n *Node) local(key string) (record, bool, error) {
+	data, found, err := n.engine.Get(key)
+	if err != nil || !found {
+		return record{}, false, err
+	}
+	return decode(data), true, nil
+}
+
+// storeLocal keeps rec unless this node holds a version at least as new.
+func (n *Node) storeLocal(key string, rec record) error {
+	n.storeLock.Lock()
+	defer n.storeLock.Unlock()
+
+	current, found, err := n.local(key)
+	if err != nil {
+		return err
+	}
+	if found && compare(rec.Version, current.Version, n.cfg.Resolution) <= 0 {
+		return nil
+	}
+
+	err = n.engine.Put(key, rec.encode())
+	if err != nil {
+		return err
+	}
+	n.track(key, current, found, rec)
+	return nil
+}
+
+func (n *Node) fetch(id string, key string) reply {
+	if id == n.cfg.ID {
+		rec, found, err := n.local(key)
+		return reply{id: id, rec: rec, found: found, err: err}
+	}
+
+	var r getReply
+	err := n.peer(id).call("GET", getRequest{Key: key}, &r, n.timeout())
+	return reply{id: id, rec: r.Record, found: r.Found, err: err}
+}
+
+func (n *Node) store(id string, key string, rec record) error {
+	if id == n.cfg.ID {
+		return n.storeLocal(key, rec)
+	}
+	return n.peer(id).call("PUT", putRequest{Key: key, Record: rec}, nil, n.timeout())
+}
+
+// read asks the replicas of key for it and returns the newest version once
+// R of them answered. The others are waited for in the background, and
+// every replica that answered with an older version is sent the newest.
+func (n *Node) read(key string) (record, bool, error) {
+	replicas := n.ring.preference(key, n.cfg.N)
+	replies := make(chan reply, len(replicas))
+	n.pending.Add(len(replicas))
+	for _, id := range replicas {
+		id := id
+		go func() {
+			defer n.pending.Done()
+			replies <- n.fetch(id, key)
+		}()
+	}
+
+	var answered []reply
+	ok := 0
+	for len(answered) < len(replicas) && ok < n.cfg.R {
+		r := <-replies
+		answered = append(answered, r)
+		if r.err == nil {
+			ok++
+		}
+	}
+	if ok < n.cfg.R {
+		return record{}, false, ErrQuorum
+	}
+
+	rec, found := n.resolve(answered)
+	n.pending.Add(1)
+	go func() {
+		defer n.pending.Done()
+		for len(answered) < len(replicas) {
+			answered = append(answered, <-replies)
+		}
+		if found {
+			n.repair(key, rec, answered)
+		}
+	}()
+	return rec, found, nil
+}
+
+// resolve returns the newest version among replies. With vector clocks it
+// carries the clocks of every version, so that it supersedes concurrent
+// ones.
+func (n *Node) resolve(replies []reply) (record, bool) {
+	var newest record
+	var clocks []map[string]uint64
+	found := false
+	for _, r := range replies {
+		if r.err != nil || !r.found {
+			continue
+		}
+		if !found || compare(r.rec.Version, newest.Version, n.cfg.Resolution) > 0 {
+			newest = r.rec
+		}
+		clocks = append(clocks, r.rec.Clock)
+		found = true
+	}
+
+	if found && n.cfg.Resolution == ResolveVectorClock {
+		newest.Clock = mergeClocks(clocks...)
+	}
+	return newest, found
+}
+
+// repair sends rec to the replicas that answered with an older version or
+// without the key.
+func (n *Node) repair(key string, rec record, replies []reply) {
+	for _, r := range replies {
+		if r.err != nil {
+			continue
+		}
+		if r.found && compare(r.rec.Version, rec.Version, n.cfg.Resolution) >= 0 {
+			continue
+		}
+
+		err := n.store(r.id, key, rec)
+		if err != nil {
+			fmt.Printf("Error repairing %s on %s: %v\n", key, r.id, err)
+		}
+	}
+}
+
+// write sends rec to the replicas of key and returns once W of them stored
+// it.
+func (n *Node) write(key string, rec record) error {
+	replicas := n.ring.preference(key, n.cfg.N)
+	acks := make(chan error, len(replicas))
+	n.pending.Add(len(replicas))
+	for _, id := range replicas {
+		id := id
+		go func() {
+			defer n.pending.Done()
+			acks <- n.store(id, key, rec)
+		}()
+	}
+
+	ok := 0
+	for range replicas {
+		if <-acks == nil {
+			ok++
+		}
+		if ok >= n.cfg.W {
+			return nil
+		}
+	}
+	return ErrQuorum
+}
+
+// version returns the version of a write that follows current.
+func (n *Node) version(current record) Version {
+	v := Version{Time: time.Now().UnixNano(), Node: n.cfg.ID}
+	if n.cfg.Resolution != ResolveVectorClock {
+		return v
+	}
+
+	v.Clock = mergeClocks(current.Clock)
+	n.clockLock.Lock()
+	// two writes coordinated here at once must not share a clock
+	if v.Clock[n.cfg.ID] < n.counter {
+		v.Clock[n.cfg.ID] = n.counter
+	}
+	v.Clock[n.cfg.ID]++
+	n.counter = v.Clock[n.cfg.ID]
+	n.clockLock.Unlock()
+	return v
+}
+
+// current returns the version a write of key follows, which only vector
+// clocks need to read.
+func (n *Node) current(key string) (record, error) {
+	if n.cfg.Resolution != ResolveVectorClock {
+		return record{}, nil
+	}
+	rec, _, err := n.read(key)
+	return rec, err
+}
+
+func (n *Node) Get(key string) (string, bool, error) {
+	rec, found, err := n.read(key)
+	if err != nil || !found || rec.Deleted {
+		return "", false, err
+	}
+	return rec.Value, true, nil
+}
+
+func (n *Node) Put(key string, value string) error {
+	err := dbengine.CheckPair(key, value)
+	if err != nil {
+		return err
+	}
+
+	current, err := n.current(key)
+	if err != nil {
+		return err
+	}
+	return n.write(key, record{Value: value, Version: n.version(current)})
+}
+
+func (n *Node) Delete(key string) error {
+	err := dbengine.CheckPair(key, "")
+	if err != nil {
+		return err
+	}
+
+	current, err := n.current(key)
+	if err != nil {
+		return err
+	}
+	return n.write(key, record{Deleted: true, Version: n.version(current)})
+}
+
+// Merge reads key from R replicas, applies the operand and writes the
+// result. Merges of a key coordinated at the same time can lose one
+// another.
+func (n *Node) Merge(key string, operator string, operand string) error {
+	err := dbengine.CheckPair(key, operand)
+	if err == nil {
+		err = lsmtree.CheckOperand(operator, operand)
+	}
+	if err != nil {
+		return err
+	}
+
+	current, found, err := n.read(key)
+	if err != nil {
+		return err
+	}
+
+	value, err := lsmtree.ApplyOperands(key, current.Value, found && !current.Deleted,
+		[]lsmtree.Operand{{Operator: operator, Value: operand}})
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(value, "|\r\n") {
+		return dbengine.ErrInvalidValue
+	}
+	return n.write(key, record{Value: value, Version: n.version(current)})
+}
+
+// Batch writes ops one after the other, keys live on different replicas so
+// the batch is not atomic. Only the default family is replicated.
+func (n *Node) Batch(ops []dbengine.Op) error {
+	for _, op := range ops {
+		if op.Family != "" && op.Family != dbengine.DefaultFamily {
+			return dbengine.ErrFamilyNotFound
+		}
+	}
+
+	for _, op := range ops {
+		var err error
+		switch {
+		case op.Delete:
+			err = n.Delete(op.Key)
+		case op.Merge != "":
+			err = n.Merge(op.Key, op.Merge, op.Value)
+		default:
+			err = n.Put(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Node) Iterate(start string, fn func(key string, value string) bool) error {
+	return n.engine.Iterate(start, func(key string, data string) bool {
+		rec := decode(data)
+		if rec.Deleted {
+			return true
+		}
+		return fn(key, rec.Value)
+	})
+}
+
+// Replicas returns the addresses of the replicas of key.
+func (n *Node) Replicas(key string) []string {
+	var addrs []string
+	for _, id := range n.ring.preference(key, n.cfg.N) {
+		addrs = append(addrs, id+"@"+n.cfg.Nodes[id])
+	}
+	return addrs
+}
+
+// Status describes a node for DYNAMO STATUS.
+type Status struct {
+	ID         string
+	N, R, W    int
+	Resolution string
+	Nodes      int
+}
+
+func (s Status) String() string {
+	return fmt.Sprintf("id=%s n=%d r=%d w=%d resolution=%s nodes=%d",
+		s.ID, s.N, s.R, s.W, s.Resolution, s.Nodes)
+}
+
+func (n *Node) Status() Status {
+	return Status{
+		ID:         n.cfg.ID,
+		N:          n.cfg.N,
+		R:          n.cfg.R,
+		W:          n.cfg.W,
+		Resolution: n.cfg.Resolution,
+		Nodes:      len(n.cfg.Nodes),
+	}
+}
+
+// Authenticate reports whether secret is the one of the nodes, which they
+// send with "DYNAMO AUTH" before their requests. It fails while the node
+// has no secret.
+func (n *Node) Authenticate(secret string) bool {
+	if n.cfg.Secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(n.cfg.Secret)) == 1
+}
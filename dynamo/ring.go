@@ -0,0 +1,68 @@
+package dynamo
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// ringReplicas is the number of points each node owns on the ring.
+const ringReplicas = 64
+
+// ring places keys on nodes with consistent hashing, so that adding or
+// removing a node only moves the keys next to its points.
+type ring struct {
+	points []uint64
+	owners map[uint64]string
+	nodes  int
+}
+
+func newRing(ids []string) *ring {
+	r := &ring{owners: make(map[uint64]string, len(ids)*ringReplicas), nodes: len(ids)}
+	for _, id := range ids {
+		for i := 0; i < ringReplicas; i++ {
+			point := hashKey(fmt.Sprintf("node-%s-%d", id, i))
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+			r.owners[point] = id
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// preference returns the n distinct nodes met walking the ring clockwise
+// from the hash of key, the replicas of key.
+func (r *ring) preference(key string, n int) []string {
+	if n > r.nodes {
+		n = r.nodes
+	}
+
+	hash := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+
+	nodes := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(nodes) < n && i < len(r.points); i++ {
+		id := r.owners[r.points[(start+i)%len(r.points)]]
+		if !seen[id] {
+			seen[id] = true
+			nodes = append(nodes, id)
+		}
+	}
+	return nodes
+}
+
+// hashKey is fnv64a followed by the splitmix64 finalizer, like the ring of
+// the disk store partitions.
+func hashKey(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+
+	h := hash.Sum64()
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
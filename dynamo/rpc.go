@@ -0,0 +1,214 @@
+package dynamo
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jiteshchawla1511/KryptonDB/dump"
+)
+
+type getRequest struct {
+	Key string
+}
+
+type getReply struct {
+	Found  bool
+	Record record
+}
+
+type putRequest struct {
+	Key    string
+	Record record
+}
+
+// treeRequest asks for the hashes of Nodes in the tree of the keys in Range
+// shared with Peer.
+type treeRequest struct {
+	Peer  string
+	Range dump.Range
+	Nodes []int
+}
+
+type treeReply struct {
+	Hashes []uint64
+}
+
+// pairsRequest asks for the pairs in Range and Leaves shared with Peer.
+type pairsRequest struct {
+	Peer   string
+	Range  dump.Range
+	Leaves []int
+}
+
+type pair struct {
+	Key    string
+	Record record
+}
+
+type pairsReply struct {
+	Pairs []pair
+}
+
+// HandleRPC answers "DYNAMO <kind> <payload>" sent by another node and
+// returns the reply line: GET replies with the record this node holds and
+// PUT stores a record unless this node holds a newer version. TREE and
+// PAIRS answer the node repairing the keys it shares with this one. A
+// connection starts with "DYNAMO AUTH <secret>", answered "OK".
+func (n *Node) HandleRPC(kind string, payload string) string {
+	switch kind {
+	case "TREE":
+		var req treeRequest
+		err := json.Unmarshal([]byte(payload), &req)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+
+		nodes, err := n.tree(req.Peer, req.Range)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+		var reply treeReply
+		for _, node := range req.Nodes {
+			if node < 1 || node >= len(nodes) {
+				return "Invalid command"
+			}
+			reply.Hashes = append(reply.Hashes, nodes[node])
+		}
+		return marshalReply(reply)
+	case "PAIRS":
+		var req pairsRequest
+		err := json.Unmarshal([]byte(payload), &req)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+
+		pairs, err := n.pairsIn(req.Peer, req.Range, req.Leaves)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+		var reply pairsReply
+		for key, rec := range pairs {
+			reply.Pairs = append(reply.Pairs, pair{Key: key, Record: rec})
+		}
+		return marshalReply(reply)
+	case "GET":
+		var req getRequest
+		err := json.Unmarshal([]byte(payload), &req)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+
+		rec, found, err := n.local(req.Key)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+		return marshalReply(getReply{Found: found, Record: rec})
+	case "PUT":
+		var req putRequest
+		err := json.Unmarshal([]byte(payload), &req)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+
+		err = n.storeLocal(req.Key, req.Record)
+		if err != nil {
+			return "Error " + err.Error()
+		}
+		return "OK"
+	default:
+		return "Invalid command"
+	}
+}
+
+func marshalReply(reply interface{}) string {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return "Error " + err.Error()
+	}
+	return string(data)
+}
+
+// peer is the connection to another node, opened on the first call and
+// again after a failure.
+type peer struct {
+	addr   string
+	secret string
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// call sends req as JSON and decodes the reply into reply, which is nil
+// for requests answered with "OK".
+func (p *peer) call(kind string, req interface{}, reply interface{}, timeout time.Duration) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", p.addr, timeout)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+		p.reader = bufio.NewReader(conn)
+
+		err = p.roundTrip("AUTH", []byte(p.secret), nil, timeout)
+		if err != nil {
+			p.closeLocked()
+			return err
+		}
+	}
+
+	err = p.roundTrip(kind, data, reply, timeout)
+	if err != nil {
+		p.closeLocked()
+	}
+	return err
+}
+
+func (p *peer) roundTrip(kind string, data []byte, reply interface{}, timeout time.Duration) error {
+	p.conn.SetDeadline(time.Now().Add(timeout))
+
+	_, err := p.conn.Write([]byte("DYNAMO " + kind + " " + string(data) + "\n"))
+	if err != nil {
+		return err
+	}
+
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	switch {
+	case reply == nil && line == "OK":
+		return nil
+	case reply != nil && strings.HasPrefix(line, "{"):
+		return json.Unmarshal([]byte(line), reply)
+	default:
+		return errors.New(line)
+	}
+}
+
+func (p *peer) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closeLocked()
+}
+
+func (p *peer) closeLocked() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
@@ -0,0 +1,99 @@
+package dynamo
+
+import "encoding/json"
+
+// Ways of ordering the versions of a key.
+const (
+	// ResolveTimestamp keeps the version written last by the coordinators'
+	// clocks.
+	ResolveTimestamp = "timestamp"
+	// ResolveVectorClock keeps the version whose vector clock descends from
+	// the others, and falls back to timestamps for concurrent versions.
+	ResolveVectorClock = "vclock"
+)
+
+// Version orders the writes of a key. Time is the wall clock of the
+// coordinator in nanoseconds and Node its ID, which breaks ties. Clock
+// counts the writes each coordinator made to the key, vector clock
+// resolution only.
+type Version struct {
+	Time  int64             `json:"t"`
+	Node  string            `json:"n,omitempty"`
+	Clock map[string]uint64 `json:"c,omitempty"`
+}
+
+// record is what a replica stores for a key. Deletes are kept as
+// tombstones so that they win over the older values of other replicas.
+type record struct {
+	Value   string `json:"v,omitempty"`
+	Deleted bool   `json:"d,omitempty"`
+	Version
+}
+
+// decode reads a stored record. Values stored before the engine was
+// replicated read as the oldest version.
+func decode(data string) record {
+	var rec record
+	if json.Unmarshal([]byte(data), &rec) != nil {
+		return record{Value: data}
+	}
+	return rec
+}
+
+func (rec record) encode() string {
+	data, _ := json.Marshal(rec)
+	return string(data)
+}
+
+// descends reports whether clock a has seen every write of clock b.
+func descends(a map[string]uint64, b map[string]uint64) bool {
+	for id, count := range b {
+		if a[id] < count {
+			return false
+		}
+	}
+	return true
+}
+
+// compare returns 1 when a is newer than b, -1 when it is older and 0 for
+// the same version.
+func compare(a Version, b Version, resolution string) int {
+	if resolution == ResolveVectorClock {
+		after, before := descends(a.Clock, b.Clock), descends(b.Clock, a.Clock)
+		switch {
+		case after && before:
+			return 0
+		case after:
+			return 1
+		case before:
+			return -1
+		}
+	}
+
+	switch {
+	case a.Time != b.Time:
+		if a.Time > b.Time {
+			return 1
+		}
+		return -1
+	case a.Node != b.Node:
+		if a.Node > b.Node {
+			return 1
+		}
+		return -1
+	}
+	return 0
+}
+
+// mergeClocks returns the clock that has seen the writes of every clock.
+func mergeClocks(clocks ...map[string]uint64) map[string]uint64 {
+	merged := make(map[string]uint64)
+	for _, clock := range clocks {
+		for id, count := range clock {
+			if count > merged[id] {
+				merged[id] = count
+			}
+		}
+	}
+	return merged
+}
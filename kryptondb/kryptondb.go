@@ -0,0 +1,157 @@
+// Package kryptondb embeds the KryptonDB storage engine in a Go program
+// without going through the TCP or UDP server.
+package kryptondb
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+const (
+	walFileName  = dbengine.CheckpointWAL
+	dataDirName  = dbengine.CheckpointStore
+	lockFileName = "LOCK"
+)
+
+var (
+	ErrNotFound = errors.New("kryptondb: key not found")
+	ErrClosed   = dbengine.ErrClosed
+)
+
+// Options tunes the database. Zero fields take the same defaults as the
+// server config.
+type Options struct {
+	MaximumElement      int
+	CompactionPeriod    int
+	BloomFilterCapacity int
+	BloomErrorRate      float64
+	NumOfPartitions     int
+	// FS defaults to vfs.Default.
+	FS vfs.FS
+}
+
+type DB struct {
+	engine *dbengine.DBEngine
+	lock   io.Closer
+}
+
+// Iterator walks the live pairs of a DB in key order, see DB.NewIterator.
+type Iterator = lsmtree.Iterator
+
+func (opts *Options) withDefaults() Options {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.MaximumElement == 0 {
+		o.MaximumElement = lsmtree.MaximumElement
+	}
+	if o.CompactionPeriod == 0 {
+		o.CompactionPeriod = lsmtree.CompactionFrequency
+	}
+	if o.BloomFilterCapacity == 0 {
+		o.BloomFilterCapacity = lsmtree.BloomFilterCapacity
+	}
+	if o.BloomErrorRate == 0 {
+		o.BloomErrorRate = lsmtree.BloomErrorRate
+	}
+	if o.NumOfPartitions == 0 {
+		o.NumOfPartitions = diskstore.DefaultNumOfPartitions
+	}
+	if o.FS == nil {
+		o.FS = vfs.Default
+	}
+	return o
+}
+
+// Open opens the database stored in dir, creating it if needed. Only one DB
+// may have dir open at a time.
+func Open(dir string, opts *Options) (*DB, error) {
+	o := opts.withDefaults()
+
+	err := o.FS.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := o.FS.Lock(filepath.Join(dir, lockFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	engine, err := dbengine.Open(dbengine.Options{
+		LSMTree: lsmtree.LSMTreeOptions{
+			MaximumElement:   o.MaximumElement,
+			CompactionPeriod: o.CompactionPeriod,
+			BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+				Capacity:  o.BloomFilterCapacity,
+				ErrorRate: o.BloomErrorRate,
+			},
+		},
+		Store: diskstore.DiskStoreOpts{
+			Directory:       filepath.Join(dir, dataDirName),
+			NumOfPartitions: o.NumOfPartitions,
+		},
+		WalPath: filepath.Join(dir, walFileName),
+		FS:      o.FS,
+	})
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return &DB{engine: engine, lock: lock}, nil
+}
+
+// Get returns the value of key or ErrNotFound.
+func (db *DB) Get(key string) (string, error) {
+	val, exist, err := db.engine.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if !exist {
+		return "", ErrNotFound
+	}
+	return val, nil
+}
+
+func (db *DB) Put(key string, value string) error {
+	return db.engine.Put(key, value)
+}
+
+func (db *DB) Delete(key string) error {
+	return db.engine.Delete(key)
+}
+
+// Checkpoint writes a consistent copy of the database to dir while it stays
+// open. dir must be empty or missing and the copy opens with Open like any
+// other database. SSTables are hard linked where they can be, so dir is best
+// kept on the same filesystem.
+func (db *DB) Checkpoint(dir string) error {
+	return db.engine.Checkpoint(dir)
+}
+
+// NewIterator returns an iterator over a snapshot of the database taken
+// when it is called.
+func (db *DB) NewIterator() *Iterator {
+	return db.engine.Lsmtree.NewIterator()
+}
+
+// Close waits for in-flight calls, stops the background work, makes every
+// write durable and releases the directory.
+func (db *DB) Close() error {
+	err := db.engine.Close()
+	if err == ErrClosed {
+		return err
+	}
+
+	db.lock.Close()
+	return err
+}
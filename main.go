@@ -1,16 +1,39 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	"github.com/jiteshchawla1511/KryptonDB/cluster"
 	"github.com/jiteshchawla1511/KryptonDB/config"
 	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
 	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/dump"
+	"github.com/jiteshchawla1511/KryptonDB/dynamo"
+	"github.com/jiteshchawla1511/KryptonDB/membership"
+	"github.com/jiteshchawla1511/KryptonDB/multileader"
+	"github.com/jiteshchawla1511/KryptonDB/raft"
+	"github.com/jiteshchawla1511/KryptonDB/replication"
 	"github.com/jiteshchawla1511/KryptonDB/server"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
 	"github.com/jiteshchawla1511/KryptonDB/wal"
 )
 
+// shutdownTimeout bounds how long open connections are given to drain.
+const shutdownTimeout = 10 * time.Second
+
 func initServerConfig(configFile string) (config.Config, error) {
 	serverConfig, err := config.Parse(configFile)
 	if err != nil {
@@ -33,6 +56,10 @@ func initServerConfig(configFile string) (config.Config, error) {
 		serverConfig.ServerConfig.UDPBufferSize = server.DefaultUDPBufferSize
 	}
 
+	if serverConfig.DBEngineConfig.Engine == "" {
+		serverConfig.DBEngineConfig.Engine = dbengine.DefaultEngine
+	}
+
 	if serverConfig.DBEngineConfig.WalPath == "" {
 		serverConfig.DBEngineConfig.WalPath = wal.DefaultWalPath
 	}
@@ -61,10 +88,480 @@ func initServerConfig(configFile string) (config.Config, error) {
 		serverConfig.DiskConfig.Directory = diskstore.DefaultDirectory
 	}
 
+	if serverConfig.DiskConfig.MaxSegmentSize == 0 {
+		serverConfig.DiskConfig.MaxSegmentSize = diskstore.DefaultMaxSegmentSize
+	}
+
+	if serverConfig.DiskConfig.MergeThreshold == 0 {
+		serverConfig.DiskConfig.MergeThreshold = diskstore.DefaultMergeThreshold
+	}
+
+	if serverConfig.DiskConfig.PersistInterval == 0 {
+		serverConfig.DiskConfig.PersistInterval = diskstore.DefaultPersistInterval
+	}
+
+	if serverConfig.DiskConfig.PersistWorkers == 0 {
+		serverConfig.DiskConfig.PersistWorkers = diskstore.DefaultPersistWorkers
+	}
+
+	if serverConfig.DiskConfig.WALSizeTrigger == 0 {
+		serverConfig.DiskConfig.WALSizeTrigger = diskstore.DefaultWALSizeTrigger
+	}
+
+	if serverConfig.RaftConfig.Directory == "" {
+		serverConfig.RaftConfig.Directory = raft.DefaultDirectory
+	}
+
+	if serverConfig.ClusterConfig.Directory == "" {
+		serverConfig.ClusterConfig.Directory = cluster.DefaultDirectory
+	}
+
+	if serverConfig.MultiLeaderConfig.Directory == "" {
+		serverConfig.MultiLeaderConfig.Directory = multileader.DefaultDirectory
+	}
+
 	return serverConfig, nil
 }
 
+// engineOptions returns the engine options described by the config.
+func engineOptions(serverConfig config.Config) dbengine.Options {
+	return dbengine.Options{
+		Engine: serverConfig.DBEngineConfig.Engine,
+		LSMTree: lsmtree.LSMTreeOptions{
+			MaximumElement:   serverConfig.DBEngineConfig.LSMTreeConfig.MaximumElement,
+			CompactionPeriod: serverConfig.DBEngineConfig.LSMTreeConfig.CompactionFrequency,
+			Directory:        serverConfig.DBEngineConfig.LSMTreeConfig.Directory,
+			BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+				ErrorRate: serverConfig.DBEngineConfig.BloomFilterConfig.ErrorRate,
+				Capacity:  serverConfig.DBEngineConfig.BloomFilterConfig.Capacity,
+			},
+		},
+		Store: diskstore.DiskStoreOpts{
+			NumOfPartitions: serverConfig.DiskConfig.NumOfPartitions,
+			Directory:       serverConfig.DiskConfig.Directory,
+			MaxSegmentSize:  serverConfig.DiskConfig.MaxSegmentSize,
+			MergeThreshold:  serverConfig.DiskConfig.MergeThreshold,
+			PersistInterval: serverConfig.DiskConfig.PersistInterval,
+			PersistWorkers:  serverConfig.DiskConfig.PersistWorkers,
+			WALSizeTrigger:  serverConfig.DiskConfig.WALSizeTrigger,
+		},
+		WalPath:    serverConfig.DBEngineConfig.WalPath,
+		WALArchive: serverConfig.DBEngineConfig.WALArchive,
+		FS:         vfs.Default,
+	}
+}
+
+// openEngine builds the engine of the config, which is a member of a Raft
+// group when raft_id is set and follows the leader named by replica_of when
+// that is set. With cluster_id it serves the slots the cluster gives it,
+// with dynamo_id it replicates keys on the dynamo_nodes without a leader
+// and with multileader_id it accepts writes and exchanges them with the
+// multileader_nodes.
+func openEngine(serverConfig config.Config) (dbengine.Engine, error) {
+	leader := serverConfig.ServerConfig.ReplicaOf
+	raftConfig := serverConfig.RaftConfig
+	clusterConfig := serverConfig.ClusterConfig
+	dynamoConfig := serverConfig.DynamoConfig
+	multiLeaderConfig := serverConfig.MultiLeaderConfig
+
+	modes := 0
+	for _, id := range []string{leader, raftConfig.ID, clusterConfig.ID, dynamoConfig.ID, multiLeaderConfig.ID} {
+		if id != "" {
+			modes++
+		}
+	}
+	switch {
+	case modes > 1:
+		return nil, errors.New("replica_of, raft_id, cluster_id, dynamo_id and multileader_id cannot be combined")
+	case modes == 0:
+		return dbengine.New(engineOptions(serverConfig))
+	case clusterConfig.ID != "":
+		return openClusterNode(serverConfig)
+	case dynamoConfig.ID != "":
+		return openDynamoNode(serverConfig)
+	}
+
+	if serverConfig.DBEngineConfig.Engine != dbengine.EngineLSM {
+		return nil, fmt.Errorf("replica_of, raft_id and multileader_id need the %s engine", dbengine.EngineLSM)
+	}
+
+	if multiLeaderConfig.ID != "" {
+		return openMultiLeaderNode(serverConfig)
+	}
+
+	if raftConfig.ID != "" {
+		return raft.Start(raft.Config{
+			ID:     raftConfig.ID,
+			Peers:  raftConfig.Peers,
+			Join:   raftConfig.Join,
+			Secret: serverConfig.ServerConfig.PeerSecret,
+			Dir:    raftConfig.Directory,
+			Engine: engineOptions(serverConfig),
+		})
+	}
+
+	db, err := dbengine.Open(engineOptions(serverConfig))
+	if err != nil {
+		return nil, err
+	}
+	return replication.StartFollower(db, replication.FollowerOptions{Leader: leader}), nil
+}
+
+func openClusterNode(serverConfig config.Config) (dbengine.Engine, error) {
+	engine, err := dbengine.New(engineOptions(serverConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	clusterConfig := serverConfig.ClusterConfig
+	node, err := cluster.Start(engine, cluster.Config{
+		ID:     clusterConfig.ID,
+		Nodes:  clusterConfig.Nodes,
+		Join:   clusterConfig.Join,
+		Secret: serverConfig.ServerConfig.PeerSecret,
+		Dir:    clusterConfig.Directory,
+	})
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	return node, nil
+}
+
+func openDynamoNode(serverConfig config.Config) (dbengine.Engine, error) {
+	engine, err := dbengine.New(engineOptions(serverConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	dynamoConfig := serverConfig.DynamoConfig
+	node, err := dynamo.Start(engine, dynamo.Config{
+		ID:                  dynamoConfig.ID,
+		Nodes:               dynamoConfig.Nodes,
+		Secret:              serverConfig.ServerConfig.PeerSecret,
+		N:                   dynamoConfig.N,
+		R:                   dynamoConfig.R,
+		W:                   dynamoConfig.W,
+		Resolution:          dynamoConfig.Resolution,
+		AntiEntropyInterval: dynamoConfig.AntiEntropy,
+	})
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	return node, nil
+}
+
+func openMultiLeaderNode(serverConfig config.Config) (dbengine.Engine, error) {
+	db, err := dbengine.Open(engineOptions(serverConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	multiLeaderConfig := serverConfig.MultiLeaderConfig
+	node, err := multileader.Start(db, multileader.Config{
+		ID:                 multiLeaderConfig.ID,
+		Nodes:              multiLeaderConfig.Nodes,
+		Dir:                multiLeaderConfig.Directory,
+		TombstoneRetention: multiLeaderConfig.TombstoneRetention,
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return node, nil
+}
+
+// openMembers returns the member list of the node when membership_id is
+// set, nil otherwise.
+func openMembers(serverConfig config.Config) (*membership.Members, error) {
+	membershipConfig := serverConfig.MembershipConfig
+	if membershipConfig.ID == "" {
+		return nil, nil
+	}
+
+	return membership.New(membership.Config{
+		ID:               membershipConfig.ID,
+		Addr:             membershipConfig.Addr,
+		Seeds:            membershipConfig.Seeds,
+		ProbeInterval:    membershipConfig.ProbeInterval,
+		ProbeTimeout:     membershipConfig.ProbeTimeout,
+		SuspicionTimeout: membershipConfig.SuspicionTimeout,
+		PacketSize:       serverConfig.ServerConfig.UDPBufferSize,
+	})
+}
+
+// parseTarget reads the --until of a restore: an LSN, or a time in RFC 3339
+// or as "2006-01-02 15:04:05" in local time. An empty string restores
+// everything the archive holds.
+func parseTarget(until string) (wal.Target, error) {
+	if until == "" {
+		return wal.Target{}, nil
+	}
+
+	lsn, err := strconv.ParseUint(until, 10, 64)
+	if err == nil {
+		return wal.Target{LSN: lsn}, nil
+	}
+
+	at, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		at, err = time.ParseInLocation("2006-01-02 15:04:05", until, time.Local)
+	}
+	if err != nil {
+		return wal.Target{}, fmt.Errorf("--until %q is neither an LSN nor a time", until)
+	}
+	return wal.Target{Time: at}, nil
+}
+
+// restore is "kdb restore --from DIR [--until LSN|TIME]": it rebuilds the
+// database the config points at from a checkpoint and the WAL archive, and
+// checks that it opens, so the server can be started on it.
+func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "path to the config file")
+	from := flags.String("from", "", "checkpoint directory written by BACKUP")
+	until := flags.String("until", "", "LSN or time to stop replaying the archive at")
+	flags.Parse(args)
+
+	if *from == "" {
+		fmt.Println("restore needs --from")
+		os.Exit(2)
+	}
+
+	target, err := parseTarget(*until)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	serverConfig, err := initServerConfig(*configFile)
+	if err != nil {
+		panic(err)
+	}
+
+	lsn, err := dbengine.Restore(engineOptions(serverConfig), *from, target)
+	if err != nil {
+		fmt.Printf("Error restoring %s: %v\n", *from, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Restored %s up to LSN %d\n", *from, lsn)
+}
+
+// openOffline opens the database the config points at for a command that
+// runs without the server.
+func openOffline(configFile string) dbengine.Engine {
+	serverConfig, err := initServerConfig(configFile)
+	if err != nil {
+		panic(err)
+	}
+
+	engine, err := dbengine.New(engineOptions(serverConfig))
+	if err != nil {
+		panic(err)
+	}
+	return engine
+}
+
+// dumpCommand is "kdb dump [--format jsonl|csv] [--prefix P] [--start A]
+// [--end B] [--addr host:port]": it writes the selected pairs to stdout,
+// read from the server at addr or, without it, from the database the config
+// points at.
+func dumpCommand(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "path to the config file")
+	format := flags.String("format", dump.JSONL, "jsonl or csv")
+	addr := flags.String("addr", "", "dump a running server instead of the config's data")
+	var r dump.Range
+	flags.StringVar(&r.Prefix, "prefix", "", "only keys starting with this prefix")
+	flags.StringVar(&r.Start, "start", "", "first key, inclusive")
+	flags.StringVar(&r.End, "end", "", "last key, exclusive")
+	flags.Parse(args)
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	var count int
+	var err error
+	if *addr != "" {
+		count, err = dumpOnline(*addr, *format, r, out)
+	} else {
+		engine := openOffline(*configFile)
+		count, err = dump.Dump(engine, out, *format, r)
+		if closeErr := engine.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if err != nil {
+		out.Flush()
+		fmt.Fprintf(os.Stderr, "Error dumping data: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Dumped %d pairs\n", count)
+}
+
+func dumpOnline(addr string, format string, r dump.Range, out io.Writer) (int, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	command := "DUMP " + format
+	for _, option := range [][2]string{{"prefix", r.Prefix}, {"start", r.Start}, {"end", r.End}} {
+		if option[1] != "" {
+			command += " " + option[0] + "=" + option[1]
+		}
+	}
+	fmt.Fprintf(conn, "%s\n", command)
+
+	reader := bufio.NewScanner(conn)
+	reader.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	if !reader.Scan() {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if reader.Text() != "OK" {
+		return 0, errors.New(reader.Text())
+	}
+
+	header, _ := dump.Header(format)
+	count := 0
+	for reader.Scan() {
+		line := reader.Text()
+		if line == "END" {
+			return count, nil
+		}
+		if strings.HasPrefix(line, "END ") {
+			return count, errors.New(strings.TrimPrefix(line, "END "))
+		}
+
+		_, err = io.WriteString(out, line+"\n")
+		if err != nil {
+			return count, err
+		}
+		if line != header {
+			count++
+		}
+	}
+	return count, io.ErrUnexpectedEOF
+}
+
+// loadCommand is "kdb load [--format jsonl|csv] [--batch N] [--addr
+// host:port] [FILE]": it writes the pairs of FILE, or of stdin, through
+// batched writes to the server at addr or, without it, to the database the
+// config points at, reporting progress on stderr.
+func loadCommand(args []string) {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "path to the config file")
+	format := flags.String("format", dump.JSONL, "jsonl or csv")
+	batch := flags.Int("batch", dump.DefaultBatchSize, "pairs per batch")
+	addr := flags.String("addr", "", "load into a running server instead of the config's data")
+	flags.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if flags.NArg() > 0 {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening %s: %v\n", flags.Arg(0), err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	var stats dump.Stats
+	var err error
+	if *addr != "" {
+		stats, err = loadOnline(*addr, *format, *batch, in)
+	} else {
+		engine := openOffline(*configFile)
+		stats, err = dump.Load(engine, in, dump.LoadOptions{
+			Format:    *format,
+			BatchSize: *batch,
+			Progress: func(stats dump.Stats) {
+				fmt.Fprintf(os.Stderr, "Loaded %d pairs, rejected %d lines\n", stats.Loaded, stats.Rejected)
+			},
+		})
+		if closeErr := engine.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading data: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Loaded %d pairs, rejected %d lines\n", stats.Loaded, stats.Rejected)
+}
+
+func loadOnline(addr string, format string, batch int, in io.Reader) (dump.Stats, error) {
+	var stats dump.Stats
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return stats, err
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "LOAD %s batch=%d\n", format, batch)
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		return stats, err
+	}
+	if reply != "OK\n" {
+		return stats, errors.New(strings.TrimSpace(reply))
+	}
+
+	out := bufio.NewWriter(conn)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	sent := 0
+	for scanner.Scan() {
+		if scanner.Text() == "END" {
+			continue
+		}
+		out.WriteString(scanner.Text() + "\n")
+		sent++
+		if sent%batch == 0 {
+			fmt.Fprintf(os.Stderr, "Sent %d lines\n", sent)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+	out.WriteString("END\n")
+	err = out.Flush()
+	if err != nil {
+		return stats, err
+	}
+
+	reply, err = reader.ReadString('\n')
+	if err != nil {
+		return stats, err
+	}
+	_, err = fmt.Sscanf(reply, "OK loaded=%d rejected=%d\n", &stats.Loaded, &stats.Rejected)
+	if err != nil {
+		return stats, errors.New(strings.TrimSpace(reply))
+	}
+	return stats, nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			restore(os.Args[2:])
+			return
+		case "dump":
+			dumpCommand(os.Args[2:])
+			return
+		case "load":
+			loadCommand(os.Args[2:])
+			return
+		}
+	}
 
 	var configFile string
 	flag.StringVar(&configFile, "config", "config.yaml", "/Users/jiteshchawla/KDB/KryptonDB/config.yaml")
@@ -76,35 +573,58 @@ func main() {
 		panic(err)
 	}
 
-	lsm_tree_options := lsmtree.LSMTreeOptions{
-		MaximumElement:   serverConfig.DBEngineConfig.LSMTreeConfig.MaximumElement,
-		CompactionPeriod: serverConfig.DBEngineConfig.LSMTreeConfig.CompactionFrequency,
-		BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
-			ErrorRate: serverConfig.DBEngineConfig.BloomFilterConfig.ErrorRate,
-			Capacity:  serverConfig.DBEngineConfig.BloomFilterConfig.Capacity,
-		},
+	engine, err := openEngine(serverConfig)
+
+	if err != nil {
+		panic(err)
 	}
 
-	lsm_tree := lsmtree.InitLsmTree(lsm_tree_options)
+	members, err := openMembers(serverConfig)
 
-	disk_store_opts := diskstore.DiskStoreOpts{
-		NumOfPartitions: serverConfig.DiskConfig.NumOfPartitions,
-		Directory:       serverConfig.DiskConfig.Directory,
+	if err != nil {
+		panic(err)
 	}
 
-	disk_store := diskstore.NewDisk(disk_store_opts)
-
-	server := server.Server{
+	srv := &server.Server{
 		Port:          serverConfig.ServerConfig.Port,
 		Host:          serverConfig.ServerConfig.Host,
 		UDPPort:       serverConfig.ServerConfig.UDPPort,
 		UDPBufferSize: serverConfig.ServerConfig.UDPBufferSize,
-		DBEngine: &dbengine.DBEngine{
-			Lsmtree: lsm_tree,
-			WAL:     wal.InitWal(serverConfig.DBEngineConfig.WalPath),
-			Store:   disk_store,
-		},
+		Engine:        engine,
+		Members:       members,
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+
+	go func() {
+		<-sigCh
+		fmt.Println("Shutting down server")
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			fmt.Printf("Error draining connections: %v\n", err)
+		}
+
+		if members != nil {
+			members.Close()
+		}
+
+		err = engine.Close()
+		if err != nil {
+			fmt.Printf("Error closing the database: %v\n", err)
+		}
+		close(stopped)
+	}()
+
+	err = srv.ListenAndServe()
+	if err != server.ErrServerClosed {
+		panic(err)
 	}
-	server.Start()
+	<-stopped
 
 }
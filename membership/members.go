@@ -0,0 +1,277 @@
+// Package membership tracks which nodes of a deployment are alive with the
+// SWIM protocol. Every node probes one other node per period over UDP,
+// asks a few others to probe it when it does not answer, suspects it when
+// none of them got an answer either and declares it dead once the
+// suspicion has not been refuted in time. Changes of the member list are
+// piggybacked on the probes, so they spread without messages of their own.
+package membership
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultProbeInterval    = 1000
+	DefaultProbeTimeout     = 300
+	DefaultSuspicionTimeout = 5000
+	DefaultIndirectProbes   = 3
+	DefaultPacketSize       = 1024
+
+	// retransmitMult times the number of bits of the member count is the
+	// number of messages an update is piggybacked on.
+	retransmitMult = 4
+)
+
+// State is what a node believes about a member.
+type State int
+
+const (
+	Alive State = iota
+	Suspect
+	Dead
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	default:
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+}
+
+// Member is a node of the list. A node raises its Incarnation to refute
+// that it is suspected or dead.
+type Member struct {
+	ID          string `json:"i"`
+	Addr        string `json:"a"`
+	State       State  `json:"s"`
+	Incarnation uint64 `json:"n"`
+}
+
+// supersedes reports whether m is newer than old about the same node: it
+// has a higher incarnation, or the same one and a worse state.
+func (m Member) supersedes(old Member) bool {
+	if m.Incarnation != old.Incarnation {
+		return m.Incarnation > old.Incarnation
+	}
+	return m.State > old.State
+}
+
+// Config describes a node. Addr is the UDP host:port the other nodes reach
+// it on, the address the server is bound to when empty, and Seeds are UDP
+// addresses of nodes it joins through. ProbeInterval is the period in
+// milliseconds of the probes, ProbeTimeout how long a direct probe waits
+// before IndirectProbes other nodes are asked to try, and SuspicionTimeout
+// how long a suspected node has to refute it. PacketSize bounds the
+// packets sent, it must not exceed the UDP buffer of the servers.
+type Config struct {
+	ID               string
+	Addr             string
+	Seeds            []string
+	ProbeInterval    int
+	ProbeTimeout     int
+	SuspicionTimeout int
+	IndirectProbes   int
+	PacketSize       int
+}
+
+// Members is the member list of one node.
+type Members struct {
+	cfg Config
+
+	lock    sync.Mutex
+	conn    net.PacketConn
+	members map[string]*member
+	started bool
+
+	// order is the probe order of a round, a shuffle of the members
+	order []string
+	next  int
+
+	// updates are the changes still piggybacked on the messages sent
+	updates map[string]*update
+
+	seq  uint64
+	acks map[uint64]chan struct{}
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type member struct {
+	Member
+	suspected time.Time
+}
+
+// update is a change of the list and the number of messages it was sent on.
+type update struct {
+	Member
+	sent int
+}
+
+// New returns the member list of the node described by cfg, which starts
+// probing once Start gives it the UDP connection of the server.
+func New(cfg Config) (*Members, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("membership needs an ID")
+	}
+	if cfg.ProbeInterval == 0 {
+		cfg.ProbeInterval = DefaultProbeInterval
+	}
+	if cfg.ProbeTimeout == 0 {
+		cfg.ProbeTimeout = DefaultProbeTimeout
+	}
+	if cfg.SuspicionTimeout == 0 {
+		cfg.SuspicionTimeout = DefaultSuspicionTimeout
+	}
+	if cfg.IndirectProbes == 0 {
+		cfg.IndirectProbes = DefaultIndirectProbes
+	}
+	if cfg.PacketSize == 0 {
+		cfg.PacketSize = DefaultPacketSize
+	}
+	if cfg.ProbeTimeout >= cfg.ProbeInterval {
+		return nil, fmt.Errorf("probe timeout %dms is not below the probe interval %dms", cfg.ProbeTimeout, cfg.ProbeInterval)
+	}
+
+	return &Members{
+		cfg:     cfg,
+		members: make(map[string]*member),
+		updates: make(map[string]*update),
+		acks:    make(map[uint64]chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Start sends and receives the messages of the protocol on conn, which the
+// server passes the packets of the protocol to with HandlePacket. When the
+// server is served again a later call only replaces conn.
+func (m *Members) Start(conn net.PacketConn) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.conn = conn
+	if m.started {
+		return
+	}
+	m.started = true
+
+	addr := m.cfg.Addr
+	if addr == "" {
+		addr = conn.LocalAddr().String()
+	}
+	self := &member{Member: Member{ID: m.cfg.ID, Addr: addr, State: Alive}}
+	m.members[m.cfg.ID] = self
+	m.queue(self.Member)
+
+	go m.loop()
+}
+
+// Close stops probing. The other nodes then suspect this one and declare
+// it dead.
+func (m *Members) Close() {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+	})
+
+	m.lock.Lock()
+	started := m.started
+	m.lock.Unlock()
+	if started {
+		<-m.done
+	}
+}
+
+// List returns the members, this node included, ordered by ID.
+func (m *Members) List() []Member {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	list := make([]Member, 0, len(m.members))
+	for _, mem := range m.members {
+		list = append(list, mem.Member)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// apply merges what another node sent about u.ID into the list.
+func (m *Members) apply(u Member) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if u.ID == m.cfg.ID {
+		self, ok := m.members[u.ID]
+		// a node that hears it is suspected or dead refutes it
+		if ok && u.State != Alive && u.Incarnation >= self.Incarnation {
+			self.Incarnation = u.Incarnation + 1
+			m.queue(self.Member)
+		}
+		return
+	}
+
+	mem, ok := m.members[u.ID]
+	if ok && !u.supersedes(mem.Member) {
+		return
+	}
+	if !ok {
+		mem = &member{}
+		m.members[u.ID] = mem
+	}
+	if !ok || mem.State != u.State {
+		fmt.Printf("Member %s at %s is %s\n", u.ID, u.Addr, u.State)
+	}
+
+	mem.Member = u
+	if u.State == Suspect {
+		mem.suspected = time.Now()
+	}
+	m.queue(u)
+}
+
+// expire declares dead the members whose suspicion has not been refuted
+// within SuspicionTimeout.
+func (m *Members) expire() {
+	timeout := time.Duration(m.cfg.SuspicionTimeout) * time.Millisecond
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, mem := range m.members {
+		if mem.State == Suspect && time.Since(mem.suspected) >= timeout {
+			mem.State = Dead
+			fmt.Printf("Member %s at %s is %s\n", mem.ID, mem.Addr, mem.State)
+			m.queue(mem.Member)
+		}
+	}
+}
+
+// queue piggybacks u on the next messages, in place of an older update of
+// the same node. The caller holds lock.
+func (m *Members) queue(u Member) {
+	m.updates[u.ID] = &update{Member: u}
+}
+
+// retransmits returns the number of messages an update is sent on, which
+// grows with the log of the member count. The caller holds lock.
+func (m *Members) retransmits() int {
+	limit := retransmitMult
+	for n := len(m.members); n > 1; n /= 2 {
+		limit += retransmitMult
+	}
+	return limit
+}
@@ -0,0 +1,334 @@
+package membership
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// prefix starts the packets of the protocol, which share the UDP port with
+// the GET requests of clients.
+const prefix = "SWIM "
+
+// The kinds of message. A ping is answered with an ack, a ping-req asks
+// the receiver to ping Target and to send the ack on, and a sync asks for
+// the whole list, which is sent back in state messages.
+const (
+	kindPing    = "ping"
+	kindAck     = "ack"
+	kindPingReq = "ping-req"
+	kindSync    = "sync"
+	kindState   = "state"
+)
+
+type message struct {
+	Kind    string   `json:"k"`
+	From    string   `json:"f"`
+	Seq     uint64   `json:"q,omitempty"`
+	Target  string   `json:"t,omitempty"`
+	Updates []Member `json:"u,omitempty"`
+}
+
+// IsPacket reports whether packet is a message of the protocol.
+func IsPacket(packet []byte) bool {
+	return bytes.HasPrefix(packet, []byte(prefix))
+}
+
+// HandlePacket answers a message another node sent from addr.
+func (m *Members) HandlePacket(packet []byte, from net.Addr) {
+	var msg message
+	err := json.Unmarshal(packet[len(prefix):], &msg)
+	if err != nil {
+		return
+	}
+
+	for _, u := range msg.Updates {
+		m.apply(u)
+	}
+	m.heard(msg.From)
+
+	switch msg.Kind {
+	case kindPing:
+		m.send(from, message{Kind: kindAck, Seq: msg.Seq})
+	case kindAck:
+		m.acked(msg.Seq)
+	case kindPingReq:
+		to, err := net.ResolveUDPAddr("udp", msg.Target)
+		if err != nil {
+			return
+		}
+
+		seq, acked := m.expect()
+		defer m.forget(seq)
+		m.send(to, message{Kind: kindPing, Seq: seq})
+
+		timeout := time.NewTimer(time.Duration(m.cfg.ProbeTimeout) * time.Millisecond)
+		defer timeout.Stop()
+		select {
+		case <-acked:
+			m.send(from, message{Kind: kindAck, Seq: msg.Seq})
+		case <-timeout.C:
+		case <-m.stop:
+		}
+	case kindSync:
+		m.sendState(from)
+	}
+}
+
+// heard tells a node declared dead that still sends messages about it, so
+// that it rejoins with a new incarnation.
+func (m *Members) heard(id string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if mem, ok := m.members[id]; ok && mem.State == Dead {
+		m.queue(mem.Member)
+	}
+}
+
+// loop probes a member every ProbeInterval, and contacts the seeds while
+// no other member is alive.
+func (m *Members) loop() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(time.Duration(m.cfg.ProbeInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		m.expire()
+		target, ok := m.nextTarget()
+		if ok {
+			m.probe(target)
+		} else {
+			m.join()
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe pings target, then has other members ping it when it does not
+// answer within ProbeTimeout, and suspects it when no ack arrived by the
+// end of the period.
+func (m *Members) probe(target Member) {
+	to, err := net.ResolveUDPAddr("udp", target.Addr)
+	if err != nil {
+		return
+	}
+
+	seq, acked := m.expect()
+	defer m.forget(seq)
+	m.send(to, message{Kind: kindPing, Seq: seq})
+
+	timeout := time.NewTimer(time.Duration(m.cfg.ProbeTimeout) * time.Millisecond)
+	defer timeout.Stop()
+	select {
+	case <-acked:
+		return
+	case <-timeout.C:
+	case <-m.stop:
+		return
+	}
+
+	for _, relay := range m.relays(target.ID) {
+		addr, err := net.ResolveUDPAddr("udp", relay.Addr)
+		if err == nil {
+			m.send(addr, message{Kind: kindPingReq, Seq: seq, Target: target.Addr})
+		}
+	}
+
+	timeout.Reset(time.Duration(m.cfg.ProbeInterval-m.cfg.ProbeTimeout) * time.Millisecond)
+	select {
+	case <-acked:
+		return
+	case <-timeout.C:
+	case <-m.stop:
+		return
+	}
+
+	target.State = Suspect
+	m.apply(target)
+}
+
+// join asks the seeds for their member list.
+func (m *Members) join() {
+	m.lock.Lock()
+	self := m.members[m.cfg.ID].Member
+	m.lock.Unlock()
+
+	for _, seed := range m.cfg.Seeds {
+		if seed == self.Addr {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", seed)
+		if err == nil {
+			m.send(addr, message{Kind: kindSync, Updates: []Member{self}})
+		}
+	}
+}
+
+// nextTarget returns the next member to probe. Every round probes the
+// members that are not dead once, in a new random order.
+func (m *Members) nextTarget() (Member, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for round := 0; round < 2; round++ {
+		for m.next < len(m.order) {
+			mem, ok := m.members[m.order[m.next]]
+			m.next++
+			if ok && mem.State != Dead {
+				return mem.Member, true
+			}
+		}
+
+		m.order = m.order[:0]
+		for id, mem := range m.members {
+			if id != m.cfg.ID && mem.State != Dead {
+				m.order = append(m.order, id)
+			}
+		}
+		rand.Shuffle(len(m.order), func(i, j int) {
+			m.order[i], m.order[j] = m.order[j], m.order[i]
+		})
+		m.next = 0
+	}
+	return Member{}, false
+}
+
+// relays returns up to IndirectProbes random alive members to probe target
+// through.
+func (m *Members) relays(target string) []Member {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var relays []Member
+	for id, mem := range m.members {
+		if id != m.cfg.ID && id != target && mem.State == Alive {
+			relays = append(relays, mem.Member)
+		}
+	}
+	rand.Shuffle(len(relays), func(i, j int) {
+		relays[i], relays[j] = relays[j], relays[i]
+	})
+	if len(relays) > m.cfg.IndirectProbes {
+		relays = relays[:m.cfg.IndirectProbes]
+	}
+	return relays
+}
+
+// expect returns a new sequence number and the channel closed when its ack
+// arrives.
+func (m *Members) expect() (uint64, chan struct{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.seq++
+	acked := make(chan struct{})
+	m.acks[m.seq] = acked
+	return m.seq, acked
+}
+
+func (m *Members) acked(seq uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if acked, ok := m.acks[seq]; ok {
+		close(acked)
+		delete(m.acks, seq)
+	}
+}
+
+func (m *Members) forget(seq uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.acks, seq)
+}
+
+// send sends msg to addr with as many pending updates as fit in a packet,
+// those sent the least first.
+func (m *Members) send(addr net.Addr, msg message) {
+	msg.From = m.cfg.ID
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	// room for the updates field around them
+	size := len(prefix) + len(data) + len(`,"u":[]`)
+	for _, u := range msg.Updates {
+		encoded, _ := json.Marshal(u)
+		size += len(encoded) + 1
+	}
+
+	m.lock.Lock()
+	pending := make([]*update, 0, len(m.updates))
+	for _, u := range m.updates {
+		pending = append(pending, u)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].sent != pending[j].sent {
+			return pending[i].sent < pending[j].sent
+		}
+		return pending[i].ID < pending[j].ID
+	})
+
+	limit := m.retransmits()
+	for _, u := range pending {
+		encoded, err := json.Marshal(u.Member)
+		if err != nil || size+len(encoded)+1 > m.cfg.PacketSize {
+			continue
+		}
+		size += len(encoded) + 1
+		msg.Updates = append(msg.Updates, u.Member)
+
+		u.sent++
+		if u.sent >= limit {
+			delete(m.updates, u.ID)
+		}
+	}
+	conn := m.conn
+	m.lock.Unlock()
+
+	m.write(conn, addr, msg)
+}
+
+// sendState sends the whole list to addr, in as many packets as it takes.
+func (m *Members) sendState(addr net.Addr) {
+	m.lock.Lock()
+	conn := m.conn
+	m.lock.Unlock()
+
+	msg := message{Kind: kindState}
+	size := len(prefix) + len(`{"k":"state","f":"","u":[]}`) + len(m.cfg.ID)
+	for _, mem := range m.List() {
+		encoded, err := json.Marshal(mem)
+		if err != nil {
+			continue
+		}
+		if len(msg.Updates) > 0 && size+len(encoded)+1 > m.cfg.PacketSize {
+			m.write(conn, addr, msg)
+			msg.Updates = nil
+			size = len(prefix) + len(`{"k":"state","f":"","u":[]}`) + len(m.cfg.ID)
+		}
+		size += len(encoded) + 1
+		msg.Updates = append(msg.Updates, mem)
+	}
+	m.write(conn, addr, msg)
+}
+
+func (m *Members) write(conn net.PacketConn, addr net.Addr, msg message) {
+	msg.From = m.cfg.ID
+	data, err := json.Marshal(msg)
+	if err != nil || conn == nil {
+		return
+	}
+	// a failed send is a lost packet, which the protocol expects
+	conn.WriteTo(append([]byte(prefix), data...), addr)
+}
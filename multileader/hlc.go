@@ -0,0 +1,118 @@
+package multileader
+
+import (
+	"sync"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+)
+
+// logicalBits is the width of the counter below the milliseconds of a
+// timestamp.
+const logicalBits = 16
+
+// Timestamp is a hybrid logical clock reading: the wall clock in
+// milliseconds in the high bits and a counter that orders the events of one
+// millisecond in the low ones. It stays close to the wall clock while
+// never going backwards, and moves past the timestamps a node receives, so
+// a write is always stamped after every write its node has seen.
+type Timestamp uint64
+
+// timestampAt returns the first timestamp of the millisecond of t.
+func timestampAt(t time.Time) Timestamp {
+	return Timestamp(uint64(t.UnixNano()/int64(time.Millisecond)) << logicalBits)
+}
+
+// clock hands out the timestamps of a node.
+type clock struct {
+	lock sync.Mutex
+	last Timestamp
+}
+
+// now returns a timestamp above every one handed out or observed.
+func (c *clock) now() Timestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	wall := timestampAt(time.Now())
+	if wall > c.last {
+		c.last = wall
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// observe moves the clock past ts, a timestamp of another node.
+func (c *clock) observe(ts Timestamp) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ts > c.last {
+		c.last = ts
+	}
+}
+
+func (c *clock) read() Timestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.last
+}
+
+// record is what a node stores for a key: the value, or a tombstone that
+// keeps a delete winning over older writes, stamped with the timestamp and
+// the ID of the node it was written on. Prev is the timestamp of the
+// version the write replaced there, which tells apart the writes made
+// without seeing each other. The stamp is stored as the version of the
+// key's record in the engine, see lsmtree.KV.
+type record struct {
+	Value   string    `json:"v,omitempty"`
+	Deleted bool      `json:"d,omitempty"`
+	Time    Timestamp `json:"h"`
+	Node    string    `json:"n,omitempty"`
+	Prev    Timestamp `json:"p,omitempty"`
+}
+
+// recordOf returns the record of a stored or shipped write. Values stored
+// before the engine was replicated have no version and read as the oldest
+// one.
+func recordOf(value string, deleted bool, version lsmtree.Version) record {
+	return record{
+		Value:   value,
+		Deleted: deleted,
+		Time:    Timestamp(version.Time),
+		Node:    version.Node,
+		Prev:    Timestamp(version.Prev),
+	}
+}
+
+// op returns the write that stores rec as the record of key.
+func (rec record) op(key string) dbengine.Op {
+	return dbengine.Op{
+		Key:     key,
+		Value:   rec.Value,
+		Delete:  rec.Deleted,
+		Version: lsmtree.Version{Time: uint64(rec.Time), Node: rec.Node, Prev: uint64(rec.Prev)},
+	}
+}
+
+// newer reports whether rec wins over other: the last writer wins, and the
+// ID of the nodes breaks ties.
+func (rec record) newer(other record) bool {
+	if rec.Time != other.Time {
+		return rec.Time > other.Time
+	}
+	return rec.Node > other.Node
+}
+
+// same reports whether rec and other are the same write.
+func (rec record) same(other record) bool {
+	return rec.Time == other.Time && rec.Node == other.Node
+}
+
+// conflicts reports whether rec and other were written without either
+// node having seen the other version.
+func (rec record) conflicts(other record) bool {
+	return !rec.same(other) && rec.Prev != other.Time && other.Prev != rec.Time
+}
@@ -0,0 +1,494 @@
+// Package multileader replicates an engine between nodes that all accept
+// writes. Every write is stamped with a hybrid logical clock timestamp,
+// stored as the version of its record, and every node tails the WAL of each
+// of the others over the replication protocol and applies the writes made
+// there.
+// Conflicting writes of a key are resolved by keeping the one with the
+// highest timestamp. Deletes are kept as tombstones for a retention period
+// so that older writes still on their way cannot bring the key back.
+package multileader
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+const (
+	DefaultDirectory          = "multileader"
+	DefaultTombstoneRetention = 24 * 60 * 60 * 1000
+	DefaultRetryPeriod        = 1000
+
+	// stateFile holds the replication state of the node in its Dir.
+	stateFile = "MULTILEADER"
+)
+
+// Config describes a node. Nodes maps the ID of every node, this one
+// included, to the host:port of its TCP server. Dir holds how far the node
+// applied the WAL of each of the others. Tombstones are purged once they
+// are TombstoneRetention milliseconds old, which must be longer than any
+// node stays away, and RetryPeriod is the wait in milliseconds before a
+// lost connection to another node is opened again.
+type Config struct {
+	ID                 string
+	Nodes              map[string]string
+	Dir                string
+	FS                 vfs.FS
+	TombstoneRetention int
+	RetryPeriod        int
+}
+
+// state is what the node stores in Dir: the last LSN it applied of each
+// other node, and the tombstones it purged by key.
+type state struct {
+	Applied map[string]uint64 `json:"applied"`
+	Purged  map[string]purged `json:"purged"`
+}
+
+// purged is the tombstone of a key that was purged At a timestamp. It is
+// kept for another TombstoneRetention, so that the writes of the key older
+// than the tombstone that are still on their way stay dropped.
+type purged struct {
+	Tombstone record    `json:"tombstone"`
+	At        Timestamp `json:"at"`
+}
+
+// Node is an engine whose writes are replicated to the other nodes and
+// which applies theirs. It serves the replication protocol through the
+// Replicator methods of the engine it wraps.
+type Node struct {
+	cfg   Config
+	db    *dbengine.DBEngine
+	clock clock
+
+	// lock orders the reads and writes of a key made to resolve a write
+	lock      sync.Mutex
+	conflicts map[string]uint64
+
+	stateLock sync.Mutex
+	state     state
+	conns     map[string]closer
+	stopped   bool
+
+	stop    chan struct{}
+	workers sync.WaitGroup
+}
+
+type closer interface {
+	Close() error
+}
+
+// Start replicates db as the node described by cfg. The node owns db and
+// closes it.
+func Start(db *dbengine.DBEngine, cfg Config) (*Node, error) {
+	if cfg.FS == nil {
+		cfg.FS = vfs.Default
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = DefaultDirectory
+	}
+	if cfg.TombstoneRetention == 0 {
+		cfg.TombstoneRetention = DefaultTombstoneRetention
+	}
+	if cfg.RetryPeriod == 0 {
+		cfg.RetryPeriod = DefaultRetryPeriod
+	}
+	if _, ok := cfg.Nodes[cfg.ID]; !ok {
+		return nil, fmt.Errorf("multileader nodes do not list %q", cfg.ID)
+	}
+
+	n := &Node{
+		cfg:       cfg,
+		db:        db,
+		conflicts: make(map[string]uint64),
+		state:     state{Applied: make(map[string]uint64), Purged: make(map[string]purged)},
+		conns:     make(map[string]closer),
+		stop:      make(chan struct{}),
+	}
+
+	err := cfg.FS.MkdirAll(cfg.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	data, err := vfs.ReadFile(cfg.FS, filepath.Join(cfg.Dir, stateFile))
+	if err == nil {
+		err = json.Unmarshal(data, &n.state)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n.state.Applied == nil {
+		n.state.Applied = make(map[string]uint64)
+	}
+	if n.state.Purged == nil {
+		n.state.Purged = make(map[string]purged)
+	}
+
+	// the clock starts past every timestamp stored, even if the wall clock
+	// went back while the node was down
+	for _, p := range n.state.Purged {
+		n.clock.observe(p.Tombstone.Time)
+	}
+	err = db.IterateRecords("", func(kv lsmtree.KV) bool {
+		n.clock.observe(Timestamp(kv.Version.Time))
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for id := range cfg.Nodes {
+		if id != cfg.ID {
+			n.workers.Add(1)
+			go n.pull(id)
+		}
+	}
+	n.workers.Add(1)
+	go n.purge()
+	return n, nil
+}
+
+// Close stops replicating, stores how far the node got and closes the
+// engine.
+func (n *Node) Close() error {
+	n.stateLock.Lock()
+	if n.stopped {
+		n.stateLock.Unlock()
+		return dbengine.ErrClosed
+	}
+	n.stopped = true
+	close(n.stop)
+	for _, conn := range n.conns {
+		conn.Close()
+	}
+	n.stateLock.Unlock()
+
+	n.workers.Wait()
+	err := n.save()
+	if closeErr := n.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// save stores the replication state in Dir.
+func (n *Node) save() error {
+	n.stateLock.Lock()
+	data, err := json.Marshal(n.state)
+	n.stateLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return vfs.WriteFileAtomic(n.cfg.FS, filepath.Join(n.cfg.Dir, stateFile), data)
+}
+
+// local returns the record this node holds for key.
+func (n *Node) local(key string) (record, bool, error) {
+	kv, found, err := n.db.Record(key)
+	if err != nil || !found {
+		return record{}, false, err
+	}
+	return recordOf(kv.Value, kv.Tombstone, kv.Version), true, nil
+}
+
+// write stamps ops with the clock and writes them as one batch. Merges are
+// resolved against the value held here.
+func (n *Node) write(ops []dbengine.Op) error {
+	for _, op := range ops {
+		if op.Family != "" && op.Family != dbengine.DefaultFamily {
+			return dbengine.ErrFamilyNotFound
+		}
+		err := dbengine.CheckPair(op.Key, op.Value)
+		if err == nil && op.Merge != "" {
+			err = lsmtree.CheckOperand(op.Merge, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	// a key written twice in the batch follows its first write
+	written := make(map[string]record, len(ops))
+	writes := make([]dbengine.Op, len(ops))
+	for i, op := range ops {
+		current, found := written[op.Key]
+		if !found {
+			var err error
+			current, found, err = n.local(op.Key)
+			if err != nil {
+				return err
+			}
+		}
+
+		rec := record{Time: n.clock.now(), Node: n.cfg.ID, Prev: current.Time}
+		switch {
+		case op.Delete:
+			rec.Deleted = true
+		case op.Merge != "":
+			value, err := lsmtree.ApplyOperands(op.Key, current.Value, found && !current.Deleted,
+				[]lsmtree.Operand{{Operator: op.Merge, Value: op.Value}})
+			if err != nil {
+				return err
+			}
+			if strings.ContainsAny(value, "|\r\n") {
+				return dbengine.ErrInvalidValue
+			}
+			rec.Value = value
+		default:
+			rec.Value = op.Value
+		}
+
+		written[op.Key] = rec
+		writes[i] = rec.op(op.Key)
+	}
+	return n.db.Batch(writes)
+}
+
+// apply keeps rec, written on another node, when it is newer than the
+// version held here, and counts the conflict when neither node saw the
+// other's version. A write of a key whose tombstone this node purged is
+// dropped unless it is newer than that tombstone.
+func (n *Node) apply(key string, rec record) error {
+	n.clock.observe(rec.Time)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	current, found, err := n.local(key)
+	if err != nil {
+		return err
+	}
+	if found && current.same(rec) {
+		return nil
+	}
+	if !found {
+		n.stateLock.Lock()
+		p, purged := n.state.Purged[key]
+		n.stateLock.Unlock()
+		if purged && !rec.newer(p.Tombstone) {
+			return nil
+		}
+	}
+
+	if found && rec.conflicts(current) {
+		n.conflicts[key]++
+	}
+	if found && !rec.newer(current) {
+		return nil
+	}
+	return n.db.Batch([]dbengine.Op{rec.op(key)})
+}
+
+// purge deletes the tombstones older than TombstoneRetention, checking
+// twice per period.
+func (n *Node) purge() {
+	defer n.workers.Done()
+
+	retention := time.Duration(n.cfg.TombstoneRetention) * time.Millisecond
+	ticker := time.NewTicker(retention/2 + time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		horizon := timestampAt(time.Now().Add(-retention))
+		forgotten := n.forget(horizon)
+
+		var expired []string
+		err := n.db.IterateRecords("", func(kv lsmtree.KV) bool {
+			if kv.Tombstone && Timestamp(kv.Version.Time) < horizon {
+				expired = append(expired, kv.Key)
+			}
+			return true
+		})
+		if err != nil {
+			continue
+		}
+
+		for _, key := range expired {
+			err = n.purgeKey(key, horizon)
+			if err != nil {
+				fmt.Printf("Error purging the tombstone of %s: %v\n", key, err)
+			}
+		}
+		if len(expired) > 0 || forgotten {
+			err = n.save()
+			if err != nil {
+				fmt.Printf("Error saving the replication state: %v\n", err)
+			}
+		}
+	}
+}
+
+// forget drops the purged tombstones that were purged before horizon and
+// reports whether there were any.
+func (n *Node) forget(horizon Timestamp) bool {
+	n.stateLock.Lock()
+	defer n.stateLock.Unlock()
+
+	forgotten := false
+	for key, p := range n.state.Purged {
+		if p.At < horizon {
+			delete(n.state.Purged, key)
+			forgotten = true
+		}
+	}
+	return forgotten
+}
+
+// purgeKey deletes the tombstone of key unless a newer write replaced it.
+// The delete has no version, so it is not applied by the other nodes, which
+// purge their own tombstones.
+func (n *Node) purgeKey(key string, horizon Timestamp) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	rec, found, err := n.local(key)
+	if err != nil || !found || !rec.Deleted || rec.Time >= horizon {
+		return err
+	}
+
+	err = n.db.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	n.stateLock.Lock()
+	n.state.Purged[key] = purged{Tombstone: rec, At: timestampAt(time.Now())}
+	n.stateLock.Unlock()
+	return nil
+}
+
+func (n *Node) Get(key string) (string, bool, error) {
+	return n.db.Get(key)
+}
+
+func (n *Node) Put(key string, value string) error {
+	return n.write([]dbengine.Op{{Key: key, Value: value}})
+}
+
+func (n *Node) Delete(key string) error {
+	return n.write([]dbengine.Op{{Key: key, Delete: true}})
+}
+
+// Merge resolves the operand against the value held here and writes the
+// result, so merges made on different nodes at once do not add up: the
+// last one wins like any other write.
+func (n *Node) Merge(key string, operator string, operand string) error {
+	return n.write([]dbengine.Op{{Key: key, Value: operand, Merge: operator}})
+}
+
+// Batch is atomic on this node and applied write by write on the others.
+// Only the default family is replicated.
+func (n *Node) Batch(ops []dbengine.Op) error {
+	return n.write(ops)
+}
+
+// Iterate walks the keys this node holds, without the tombstones.
+func (n *Node) Iterate(start string, fn func(key string, value string) bool) error {
+	return n.db.Iterate(start, fn)
+}
+
+func (n *Node) Follow(from uint64) (*dbengine.Feed, error) {
+	return n.db.Follow(from)
+}
+
+func (n *Node) Feeds() []*dbengine.Feed {
+	return n.db.Feeds()
+}
+
+func (n *Node) LastLSN() uint64 {
+	return n.db.LastLSN()
+}
+
+// Conflicts returns the number of conflicting writes of key this node has
+// resolved since it started.
+func (n *Node) Conflicts(key string) uint64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.conflicts[key]
+}
+
+// ConflictCount is the number of conflicting writes of a key.
+type ConflictCount struct {
+	Key   string
+	Count uint64
+}
+
+// AllConflicts returns the keys that had conflicting writes since the node
+// started, ordered by key.
+func (n *Node) AllConflicts() []ConflictCount {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	counts := make([]ConflictCount, 0, len(n.conflicts))
+	for key, count := range n.conflicts {
+		counts = append(counts, ConflictCount{Key: key, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Key < counts[j].Key
+	})
+	return counts
+}
+
+// Status is the replication state of a node for the MULTILEADER STATUS
+// command. Clock is the last timestamp handed out or observed, Applied the
+// last LSN applied of every other node and Conflicts the number of
+// conflicting writes resolved since the node started.
+type Status struct {
+	ID        string
+	Clock     Timestamp
+	Applied   map[string]uint64
+	Conflicts uint64
+}
+
+func (s Status) String() string {
+	ids := make([]string, 0, len(s.Applied))
+	for id := range s.Applied {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	applied := make([]string, len(ids))
+	for i, id := range ids {
+		applied[i] = fmt.Sprintf("%s:%d", id, s.Applied[id])
+	}
+	return fmt.Sprintf("id=%s hlc=%d conflicts=%d applied=%s", s.ID, s.Clock, s.Conflicts, strings.Join(applied, ","))
+}
+
+func (n *Node) Status() Status {
+	s := Status{ID: n.cfg.ID, Clock: n.clock.read(), Applied: make(map[string]uint64)}
+
+	n.stateLock.Lock()
+	for id := range n.cfg.Nodes {
+		if id != n.cfg.ID {
+			s.Applied[id] = n.state.Applied[id]
+		}
+	}
+	n.stateLock.Unlock()
+
+	n.lock.Lock()
+	for _, count := range n.conflicts {
+		s.Conflicts += count
+	}
+	n.lock.Unlock()
+	return s
+}
@@ -0,0 +1,173 @@
+package multileader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jiteshchawla1511/KryptonDB/dump"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+// pull applies the writes made on peer until Close, reconnecting whenever
+// the connection is lost.
+func (n *Node) pull(peer string) {
+	defer n.workers.Done()
+
+	for {
+		err := n.follow(peer)
+
+		n.stateLock.Lock()
+		stopped := n.stopped
+		n.stateLock.Unlock()
+		if stopped {
+			return
+		}
+		fmt.Printf("Replication from %s interrupted: %v\n", peer, err)
+
+		select {
+		case <-n.stop:
+			return
+		case <-time.After(time.Duration(n.cfg.RetryPeriod) * time.Millisecond):
+		}
+	}
+}
+
+// follow runs one connection to peer. It asks for the WAL records after
+// the last one applied from peer, as a follower does, and applies the
+// writes made on peer that they hold. The writes peer applied from other
+// nodes are left to the connections to those nodes.
+func (n *Node) follow(peer string) error {
+	retry := time.Duration(n.cfg.RetryPeriod) * time.Millisecond
+	conn, err := net.DialTimeout("tcp", n.cfg.Nodes[peer], retry)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	n.stateLock.Lock()
+	if n.stopped {
+		n.stateLock.Unlock()
+		return nil
+	}
+	n.conns[peer] = conn
+	from := n.state.Applied[peer]
+	n.stateLock.Unlock()
+
+	defer func() {
+		n.stateLock.Lock()
+		delete(n.conns, peer)
+		n.stateLock.Unlock()
+	}()
+
+	_, err = fmt.Fprintf(conn, "REPLICATE %d\n", from)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+
+	if !scanner.Scan() {
+		return closed(scanner)
+	}
+	first := scanner.Text()
+	switch {
+	case strings.HasPrefix(first, "SNAPSHOT "):
+		lsn, err := strconv.ParseUint(first[len("SNAPSHOT "):], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s replied %q", peer, first)
+		}
+		err = n.applySnapshot(scanner)
+		if err != nil {
+			return err
+		}
+		n.applied(peer, lsn)
+	case strings.HasPrefix(first, "RESUME "):
+	default:
+		return fmt.Errorf("%s replied %q", peer, first)
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "#") {
+			lsn, entries, err := wal.ParseRecord(line)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if entry.Family != "" || entry.Version.Node != peer {
+					continue
+				}
+				err = n.apply(entry.Key, recordOf(entry.Value, entry.Delete, entry.Version))
+				if err != nil {
+					return err
+				}
+			}
+			n.applied(peer, lsn)
+			continue
+		}
+
+		if !strings.HasPrefix(line, "LSN ") {
+			return fmt.Errorf("%s sent %q", peer, line)
+		}
+		err = n.save()
+		if err != nil {
+			return err
+		}
+		n.stateLock.Lock()
+		lsn := n.state.Applied[peer]
+		n.stateLock.Unlock()
+		_, err = fmt.Fprintf(conn, "ACK %d\n", lsn)
+		if err != nil {
+			return err
+		}
+	}
+	return closed(scanner)
+}
+
+// applySnapshot applies the pairs of a snapshot up to END. They hold the
+// writes of every node, which are resolved like the others.
+func (n *Node) applySnapshot(scanner *bufio.Scanner) error {
+	// the other column families come after the default one, and are not
+	// replicated between leaders
+	family := false
+	for scanner.Scan() && scanner.Text() != "END" {
+		family = family || strings.HasPrefix(scanner.Text(), "FAMILY ")
+		if family {
+			continue
+		}
+		op, err := dump.DecodeOp(scanner.Text())
+		if err != nil {
+			return err
+		}
+		err = n.apply(op.Key, recordOf(op.Value, op.Delete, op.Version))
+		if err != nil {
+			return err
+		}
+	}
+	if scanner.Text() != "END" {
+		return closed(scanner)
+	}
+	return nil
+}
+
+// applied records that every write of peer up to lsn was applied.
+func (n *Node) applied(peer string, lsn uint64) {
+	n.stateLock.Lock()
+	defer n.stateLock.Unlock()
+	n.state.Applied[peer] = lsn
+}
+
+// closed returns why the stream of a peer ended.
+func closed(scanner *bufio.Scanner) error {
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
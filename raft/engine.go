@@ -0,0 +1,74 @@
+package raft
+
+import (
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+)
+
+// Get reads key on the leader, see readIndex.
+func (n *Node) Get(key string) (string, bool, error) {
+	err := n.readIndex()
+	if err != nil {
+		return "", false, err
+	}
+
+	n.dbLock.RLock()
+	defer n.dbLock.RUnlock()
+	return n.db.Get(key)
+}
+
+// LocalGet reads key from the engine of this node, whatever its role. The
+// value can be stale.
+func (n *Node) LocalGet(key string) (string, bool, error) {
+	n.dbLock.RLock()
+	defer n.dbLock.RUnlock()
+	return n.db.Get(key)
+}
+
+// Iterate walks the default family on the leader, see readIndex.
+func (n *Node) Iterate(start string, fn func(key string, value string) bool) error {
+	err := n.readIndex()
+	if err != nil {
+		return err
+	}
+
+	n.dbLock.RLock()
+	defer n.dbLock.RUnlock()
+	return n.db.Iterate(start, fn)
+}
+
+func (n *Node) Put(key string, value string) error {
+	return n.Batch([]dbengine.Op{{Key: key, Value: value}})
+}
+
+func (n *Node) Delete(key string) error {
+	return n.Batch([]dbengine.Op{{Key: key, Delete: true}})
+}
+
+func (n *Node) Merge(key string, operator string, operand string) error {
+	return n.Batch([]dbengine.Op{{Key: key, Value: operand, Merge: operator}})
+}
+
+// Batch proposes ops as one entry and returns once it is applied. Only the
+// default family is replicated, ops of other families are refused.
+func (n *Node) Batch(ops []dbengine.Op) error {
+	for _, op := range ops {
+		if op.Family != "" && op.Family != dbengine.DefaultFamily {
+			return dbengine.ErrFamilyNotFound
+		}
+
+		value := op.Value
+		if op.Delete {
+			value = ""
+		}
+		err := dbengine.CheckPair(op.Key, value)
+		if err == nil && op.Merge != "" {
+			err = lsmtree.CheckOperand(op.Merge, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return n.propose(Entry{Kind: kindCommand, Ops: ops})
+}
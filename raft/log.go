@@ -0,0 +1,221 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// Files of a node's directory. LOG holds one JSON entry per line, STATE the
+// current term and vote and SNAPSHOT the metadata of the last snapshot,
+// whose checkpoint is in the directory it names.
+const (
+	logFile      = "LOG"
+	stateFile    = "STATE"
+	snapshotFile = "SNAPSHOT"
+)
+
+// Kinds of entries. A command entry holds the ops of one client write, a
+// members entry the whole membership from then on, and every new leader
+// starts its term with a noop entry so that it can commit the ones before.
+const (
+	kindCommand = "command"
+	kindMembers = "members"
+	kindNoop    = "noop"
+)
+
+// Entry is one entry of the replicated log.
+type Entry struct {
+	Index   uint64            `json:"index"`
+	Term    uint64            `json:"term"`
+	Kind    string            `json:"kind"`
+	Ops     []dbengine.Op     `json:"ops,omitempty"`
+	Members map[string]string `json:"members,omitempty"`
+}
+
+// hardState is what a node must not forget across restarts to keep its
+// votes.
+type hardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote"`
+}
+
+// snapshotMeta describes the checkpoint that replaces the entries up to
+// Index, and the membership as of it.
+type snapshotMeta struct {
+	Index   uint64            `json:"index"`
+	Term    uint64            `json:"term"`
+	Members map[string]string `json:"members"`
+	Dir     string            `json:"dir"`
+}
+
+// raftLog keeps the entries after the last snapshot in memory and in LOG.
+// Appends are synced before they return. Dropping entries rewrites the file.
+type raftLog struct {
+	fs      vfs.FS
+	path    string
+	file    vfs.File
+	snap    snapshotMeta
+	entries []Entry
+}
+
+func openLog(fs vfs.FS, dir string, snap snapshotMeta) (*raftLog, error) {
+	l := &raftLog{fs: fs, path: filepath.Join(dir, logFile), snap: snap}
+
+	data, err := vfs.ReadFile(fs, l.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// a line torn by a crash ends the log, the rewrite below drops it
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var entry Entry
+		if json.Unmarshal(line, &entry) != nil {
+			break
+		}
+		if entry.Index == l.lastIndex()+1 {
+			l.entries = append(l.entries, entry)
+		}
+	}
+
+	err = l.rewrite()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snap.Index + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snap.Term
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term returns the term of the entry at index, and whether the log still
+// knows it.
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	if index == l.snap.Index {
+		return l.snap.Term, true
+	}
+	if index < l.snap.Index || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[index-l.snap.Index-1].Term, true
+}
+
+// entry returns the entry at index, which must be after the snapshot.
+func (l *raftLog) entry(index uint64) Entry {
+	return l.entries[index-l.snap.Index-1]
+}
+
+// from returns up to max entries starting at index.
+func (l *raftLog) from(index uint64, max int) []Entry {
+	entries := l.entries[index-l.snap.Index-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+func (l *raftLog) append(entries ...Entry) error {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	_, err := l.file.Write(buf.Bytes())
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	l.entries = append(l.entries, entries...)
+	return nil
+}
+
+// truncateAfter drops the entries after index.
+func (l *raftLog) truncateAfter(index uint64) error {
+	l.entries = l.entries[:index-l.snap.Index]
+	return l.rewrite()
+}
+
+// compact drops the entries the snapshot snap replaces, or all of them when
+// the log does not agree with it on the term of its last entry.
+func (l *raftLog) compact(snap snapshotMeta) error {
+	term, ok := l.term(snap.Index)
+	if ok && term == snap.Term {
+		l.entries = append([]Entry(nil), l.entries[snap.Index-l.snap.Index:]...)
+	} else {
+		l.entries = nil
+	}
+	l.snap = snap
+	return l.rewrite()
+}
+
+// rewrite replaces LOG with the entries in memory and reopens it.
+func (l *raftLog) rewrite() error {
+	var buf bytes.Buffer
+	for _, entry := range l.entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	err := vfs.WriteFileAtomic(l.fs, l.path, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	file, err := l.fs.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	return nil
+}
+
+func (l *raftLog) close() error {
+	return l.file.Close()
+}
+
+// readJSON decodes the file at path into v, leaving v alone when the file
+// does not exist.
+func readJSON(fs vfs.FS, path string, v interface{}) error {
+	data, err := vfs.ReadFile(fs, path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSON(fs vfs.FS, path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return vfs.WriteFileAtomic(fs, path, data)
+}
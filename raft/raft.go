@@ -0,0 +1,1070 @@
+// Package raft replicates a DBEngine across a group of nodes with the Raft
+// consensus algorithm. Client writes become entries of a replicated log and
+// every node applies the committed entries to its engine, in log order.
+// Logs are compacted with snapshots, which are engine checkpoints, and the
+// membership is changed one node at a time.
+package raft
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+// Defaults of Config, periods are in milliseconds. The election timeout of
+// a node is drawn anew between ElectionTimeout and twice that every time it
+// is reset.
+const (
+	DefaultDirectory         = "raft"
+	DefaultElectionTimeout   = 300
+	DefaultHeartbeatInterval = 50
+	DefaultRequestTimeout    = 5000
+	DefaultSnapshotThreshold = 10000
+
+	// maxAppendEntries bounds the entries of one append request.
+	maxAppendEntries = 256
+
+	// appliedFamily holds the index of the last entry applied to the
+	// engine, written in the same batch as the entry.
+	appliedFamily = "raft"
+	appliedKey    = "applied"
+)
+
+var (
+	ErrTimeout          = errors.New("raft entry was not applied in time")
+	ErrMembershipChange = errors.New("another membership change is in progress")
+	ErrUnknownMember    = errors.New("node is not a member")
+	ErrMemberExists     = errors.New("node is already a member")
+)
+
+// NotLeaderError is returned by the requests a node cannot serve because
+// it is not the leader. Leader is the TCP address of the leader, empty when
+// it is not known.
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "no raft leader"
+	}
+	return "raft leader is " + e.Leader
+}
+
+// Config describes a node. Peers maps the ID of every node of the group,
+// this one included, to the address of its TCP server, and is only read
+// the first time the node starts: the membership is part of the log from
+// then on. A node started with Join waits for the leader to add it with
+// AddMember instead, Peers then names the nodes of the group it joins.
+// Secret is shared by the nodes of the group, which send it before their
+// requests, and is needed as soon as the group has more than one node.
+// Dir holds the log and snapshots of the node and Engine the engine it
+// applies entries to, which must keep its data in directories of its own.
+type Config struct {
+	ID     string
+	Peers  map[string]string
+	Join   bool
+	Secret string
+	Dir    string
+	Engine dbengine.Options
+
+	ElectionTimeout   int
+	HeartbeatInterval int
+	RequestTimeout    int
+	SnapshotThreshold int
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case candidate:
+		return "candidate"
+	case leader:
+		return "leader"
+	default:
+		return "follower"
+	}
+}
+
+// waiter is a client waiting for the entry it proposed in term.
+type waiter struct {
+	term   uint64
+	result chan error
+}
+
+// Node is one member of a Raft group. It owns its engine and serves it as a
+// dbengine.Engine: writes are proposed to the log and reads are served by
+// the leader once it is sure to still be the leader. A node that is not
+// the leader fails them with a NotLeaderError.
+type Node struct {
+	cfg Config
+	fs  vfs.FS
+
+	lock      sync.Mutex
+	role      role
+	hard      hardState
+	leader    string
+	log       *raftLog
+	commit    uint64
+	applied   uint64
+	members   map[string]string
+	next      map[string]uint64
+	match     map[string]uint64
+	termStart uint64
+	deadline  time.Time
+	waiters   map[uint64]waiter
+	triggers  map[string]chan struct{}
+	peers     map[string]*peer
+	// appliedSignal is closed and replaced whenever applied moves.
+	appliedSignal chan struct{}
+	// incoming is the index of the snapshot being received, if any.
+	incoming uint64
+
+	// applyLock is held while entries are applied and while a snapshot is
+	// taken or installed, snapLock while a snapshot is sent or replaced.
+	applyLock sync.Mutex
+	snapLock  sync.RWMutex
+	wake      chan struct{}
+
+	dbLock sync.RWMutex
+	db     *dbengine.DBEngine
+
+	stop    chan struct{}
+	stopped bool
+	loops   sync.WaitGroup
+}
+
+// Start opens the engine and the log of the node described by cfg and
+// starts taking part in the group.
+func Start(cfg Config) (*Node, error) {
+	if cfg.Secret == "" && (cfg.Join || len(cfg.Peers) > 1) {
+		return nil, errors.New("raft nodes of a group need a secret")
+	}
+	if cfg.Engine.FS == nil {
+		cfg.Engine.FS = vfs.Default
+	}
+	cfg.Engine.WALArchive = ""
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = DefaultElectionTimeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = DefaultRequestTimeout
+	}
+	if cfg.SnapshotThreshold <= 0 {
+		cfg.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+
+	n := &Node{
+		cfg:           cfg,
+		fs:            cfg.Engine.FS,
+		waiters:       make(map[uint64]waiter),
+		triggers:      make(map[string]chan struct{}),
+		peers:         make(map[string]*peer),
+		appliedSignal: make(chan struct{}),
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+
+	err := n.fs.MkdirAll(cfg.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = readJSON(n.fs, filepath.Join(cfg.Dir, stateFile), &n.hard)
+	if err != nil {
+		return nil, err
+	}
+	var snap snapshotMeta
+	err = readJSON(n.fs, filepath.Join(cfg.Dir, snapshotFile), &snap)
+	if err != nil {
+		return nil, err
+	}
+
+	n.applied, err = n.openEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	// an install cut short by a crash leaves the engine behind its snapshot
+	if n.applied < snap.Index {
+		n.applied, err = n.restoreEngine(filepath.Join(cfg.Dir, snap.Dir))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n.log, err = openLog(n.fs, cfg.Dir, snap)
+	if err != nil {
+		return nil, err
+	}
+	n.commit = n.applied
+	n.members = n.membersAt(n.log.lastIndex())
+	n.resetDeadline()
+
+	n.loops.Add(2)
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+// openEngine opens the engine and returns the index of the last entry
+// applied to it.
+func (n *Node) openEngine() (uint64, error) {
+	db, err := dbengine.Open(n.cfg.Engine)
+	if err != nil {
+		return 0, err
+	}
+
+	family, err := db.Family(appliedFamily)
+	if err == dbengine.ErrFamilyNotFound {
+		err = db.CreateFamily(appliedFamily, dbengine.FamilyOptions{})
+		if err == nil {
+			family, err = db.Family(appliedFamily)
+		}
+	}
+	if err != nil {
+		db.Close()
+		return 0, err
+	}
+
+	val, exist, err := family.Get(appliedKey)
+	if err != nil {
+		db.Close()
+		return 0, err
+	}
+
+	var applied uint64
+	if exist {
+		applied, err = strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			db.Close()
+			return 0, err
+		}
+	}
+	n.db = db
+	return applied, nil
+}
+
+// restoreEngine replaces the engine with the checkpoint in dir and returns
+// the index the checkpoint was cut at. The caller must hold dbLock or own
+// the node alone.
+func (n *Node) restoreEngine(dir string) (uint64, error) {
+	if n.db != nil {
+		err := n.db.Close()
+		if err != nil {
+			return 0, err
+		}
+		n.db = nil
+	}
+
+	opts := n.cfg.Engine
+	for _, path := range []string{opts.Store.Directory, opts.LSMTree.Directory} {
+		if path == "" {
+			continue
+		}
+		err := vfs.RemoveAll(n.fs, path)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err := n.fs.Remove(opts.WalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	_, err = dbengine.Restore(opts, dir, wal.Target{})
+	if err != nil {
+		return 0, err
+	}
+	return n.openEngine()
+}
+
+// Close stops the node and closes its engine and log.
+func (n *Node) Close() error {
+	n.lock.Lock()
+	if n.stopped {
+		n.lock.Unlock()
+		return dbengine.ErrClosed
+	}
+	n.stopped = true
+	close(n.stop)
+	peers := n.peers
+	n.lock.Unlock()
+
+	for _, p := range peers {
+		p.close()
+	}
+
+	n.loops.Wait()
+
+	n.dbLock.Lock()
+	defer n.dbLock.Unlock()
+
+	err := n.db.Close()
+	if logErr := n.log.close(); err == nil {
+		err = logErr
+	}
+	return err
+}
+
+func (n *Node) timeout(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// resetDeadline pushes the next election back. The caller must hold n.lock.
+func (n *Node) resetDeadline() {
+	jitter := rand.Intn(n.cfg.ElectionTimeout)
+	n.deadline = time.Now().Add(n.timeout(n.cfg.ElectionTimeout + jitter))
+}
+
+// saveState persists the term and vote. The caller must hold n.lock.
+func (n *Node) saveState() error {
+	return writeJSON(n.fs, filepath.Join(n.cfg.Dir, stateFile), n.hard)
+}
+
+// stepDown makes the node a follower, in term if it is newer. The caller
+// must hold n.lock.
+func (n *Node) stepDown(term uint64) {
+	if term > n.hard.Term {
+		n.hard = hardState{Term: term}
+		n.leader = ""
+		err := n.saveState()
+		if err != nil {
+			log.Printf("raft %s: saving state: %v", n.cfg.ID, err)
+		}
+	}
+	n.role = follower
+}
+
+// membersAt returns the membership as of index, the one of the last
+// members entry at or before it.
+func (n *Node) membersAt(index uint64) map[string]string {
+	for i := index; i > n.log.snap.Index; i-- {
+		if entry := n.log.entry(i); entry.Kind == kindMembers {
+			return entry.Members
+		}
+	}
+	if n.log.snap.Members != nil {
+		return n.log.snap.Members
+	}
+	if n.cfg.Join {
+		return map[string]string{}
+	}
+	return n.cfg.Peers
+}
+
+// pendingMembers reports whether the log holds a members entry that is not
+// committed yet. The caller must hold n.lock.
+func (n *Node) pendingMembers() bool {
+	for i := n.log.lastIndex(); i > n.commit && i > n.log.snap.Index; i-- {
+		if n.log.entry(i).Kind == kindMembers {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) peer(id string, addr string) *peer {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	p, ok := n.peers[id]
+	if !ok || p.addr != addr {
+		if ok {
+			p.close()
+		}
+		p = &peer{addr: addr, secret: n.cfg.Secret}
+		n.peers[id] = p
+	}
+	return p
+}
+
+// run starts elections when the leader goes quiet.
+func (n *Node) run() {
+	defer n.loops.Done()
+
+	ticker := time.NewTicker(n.timeout(n.cfg.HeartbeatInterval) / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n.lock.Lock()
+		_, member := n.members[n.cfg.ID]
+		due := n.role != leader && member && time.Now().After(n.deadline)
+		n.lock.Unlock()
+
+		if due {
+			n.campaign()
+		}
+	}
+}
+
+// campaign runs for leader in a new term.
+func (n *Node) campaign() {
+	n.lock.Lock()
+	n.role = candidate
+	n.hard = hardState{Term: n.hard.Term + 1, Vote: n.cfg.ID}
+	n.leader = ""
+	n.resetDeadline()
+	err := n.saveState()
+	if err != nil {
+		n.lock.Unlock()
+		log.Printf("raft %s: saving state: %v", n.cfg.ID, err)
+		return
+	}
+
+	req := voteRequest{
+		Term:      n.hard.Term,
+		Candidate: n.cfg.ID,
+		LastIndex: n.log.lastIndex(),
+		LastTerm:  n.log.lastTerm(),
+	}
+	members := n.members
+	votes := 1
+	if votes > len(members)/2 {
+		n.becomeLeader()
+	}
+	n.lock.Unlock()
+
+	for id, addr := range members {
+		if id == n.cfg.ID {
+			continue
+		}
+
+		p := n.peer(id, addr)
+		go func() {
+			var reply voteReply
+			err := p.call(rpcVote, req, &reply, n.timeout(n.cfg.ElectionTimeout))
+			if err != nil {
+				return
+			}
+
+			n.lock.Lock()
+			defer n.lock.Unlock()
+
+			if reply.Term > n.hard.Term {
+				n.stepDown(reply.Term)
+				return
+			}
+			if !reply.Granted || n.role != candidate || n.hard.Term != req.Term {
+				return
+			}
+			votes++
+			if votes > len(members)/2 {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader takes over the group with a noop entry, which commits the
+// entries of earlier terms along with it. The caller must hold n.lock.
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leader = n.cfg.ID
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.triggers = make(map[string]chan struct{})
+
+	_, err := n.appendLocal(Entry{Kind: kindNoop})
+	if err != nil {
+		log.Printf("raft %s: appending noop: %v", n.cfg.ID, err)
+		n.role = follower
+		return
+	}
+	n.termStart = n.log.lastIndex()
+	log.Printf("raft %s: leader of term %d", n.cfg.ID, n.hard.Term)
+}
+
+// appendLocal appends an entry of the leader's term to its log and wakes
+// the replication to the other members. The caller must hold n.lock.
+func (n *Node) appendLocal(entry Entry) (uint64, error) {
+	entry.Index = n.log.lastIndex() + 1
+	entry.Term = n.hard.Term
+
+	err := n.log.append(entry)
+	if err != nil {
+		return 0, err
+	}
+	if entry.Kind == kindMembers {
+		n.members = entry.Members
+	}
+	n.match[n.cfg.ID] = entry.Index
+
+	for id := range n.members {
+		if id == n.cfg.ID {
+			continue
+		}
+		trigger, ok := n.triggers[id]
+		if !ok {
+			trigger = make(chan struct{}, 1)
+			n.triggers[id] = trigger
+			n.next[id] = entry.Index
+			n.loops.Add(1)
+			go n.replicate(id, n.hard.Term, trigger)
+		}
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+
+	n.advanceCommit()
+	return entry.Index, nil
+}
+
+// replicate keeps the member id up to date for as long as the node leads in
+// term, sending heartbeats when there is nothing new.
+func (n *Node) replicate(id string, term uint64, trigger chan struct{}) {
+	defer n.loops.Done()
+
+	ticker := time.NewTicker(n.timeout(n.cfg.HeartbeatInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-trigger:
+		case <-ticker.C:
+		}
+
+		n.lock.Lock()
+		_, member := n.members[id]
+		if n.role != leader || n.hard.Term != term || !member {
+			if n.hard.Term == term {
+				delete(n.triggers, id)
+			}
+			n.lock.Unlock()
+			return
+		}
+		n.lock.Unlock()
+
+		if n.send(id, term) {
+			n.lock.Lock()
+			behind := n.role == leader && n.next[id] <= n.log.lastIndex()
+			n.lock.Unlock()
+			if behind {
+				select {
+				case trigger <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// send brings the member id closer to the leader's log with one append
+// request, or a snapshot when the entries it needs are compacted, and
+// reports whether it answered as a follower of term.
+func (n *Node) send(id string, term uint64) bool {
+	n.lock.Lock()
+	if n.role != leader || n.hard.Term != term {
+		n.lock.Unlock()
+		return false
+	}
+
+	addr := n.members[id]
+	next := n.next[id]
+	if next <= n.log.snap.Index {
+		n.lock.Unlock()
+		return n.sendSnapshot(id, addr, term)
+	}
+
+	prevTerm, _ := n.log.term(next - 1)
+	req := appendRequest{
+		Term:      term,
+		Leader:    n.cfg.ID,
+		PrevIndex: next - 1,
+		PrevTerm:  prevTerm,
+		Entries:   n.log.from(next, maxAppendEntries),
+		Commit:    n.commit,
+	}
+	n.lock.Unlock()
+
+	var reply appendReply
+	err := n.peer(id, addr).call(rpcAppend, req, &reply, n.timeout(n.cfg.ElectionTimeout))
+	if err != nil {
+		return false
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if reply.Term > n.hard.Term {
+		n.stepDown(reply.Term)
+		return false
+	}
+	if n.role != leader || n.hard.Term != term {
+		return false
+	}
+
+	if reply.Success {
+		match := req.PrevIndex + uint64(len(req.Entries))
+		if match > n.match[id] {
+			n.match[id] = match
+		}
+		if match+1 > n.next[id] {
+			n.next[id] = match + 1
+		}
+		n.advanceCommit()
+	} else {
+		next := req.PrevIndex
+		if reply.LastIndex+1 < next {
+			next = reply.LastIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.next[id] = next
+	}
+	return true
+}
+
+// advanceCommit commits the entries of the leader's term that a majority
+// of the members hold. The caller must hold n.lock.
+func (n *Node) advanceCommit() {
+	matches := make([]uint64, 0, len(n.members))
+	for id := range n.members {
+		matches = append(matches, n.match[id])
+	}
+	if len(matches) == 0 {
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+
+	index := matches[len(matches)/2]
+	if term, ok := n.log.term(index); index > n.commit && ok && term == n.hard.Term {
+		n.commit = index
+		n.wakeApplier()
+	}
+}
+
+func (n *Node) wakeApplier() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) handleVote(req voteRequest) voteReply {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if req.Term > n.hard.Term {
+		n.stepDown(req.Term)
+	}
+
+	upToDate := req.LastTerm > n.log.lastTerm() || req.LastTerm == n.log.lastTerm() && req.LastIndex >= n.log.lastIndex()
+	granted := req.Term == n.hard.Term && upToDate && (n.hard.Vote == "" || n.hard.Vote == req.Candidate)
+	if granted && n.hard.Vote == "" {
+		n.hard.Vote = req.Candidate
+		err := n.saveState()
+		if err != nil {
+			log.Printf("raft %s: saving state: %v", n.cfg.ID, err)
+			n.hard.Vote = ""
+			granted = false
+		}
+	}
+	if granted {
+		n.resetDeadline()
+	}
+	return voteReply{Term: n.hard.Term, Granted: granted}
+}
+
+// follow accepts the sender of a request of term as the leader, and reports
+// whether term is current. The caller must hold n.lock.
+func (n *Node) follow(term uint64, leaderID string) bool {
+	if term < n.hard.Term {
+		return false
+	}
+	if term > n.hard.Term || n.role != follower {
+		n.stepDown(term)
+	}
+	n.leader = leaderID
+	n.resetDeadline()
+	return true
+}
+
+func (n *Node) handleAppend(req appendRequest) appendReply {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if !n.follow(req.Term, req.Leader) {
+		return appendReply{Term: n.hard.Term}
+	}
+	reply := appendReply{Term: n.hard.Term, LastIndex: n.log.lastIndex()}
+
+	// entries the snapshot already covers are committed and agree
+	entries := req.Entries
+	if req.PrevIndex < n.log.snap.Index {
+		skip := n.log.snap.Index - req.PrevIndex
+		if uint64(len(entries)) < skip {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		req.PrevIndex, req.PrevTerm = n.log.snap.Index, n.log.snap.Term
+	}
+
+	term, ok := n.log.term(req.PrevIndex)
+	if !ok {
+		return reply
+	}
+	if term != req.PrevTerm {
+		reply.LastIndex = req.PrevIndex - 1
+		return reply
+	}
+
+	changed := false
+	for i, entry := range entries {
+		if entry.Index <= n.log.lastIndex() {
+			if term, _ := n.log.term(entry.Index); term == entry.Term {
+				continue
+			}
+			err := n.log.truncateAfter(entry.Index - 1)
+			if err != nil {
+				log.Printf("raft %s: truncating log: %v", n.cfg.ID, err)
+				return reply
+			}
+		}
+		err := n.log.append(entries[i:]...)
+		if err != nil {
+			log.Printf("raft %s: appending entries: %v", n.cfg.ID, err)
+			return reply
+		}
+		changed = true
+		break
+	}
+	if changed {
+		n.members = n.membersAt(n.log.lastIndex())
+	}
+
+	last := req.PrevIndex + uint64(len(entries))
+	if commit := req.Commit; commit > n.commit {
+		if commit > last {
+			commit = last
+		}
+		if commit > n.commit {
+			n.commit = commit
+			n.wakeApplier()
+		}
+	}
+
+	reply.Success = true
+	reply.LastIndex = n.log.lastIndex()
+	return reply
+}
+
+// applyLoop applies the committed entries to the engine in log order.
+func (n *Node) applyLoop() {
+	defer n.loops.Done()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.wake:
+		}
+
+		n.applyLock.Lock()
+		err := n.applyCommitted()
+		if err == nil {
+			err = n.maybeSnapshot()
+		}
+		n.applyLock.Unlock()
+
+		if err != nil {
+			log.Printf("raft %s: applying entries: %v", n.cfg.ID, err)
+		}
+	}
+}
+
+// applyCommitted applies the entries up to the commit index. The caller
+// must hold applyLock.
+func (n *Node) applyCommitted() error {
+	for {
+		n.lock.Lock()
+		if n.applied >= n.commit || n.stopped {
+			n.lock.Unlock()
+			return nil
+		}
+		entry := n.log.entry(n.applied + 1)
+		n.lock.Unlock()
+
+		result, err := n.apply(entry)
+		if err != nil {
+			return err
+		}
+
+		n.lock.Lock()
+		n.applied = entry.Index
+		close(n.appliedSignal)
+		n.appliedSignal = make(chan struct{})
+
+		if w, ok := n.waiters[entry.Index]; ok {
+			if w.term != entry.Term {
+				result = &NotLeaderError{Leader: n.members[n.leader]}
+			}
+			w.result <- result
+			delete(n.waiters, entry.Index)
+		}
+
+		// a leader that removed itself hands over once that is committed
+		if _, member := n.members[n.cfg.ID]; entry.Kind == kindMembers && !member && n.role == leader {
+			n.role = follower
+			n.leader = ""
+		}
+		n.lock.Unlock()
+	}
+}
+
+// apply writes the ops of an entry to the engine in one batch with its
+// index. It returns the result of the ops, for the client that proposed
+// them, and fails only if the index could not be written.
+func (n *Node) apply(entry Entry) (result error, err error) {
+	index := dbengine.Op{Family: appliedFamily, Key: appliedKey, Value: strconv.FormatUint(entry.Index, 10)}
+
+	n.dbLock.RLock()
+	defer n.dbLock.RUnlock()
+
+	if len(entry.Ops) > 0 {
+		ops := append(append([]dbengine.Op(nil), entry.Ops...), index)
+		result = n.db.Batch(ops)
+		if result == nil {
+			return nil, nil
+		}
+	}
+
+	// the ops were refused, as they were on every other node
+	return result, n.db.Batch([]dbengine.Op{index})
+}
+
+// propose appends an entry as the leader and waits until it is applied.
+func (n *Node) propose(entry Entry) error {
+	n.lock.Lock()
+	if n.stopped {
+		n.lock.Unlock()
+		return dbengine.ErrClosed
+	}
+	if n.role != leader {
+		err := &NotLeaderError{Leader: n.members[n.leader]}
+		n.lock.Unlock()
+		return err
+	}
+	if entry.Kind == kindMembers && n.pendingMembers() {
+		n.lock.Unlock()
+		return ErrMembershipChange
+	}
+
+	index, err := n.appendLocal(entry)
+	if err != nil {
+		n.lock.Unlock()
+		return err
+	}
+	result := make(chan error, 1)
+	n.waiters[index] = waiter{term: n.hard.Term, result: result}
+	n.lock.Unlock()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(n.timeout(n.cfg.RequestTimeout)):
+	case <-n.stop:
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.waiters, index)
+	if n.stopped {
+		return dbengine.ErrClosed
+	}
+	return ErrTimeout
+}
+
+// readIndex waits until the engine reflects every write acknowledged
+// before the call: the node checks with a majority that it still leads and
+// waits for its entries of the term to be applied.
+func (n *Node) readIndex() error {
+	n.lock.Lock()
+	if n.stopped {
+		n.lock.Unlock()
+		return dbengine.ErrClosed
+	}
+	if n.role != leader {
+		err := &NotLeaderError{Leader: n.members[n.leader]}
+		n.lock.Unlock()
+		return err
+	}
+	index := n.commit
+	if n.termStart > index {
+		index = n.termStart
+	}
+	term := n.hard.Term
+	members := n.members
+	n.lock.Unlock()
+
+	acks := make(chan bool, len(members))
+	for id := range members {
+		if id == n.cfg.ID {
+			continue
+		}
+		go func(id string) {
+			acks <- n.send(id, term)
+		}(id)
+	}
+
+	confirmed := 1
+	timeout := time.After(n.timeout(n.cfg.RequestTimeout))
+	for waiting := len(members) - 1; confirmed <= len(members)/2; waiting-- {
+		if waiting == 0 {
+			return &NotLeaderError{}
+		}
+		select {
+		case ok := <-acks:
+			if ok {
+				confirmed++
+			}
+		case <-timeout:
+			return ErrTimeout
+		}
+	}
+
+	for {
+		n.lock.Lock()
+		applied, signal := n.applied, n.appliedSignal
+		n.lock.Unlock()
+		if applied >= index {
+			return nil
+		}
+
+		select {
+		case <-signal:
+		case <-timeout:
+			return ErrTimeout
+		case <-n.stop:
+			return dbengine.ErrClosed
+		}
+	}
+}
+
+// AddMember adds the node id, serving at addr, to the group. The node
+// should be started with Join, it receives a snapshot and the log from the
+// leader.
+func (n *Node) AddMember(id string, addr string) error {
+	n.lock.Lock()
+	if _, ok := n.members[id]; ok {
+		n.lock.Unlock()
+		return ErrMemberExists
+	}
+	members := map[string]string{id: addr}
+	for id, addr := range n.members {
+		members[id] = addr
+	}
+	n.lock.Unlock()
+
+	return n.propose(Entry{Kind: kindMembers, Members: members})
+}
+
+// RemoveMember removes the node id from the group. A leader can remove
+// itself, another member takes over once the removal is committed.
+func (n *Node) RemoveMember(id string) error {
+	n.lock.Lock()
+	if _, ok := n.members[id]; !ok {
+		n.lock.Unlock()
+		return ErrUnknownMember
+	}
+	members := make(map[string]string)
+	for member, addr := range n.members {
+		if member != id {
+			members[member] = addr
+		}
+	}
+	n.lock.Unlock()
+
+	return n.propose(Entry{Kind: kindMembers, Members: members})
+}
+
+// Status is the view a node has of the group.
+type Status struct {
+	ID       string
+	Role     string
+	Term     uint64
+	Leader   string
+	Commit   uint64
+	Applied  uint64
+	Last     uint64
+	Snapshot uint64
+	Members  []string
+}
+
+// String describes the status for the RAFT STATUS command.
+func (s Status) String() string {
+	return fmt.Sprintf("id=%s role=%s term=%d leader=%s commit=%d applied=%d last=%d snapshot=%d members=%s",
+		s.ID, s.Role, s.Term, s.Leader, s.Commit, s.Applied, s.Last, s.Snapshot, strings.Join(s.Members, ","))
+}
+
+func (n *Node) Status() Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	members := make([]string, 0, len(n.members))
+	for id := range n.members {
+		members = append(members, id)
+	}
+	sort.Strings(members)
+
+	return Status{
+		ID:       n.cfg.ID,
+		Role:     n.role.String(),
+		Term:     n.hard.Term,
+		Leader:   n.leader,
+		Commit:   n.commit,
+		Applied:  n.applied,
+		Last:     n.log.lastIndex(),
+		Snapshot: n.log.snap.Index,
+		Members:  members,
+	}
+}
+
+// Authenticate reports whether secret is the one of the group, which the
+// nodes send with "RAFT AUTH" before their requests. It fails while the
+// node has no secret, or neither members nor configured peers.
+func (n *Node) Authenticate(secret string) bool {
+	n.lock.Lock()
+	configured := len(n.members) > 0 || len(n.cfg.Peers) > 0
+	n.lock.Unlock()
+
+	if !configured || n.cfg.Secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(n.cfg.Secret)) == 1
+}
@@ -0,0 +1,199 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nodes talk over the TCP port of their server. A connection starts with
+// "RAFT AUTH <secret>", answered "OK", then a request is one line,
+// "RAFT <kind> <json>", and its reply one line of JSON.
+const (
+	rpcVote     = "VOTE"
+	rpcAppend   = "APPEND"
+	rpcSnapshot = "SNAPSHOT"
+)
+
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type voteReply struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term      uint64  `json:"term"`
+	Leader    string  `json:"leader"`
+	PrevIndex uint64  `json:"prev_index"`
+	PrevTerm  uint64  `json:"prev_term"`
+	Entries   []Entry `json:"entries,omitempty"`
+	Commit    uint64  `json:"commit"`
+}
+
+// appendReply carries the last index of a follower that refused entries,
+// so that the leader can skip back to it at once.
+type appendReply struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"last_index"`
+}
+
+// snapshotRequest carries one file of a checkpoint. First starts a new
+// transfer and Done ends it, the follower then installs the checkpoint.
+type snapshotRequest struct {
+	Term   uint64       `json:"term"`
+	Leader string       `json:"leader"`
+	Meta   snapshotMeta `json:"meta"`
+	Name   string       `json:"name"`
+	Data   []byte       `json:"data"`
+	First  bool         `json:"first"`
+	Done   bool         `json:"done"`
+}
+
+type snapshotReply struct {
+	Term uint64 `json:"term"`
+}
+
+// HandleRPC answers the request of another node, kind and payload being
+// the rest of its "RAFT" line.
+func (n *Node) HandleRPC(kind string, payload string) string {
+	var reply interface{}
+	var err error
+
+	switch kind {
+	case rpcVote:
+		var req voteRequest
+		err = json.Unmarshal([]byte(payload), &req)
+		if err == nil {
+			reply = n.handleVote(req)
+		}
+	case rpcAppend:
+		var req appendRequest
+		err = json.Unmarshal([]byte(payload), &req)
+		if err == nil {
+			reply = n.handleAppend(req)
+		}
+	case rpcSnapshot:
+		var req snapshotRequest
+		err = json.Unmarshal([]byte(payload), &req)
+		if err == nil {
+			reply, err = n.handleSnapshot(req)
+		}
+	default:
+		err = fmt.Errorf("unknown request %q", kind)
+	}
+	if err != nil {
+		return "Error " + err.Error()
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return "Error " + err.Error()
+	}
+	return string(data)
+}
+
+// peer is the connection to another node. Calls are made one at a time
+// and a failed call drops the connection, the next one dials again.
+type peer struct {
+	addr   string
+	secret string
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (p *peer) call(kind string, req interface{}, reply interface{}, timeout time.Duration) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", p.addr, timeout)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+		p.reader = bufio.NewReader(conn)
+
+		err = p.authenticate(timeout)
+		if err != nil {
+			p.closeLocked()
+			return err
+		}
+	}
+
+	err = p.roundTrip(kind, data, reply, timeout)
+	if err != nil {
+		p.closeLocked()
+	}
+	return err
+}
+
+// authenticate sends the secret of the group on a new connection.
+func (p *peer) authenticate(timeout time.Duration) error {
+	p.conn.SetDeadline(time.Now().Add(timeout))
+
+	_, err := p.conn.Write([]byte("RAFT AUTH " + p.secret + "\n"))
+	if err != nil {
+		return err
+	}
+
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if line != "OK" {
+		return errors.New(line)
+	}
+	return nil
+}
+
+func (p *peer) roundTrip(kind string, data []byte, reply interface{}, timeout time.Duration) error {
+	p.conn.SetDeadline(time.Now().Add(timeout))
+
+	_, err := p.conn.Write([]byte("RAFT " + kind + " " + string(data) + "\n"))
+	if err != nil {
+		return err
+	}
+
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if !strings.HasPrefix(line, "{") {
+		return errors.New(line)
+	}
+	return json.Unmarshal([]byte(line), reply)
+}
+
+func (p *peer) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closeLocked()
+}
+
+func (p *peer) closeLocked() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
@@ -0,0 +1,241 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+var errSnapshotOrder = errors.New("snapshot file out of order")
+
+func snapshotName(index uint64) string {
+	return fmt.Sprintf("snapshot-%020d", index)
+}
+
+// maybeSnapshot checkpoints the engine and compacts the log once
+// SnapshotThreshold entries were applied since the last snapshot. The
+// caller must hold applyLock, so that the checkpoint is cut exactly at the
+// applied index.
+func (n *Node) maybeSnapshot() error {
+	n.lock.Lock()
+	index := n.applied
+	if index < n.log.snap.Index+uint64(n.cfg.SnapshotThreshold) {
+		n.lock.Unlock()
+		return nil
+	}
+	term, _ := n.log.term(index)
+	meta := snapshotMeta{Index: index, Term: term, Members: n.membersAt(index), Dir: snapshotName(index)}
+	n.lock.Unlock()
+
+	dir := filepath.Join(n.cfg.Dir, meta.Dir)
+	err := vfs.RemoveAll(n.fs, dir)
+	if err != nil {
+		return err
+	}
+
+	n.dbLock.RLock()
+	err = n.db.Checkpoint(dir)
+	n.dbLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return n.replaceSnapshot(meta)
+}
+
+// replaceSnapshot makes meta the snapshot of the node, drops the entries it
+// covers and removes the previous snapshot.
+func (n *Node) replaceSnapshot(meta snapshotMeta) error {
+	n.snapLock.Lock()
+	defer n.snapLock.Unlock()
+
+	n.lock.Lock()
+	old := n.log.snap.Dir
+	err := writeJSON(n.fs, filepath.Join(n.cfg.Dir, snapshotFile), meta)
+	if err == nil {
+		err = n.log.compact(meta)
+	}
+	n.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if old == "" || old == meta.Dir {
+		return nil
+	}
+	return vfs.RemoveAll(n.fs, filepath.Join(n.cfg.Dir, old))
+}
+
+// sendSnapshot sends the files of the snapshot to the member id one request
+// at a time, and reports whether it took them as a follower of term.
+func (n *Node) sendSnapshot(id string, addr string, term uint64) bool {
+	n.snapLock.RLock()
+	defer n.snapLock.RUnlock()
+
+	n.lock.Lock()
+	meta := n.log.snap
+	n.lock.Unlock()
+
+	dir := filepath.Join(n.cfg.Dir, meta.Dir)
+	names, err := listFiles(n.fs, dir, "")
+	if err != nil {
+		return false
+	}
+
+	p := n.peer(id, addr)
+	for i, name := range names {
+		data, err := vfs.ReadFile(n.fs, filepath.Join(dir, name))
+		if err != nil {
+			return false
+		}
+
+		req := snapshotRequest{
+			Term:   term,
+			Leader: n.cfg.ID,
+			Meta:   meta,
+			Name:   name,
+			Data:   data,
+			First:  i == 0,
+			Done:   i == len(names)-1,
+		}
+		var reply snapshotReply
+		err = p.call(rpcSnapshot, req, &reply, n.timeout(n.cfg.RequestTimeout))
+		if err != nil {
+			return false
+		}
+
+		if reply.Term > term {
+			n.lock.Lock()
+			n.stepDown(reply.Term)
+			n.lock.Unlock()
+			return false
+		}
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.role != leader || n.hard.Term != term {
+		return false
+	}
+	if meta.Index > n.match[id] {
+		n.match[id] = meta.Index
+	}
+	n.next[id] = n.match[id] + 1
+	return true
+}
+
+// listFiles returns the paths of the files below dir, relative to it.
+func listFiles(fs vfs.FS, dir string, rel string) ([]string, error) {
+	names, err := fs.ReadDir(filepath.Join(dir, rel))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, name := range names {
+		path := filepath.Join(rel, name)
+		info, err := fs.Stat(filepath.Join(dir, path))
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		below, err := listFiles(fs, dir, path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, below...)
+	}
+	return files, nil
+}
+
+// handleSnapshot stores one file of the leader's snapshot and installs the
+// snapshot with its last file. A node that already applied the snapshot's
+// entries takes the files without storing them.
+func (n *Node) handleSnapshot(req snapshotRequest) (snapshotReply, error) {
+	n.lock.Lock()
+	if !n.follow(req.Term, req.Leader) {
+		defer n.lock.Unlock()
+		return snapshotReply{Term: n.hard.Term}, nil
+	}
+	reply := snapshotReply{Term: n.hard.Term}
+	ahead := n.applied >= req.Meta.Index
+	if req.First {
+		n.incoming = req.Meta.Index
+	}
+	inOrder := n.incoming == req.Meta.Index
+	n.lock.Unlock()
+
+	if ahead {
+		return reply, nil
+	}
+	name := filepath.Clean(req.Name)
+	if !inOrder || filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+		return reply, errSnapshotOrder
+	}
+
+	dir := filepath.Join(n.cfg.Dir, snapshotName(req.Meta.Index))
+	if req.First {
+		err := vfs.RemoveAll(n.fs, dir)
+		if err != nil {
+			return reply, err
+		}
+	}
+
+	path := filepath.Join(dir, name)
+	err := n.fs.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = vfs.WriteFileAtomic(n.fs, path, req.Data)
+	}
+	if err != nil || !req.Done {
+		return reply, err
+	}
+
+	req.Meta.Dir = snapshotName(req.Meta.Index)
+	return reply, n.install(req.Meta)
+}
+
+// install replaces the engine with the checkpoint of meta, received in its
+// directory, and drops the log entries it covers.
+func (n *Node) install(meta snapshotMeta) error {
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+
+	n.lock.Lock()
+	ahead := n.applied >= meta.Index
+	n.incoming = 0
+	n.lock.Unlock()
+	if ahead {
+		return nil
+	}
+
+	n.dbLock.Lock()
+	_, err := n.restoreEngine(filepath.Join(n.cfg.Dir, meta.Dir))
+	n.dbLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = n.replaceSnapshot(meta)
+	if err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.applied = meta.Index
+	if meta.Index > n.commit {
+		n.commit = meta.Index
+	}
+	n.members = n.membersAt(n.log.lastIndex())
+	close(n.appliedSignal)
+	n.appliedSignal = make(chan struct{})
+	return nil
+}
@@ -0,0 +1,318 @@
+package replication
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/dump"
+)
+
+// FollowerOptions configures a Follower. Leader is the host:port of the
+// leader's TCP server and RetryPeriod, in milliseconds, the wait before
+// reconnecting to it. It defaults to DefaultRetryPeriod.
+type FollowerOptions struct {
+	Leader      string
+	RetryPeriod int
+}
+
+// Status is the replication state of a follower. Applied is the last LSN
+// it applied and LeaderLSN the last one the leader reported, LastContact
+// the time the leader was last heard from.
+type Status struct {
+	Leader      string
+	Connected   bool
+	Applied     uint64
+	LeaderLSN   uint64
+	LastContact time.Time
+}
+
+// Lag is the number of LSNs the follower has yet to apply.
+func (s Status) Lag() uint64 {
+	if s.LeaderLSN < s.Applied {
+		return 0
+	}
+	return s.LeaderLSN - s.Applied
+}
+
+// String describes the status for the REPLICATION command. last_contact
+// is in milliseconds, -1 until the leader was heard from.
+func (s Status) String() string {
+	contact := int64(-1)
+	if !s.LastContact.IsZero() {
+		contact = time.Since(s.LastContact).Milliseconds()
+	}
+	return fmt.Sprintf("role=follower leader=%s connected=%t lsn=%d leader_lsn=%d lag=%d last_contact=%d",
+		s.Leader, s.Connected, s.Applied, s.LeaderLSN, s.Lag(), contact)
+}
+
+// Follower is a read only engine that tails the WAL of a leader. Writes
+// fail with ErrReadOnly. Reads see the records applied so far.
+type Follower struct {
+	db   *dbengine.DBEngine
+	opts FollowerOptions
+
+	lock      sync.Mutex
+	conn      net.Conn
+	connected bool
+	leaderLSN uint64
+	contact   time.Time
+	stopped   bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartFollower makes db follow the leader of opts, resuming after the last
+// LSN db logged. The follower owns db from then on and closes it in Close.
+func StartFollower(db *dbengine.DBEngine, opts FollowerOptions) *Follower {
+	if opts.RetryPeriod <= 0 {
+		opts.RetryPeriod = DefaultRetryPeriod
+	}
+
+	f := &Follower{
+		db:   db,
+		opts: opts,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+// run follows the leader until Close, reconnecting whenever the connection
+// is lost.
+func (f *Follower) run() {
+	defer close(f.done)
+
+	for {
+		err := f.follow()
+
+		f.lock.Lock()
+		f.connected = false
+		f.conn = nil
+		stopped := f.stopped
+		f.lock.Unlock()
+
+		if stopped {
+			return
+		}
+		fmt.Printf("Replication from %s interrupted: %v\n", f.opts.Leader, err)
+
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(time.Duration(f.opts.RetryPeriod) * time.Millisecond):
+		}
+	}
+}
+
+// follow runs one connection to the leader.
+func (f *Follower) follow() error {
+	conn, err := net.DialTimeout("tcp", f.opts.Leader, time.Duration(f.opts.RetryPeriod)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	f.lock.Lock()
+	if f.stopped {
+		f.lock.Unlock()
+		return nil
+	}
+	f.conn = conn
+	f.lock.Unlock()
+
+	_, err = fmt.Fprintf(conn, "REPLICATE %d\n", f.db.LastLSN())
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+
+	if !scanner.Scan() {
+		return closed(scanner)
+	}
+	lsn, ok := parseLSN(scanner.Text(), "SNAPSHOT")
+	if ok {
+		err = f.installSnapshot(scanner, lsn)
+		if err != nil {
+			return err
+		}
+	} else if lsn, ok = parseLSN(scanner.Text(), "RESUME"); !ok {
+		return fmt.Errorf("leader replied %q", scanner.Text())
+	}
+	f.heard(lsn)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "#") {
+			err = f.db.Replay(line)
+			if err != nil {
+				return err
+			}
+			f.heard(f.db.LastLSN())
+			continue
+		}
+
+		lsn, ok := parseLSN(line, "LSN")
+		if !ok {
+			return fmt.Errorf("leader sent %q", line)
+		}
+		f.heard(lsn)
+
+		_, err = fmt.Fprintf(conn, "ACK %d\n", f.db.LastLSN())
+		if err != nil {
+			return err
+		}
+	}
+	return closed(scanner)
+}
+
+// installSnapshot reads the records of a snapshot up to END and installs
+// them, each in the family of the last FAMILY line before it.
+func (f *Follower) installSnapshot(scanner *bufio.Scanner, lsn uint64) error {
+	var pairs []dbengine.Op
+	families := make(map[string]dbengine.FamilyOptions)
+	family := ""
+	for scanner.Scan() && scanner.Text() != "END" {
+		if name, opts, ok := parseFamily(scanner.Text()); ok {
+			families[name] = opts
+			family = name
+			continue
+		}
+		op, err := dump.DecodeOp(scanner.Text())
+		if err != nil {
+			return err
+		}
+		op.Family = family
+		pairs = append(pairs, op)
+	}
+	if scanner.Text() != "END" {
+		return closed(scanner)
+	}
+	return f.db.InstallSnapshot(lsn, pairs, families)
+}
+
+// closed returns why the leader's stream ended.
+func closed(scanner *bufio.Scanner) error {
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// heard records that the leader is at lsn or further.
+func (f *Follower) heard(lsn uint64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.connected = true
+	f.contact = time.Now()
+	if lsn > f.leaderLSN {
+		f.leaderLSN = lsn
+	}
+}
+
+// Status returns the replication state of the follower.
+func (f *Follower) Status() Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return Status{
+		Leader:      f.opts.Leader,
+		Connected:   f.connected,
+		Applied:     f.db.LastLSN(),
+		LeaderLSN:   f.leaderLSN,
+		LastContact: f.contact,
+	}
+}
+
+func (f *Follower) Get(key string) (string, bool, error) {
+	return f.db.Get(key)
+}
+
+func (f *Follower) Iterate(start string, fn func(key string, value string) bool) error {
+	return f.db.Iterate(start, fn)
+}
+
+func (f *Follower) Put(key string, value string) error {
+	return ErrReadOnly
+}
+
+func (f *Follower) Delete(key string) error {
+	return ErrReadOnly
+}
+
+func (f *Follower) Merge(key string, operator string, operand string) error {
+	return ErrReadOnly
+}
+
+func (f *Follower) Batch(ops []dbengine.Op) error {
+	return ErrReadOnly
+}
+
+// CreateFamily and DropFamily fail with ErrReadOnly, the follower gets the
+// column families of the leader.
+func (f *Follower) CreateFamily(name string, opts dbengine.FamilyOptions) error {
+	return ErrReadOnly
+}
+
+func (f *Follower) DropFamily(name string) error {
+	return ErrReadOnly
+}
+
+// Family returns a read only view of a column family.
+func (f *Follower) Family(name string) (dbengine.Engine, error) {
+	family, err := f.db.Family(name)
+	if err != nil {
+		return nil, err
+	}
+	return readOnly{family}, nil
+}
+
+// readOnly is a column family of a follower.
+type readOnly struct {
+	dbengine.Engine
+}
+
+func (r readOnly) Put(key string, value string) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) Delete(key string) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) Merge(key string, operator string, operand string) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) Batch(ops []dbengine.Op) error {
+	return ErrReadOnly
+}
+
+// Close stops following the leader and closes the engine.
+func (f *Follower) Close() error {
+	f.lock.Lock()
+	if f.stopped {
+		f.lock.Unlock()
+		return dbengine.ErrClosed
+	}
+	f.stopped = true
+	close(f.stop)
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.lock.Unlock()
+
+	<-f.done
+	return f.db.Close()
+}
@@ -0,0 +1,171 @@
+// Package replication ships the WAL of a leader to read only followers.
+//
+// A follower connects to the leader's TCP port and sends
+// "REPLICATE <lsn>", the last LSN it applied. The leader replies
+// "RESUME <lsn>" when its WAL still holds every record after that LSN, or
+// else "SNAPSHOT <lsn>" followed by the records of its default family as
+// written by dump.EncodeOp, then for every other column family a
+// "FAMILY <name> <options>" line, the options in JSON, followed by its
+// records, and a closing "END". It then streams
+// its WAL records, one per line and in LSN order, and "LSN <lsn>" with its
+// last LSN whenever it is idle for a heartbeat. The follower answers each
+// heartbeat with "ACK <lsn>", the last LSN it applied.
+package replication
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/dump"
+)
+
+// DefaultHeartbeat is the period of the leader's heartbeats and
+// DefaultRetryPeriod the wait of a follower before it reconnects, both in
+// milliseconds.
+const (
+	DefaultHeartbeat   = 1000
+	DefaultRetryPeriod = 1000
+)
+
+var (
+	ErrReadOnly    = errors.New("replica does not accept writes")
+	ErrFeedDropped = errors.New("follower fell too far behind")
+)
+
+// Ship serves a follower that sent REPLICATE from: it writes the backlog
+// or snapshot of a feed and then its records to w, and reads the
+// follower's acknowledgements from acks. It returns once the follower is
+// gone, the feed is dropped or a write fails.
+func Ship(w *bufio.Writer, acks *bufio.Scanner, source dbengine.Replicator, from uint64, heartbeat int) error {
+	if heartbeat <= 0 {
+		heartbeat = DefaultHeartbeat
+	}
+
+	feed, err := source.Follow(from)
+	if err != nil {
+		return err
+	}
+	defer feed.Close()
+
+	if feed.Snapshot != nil {
+		w.WriteString(fmt.Sprintf("SNAPSHOT %d\n", feed.LSN))
+		err = writeSnapshot(w, feed.Snapshot)
+		if err != nil {
+			return err
+		}
+		for _, family := range feed.Families {
+			options, err := json.Marshal(family.Options)
+			if err != nil {
+				return err
+			}
+			w.WriteString(fmt.Sprintf("FAMILY %s %s\n", family.Name, options))
+			err = writeSnapshot(w, family.Snapshot)
+			if err != nil {
+				return err
+			}
+		}
+		w.WriteString("END\n")
+	} else {
+		w.WriteString(fmt.Sprintf("RESUME %d\n", feed.LSN))
+	}
+	for _, record := range feed.Backlog {
+		w.WriteString(record + "\n")
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	// the follower only talks to acknowledge, so a failed read means that
+	// it left or that the server is shutting down
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for acks.Scan() {
+			lsn, ok := parseLSN(acks.Text(), "ACK")
+			if ok {
+				feed.Ack(lsn)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(heartbeat) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case record, ok := <-feed.Records():
+			if !ok {
+				return ErrFeedDropped
+			}
+			w.WriteString(record + "\n")
+			if len(feed.Records()) > 0 {
+				continue
+			}
+		case <-ticker.C:
+			w.WriteString(fmt.Sprintf("LSN %d\n", feed.Head()))
+		case <-gone:
+			return nil
+		}
+
+		err = w.Flush()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeSnapshot writes the records it walks, one per line.
+func writeSnapshot(w *bufio.Writer, it *lsmtree.Iterator) error {
+	for it.Next() {
+		record := it.Record()
+		line, err := dump.EncodeOp(dbengine.Op{Key: record.Key, Value: record.Value, Delete: record.Tombstone, Version: record.Version})
+		if err != nil {
+			return err
+		}
+		w.WriteString(line + "\n")
+	}
+	return nil
+}
+
+// LeaderStatus describes the followers of source for the REPLICATION
+// command. The lag of a follower is the number of LSNs it has yet to
+// acknowledge, the largest one is reported.
+func LeaderStatus(source dbengine.Replicator) string {
+	feeds := source.Feeds()
+	head := source.LastLSN()
+
+	var lag uint64
+	for _, feed := range feeds {
+		if acked := feed.Acked(); acked < head && head-acked > lag {
+			lag = head - acked
+		}
+	}
+	return fmt.Sprintf("role=leader lsn=%d followers=%d lag=%d", head, len(feeds), lag)
+}
+
+// parseLSN reads a "<name> <lsn>" line of the protocol.
+func parseLSN(line string, name string) (uint64, bool) {
+	if !strings.HasPrefix(line, name+" ") {
+		return 0, false
+	}
+	lsn, err := strconv.ParseUint(line[len(name)+1:], 10, 64)
+	return lsn, err == nil
+}
+
+// parseFamily reads a "FAMILY <name> <options>" line of a snapshot.
+func parseFamily(line string) (string, dbengine.FamilyOptions, bool) {
+	var opts dbengine.FamilyOptions
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 || fields[0] != "FAMILY" || json.Unmarshal([]byte(fields[2]), &opts) != nil {
+		return "", opts, false
+	}
+	return fields[1], opts, true
+}
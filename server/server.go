@@ -2,16 +2,26 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net"
-	"os"
-	"os/signal"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 
 	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	"github.com/jiteshchawla1511/KryptonDB/cdc"
+	"github.com/jiteshchawla1511/KryptonDB/cluster"
 	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
-	"github.com/jiteshchawla1511/KryptonDB/wal"
+	"github.com/jiteshchawla1511/KryptonDB/dump"
+	"github.com/jiteshchawla1511/KryptonDB/dynamo"
+	"github.com/jiteshchawla1511/KryptonDB/membership"
+	"github.com/jiteshchawla1511/KryptonDB/multileader"
+	"github.com/jiteshchawla1511/KryptonDB/raft"
+	"github.com/jiteshchawla1511/KryptonDB/replication"
 )
 
 const (
@@ -19,114 +29,562 @@ const (
 	DefaultUDPPort       = "1053"
 	DefaultUDPBufferSize = 1024
 	DefaultHost          = "localhost"
+
+	// maxLineSize bounds a command line, which carries a whole file of a
+	// Raft snapshot.
+	maxLineSize = 64 * 1024 * 1024
 )
 
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown.
+var ErrServerClosed = errors.New("server closed")
+
+// Server answers the TCP and UDP protocols. A port of "0" binds an ephemeral
+// port, Addr and UDPAddr report what was bound. Heartbeat is the period in
+// milliseconds of the heartbeats sent to followers, see replication.Ship.
+// When Members is set it runs its protocol on the UDP port while the server
+// is served.
 type Server struct {
 	Port          string
 	Host          string
 	UDPPort       string
 	UDPBufferSize int
-	DBEngine      *dbengine.DBEngine
+	Heartbeat     int
+	Engine        dbengine.Engine
+	Members       *membership.Members
+
+	lock     sync.Mutex
+	listener net.Listener
+	udpConn  net.PacketConn
+	conns    map[net.Conn]struct{}
+	handlers sync.WaitGroup
+	shutdown bool
 }
 
-func (s *Server) Start() {
-	listen, err := net.Listen("tcp", fmt.Sprintf("%s:%s", s.Host, s.Port))
+// Listen binds the TCP and UDP ports without serving them yet.
+func (s *Server) Listen() error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(s.Host, s.Port))
 	if err != nil {
-		fmt.Println("Error Listening")
-		return
+		return err
 	}
-	defer listen.Close()
 
-	udpServer, err := net.ListenPacket("udp", fmt.Sprintf("%s:%s", s.Host, s.UDPPort))
+	udpConn, err := net.ListenPacket("udp", net.JoinHostPort(s.Host, s.UDPPort))
 	if err != nil {
-		fmt.Println("Error Listening UDP Port")
-		return
+		listener.Close()
+		return err
 	}
-	defer udpServer.Close()
 
-	dataLoadSignal := make(chan bool, 1)
-	startPersistCycle := make(chan bool, 1)
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	go func() {
-		fmt.Println("Loading data from disk")
+	s.listener = listener
+	s.udpConn = udpConn
+	s.conns = make(map[net.Conn]struct{})
+	return nil
+}
 
-		err := s.DBEngine.LoadFromDisk(s.DBEngine.Lsmtree, s.DBEngine.WAL)
+// Addr returns the bound TCP address, nil before Listen.
+func (s *Server) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-		if err != nil {
-			fmt.Printf("Error loading data from disk")
-			panic(err)
-		}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
 
-		fmt.Println("Data loaded from disk")
+// UDPAddr returns the bound UDP address, nil before Listen.
+func (s *Server) UDPAddr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-		dataLoadSignal <- true
-		startPersistCycle <- true
-	}()
+	if s.udpConn == nil {
+		return nil
+	}
+	return s.udpConn.LocalAddr()
+}
 
-	<-dataLoadSignal
+func (s *Server) ListenAndServe() error {
+	err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve()
+}
 
-	go s.DBEngine.Store.PersistToDisk(s.DBEngine.WAL, startPersistCycle)
+// Serve answers requests on the bound ports until Shutdown or a listener
+// failure, and always returns a non nil error.
+func (s *Server) Serve() error {
+	s.lock.Lock()
+	listener, udpConn := s.listener, s.udpConn
+	s.lock.Unlock()
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	if listener == nil {
+		return errors.New("server is not listening")
+	}
+	if s.Members != nil {
+		s.Members.Start(udpConn)
+	}
 
+	// whichever side fails first takes the other one down with it
+	udpErr := make(chan error, 1)
 	go func() {
-		<-sigCh
-		fmt.Println("Shutting down server")
-		err := s.DBEngine.WAL.Persist()
+		err := s.serveUDP(udpConn)
+		listener.Close()
+		udpErr <- err
+	}()
+
+	err := s.serveTCP(listener)
+	if s.isShutdown() {
+		return ErrServerClosed
+	}
 
+	udpConn.Close()
+	if udpServeErr := <-udpErr; !errors.Is(udpServeErr, net.ErrClosed) {
+		return udpServeErr
+	}
+	return err
+}
+
+func (s *Server) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Printf("Error persisting WAL\n")
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
 		}
 
-		os.Exit(0)
-	}()
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
 
-	go func() {
-		for {
-			conn, err := listen.Accept()
-			if err != nil {
-				fmt.Printf("Error accepting (TCP)")
-				continue
+		go func() {
+			defer s.untrack(conn)
+			handleConnection(conn, s.Engine, s.Members, s.Heartbeat)
+		}()
+	}
+}
+
+func (s *Server) serveUDP(udpConn net.PacketConn) error {
+	buf := make([]byte, s.UDPBufferSize)
+	for {
+		n, addr, err := udpConn.ReadFrom(buf)
+		if err != nil {
+			if s.isShutdown() {
+				return ErrServerClosed
 			}
+			return err
+		}
 
-			go handleConnection(conn, s.DBEngine.Lsmtree, s.DBEngine.WAL)
+		if !s.track(nil) {
+			return ErrServerClosed
 		}
-	}()
 
-	go func() {
-		buf := make([]byte, s.UDPBufferSize)
-		for {
-			n, addr, err := udpServer.ReadFrom(buf)
-			if err != nil {
-				fmt.Printf("Error reading UDP packet")
-				continue
+		// buf is reused by the next read
+		packet := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer s.untrack(nil)
+			if s.Members != nil && membership.IsPacket(packet) {
+				s.Members.HandlePacket(packet, addr)
+				return
 			}
+			handleUDPPacket(udpConn, packet, addr, s.Engine)
+		}()
+	}
+}
+
+// track registers a handler, and its connection for TCP, unless the server
+// is shutting down.
+func (s *Server) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+	if conn != nil {
+		s.conns[conn] = struct{}{}
+	}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.lock.Lock()
+	if conn != nil {
+		delete(s.conns, conn)
+	}
+	s.lock.Unlock()
 
-			go handleUDPPacket(udpServer, buf[:n], addr, s.DBEngine.Lsmtree, s.DBEngine.WAL)
+	s.handlers.Done()
+}
+
+func (s *Server) isShutdown() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.shutdown
+}
+
+// Shutdown stops accepting requests and drains the open connections: each
+// one finishes the command it is running and is then closed. When ctx ends
+// first the remaining connections are closed forcibly and ctx.Err() is
+// returned. Shutdown does not close the Engine.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+
+	var err error
+	if !s.shutdown && s.listener != nil {
+		err = s.listener.Close()
+		if udpErr := s.udpConn.Close(); err == nil {
+			err = udpErr
 		}
+	}
+	s.shutdown = true
+
+	// wake up the handlers blocked reading the next command
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.lock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(drained)
 	}()
 
-	select {}
+	select {
+	case <-drained:
+		return err
+	case <-ctx.Done():
+		s.lock.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.lock.Unlock()
+		return ctx.Err()
+	}
+}
+
+// errorResponse maps an engine error to the reply sent to the client, using
+// fallback for storage failures. A Raft node that is not the leader sends
+// the client to it with "REDIRECT host:port", and a cluster node sends the
+// keys of another node there with "MOVED slot host:port".
+func errorResponse(err error, fallback string) string {
+	var moved *cluster.MovedError
+	if errors.As(err, &moved) {
+		return fmt.Sprintf("MOVED %d %s", moved.Slot, moved.Addr)
+	}
+
+	var notLeader *raft.NotLeaderError
+	if errors.As(err, &notLeader) {
+		if notLeader.Leader == "" {
+			return "No leader"
+		}
+		return "REDIRECT " + notLeader.Leader
+	}
+
+	switch err {
+	case dbengine.ErrInvalidKey, dbengine.ErrInvalidValue, dbengine.ErrInvalidFamily:
+		return "Invalid command"
+	case dbengine.ErrClosed:
+		return "Server is shutting down"
+	case dbengine.ErrFamilyNotFound:
+		return "Column family not found"
+	case dbengine.ErrFamilyExists:
+		return "Column family already exists"
+	case lsmtree.ErrInvalidOperand:
+		return "Invalid operand"
+	case lsmtree.ErrNotInteger:
+		return "Value is not an integer"
+	case lsmtree.ErrOverflow:
+		return "Integer overflow"
+	case lsmtree.ErrCorruptTable, lsmtree.ErrUnsortedTable:
+		return "Invalid table"
+	case lsmtree.ErrOverlappingTables:
+		return "Tables overlap"
+	case dbengine.ErrCheckpointExists:
+		return "Backup directory is not empty"
+	case dbengine.ErrNotRetained:
+		return "Sequence not retained"
+	case replication.ErrReadOnly:
+		return "Read only replica"
+	case raft.ErrTimeout:
+		return "Request timed out"
+	case raft.ErrMembershipChange:
+		return "Membership change in progress"
+	case raft.ErrMemberExists:
+		return "Member already exists"
+	case raft.ErrUnknownMember:
+		return "Member not found"
+	case cluster.ErrUnassigned:
+		return "Slot not assigned"
+	case cluster.ErrNotOwner:
+		return "Slot not owned"
+	case cluster.ErrUnknownNode:
+		return "Node not found"
+	case cluster.ErrMigrating:
+		return "Migration in progress"
+	case cluster.ErrNodeExists:
+		return "Node already exists"
+	case dynamo.ErrQuorum:
+		return "Quorum not reached"
+	case dynamo.ErrUnknownNode:
+		return "Node not found"
+	default:
+		return fallback
+	}
+}
+
+// parseSlotRange reads the "slot" or "first-last" argument of CLUSTER
+// MIGRATE.
+func parseSlotRange(arg string) (int, int, bool) {
+	from, to, isRange := strings.Cut(arg, "-")
+	first, err := strconv.Atoi(from)
+	if err != nil {
+		return 0, 0, false
+	}
+	if !isRange {
+		return first, first, true
+	}
+
+	last, err := strconv.Atoi(to)
+	if err != nil {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// formatSlots is the reply of CLUSTER SLOTS, one "first-last=id@host:port"
+// per range of slots.
+func formatSlots(s cluster.State) string {
+	ranges := make([]string, len(s.Slots))
+	for i, r := range s.Slots {
+		ranges[i] = fmt.Sprintf("%d-%d=%s@%s", r.First, r.Last, r.Node, s.Nodes[r.Node])
+	}
+	return strings.Join(ranges, " ")
+}
+
+// formatMembers is the reply of CLUSTER MEMBERS, one "id@host:port=state"
+// per member.
+func formatMembers(list []membership.Member) string {
+	members := make([]string, len(list))
+	for i, m := range list {
+		members[i] = fmt.Sprintf("%s@%s=%s", m.ID, m.Addr, m.State)
+	}
+	return strings.Join(members, " ")
+}
+
+// formatConflicts is the reply of MULTILEADER CONFLICTS, one "key=count"
+// per key that had conflicting writes.
+func formatConflicts(counts []multileader.ConflictCount) string {
+	conflicts := make([]string, len(counts))
+	for i, c := range counts {
+		conflicts[i] = fmt.Sprintf("%s=%d", c.Key, c.Count)
+	}
+	return strings.Join(conflicts, " ")
+}
+
+// parseDumpOptions reads the prefix=, start= and end= arguments of DUMP and
+// REPAIR.
+func parseDumpOptions(args []string) (dump.Range, error) {
+	var r dump.Range
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return r, errInvalidOption
+		}
+
+		switch name {
+		case "prefix":
+			r.Prefix = value
+		case "start":
+			r.Start = value
+		case "end":
+			r.End = value
+		default:
+			return r, errInvalidOption
+		}
+	}
+	return r, nil
+}
+
+// parseLoadOptions reads the batch= argument of LOAD.
+func parseLoadOptions(format string, args []string) (dump.LoadOptions, error) {
+	opts := dump.LoadOptions{Format: format}
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name != "batch" {
+			return opts, errInvalidOption
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return opts, errInvalidOption
+		}
+		opts.BatchSize = n
+	}
+	return opts, nil
+}
+
+// parseMerge turns the merge commands into the merge operand they write:
+// INCR key, DECR key, INCRBY key n, DECRBY key n, APPEND key value and
+// MAX key n.
+func parseMerge(cmd []string) (string, string, string, bool) {
+	switch {
+	case (cmd[0] == "INCR" || cmd[0] == "DECR") && len(cmd) == 2:
+		if cmd[0] == "DECR" {
+			return cmd[1], lsmtree.AddOperator, "-1", true
+		}
+		return cmd[1], lsmtree.AddOperator, "1", true
+	case cmd[0] == "DECRBY" && len(cmd) == 3:
+		n, err := strconv.ParseInt(cmd[2], 10, 64)
+		if err != nil || n == math.MinInt64 {
+			return "", "", "", false
+		}
+		return cmd[1], lsmtree.AddOperator, strconv.FormatInt(-n, 10), true
+	case cmd[0] == "INCRBY" && len(cmd) == 3:
+		return cmd[1], lsmtree.AddOperator, cmd[2], true
+	case cmd[0] == "APPEND" && len(cmd) == 3:
+		return cmd[1], lsmtree.AppendOperator, cmd[2], true
+	case cmd[0] == "MAX" && len(cmd) == 3:
+		return cmd[1], lsmtree.MaxOperator, cmd[2], true
+	}
+	return "", "", "", false
+}
+
+// parseFamilyOptions reads the name=value settings of CREATECF, named like
+// the keys of the config file.
+func parseFamilyOptions(args []string) (dbengine.FamilyOptions, error) {
+	var opts dbengine.FamilyOptions
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return opts, errInvalidOption
+		}
 
+		var err error
+		switch name {
+		case "maximum_element":
+			opts.MaximumElement, err = strconv.Atoi(value)
+		case "compaction_frequency":
+			opts.CompactionPeriod, err = strconv.Atoi(value)
+		case "bloom_capacity":
+			opts.BloomCapacity, err = strconv.Atoi(value)
+		case "bloom_error_rate":
+			opts.BloomErrorRate, err = strconv.ParseFloat(value, 64)
+		default:
+			err = errInvalidOption
+		}
+		if err != nil {
+			return opts, errInvalidOption
+		}
+	}
+	return opts, nil
 }
 
-func handleConnection(conn net.Conn, ltree *lsmtree.LSMTree, wal *wal.WAL) {
+var errInvalidOption = errors.New("invalid column family option")
+
+// handleConnection serves the commands of one client. PUT, GET and DEL act
+// on the column family picked with USE, the default one until then. A
+// REPLICATE command hands the connection over to a follower, and a WATCH
+// command to a client streaming the writes.
+func handleConnection(conn net.Conn, engine dbengine.Engine, members *membership.Members, heartbeat int) {
 	defer conn.Close()
 
 	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
 	writer := bufio.NewWriter(conn)
 
+	families, _ := engine.(dbengine.ColumnFamilies)
+	db := engine
+
+	// peer is set once the connection sent the secret of the group with
+	// RAFT AUTH, CLUSTER AUTH or DYNAMO AUTH, as the nodes of a group keep
+	// theirs open and only answer each other's requests on such
+	// connections.
+	peer := false
+
 	for scanner.Scan() {
 		text := scanner.Text()
 
 		cmd := strings.Split(text, " ")
 
-		if len(cmd) == 0 {
-			writer.WriteString("Invalid command\n")
-		}
-
 		switch cmd[0] {
+		case "CREATECF":
+			if len(cmd) < 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+			if families == nil {
+				writer.WriteString("Column families not supported\n")
+				writer.Flush()
+				continue
+			}
+
+			opts, err := parseFamilyOptions(cmd[2:])
+			if err == nil {
+				err = families.CreateFamily(cmd[1], opts)
+			}
+
+			if err != nil {
+				writer.WriteString(errorResponse(err, "Invalid command") + "\n")
+				writer.Flush()
+				continue
+			}
+
+			writer.WriteString("OK\n")
+			writer.Flush()
+		case "DROPCF":
+			if len(cmd) != 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+			if families == nil {
+				writer.WriteString("Column families not supported\n")
+				writer.Flush()
+				continue
+			}
+
+			err := families.DropFamily(cmd[1])
+
+			if err != nil {
+				writer.WriteString(errorResponse(err, "Error dropping column family") + "\n")
+				writer.Flush()
+				continue
+			}
+
+			writer.WriteString("OK\n")
+			writer.Flush()
+		case "USE":
+			if len(cmd) != 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+			if families == nil {
+				writer.WriteString("Column families not supported\n")
+				writer.Flush()
+				continue
+			}
+
+			family, err := families.Family(cmd[1])
+
+			if err != nil {
+				writer.WriteString(errorResponse(err, "Invalid command") + "\n")
+				writer.Flush()
+				continue
+			}
+
+			db = family
+			writer.WriteString("OK\n")
+			writer.Flush()
 		case "PUT":
 			if len(cmd) != 3 {
 				writer.WriteString("Invalid command\n")
@@ -134,28 +592,31 @@ func handleConnection(conn net.Conn, ltree *lsmtree.LSMTree, wal *wal.WAL) {
 				continue
 			}
 
-			err := wal.Write([]byte("+"), []byte(cmd[1]), []byte(cmd[2]))
+			err := db.Put(cmd[1], cmd[2])
 
 			if err != nil {
-				writer.WriteString("Error writing to WAL\n")
+				writer.WriteString(errorResponse(err, "Error writing to WAL") + "\n")
 				writer.Flush()
 				continue
 			}
 
-			ltree.Put(cmd[1], cmd[2])
 			writer.WriteString("OK\n")
 			writer.Flush()
 		case "GET":
+			if len(cmd) != 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
 
-			err := wal.Persist()
+			val, exist, err := db.Get(cmd[1])
 
 			if err != nil {
-				writer.WriteString("Error persisting WAL\n")
+				writer.WriteString(errorResponse(err, "Error persisting WAL") + "\n")
 				writer.Flush()
 				continue
 			}
 
-			val, exist := ltree.Get(cmd[1])
 			if !exist {
 				writer.WriteString("Data not found\n")
 				writer.Flush()
@@ -163,17 +624,429 @@ func handleConnection(conn net.Conn, ltree *lsmtree.LSMTree, wal *wal.WAL) {
 				writer.WriteString(val + "\n")
 				writer.Flush()
 			}
+		case "INCR", "DECR", "INCRBY", "DECRBY", "APPEND", "MAX":
+			key, operator, operand, ok := parseMerge(cmd)
+			if !ok {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			err := db.Merge(key, operator, operand)
+
+			if err != nil {
+				writer.WriteString(errorResponse(err, "Error writing to WAL") + "\n")
+				writer.Flush()
+				continue
+			}
+
+			writer.WriteString("OK\n")
+			writer.Flush()
+		case "INGEST":
+			if len(cmd) < 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			ingester, ok := db.(dbengine.Ingester)
+			if !ok {
+				writer.WriteString("Ingest not supported\n")
+				writer.Flush()
+				continue
+			}
+
+			err := ingester.Ingest(cmd[1:]...)
+
+			if err != nil {
+				writer.WriteString(errorResponse(err, "Error ingesting tables") + "\n")
+				writer.Flush()
+				continue
+			}
+
+			writer.WriteString("OK\n")
+			writer.Flush()
+		case "BACKUP":
+			if len(cmd) != 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			checkpointer, ok := engine.(dbengine.Checkpointer)
+			if !ok {
+				writer.WriteString("Backup not supported\n")
+				writer.Flush()
+				continue
+			}
+
+			err := checkpointer.Checkpoint(cmd[1])
+
+			if err != nil {
+				writer.WriteString(errorResponse(err, "Error creating backup") + "\n")
+				writer.Flush()
+				continue
+			}
+
+			writer.WriteString("OK\n")
+			writer.Flush()
+		case "DUMP":
+			if len(cmd) < 2 || dump.CheckFormat(cmd[1]) != nil {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			r, err := parseDumpOptions(cmd[2:])
+			if err != nil {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			writer.WriteString("OK\n")
+			_, err = dump.Dump(db, writer, cmd[1], r)
+
+			if err != nil {
+				writer.WriteString("END " + errorResponse(err, "Error dumping data") + "\n")
+				writer.Flush()
+				continue
+			}
+
+			writer.WriteString("END\n")
+			writer.Flush()
+		case "LOAD":
+			if len(cmd) < 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			opts, err := parseLoadOptions(cmd[1], cmd[2:])
+			var loader *dump.Loader
+			if err == nil {
+				loader, err = dump.NewLoader(db, opts)
+			}
+			if err != nil {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			// the lines of the dump follow, up to END
+			writer.WriteString("OK\n")
+			writer.Flush()
+
+			for scanner.Scan() && scanner.Text() != "END" {
+				if err == nil {
+					err = loader.Add(scanner.Text())
+				}
+			}
+
+			var stats dump.Stats
+			if err == nil {
+				stats, err = loader.Finish()
+			}
+
+			if err != nil {
+				writer.WriteString(errorResponse(err, "Error loading data") + "\n")
+				writer.Flush()
+				continue
+			}
+
+			writer.WriteString(fmt.Sprintf("OK loaded=%d rejected=%d\n", stats.Loaded, stats.Rejected))
+			writer.Flush()
+		case "REPLICATE":
+			if len(cmd) != 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			from, err := strconv.ParseUint(cmd[1], 10, 64)
+			if err != nil {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			source, ok := engine.(dbengine.Replicator)
+			if !ok {
+				writer.WriteString("Replication not supported\n")
+				writer.Flush()
+				continue
+			}
+
+			// the connection belongs to the follower from now on
+			err = replication.Ship(writer, scanner, source, from, heartbeat)
+			if err != nil {
+				fmt.Printf("Replication to %s stopped: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		case "WATCH":
+			// a bare FROM SEQ watches every key
+			if len(cmd) == 3 && cmd[1] == "FROM" {
+				cmd = []string{cmd[0], "", cmd[1], cmd[2]}
+			}
+			if len(cmd) > 4 || len(cmd) == 3 || len(cmd) == 4 && cmd[2] != "FROM" {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			source, ok := engine.(dbengine.Watcher)
+			if !ok {
+				writer.WriteString("Watch not supported\n")
+				writer.Flush()
+				continue
+			}
+
+			var prefix string
+			if len(cmd) > 1 {
+				prefix = cmd[1]
+			}
+			from := source.LastLSN()
+			if len(cmd) == 4 {
+				var err error
+				from, err = strconv.ParseUint(cmd[3], 10, 64)
+				if err != nil {
+					writer.WriteString("Invalid command\n")
+					writer.Flush()
+					continue
+				}
+			}
+
+			// the connection streams the writes from now on
+			err := cdc.Watch(writer, scanner, source, prefix, from)
+			if err != nil {
+				writer.WriteString(errorResponse(err, "Error watching writes") + "\n")
+				writer.Flush()
+				fmt.Printf("Watch of %s stopped: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		case "REPLICATION":
+			if len(cmd) != 1 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			switch replicated := engine.(type) {
+			case *replication.Follower:
+				writer.WriteString(replicated.Status().String() + "\n")
+			case dbengine.Replicator:
+				writer.WriteString(replication.LeaderStatus(replicated) + "\n")
+			default:
+				writer.WriteString("Replication not supported\n")
+			}
+			writer.Flush()
+		case "RAFT":
+			node, ok := engine.(*raft.Node)
+			if !ok {
+				writer.WriteString("Raft not supported\n")
+				writer.Flush()
+				continue
+			}
+			if len(cmd) < 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			var err error
+			switch {
+			case cmd[1] == "STATUS" && len(cmd) == 2:
+				writer.WriteString(node.Status().String() + "\n")
+				writer.Flush()
+				continue
+			case cmd[1] == "ADD" && len(cmd) == 4:
+				err = node.AddMember(cmd[2], cmd[3])
+			case cmd[1] == "REMOVE" && len(cmd) == 3:
+				err = node.RemoveMember(cmd[2])
+			case cmd[1] == "AUTH" && len(cmd) >= 3:
+				peer = node.Authenticate(strings.Join(cmd[2:], " "))
+				if !peer {
+					writer.WriteString("Not a peer\n")
+					writer.Flush()
+					continue
+				}
+			case !peer:
+				writer.WriteString("Not a peer\n")
+				writer.Flush()
+				continue
+			default:
+				// requests of the other nodes carry JSON, which may hold spaces
+				writer.WriteString(node.HandleRPC(cmd[1], strings.Join(cmd[2:], " ")) + "\n")
+				writer.Flush()
+				continue
+			}
+
+			if err != nil {
+				writer.WriteString(errorResponse(err, "Error changing membership") + "\n")
+				writer.Flush()
+				continue
+			}
+
+			writer.WriteString("OK\n")
+			writer.Flush()
+		case "CLUSTER":
+			if len(cmd) == 2 && cmd[1] == "MEMBERS" {
+				if members == nil {
+					writer.WriteString("Membership not supported\n")
+				} else {
+					writer.WriteString(formatMembers(members.List()) + "\n")
+				}
+				writer.Flush()
+				continue
+			}
+
+			node, ok := engine.(*cluster.Node)
+			if !ok {
+				writer.WriteString("Cluster not supported\n")
+				writer.Flush()
+				continue
+			}
+			if len(cmd) < 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			switch {
+			case cmd[1] == "INFO" && len(cmd) == 2:
+				writer.WriteString(node.Info().String() + "\n")
+			case cmd[1] == "SLOTS" && len(cmd) == 2:
+				writer.WriteString(formatSlots(node.State()) + "\n")
+			case cmd[1] == "KEYSLOT" && len(cmd) == 3:
+				writer.WriteString(strconv.Itoa(cluster.SlotOf(cmd[2])) + "\n")
+			case cmd[1] == "AUTH" && len(cmd) >= 3:
+				peer = node.Authenticate(strings.Join(cmd[2:], " "))
+				if !peer {
+					writer.WriteString("Not a peer\n")
+					break
+				}
+				writer.WriteString("OK\n")
+			case !peer:
+				writer.WriteString("Not a peer\n")
+			case cmd[1] == "MEET" && len(cmd) == 4:
+				err := node.Meet(cmd[2], cmd[3])
+				if err != nil {
+					writer.WriteString(errorResponse(err, "Error saving the cluster table") + "\n")
+					break
+				}
+				writer.WriteString("OK\n")
+			case cmd[1] == "MIGRATE" && len(cmd) == 4:
+				first, last, ok := parseSlotRange(cmd[2])
+				if !ok {
+					writer.WriteString("Invalid command\n")
+					break
+				}
+
+				keys, err := node.Migrate(first, last, cmd[3])
+				if err != nil {
+					writer.WriteString(errorResponse(err, "Error migrating slots") + "\n")
+					break
+				}
+				writer.WriteString(fmt.Sprintf("OK keys=%d\n", keys))
+			default:
+				// requests of the other nodes carry JSON, which may hold spaces
+				writer.WriteString(node.HandleRPC(cmd[1], strings.Join(cmd[2:], " ")) + "\n")
+			}
+			writer.Flush()
+		case "DYNAMO":
+			node, ok := engine.(*dynamo.Node)
+			if !ok {
+				writer.WriteString("Dynamo not supported\n")
+				writer.Flush()
+				continue
+			}
+			if len(cmd) < 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			switch {
+			case cmd[1] == "STATUS" && len(cmd) == 2:
+				writer.WriteString(node.Status().String() + "\n")
+			case cmd[1] == "REPLICAS" && len(cmd) == 3:
+				writer.WriteString(strings.Join(node.Replicas(cmd[2]), " ") + "\n")
+			case cmd[1] == "AUTH" && len(cmd) >= 3:
+				peer = node.Authenticate(strings.Join(cmd[2:], " "))
+				if !peer {
+					writer.WriteString("Not a peer\n")
+					break
+				}
+				writer.WriteString("OK\n")
+			case !peer:
+				writer.WriteString("Not a peer\n")
+			default:
+				// requests of the coordinators carry JSON, which may hold spaces
+				writer.WriteString(node.HandleRPC(cmd[1], strings.Join(cmd[2:], " ")) + "\n")
+			}
+			writer.Flush()
+		case "REPAIR":
+			node, ok := engine.(*dynamo.Node)
+			if !ok {
+				writer.WriteString("Repair not supported\n")
+				writer.Flush()
+				continue
+			}
+			if len(cmd) < 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			r, err := parseDumpOptions(cmd[2:])
+			if err != nil {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
+
+			stats, err := node.Repair(cmd[1], r)
+			if err != nil {
+				writer.WriteString(errorResponse(err, "Error repairing keys") + "\n")
+				writer.Flush()
+				continue
+			}
+			writer.WriteString("OK " + stats.String() + "\n")
+			writer.Flush()
+		case "MULTILEADER":
+			node, ok := engine.(*multileader.Node)
+			if !ok {
+				writer.WriteString("Multi-leader not supported\n")
+				writer.Flush()
+				continue
+			}
+
+			switch {
+			case len(cmd) == 2 && cmd[1] == "STATUS":
+				writer.WriteString(node.Status().String() + "\n")
+			case len(cmd) == 2 && cmd[1] == "CONFLICTS":
+				writer.WriteString(formatConflicts(node.AllConflicts()) + "\n")
+			case len(cmd) == 3 && cmd[1] == "CONFLICTS":
+				writer.WriteString(strconv.FormatUint(node.Conflicts(cmd[2]), 10) + "\n")
+			default:
+				writer.WriteString("Invalid command\n")
+			}
+			writer.Flush()
 		case "DEL":
+			if len(cmd) != 2 {
+				writer.WriteString("Invalid command\n")
+				writer.Flush()
+				continue
+			}
 
-			err := wal.Write([]byte("-"), []byte(cmd[1]))
+			err := db.Delete(cmd[1])
 
 			if err != nil {
-				writer.WriteString("Error writing to WAL\n")
+				writer.WriteString(errorResponse(err, "Error writing to WAL") + "\n")
 				writer.Flush()
 				continue
 			}
 
-			ltree.Del(cmd[1])
 			writer.WriteString("OK\n")
 			writer.Flush()
 		default:
@@ -185,7 +1058,7 @@ func handleConnection(conn net.Conn, ltree *lsmtree.LSMTree, wal *wal.WAL) {
 
 }
 
-func handleUDPPacket(udpConn net.PacketConn, packet []byte, addr net.Addr, ltree *lsmtree.LSMTree, wal *wal.WAL) {
+func handleUDPPacket(udpConn net.PacketConn, packet []byte, addr net.Addr, db dbengine.Engine) {
 
 	response := ""
 
@@ -193,35 +1066,29 @@ func handleUDPPacket(udpConn net.PacketConn, packet []byte, addr net.Addr, ltree
 
 	cmd := strings.Split(request, " ")
 
-	if len(cmd) == 0 {
-		response = "Invalid command"
-	} else {
-		switch cmd[0] {
-		case "GET":
-			if len(cmd) != 2 {
-				response = "Invalid command"
-				break
-			}
-
-			err := wal.Persist()
+	switch cmd[0] {
+	case "GET":
+		if len(cmd) != 2 {
+			response = "Invalid command"
+			break
+		}
 
-			if err != nil {
-				response = "Error persisting WAL"
-				break
-			}
+		cmd[1] = strings.Trim(cmd[1], "\n")
 
-			cmd[1] = strings.Trim(cmd[1], "\n")
+		val, exist, err := db.Get(cmd[1])
 
-			val, exist := ltree.Get(cmd[1])
+		if err != nil {
+			response = errorResponse(err, "Error persisting WAL")
+			break
+		}
 
-			if !exist {
-				response = "Data not found"
-			} else {
-				response = val
-			}
-		default:
-			response = "Invalid command"
+		if !exist {
+			response = "Data not found"
+		} else {
+			response = val
 		}
+	default:
+		response = "Invalid command"
 	}
 
 	responseBytes := []byte(response)
@@ -0,0 +1,185 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/kryptondb"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+func TestCheckpointOpensStandalone(t *testing.T) {
+	fs := vfs.NewMem()
+	db := openFamilies(t, fs)
+
+	err := db.CreateFamily("users", dbengine.FamilyOptions{MaximumElement: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first half ends up in the store, the second half stays in the WAL,
+	// enough of both for the memtables to be flushed to SSTables
+	for i := 0; i < 3000; i++ {
+		if i == 1500 {
+			err = db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			db = openFamilies(t, fs)
+		}
+
+		users, err := db.Family("users")
+		if err == nil {
+			err = db.Put(fmt.Sprintf("key%04d", i), fmt.Sprint(i))
+		}
+		if err == nil {
+			err = db.Merge("counter", lsmtree.AddOperator, "1")
+		}
+		if err == nil && i%100 == 0 {
+			err = users.Put(fmt.Sprintf("user%d", i), "name")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// writes keep going while the checkpoint is taken, in order, so the copy
+	// must hold a prefix of them
+	stop := make(chan struct{})
+	written := make(chan int)
+	go func() {
+		i := 0
+		for {
+			select {
+			case <-stop:
+				written <- i
+				return
+			default:
+			}
+			if db.Put(fmt.Sprintf("live%06d", i), "x") != nil {
+				break
+			}
+			i++
+		}
+		written <- i
+	}()
+
+	err = db.Checkpoint("backup")
+	close(stop)
+	live := <-written
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Checkpoint("backup"); err != dbengine.ErrCheckpointExists {
+		t.Fatalf("Checkpoint to a used directory = %v, want ErrCheckpointExists", err)
+	}
+
+	// the source keeps working and its later writes stay out of the copy
+	err = db.Put("after", "1")
+	if err == nil {
+		err = db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Crash()
+
+	names, _ := fs.ReadDir("backup/sstables")
+	if len(names) == 0 || !strings.HasSuffix(names[0], ".sst") {
+		t.Fatalf("backup/sstables holds %v, want the linked tables first", names)
+	}
+
+	backup, err := dbengine.Open(dbengine.Options{
+		LSMTree: lsmtree.LSMTreeOptions{
+			MaximumElement:   lsmtree.MaximumElement,
+			CompactionPeriod: lsmtree.CompactionFrequency,
+			BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+				Capacity:  1000,
+				ErrorRate: lsmtree.BloomErrorRate,
+			},
+			Directory: "backup/sstables",
+		},
+		Store: diskstore.DiskStoreOpts{
+			Directory:       "backup/data",
+			NumOfPartitions: 2,
+		},
+		WalPath: "backup/wal.aof",
+		FS:      fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{"key0000": "0", "key2999": "2999", "counter": "3000"} {
+		val, exist, err := backup.Get(key)
+		if err != nil || !exist || val != want {
+			t.Fatalf("Get(%s) = %q, %v, %v, want %q", key, val, exist, err, want)
+		}
+	}
+	if _, exist, _ := backup.Get("after"); exist {
+		t.Fatal("a write made after the checkpoint is in it")
+	}
+
+	copied := 0
+	for ; copied < live; copied++ {
+		if _, exist, _ := backup.Get(fmt.Sprintf("live%06d", copied)); !exist {
+			break
+		}
+	}
+	for i := copied; i < live; i++ {
+		if _, exist, _ := backup.Get(fmt.Sprintf("live%06d", i)); exist {
+			t.Fatalf("the checkpoint holds live%06d but not live%06d", i, copied)
+		}
+	}
+
+	backupUsers, err := backup.Family("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := backupUsers.Get("user2900"); val != "name" {
+		t.Fatalf("users Get(user2900) = %q, want name", val)
+	}
+	err = backup.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the layout is the one the embedded package opens
+	embedded, err := kryptondb.Open("backup", &kryptondb.Options{NumOfPartitions: 2, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer embedded.Close()
+	if val, err := embedded.Get("key1234"); err != nil || val != "1234" {
+		t.Fatalf("kryptondb Get(key1234) = %q, %v", val, err)
+	}
+}
+
+func TestServerBackupCommand(t *testing.T) {
+	srv := startServer(t)
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for _, step := range []struct{ command, reply string }{
+		{"PUT key value", "OK"},
+		{"BACKUP backup", "OK"},
+		{"BACKUP backup", "Backup directory is not empty"},
+		{"BACKUP", "Invalid command"},
+	} {
+		if reply := roundTrip(t, conn, reader, step.command); reply != step.reply {
+			t.Fatalf("%s replied %q, want %q", step.command, reply, step.reply)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jiteshchawla1511/KryptonDB/cluster"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/server"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// clusterSecret is the secret the nodes of the test clusters share.
+const clusterSecret = "cluster secret"
+
+// clusterMember is one node of a test cluster and the server it answers on.
+type clusterMember struct {
+	id     string
+	fs     vfs.FS
+	engine dbengine.Engine
+	srv    *server.Server
+	node   *cluster.Node
+	stop   func()
+}
+
+func (m *clusterMember) addr() string {
+	return m.srv.Addr().String()
+}
+
+func (m *clusterMember) start(t *testing.T, nodes map[string]string, join bool) {
+	node, err := cluster.Start(m.engine, cluster.Config{
+		ID:             m.id,
+		Nodes:          nodes,
+		Join:           join,
+		Secret:         clusterSecret,
+		Dir:            "cluster",
+		FS:             m.fs,
+		GossipInterval: 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.node = node
+	m.srv.Engine = node
+
+	stopServer := serveListening(t, m.srv)
+	m.stop = func() {
+		stopServer()
+		m.node.Close()
+	}
+}
+
+// taggedSlot returns a tag whose keys hash to a slot owned by m.
+func taggedSlot(t *testing.T, m *clusterMember) (string, int) {
+	for i := 0; i < 1000; i++ {
+		tag := fmt.Sprintf("{t%d}", i)
+		if slot, addr := m.node.Slot(tag); addr == m.addr() {
+			return tag, slot
+		}
+	}
+	t.Fatalf("no slot of %s found", m.id)
+	return "", 0
+}
+
+// waitForOwner waits until m sends the keys of key's slot to addr.
+func waitForOwner(t *testing.T, m *clusterMember, key string, addr string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, owner := m.node.Slot(key)
+		if owner == addr {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %s is served by %q, want %s", m.id, key, owner, addr)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestClusterRedirectsAndMigratesSlots(t *testing.T) {
+	nodes := make(map[string]string)
+	var members []*clusterMember
+	for _, id := range []string{"a", "b", "c"} {
+		m := &clusterMember{id: id, fs: vfs.NewMem(), engine: dbengine.NewMemory(), srv: listenOn(t, "0")}
+		nodes[id] = m.addr()
+		members = append(members, m)
+	}
+	for _, m := range members {
+		m.start(t, nodes, false)
+	}
+	a, b, c := members[0], members[1], members[2]
+	defer func() {
+		for _, m := range members {
+			m.stop()
+		}
+	}()
+
+	if info := a.node.Info(); info.Slots != cluster.Slots/3 || info.Nodes != 3 {
+		t.Fatalf("a: %s", info)
+	}
+
+	tag, slot := taggedSlot(t, a)
+	for i := 0; i < 50; i++ {
+		if err := a.node.Put(fmt.Sprintf("%sk%02d", tag, i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var moved *cluster.MovedError
+	if err := b.node.Put(tag+"k00", "w"); !errors.As(err, &moved) || moved.Slot != slot || moved.Addr != a.addr() {
+		t.Fatalf("Put on b returned %v", err)
+	}
+
+	conn, err := net.Dial("tcp", b.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	for _, step := range []struct{ command, reply string }{
+		{"GET " + tag + "k00", fmt.Sprintf("MOVED %d %s", slot, a.addr())},
+		{"CLUSTER KEYSLOT " + tag + "other", fmt.Sprint(slot)},
+		{"CLUSTER AUTH " + clusterSecret, "OK"},
+		{fmt.Sprintf("CLUSTER MIGRATE %d c", slot), "Slot not owned"},
+	} {
+		if reply := roundTrip(t, conn, reader, step.command); reply != step.reply {
+			t.Fatalf("%s replied %q, want %q", step.command, reply, step.reply)
+		}
+	}
+	if reply := roundTrip(t, conn, reader, "CLUSTER SLOTS"); !strings.HasPrefix(reply, "0-5460=a@"+a.addr()+" ") {
+		t.Fatalf("CLUSTER SLOTS replied %q", reply)
+	}
+	conn.Close()
+
+	// writes keep going to whichever node owns the slot while it moves
+	stop := make(chan struct{})
+	var writes sync.WaitGroup
+	writes.Add(1)
+	var written int
+	go func() {
+		defer writes.Done()
+		owner := a.node
+		var moved *cluster.MovedError
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				written = i
+				return
+			default:
+			}
+
+			err := owner.Put(fmt.Sprintf("%sk%02d", tag, i%50), fmt.Sprint(i))
+			if errors.As(err, &moved) {
+				owner = c.node
+				err = owner.Put(fmt.Sprintf("%sk%02d", tag, i%50), fmt.Sprint(i))
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	conn, err = net.Dial("tcp", a.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = bufio.NewReader(conn)
+	if reply := roundTrip(t, conn, reader, "CLUSTER AUTH "+clusterSecret); reply != "OK" {
+		t.Fatalf("CLUSTER AUTH replied %q", reply)
+	}
+	if reply := roundTrip(t, conn, reader, fmt.Sprintf("CLUSTER MIGRATE %d c", slot)); !strings.HasPrefix(reply, "OK keys=") {
+		t.Fatalf("CLUSTER MIGRATE replied %q", reply)
+	}
+	conn.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	writes.Wait()
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("%sk%02d", tag, i)
+		want := "v"
+		if written > i {
+			// the last write of the key
+			want = fmt.Sprint(written - 1 - (written-1-i)%50)
+		}
+		if val, ok, err := c.node.Get(key); err != nil || !ok || val != want {
+			t.Fatalf("c: Get(%s) = %q, %v, %v, want %q", key, val, ok, err, want)
+		}
+		if _, ok, err := a.engine.Get(key); err != nil || ok {
+			t.Fatalf("a: Get(%s) = %v, %v after the migration", key, ok, err)
+		}
+	}
+	if _, _, err := a.node.Get(tag + "k00"); !errors.As(err, &moved) || moved.Addr != c.addr() {
+		t.Fatalf("Get on a returned %v", err)
+	}
+	waitForOwner(t, b, tag, c.addr())
+
+	// a new node learns the table from a and the others learn about it
+	d := &clusterMember{id: "d", fs: vfs.NewMem(), engine: dbengine.NewMemory(), srv: listenOn(t, "0")}
+	conn, err = net.Dial("tcp", a.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = bufio.NewReader(conn)
+	for _, step := range []struct{ command, reply string }{
+		{"CLUSTER AUTH " + clusterSecret, "OK"},
+		{"CLUSTER MEET d " + d.addr(), "OK"},
+		{"CLUSTER MEET d " + d.addr(), "OK"},
+		{"CLUSTER MEET d 127.0.0.1:1", "Node already exists"},
+	} {
+		if reply := roundTrip(t, conn, reader, step.command); reply != step.reply {
+			t.Fatalf("%s replied %q, want %q", step.command, reply, step.reply)
+		}
+	}
+	conn.Close()
+	d.start(t, map[string]string{"d": d.addr(), "a": a.addr()}, true)
+	members = append(members, d)
+	waitForOwner(t, d, tag, c.addr())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.node.Info().Nodes != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("c: %s", c.node.Info())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := c.node.Migrate(slot, slot, "d"); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, err := d.node.Get(tag + "k00"); err != nil || !ok || val == "" {
+		t.Fatalf("d: Get = %q, %v, %v", val, ok, err)
+	}
+
+	// the table survives a restart
+	_, port, _ := net.SplitHostPort(c.addr())
+	c.stop()
+	c.srv = listenOn(t, port)
+	c.engine = dbengine.NewMemory()
+	c.start(t, nodes, false)
+	if _, owner := c.node.Slot(tag); owner != d.addr() {
+		t.Fatalf("c sends %s to %q after a restart, want %s", tag, owner, d.addr())
+	}
+
+	// only connections that sent the secret may send the requests of the
+	// nodes or move slots
+	conn, err = net.Dial("tcp", a.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader = bufio.NewReader(conn)
+	for _, command := range []string{
+		`CLUSTER GOSSIP {"nodes":{"x":"127.0.0.2:1"}}`,
+		"CLUSTER WIPE [0,16383]",
+		"CLUSTER IMPORT []",
+		fmt.Sprintf("CLUSTER MIGRATE %d a", slot),
+		"CLUSTER MEET x 127.0.0.2:1",
+		"CLUSTER AUTH wrong",
+	} {
+		if reply := roundTrip(t, conn, reader, command); reply != "Not a peer" {
+			t.Fatalf("%s without the secret replied %q", command, reply)
+		}
+	}
+	if reply := roundTrip(t, conn, reader, "CLUSTER INFO"); !strings.HasPrefix(reply, "id=a ") || !strings.Contains(reply, "nodes=4") {
+		t.Fatalf("CLUSTER INFO without the secret replied %q", reply)
+	}
+	for _, step := range []struct{ command, reply string }{
+		{"CLUSTER AUTH " + clusterSecret, "OK"},
+		{"CLUSTER IMPORT []", "OK"},
+		{`CLUSTER IMPORT [{"Key":"k","Value":"v"}]`, "Error " + cluster.ErrNotImported.Error()},
+		{fmt.Sprintf("CLUSTER WIPE [%d,%d]", slot, slot), "OK"},
+		{`CLUSTER IMPORT [{"Key":"` + tag + `x","Value":"v","Family":"f"}]`, "Error " + cluster.ErrNotImported.Error()},
+		{`CLUSTER IMPORT [{"Key":"` + tag + `x","Value":"v"}]`, "OK"},
+	} {
+		if reply := roundTrip(t, conn, reader, step.command); reply != step.reply {
+			t.Fatalf("%s replied %q, want %q", step.command, reply, step.reply)
+		}
+	}
+}
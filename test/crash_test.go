@@ -0,0 +1,269 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+func writeTable(t *testing.T, fs vfs.FS, m *lsmtree.Manifest, level int, keys ...string) lsmtree.TableMeta {
+	var pairs []lsmtree.KV
+	for _, k := range keys {
+		pairs = append(pairs, lsmtree.KV{Key: k, Value: "v" + k})
+	}
+
+	table := lsmtree.NewDiskFile(pairs)
+	meta := lsmtree.TableMeta{
+		Number:   m.NewFileNumber(),
+		Level:    level,
+		Smallest: keys[0],
+		Largest:  keys[len(keys)-1],
+		Elements: len(keys),
+	}
+
+	err := table.WriteTable(fs, m.TablePath(meta.Number))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+func liveTables(t *testing.T, fs vfs.FS) []uint64 {
+	m, err := lsmtree.OpenManifest(fs, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	var numbers []uint64
+	for _, meta := range m.Tables() {
+		_, err := lsmtree.LoadTable(fs, m.TablePath(meta.Number))
+		if err != nil {
+			t.Fatalf("table %d: %v", meta.Number, err)
+		}
+		numbers = append(numbers, meta.Number)
+	}
+	return numbers
+}
+
+func TestCompactionCrashKeepsOldTableSet(t *testing.T) {
+	fs := vfs.NewFault()
+
+	m, err := lsmtree.OpenManifest(fs, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := writeTable(t, fs, m, 0, "a", "b")
+	b := writeTable(t, fs, m, 0, "c", "d")
+	err = m.LogEdit(lsmtree.VersionEdit{Added: []lsmtree.TableMeta{a}})
+	if err == nil {
+		err = m.LogEdit(lsmtree.VersionEdit{Added: []lsmtree.TableMeta{b}})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := writeTable(t, fs, m, 1, "a", "b", "c", "d")
+
+	fs.FailWrite(1)
+	err = m.LogEdit(lsmtree.VersionEdit{Added: []lsmtree.TableMeta{out}, Deleted: []uint64{a.Number, b.Number}})
+	if err == nil {
+		t.Fatal("expected the torn manifest write to fail")
+	}
+	fs.Crash()
+
+	live := liveTables(t, fs)
+	if fmt.Sprint(live) != fmt.Sprint([]uint64{a.Number, b.Number}) {
+		t.Fatalf("live tables after crash = %v, want %v", live, []uint64{a.Number, b.Number})
+	}
+
+	_, err = fs.Stat(m.TablePath(out.Number))
+	if err == nil {
+		t.Fatal("orphaned compaction output was not removed")
+	}
+}
+
+func TestCompactionCrashAfterEditKeepsNewTableSet(t *testing.T) {
+	fs := vfs.NewFault()
+
+	m, err := lsmtree.OpenManifest(fs, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := writeTable(t, fs, m, 0, "a", "b")
+	b := writeTable(t, fs, m, 0, "c", "d")
+	out := writeTable(t, fs, m, 1, "a", "b", "c", "d")
+
+	err = m.LogEdit(lsmtree.VersionEdit{Added: []lsmtree.TableMeta{a, b}})
+	if err == nil {
+		err = m.LogEdit(lsmtree.VersionEdit{Added: []lsmtree.TableMeta{out}, Deleted: []uint64{a.Number, b.Number}})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crash before the inputs are removed
+	fs.Crash()
+
+	live := liveTables(t, fs)
+	if fmt.Sprint(live) != fmt.Sprint([]uint64{out.Number}) {
+		t.Fatalf("live tables after crash = %v, want %v", live, []uint64{out.Number})
+	}
+
+	for _, number := range []uint64{a.Number, b.Number} {
+		_, err = fs.Stat(m.TablePath(number))
+		if err == nil {
+			t.Fatalf("compaction input %d was not removed", number)
+		}
+	}
+}
+
+func TestWALDropsUnsyncedWrites(t *testing.T) {
+	fs := vfs.NewFault()
+	fs.MkdirAll("db", 0755)
+
+	w := wal.InitWal(fs, "db/wal.aof")
+	w.Write([]byte("+"), []byte("a"), []byte("1"))
+	err := w.Persist()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write([]byte("+"), []byte("b"), []byte("2"))
+
+	fs.FailWrite(1)
+	err = w.Persist()
+	if err == nil {
+		t.Fatal("expected the injected write fault")
+	}
+	fs.Crash()
+
+	entries := wal.InitWal(fs, "db/wal.aof").ReadEntries()
+	if len(entries) != 1 || entries[0].Key != "a" || entries[0].Value != "1" {
+		t.Fatalf("entries after crash = %+v, want only a=1", entries)
+	}
+}
+
+func TestWALDropsTornBatch(t *testing.T) {
+	fs := vfs.NewFault()
+	fs.MkdirAll("db", 0755)
+
+	w := wal.InitWal(fs, "db/wal.aof")
+	w.WriteBatch([]wal.Entry{{Key: "a", Value: "1"}, {Key: "b", Delete: true}})
+	err := w.Persist()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.WriteBatch([]wal.Entry{{Key: "c", Value: "3"}, {Key: "d", Value: "4"}})
+
+	fs.FailWrite(1)
+	err = w.Persist()
+	if err == nil {
+		t.Fatal("expected the injected write fault")
+	}
+	fs.Crash()
+
+	entries := wal.InitWal(fs, "db/wal.aof").ReadEntries()
+	if fmt.Sprint(entries) != "[{a 1 false 1   {0  0}} {b  true 1   {0  0}}]" {
+		t.Fatalf("entries after crash = %+v, want only the first batch", entries)
+	}
+}
+
+func TestPartitionTornAppendKeepsOldContents(t *testing.T) {
+	fs := vfs.NewFault()
+	opts := diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: 1, FS: fs}
+
+	disk, err := diskstore.NewDisk(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		err = disk.WriteValue(key, []byte("old"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = disk.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.FailWrite(1)
+	err = disk.WriteValue("b", []byte("new"), 0)
+	if err == nil {
+		t.Fatal("expected the injected write fault")
+	}
+	fs.Crash()
+
+	disk, err = diskstore.NewDisk(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := disk.GetFileContents(0)
+	if fmt.Sprint(entries) != "[{a old false 0   {0  0}} {b old false 0   {0  0}} {c old false 0   {0  0}}]" {
+		t.Fatalf("partition after crash = %+v, want the three old records", entries)
+	}
+}
+
+func TestPartitionMergeSurvivesReopen(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: 1, MaxSegmentSize: 64, FS: fs}
+
+	disk, err := diskstore.NewDisk(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10; i++ {
+			err = disk.WriteValue(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("v%d", round)), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 5; i++ {
+		err = disk.DeleteFromDisk(fmt.Sprintf("key%d", i), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = disk.Merge()
+	if err == nil {
+		err = disk.Sync()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Crash()
+
+	disk, err = diskstore.NewDisk(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := disk.GetFileContents(0)
+	if len(entries) != 5 {
+		t.Fatalf("partition after merge = %+v, want key5 to key9", entries)
+	}
+	for i, entry := range entries {
+		if entry.Key != fmt.Sprintf("key%d", i+5) || entry.Value != "v2" {
+			t.Fatalf("partition after merge = %+v, want key5 to key9 at v2", entries)
+		}
+	}
+
+	names, _ := fs.ReadDir("data/partitions/0")
+	if len(names) > 4 {
+		t.Fatalf("merge left %d files behind: %v", len(names), names)
+	}
+}
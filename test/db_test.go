@@ -13,7 +13,8 @@ var key = make([]string, Threshold)
 var value = make([]string, Threshold)
 
 func BenchmarkPutTest(t *testing.B) {
-	conn, err := net.Dial("tcp", "localhost:8080")
+	srv := startServer(t)
+	conn, err := net.Dial("tcp", srv.Addr().String())
 
 	if err != nil {
 		t.Error(err)
@@ -36,7 +37,8 @@ func BenchmarkPutTest(t *testing.B) {
 }
 
 func BenchmarkGetTest(t *testing.B) {
-	conn, err := net.Dial("tcp", "localhost:8080")
+	srv := startServer(t)
+	conn, err := net.Dial("tcp", srv.Addr().String())
 
 	if err != nil {
 		t.Error(err)
@@ -66,7 +68,8 @@ func BenchmarkGetTest(t *testing.B) {
 }
 
 func BenchmarkGetUDPTest(t *testing.B) {
-	conn, err := net.Dial("udp", "localhost:1053")
+	srv := startServer(t)
+	conn, err := net.Dial("udp", srv.UDPAddr().String())
 
 	errorRate := 0
 
@@ -0,0 +1,126 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/dump"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+func TestDumpAndLoadRoundTrip(t *testing.T) {
+	for _, format := range []string{dump.JSONL, dump.CSV} {
+		t.Run(format, func(t *testing.T) {
+			src := openFamilies(t, vfs.NewMem())
+			defer src.Close()
+
+			err := src.Batch([]dbengine.Op{
+				{Key: "user:1", Value: "ada, \"the first\""},
+				{Key: "user:2", Value: "grace"},
+				{Key: "blob", Value: "\x00\xff\x01"},
+				{Key: "zeta", Value: "last"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			count, err := dump.Dump(src, &out, format, dump.Range{})
+			if err != nil || count != 4 {
+				t.Fatalf("Dump = %d, %v, want 4 pairs", count, err)
+			}
+			if strings.Contains(out.String(), "\x00") {
+				t.Fatal("a binary value was dumped as is")
+			}
+
+			var prefixed bytes.Buffer
+			count, err = dump.Dump(src, &prefixed, format, dump.Range{Prefix: "user:", End: "user:2"})
+			if err != nil || count != 1 {
+				t.Fatalf("Dump of a prefix and range = %d, %v, want 1 pair", count, err)
+			}
+
+			// a line that is not a pair and one the engine refuses
+			out.WriteString("not a pair\n")
+			bad, _ := dump.Encode(format, "bad|key", "x")
+			out.WriteString(bad + "\n")
+
+			dst := openFamilies(t, vfs.NewMem())
+			defer dst.Close()
+
+			var progress []dump.Stats
+			stats, err := dump.Load(dst, &out, dump.LoadOptions{
+				Format:    format,
+				BatchSize: 3,
+				Progress:  func(stats dump.Stats) { progress = append(progress, stats) },
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats != (dump.Stats{Loaded: 4, Rejected: 2}) || len(progress) != 2 {
+				t.Fatalf("Load = %+v with progress %+v", stats, progress)
+			}
+
+			for key, want := range map[string]string{"user:1": "ada, \"the first\"", "blob": "\x00\xff\x01", "zeta": "last"} {
+				val, exist, err := dst.Get(key)
+				if err != nil || !exist || val != want {
+					t.Fatalf("Get(%s) = %q, %v, %v, want %q", key, val, exist, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestServerDumpAndLoadCommands(t *testing.T) {
+	srv := startServer(t)
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	if reply := roundTrip(t, conn, reader, "LOAD jsonl batch=2"); reply != "OK" {
+		t.Fatalf("LOAD replied %q", reply)
+	}
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(conn, "{\"key\":\"k%d\",\"value\":\"v%d\"}\n", i, i)
+	}
+	if reply := roundTrip(t, conn, reader, "garbage\nEND"); reply != "OK loaded=5 rejected=1" {
+		t.Fatalf("LOAD finished with %q", reply)
+	}
+
+	if reply := roundTrip(t, conn, reader, "DUMP csv prefix=k start=k3"); reply != "OK" {
+		t.Fatalf("DUMP replied %q", reply)
+	}
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "END" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	if strings.Join(lines, ";") != "key,value,encoding;k3,v3,;k4,v4," {
+		t.Fatalf("DUMP streamed %q", lines)
+	}
+
+	for _, step := range []struct{ command, reply string }{
+		{"DUMP xml", "Invalid command"},
+		{"DUMP jsonl size=1", "Invalid command"},
+		{"LOAD csv batch=0", "Invalid command"},
+	} {
+		if reply := roundTrip(t, conn, reader, step.command); reply != step.reply {
+			t.Fatalf("%s replied %q, want %q", step.command, reply, step.reply)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/dump"
+	"github.com/jiteshchawla1511/KryptonDB/dynamo"
+	"github.com/jiteshchawla1511/KryptonDB/server"
+)
+
+// dynamoSecret is the secret the nodes of the test rings share.
+const dynamoSecret = "dynamo secret"
+
+// dynamoMember is one node of a test ring and the server it answers on.
+type dynamoMember struct {
+	id   string
+	srv  *server.Server
+	node *dynamo.Node
+	stop func()
+}
+
+func (m *dynamoMember) addr() string {
+	return m.srv.Addr().String()
+}
+
+// startDynamo starts a node for each id with the settings of cfg.
+func startDynamo(t *testing.T, cfg dynamo.Config, ids ...string) []*dynamoMember {
+	nodes := make(map[string]string)
+	var members []*dynamoMember
+	for _, id := range ids {
+		m := &dynamoMember{id: id, srv: listenOn(t, "0")}
+		nodes[id] = m.addr()
+		members = append(members, m)
+	}
+
+	for _, m := range members {
+		cfg.ID = m.id
+		cfg.Nodes = nodes
+		cfg.Secret = dynamoSecret
+		node, err := dynamo.Start(dbengine.NewMemory(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.node = node
+		m.srv.Engine = node
+		m.stop = serveListening(t, m.srv)
+	}
+	return members
+}
+
+// restart serves m again on its port after m.stop.
+func (m *dynamoMember) restart(t *testing.T) {
+	_, port, _ := net.SplitHostPort(m.addr())
+	m.srv = listenOn(t, port)
+	m.srv.Engine = m.node
+	m.stop = serveListening(t, m.srv)
+}
+
+// localValue returns the value m holds itself for key.
+func localValue(t *testing.T, m *dynamoMember, key string) string {
+	var value string
+	err := m.node.Iterate(key, func(k string, v string) bool {
+		if k == key {
+			value = v
+		}
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestDynamoQuorumsAndReadRepair(t *testing.T) {
+	for _, resolution := range []string{dynamo.ResolveTimestamp, dynamo.ResolveVectorClock} {
+		t.Run(resolution, func(t *testing.T) {
+			members := startDynamo(t, dynamo.Config{
+				N:              3,
+				R:              2,
+				W:              2,
+				Resolution:     resolution,
+				RequestTimeout: 1000,
+			}, "a", "b", "c")
+			a, b, c := members[0], members[1], members[2]
+			defer func() {
+				for _, m := range members {
+					m.stop()
+					m.node.Close()
+				}
+			}()
+
+			if err := a.node.Put("k", "v1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.node.Put("k", "v2"); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.node.Merge("n", lsmtree.AddOperator, "5"); err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range members {
+				if val, ok, err := m.node.Get("k"); err != nil || !ok || val != "v2" {
+					t.Fatalf("%s: Get(k) = %q, %v, %v", m.id, val, ok, err)
+				}
+				if val, _, err := m.node.Get("n"); err != nil || val != "5" {
+					t.Fatalf("%s: Get(n) = %q, %v", m.id, val, err)
+				}
+			}
+
+			// c misses the writes made while it is down
+			c.stop()
+			if err := a.node.Put("k", "v3"); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.node.Delete("n"); err != nil {
+				t.Fatal(err)
+			}
+			c.restart(t)
+			if got := localValue(t, c, "k"); got != "v2" {
+				t.Fatalf("c holds %q before the repair", got)
+			}
+
+			// a read through c sees the newer versions of a and b and
+			// repairs c in the background
+			if val, ok, err := c.node.Get("k"); err != nil || !ok || val != "v3" {
+				t.Fatalf("c: Get(k) = %q, %v, %v", val, ok, err)
+			}
+			if _, ok, err := c.node.Get("n"); err != nil || ok {
+				t.Fatalf("c: Get(n) = %v, %v after the delete", ok, err)
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for localValue(t, c, "k") != "v3" || localValue(t, c, "n") != "" {
+				if time.Now().After(deadline) {
+					t.Fatalf("c was not repaired: k=%q n=%q", localValue(t, c, "k"), localValue(t, c, "n"))
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			// one replica left is below both quorums
+			b.stop()
+			c.stop()
+			if err := a.node.Put("k", "v4"); err != dynamo.ErrQuorum {
+				t.Fatalf("Put with one replica returned %v", err)
+			}
+			if _, _, err := a.node.Get("k"); err != dynamo.ErrQuorum {
+				t.Fatalf("Get with one replica returned %v", err)
+			}
+
+			conn, err := net.Dial("tcp", a.addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader := bufio.NewReader(conn)
+			if reply := roundTrip(t, conn, reader, "GET k"); reply != "Quorum not reached" {
+				t.Fatalf("GET replied %q", reply)
+			}
+			if reply := roundTrip(t, conn, reader, "DYNAMO STATUS"); reply != "id=a n=3 r=2 w=2 resolution="+resolution+" nodes=3" {
+				t.Fatalf("DYNAMO STATUS replied %q", reply)
+			}
+			if reply := roundTrip(t, conn, reader, "DYNAMO REPLICAS k"); len(strings.Fields(reply)) != 3 {
+				t.Fatalf("DYNAMO REPLICAS replied %q", reply)
+			}
+			conn.Close()
+
+			// only connections that sent the secret may read or write replicas
+			conn, err = net.Dial("tcp", a.addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader = bufio.NewReader(conn)
+			for _, command := range []string{`DYNAMO GET {"Key":"k"}`, `DYNAMO PUT {"Key":"k"}`, "DYNAMO AUTH wrong"} {
+				if reply := roundTrip(t, conn, reader, command); reply != "Not a peer" {
+					t.Fatalf("%s without the secret replied %q", command, reply)
+				}
+			}
+			if reply := roundTrip(t, conn, reader, "DYNAMO STATUS"); !strings.HasPrefix(reply, "id=a ") {
+				t.Fatalf("DYNAMO STATUS without the secret replied %q", reply)
+			}
+			if reply := roundTrip(t, conn, reader, "DYNAMO AUTH "+dynamoSecret); reply != "OK" {
+				t.Fatalf("DYNAMO AUTH replied %q", reply)
+			}
+			if reply := roundTrip(t, conn, reader, `DYNAMO GET {"Key":"k"}`); !strings.HasPrefix(reply, "{") {
+				t.Fatalf("DYNAMO GET of a peer replied %q", reply)
+			}
+			conn.Close()
+
+			b.restart(t)
+			c.restart(t)
+		})
+	}
+}
+
+func TestDynamoRepairExchangesDivergentKeys(t *testing.T) {
+	members := startDynamo(t, dynamo.Config{RequestTimeout: 1000}, "a", "b", "c")
+	a, b, c := members[0], members[1], members[2]
+	defer func() {
+		for _, m := range members {
+			m.stop()
+			m.node.Close()
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if err := a.node.Put(fmt.Sprintf("k%03d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a write returns once W replicas stored it, c may still be storing the
+	// last ones
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; i < 100; i++ {
+		for localValue(t, c, fmt.Sprintf("k%03d", i)) == "" {
+			if time.Now().After(deadline) {
+				t.Fatalf("c does not hold k%03d", i)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// c misses new keys, updates and deletes
+	c.stop()
+	for i := 0; i < 10; i++ {
+		if err := a.node.Put(fmt.Sprintf("new%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.node.Put(fmt.Sprintf("k%03d", i), "w"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.node.Delete("k050"); err != nil {
+		t.Fatal(err)
+	}
+	c.restart(t)
+
+	conn, err := net.Dial("tcp", c.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	reply := roundTrip(t, conn, reader, "REPAIR a")
+	var leaves, pulled, pushed int
+	if _, err := fmt.Sscanf(reply, "OK leaves=%d pulled=%d pushed=%d", &leaves, &pulled, &pushed); err != nil {
+		t.Fatalf("REPAIR replied %q", reply)
+	}
+	if leaves == 0 || leaves > 21 || pulled != 21 || pushed != 0 {
+		t.Fatalf("REPAIR replied %q, want 21 pairs pulled", reply)
+	}
+	if localValue(t, c, "new9") != "v" || localValue(t, c, "k009") != "w" || localValue(t, c, "k050") != "" {
+		t.Fatal("c did not take the pairs of a")
+	}
+	for _, step := range []struct{ command, reply string }{
+		{"REPAIR a", "OK leaves=0 pulled=0 pushed=0"},
+		{"REPAIR z", "Node not found"},
+		{"REPAIR a limit=1", "Invalid command"},
+	} {
+		if reply := roundTrip(t, conn, reader, step.command); reply != step.reply {
+			t.Fatalf("%s replied %q, want %q", step.command, reply, step.reply)
+		}
+	}
+	conn.Close()
+
+	// b misses a key inside and a key outside of the range it repairs,
+	// then a misses one that b sends it
+	b.stop()
+	for _, key := range []string{"r1", "s1"} {
+		if err := c.node.Put(key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.restart(t)
+	stats, err := b.node.Repair("c", dump.Range{Start: "r", End: "s"})
+	if err != nil || stats.Pulled != 1 || stats.Pushed != 0 {
+		t.Fatalf("ranged Repair = %s, %v", stats, err)
+	}
+	if localValue(t, b, "r1") != "v" || localValue(t, b, "s1") != "" {
+		t.Fatal("b did not repair only the range")
+	}
+
+	a.stop()
+	if err := b.node.Put("p1", "v"); err != nil {
+		t.Fatal(err)
+	}
+	a.restart(t)
+	stats, err = b.node.Repair("a", dump.Range{Prefix: "p"})
+	if err != nil || stats.Pulled != 0 || stats.Pushed != 1 {
+		t.Fatalf("Repair = %s, %v", stats, err)
+	}
+	if localValue(t, a, "p1") != "v" {
+		t.Fatal("a did not receive p1")
+	}
+}
+
+func TestDynamoAntiEntropyRepairsInBackground(t *testing.T) {
+	members := startDynamo(t, dynamo.Config{RequestTimeout: 1000, AntiEntropyInterval: 20}, "a", "b", "c")
+	a, c := members[0], members[2]
+	defer func() {
+		for _, m := range members {
+			m.stop()
+			m.node.Close()
+		}
+	}()
+
+	c.stop()
+	for i := 0; i < 20; i++ {
+		if err := a.node.Put(fmt.Sprintf("k%02d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.restart(t)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; i < 20; i++ {
+		for localValue(t, c, fmt.Sprintf("k%02d", i)) != "v" {
+			if time.Now().After(deadline) {
+				t.Fatalf("c was not repaired: k%02d", i)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+func openEngine(t *testing.T, kind string) dbengine.Engine {
+	engine, err := dbengine.New(dbengine.Options{
+		Engine: kind,
+		LSMTree: lsmtree.LSMTreeOptions{
+			MaximumElement:   lsmtree.MaximumElement,
+			CompactionPeriod: lsmtree.CompactionFrequency,
+			BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+				Capacity:  1000,
+				ErrorRate: lsmtree.BloomErrorRate,
+			},
+		},
+		Store: diskstore.DiskStoreOpts{
+			Directory:       "data",
+			NumOfPartitions: 4,
+		},
+		WalPath: "wal.aof",
+		FS:      vfs.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+func TestEnginesAgree(t *testing.T) {
+	for _, kind := range []string{dbengine.EngineLSM, dbengine.EngineMemory, dbengine.EngineDiskStore} {
+		t.Run(kind, func(t *testing.T) {
+			engine := openEngine(t, kind)
+
+			for _, key := range []string{"b", "d", "a", "c"} {
+				err := engine.Put(key, "v"+key)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := engine.Batch([]dbengine.Op{
+				{Key: "a", Delete: true},
+				{Key: "c", Value: "new"},
+				{Key: "e", Value: "ve"},
+			})
+			if err == nil {
+				err = engine.Delete("d")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			val, exist, err := engine.Get("c")
+			if err != nil || !exist || val != "new" {
+				t.Fatalf("Get(c) = %q, %v, %v", val, exist, err)
+			}
+			_, exist, err = engine.Get("a")
+			if err != nil || exist {
+				t.Fatalf("Get(a) after delete = %v, %v", exist, err)
+			}
+
+			var pairs []string
+			err = engine.Iterate("b", func(key string, value string) bool {
+				pairs = append(pairs, key+"="+value)
+				return len(pairs) < 2
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(pairs) != "[b=vb c=new]" {
+				t.Fatalf("Iterate from b = %v", pairs)
+			}
+
+			err = engine.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := engine.Put("f", "vf"); err != dbengine.ErrClosed {
+				t.Fatalf("Put after Close = %v, want ErrClosed", err)
+			}
+		})
+	}
+}
+
+func TestIteratorMergesTablesAndMemtables(t *testing.T) {
+	tree, err := lsmtree.InitLsmTree(lsmtree.LSMTreeOptions{
+		MaximumElement:   16,
+		CompactionPeriod: 60 * 60 * 1000,
+		BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+			Capacity:  1000,
+			ErrorRate: lsmtree.BloomErrorRate,
+		},
+		FS: vfs.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// every round rewrites, deletes and merges keys an older table holds
+	want := make(map[string]string)
+	for round := 0; round < 5; round++ {
+		for i := round; i < 100; i += 2 {
+			key := fmt.Sprintf("key%03d", i)
+			switch i % 5 {
+			case 0:
+				tree.Del(key)
+				delete(want, key)
+			case 1:
+				tree.Merge(key, lsmtree.AppendOperator, fmt.Sprint(round))
+				want[key] += fmt.Sprint(round)
+			default:
+				tree.Put(key, fmt.Sprintf("%d-%d", i, round))
+				want[key] = fmt.Sprintf("%d-%d", i, round)
+			}
+		}
+	}
+
+	for _, start := range []string{"", "key000", "key037", "key0375", "key099", "key1"} {
+		var got []string
+		it := tree.NewIterator()
+		for it.Seek(start); it.Next(); {
+			got = append(got, it.Key()+"="+it.Value())
+		}
+
+		var expected []string
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			if val, ok := want[key]; ok && key >= start {
+				expected = append(expected, key+"="+val)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("iterating from %q got\n%v\nwant\n%v", start, got, expected)
+		}
+	}
+}
+
+func TestVersionsSurviveTablesAndLog(t *testing.T) {
+	tree, err := lsmtree.InitLsmTree(lsmtree.LSMTreeOptions{
+		MaximumElement:   4,
+		CompactionPeriod: 5,
+		BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+			Capacity:  1000,
+			ErrorRate: lsmtree.BloomErrorRate,
+		},
+		FS: vfs.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	tree.Put("gone", "old")
+	tree.PutVersion("kept", "1", lsmtree.Version{Time: 5, Node: "a", Prev: 3})
+	tree.DelVersion("gone", lsmtree.Version{Time: 7, Node: "b"})
+	tree.DelVersion("never", lsmtree.Version{Time: 8, Node: "b"})
+	// other keys push the records through flushes and compactions down to
+	// the last table, where tombstones are dropped
+	for i := 0; i < 20; i++ {
+		tree.Put(fmt.Sprintf("key%03d", i), "value")
+		if i%5 == 4 {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for key, want := range map[string]lsmtree.KV{
+		"kept":  {Key: "kept", Value: "1", Version: lsmtree.Version{Time: 5, Node: "a", Prev: 3}},
+		"gone":  {Key: "gone", Tombstone: true, Version: lsmtree.Version{Time: 7, Node: "b"}},
+		"never": {Key: "never", Tombstone: true, Version: lsmtree.Version{Time: 8, Node: "b"}},
+	} {
+		record, found := tree.Record(key)
+		if !found || fmt.Sprint(record) != fmt.Sprint(want) {
+			t.Fatalf("Record(%s) = %+v, %v, want %+v", key, record, found, want)
+		}
+	}
+	if _, found := tree.Get("gone"); found {
+		t.Fatal("Get finds a versioned tombstone")
+	}
+
+	var records, pairs []string
+	for it := tree.NewRecordIterator(); it.Next(); {
+		if !strings.HasPrefix(it.Key(), "key") {
+			records = append(records, it.Key())
+		}
+	}
+	for it := tree.NewIterator(); it.Next(); {
+		if !strings.HasPrefix(it.Key(), "key") {
+			pairs = append(pairs, it.Key())
+		}
+	}
+	if fmt.Sprint(records) != "[gone kept never]" || fmt.Sprint(pairs) != "[kept]" {
+		t.Fatalf("records %v and pairs %v", records, pairs)
+	}
+
+	fs := vfs.NewMem()
+	w := wal.InitWal(fs, "wal.aof")
+	written := []wal.Entry{
+		{Key: "kept", Value: "1", Version: lsmtree.Version{Time: 5, Node: "n.1", Prev: 3}},
+		{Key: "gone", Delete: true, Version: lsmtree.Version{Time: 7, Node: "b"}},
+		{Key: "plain", Value: "2"},
+	}
+	err = w.WriteBatch(written)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := wal.InitWal(fs, "wal.aof").ReadEntries()
+	for i := range written {
+		written[i].LSN = 1
+	}
+	if fmt.Sprint(read) != fmt.Sprint(written) {
+		t.Fatalf("read back %+v, want %+v", read, written)
+	}
+}
@@ -0,0 +1,134 @@
+package test
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+func openFamilies(t *testing.T, fs vfs.FS) *dbengine.DBEngine {
+	engine, err := dbengine.Open(dbengine.Options{
+		LSMTree: lsmtree.LSMTreeOptions{
+			MaximumElement:   lsmtree.MaximumElement,
+			CompactionPeriod: lsmtree.CompactionFrequency,
+			BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+				Capacity:  1000,
+				ErrorRate: lsmtree.BloomErrorRate,
+			},
+			Directory: "lsm",
+		},
+		Store: diskstore.DiskStoreOpts{
+			Directory:       "data",
+			NumOfPartitions: 2,
+		},
+		WalPath: "wal.aof",
+		FS:      fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+func TestFamiliesKeepSeparateKeyspaces(t *testing.T) {
+	fs := vfs.NewMem()
+	db := openFamilies(t, fs)
+
+	err := db.CreateFamily("users", dbengine.FamilyOptions{MaximumElement: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateFamily("users", dbengine.FamilyOptions{}); err != dbengine.ErrFamilyExists {
+		t.Fatalf("second CreateFamily = %v, want ErrFamilyExists", err)
+	}
+
+	err = db.Batch([]dbengine.Op{
+		{Key: "k", Value: "default"},
+		{Key: "k", Value: "user", Family: "users"},
+		{Key: "only", Value: "user", Family: "users"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = openFamilies(t, fs)
+	defer db.Close()
+
+	users, err := db.Family("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := db.Get("k"); val != "default" {
+		t.Fatalf("default Get(k) = %q", val)
+	}
+	if val, _, _ := users.Get("k"); val != "user" {
+		t.Fatalf("users Get(k) = %q", val)
+	}
+	if _, exist, _ := db.Get("only"); exist {
+		t.Fatal("a key of users is visible in the default family")
+	}
+
+	err = db.DropFamily("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := users.Get("k"); err != dbengine.ErrFamilyNotFound {
+		t.Fatalf("Get on a dropped family = %v, want ErrFamilyNotFound", err)
+	}
+	for _, dir := range []string{"lsm/families/users", "data/families/users"} {
+		if _, err := fs.Stat(dir); err == nil {
+			t.Fatalf("%s is left after DropFamily", dir)
+		}
+	}
+
+	err = db.CreateFamily("users", dbengine.FamilyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err = db.Family("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exist, _ := users.Get("k"); exist {
+		t.Fatal("a recreated family kept the data of the dropped one")
+	}
+}
+
+func TestServerColumnFamilyCommands(t *testing.T) {
+	srv := startServer(t)
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for _, step := range []struct{ command, reply string }{
+		{"USE users", "Column family not found"},
+		{"CREATECF users maximum_element=4", "OK"},
+		{"CREATECF users", "Column family already exists"},
+		{"CREATECF other size=4", "Invalid command"},
+		{"PUT key default", "OK"},
+		{"USE users", "OK"},
+		{"PUT key user", "OK"},
+		{"GET key", "user"},
+		{"USE default", "OK"},
+		{"GET key", "default"},
+		{"DROPCF users", "OK"},
+		{"DROPCF users", "Column family not found"},
+	} {
+		if reply := roundTrip(t, conn, reader, step.command); reply != step.reply {
+			t.Fatalf("%s replied %q, want %q", step.command, reply, step.reply)
+		}
+	}
+}
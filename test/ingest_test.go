@@ -0,0 +1,215 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// buildTable writes a table holding pairs, given as key=value or key for a
+// tombstone, in the order given.
+func buildTable(t *testing.T, fs vfs.FS, path string, pairs ...string) {
+	w, err := lsmtree.NewSSTableWriter(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		key, value, put := strings.Cut(pair, "=")
+		if put {
+			err = w.Put(key, value)
+		} else {
+			err = w.Delete(key)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestLinksTablesWithoutWAL(t *testing.T) {
+	fs := vfs.NewMem()
+	open := func() *dbengine.DBEngine {
+		engine, err := dbengine.Open(dbengine.Options{
+			LSMTree: lsmtree.LSMTreeOptions{
+				MaximumElement:   4,
+				CompactionPeriod: lsmtree.CompactionFrequency,
+				Directory:        "lsm",
+				BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+					Capacity:  1000,
+					ErrorRate: lsmtree.BloomErrorRate,
+				},
+			},
+			Store: diskstore.DiskStoreOpts{
+				Directory:       "data",
+				NumOfPartitions: 2,
+			},
+			WalPath: "wal.aof",
+			FS:      fs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return engine
+	}
+
+	db := open()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		err := db.Put(key, "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var bulk []string
+	for i := 0; i < 100; i++ {
+		bulk = append(bulk, fmt.Sprintf("x%03d=%d", i, i))
+	}
+	fs.MkdirAll("load", 0755)
+	buildTable(t, fs, "load/bulk.sst", bulk...)
+	buildTable(t, fs, "load/fix.sst", "a=new", "b")
+
+	err := db.Ingest("load/bulk.sst", "load/fix.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *dbengine.DBEngine) {
+		for key, want := range map[string]string{"a": "new", "c": "old", "e": "old", "x042": "42"} {
+			val, exist, err := db.Get(key)
+			if err != nil || !exist || val != want {
+				t.Fatalf("Get(%s) = %q, %v, %v, want %q", key, val, exist, err, want)
+			}
+		}
+		if _, exist, _ := db.Get("b"); exist {
+			t.Fatal("the tombstone of the ingested table did not delete b")
+		}
+	}
+	check(db)
+
+	log, err := vfs.ReadFile(fs, "wal.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(log), "x042") {
+		t.Fatal("ingested pairs were written to the WAL")
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the table that overlapped nothing sits under the others
+	manifest, err := lsmtree.OpenManifest(fs, "lsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables := manifest.Tables(); tables[0].Smallest != "x000" {
+		t.Fatalf("oldest table = %+v, want the bulk table", tables[0])
+	}
+	manifest.Close()
+
+	db = open()
+	defer db.Close()
+	check(db)
+}
+
+func TestIngestSurvivesCrashUnderLaterWrites(t *testing.T) {
+	fs := vfs.NewMem()
+	db := openFamilies(t, fs)
+	for _, key := range []string{"a", "x050"} {
+		if err := db.Put(key, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bulk := []string{"a=new"}
+	for i := 0; i < 100; i++ {
+		bulk = append(bulk, fmt.Sprintf("x%03d=%d", i, i))
+	}
+	buildTable(t, fs, "bulk.sst", bulk...)
+	if err := db.Ingest("bulk.sst"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("x050", "later"); err != nil {
+		t.Fatal(err)
+	}
+	// Get syncs the WAL
+	if val, _, _ := db.Get("x050"); val != "later" {
+		t.Fatalf("Get(x050) = %q, want later", val)
+	}
+
+	// the store holds the ingested pairs and the WAL the write after them
+	fs.Crash()
+	db = openFamilies(t, fs)
+	defer db.Close()
+	for key, want := range map[string]string{"a": "new", "x042": "42", "x050": "later"} {
+		val, exist, err := db.Get(key)
+		if err != nil || !exist || val != want {
+			t.Fatalf("Get(%s) after a crash = %q, %v, %v, want %q", key, val, exist, err, want)
+		}
+	}
+}
+
+func TestIngestRejectsBadTables(t *testing.T) {
+	fs := vfs.NewMem()
+
+	w, err := lsmtree.NewSSTableWriter(fs, "unsorted.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Put("b", "1")
+	if err := w.Put("a", "1"); err != lsmtree.ErrUnsortedTable {
+		t.Fatalf("Put out of order = %v, want ErrUnsortedTable", err)
+	}
+	w.Abort()
+
+	buildTable(t, fs, "one.sst", "a=1", "m=1")
+	buildTable(t, fs, "two.sst", "k=1", "z=1")
+
+	data, _ := vfs.ReadFile(fs, "one.sst")
+	data[0] ^= 0xff
+	vfs.WriteFileAtomic(fs, "corrupt.sst", data)
+
+	db := openFamilies(t, fs)
+	defer db.Close()
+
+	if err := db.Ingest("one.sst", "two.sst"); err != lsmtree.ErrOverlappingTables {
+		t.Fatalf("Ingest of overlapping tables = %v, want ErrOverlappingTables", err)
+	}
+	if err := db.Ingest("corrupt.sst"); err != lsmtree.ErrCorruptTable {
+		t.Fatalf("Ingest of a corrupt table = %v, want ErrCorruptTable", err)
+	}
+	if _, exist, _ := db.Get("a"); exist {
+		t.Fatal("a rejected ingest left data behind")
+	}
+}
+
+func TestServerIngestCommand(t *testing.T) {
+	srv := startServer(t)
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	if reply := roundTrip(t, conn, reader, "INGEST missing.sst"); reply != "Error ingesting tables" {
+		t.Fatalf("INGEST of a missing file replied %q", reply)
+	}
+	if reply := roundTrip(t, conn, reader, "INGEST"); reply != "Invalid command" {
+		t.Fatalf("INGEST without paths replied %q", reply)
+	}
+}
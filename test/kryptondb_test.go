@@ -0,0 +1,111 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jiteshchawla1511/KryptonDB/kryptondb"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+func TestEmbeddedPutGetDelete(t *testing.T) {
+	db, err := kryptondb.Open("db", &kryptondb.Options{FS: vfs.NewMem(), BloomFilterCapacity: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		err = db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	val, err := db.Get("key3")
+	if err != nil || val != "value3" {
+		t.Fatalf("Get(key3) = %q, %v", val, err)
+	}
+
+	err = db.Delete("key3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Get("key3")
+	if err != kryptondb.ErrNotFound {
+		t.Fatalf("Get(deleted key) error = %v, want ErrNotFound", err)
+	}
+
+	err = db.Put("bad|key", "value")
+	if err == nil {
+		t.Fatal("expected a key containing '|' to be rejected")
+	}
+
+	it := db.NewIterator()
+	it.Seek("key5")
+
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if fmt.Sprint(keys) != "[key5 key6 key7 key8 key9]" {
+		t.Fatalf("iterated keys = %v", keys)
+	}
+}
+
+func TestEmbeddedCloseAndReopen(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := &kryptondb.Options{FS: fs, BloomFilterCapacity: 1000, MaximumElement: 4}
+
+	db, err := kryptondb.Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i += 3 {
+		err = db.Delete(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Put("key", "value")
+	if err != kryptondb.ErrClosed {
+		t.Fatalf("Put after Close error = %v, want ErrClosed", err)
+	}
+
+	// everything must have been synced, a crash right after Close loses nothing
+	fs.Crash()
+
+	db, err = kryptondb.Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		val, err := db.Get(fmt.Sprintf("key%d", i))
+		if i%3 == 0 {
+			if err != kryptondb.ErrNotFound {
+				t.Fatalf("Get(key%d) after delete and reopen = %q, %v", i, val, err)
+			}
+			continue
+		}
+		if err != nil || val != fmt.Sprintf("value%d", i) {
+			t.Fatalf("Get(key%d) after reopen = %q, %v", i, val, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/membership"
+	"github.com/jiteshchawla1511/KryptonDB/server"
+)
+
+// startMember serves a memory engine with the member list id, which joins
+// through seeds. The returned func stops both once.
+func startMember(t *testing.T, id string, seeds ...string) (*server.Server, func()) {
+	members, err := membership.New(membership.Config{
+		ID:               id,
+		Seeds:            seeds,
+		ProbeInterval:    100,
+		ProbeTimeout:     40,
+		SuspicionTimeout: 500,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := listenOn(t, "0")
+	srv.Engine = dbengine.NewMemory()
+	srv.Members = members
+	stopServer := serveListening(t, srv)
+	var once sync.Once
+	return srv, func() {
+		once.Do(func() {
+			stopServer()
+			members.Close()
+		})
+	}
+}
+
+// waitForState waits until members lists id in state and returns it.
+func waitForState(t *testing.T, members *membership.Members, id string, state membership.State) membership.Member {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, m := range members.List() {
+			if m.ID == id && m.State == state {
+				return m
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is not %s: %v", id, state, members.List())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMembershipDetectsFailures(t *testing.T) {
+	a, stopA := startMember(t, "a")
+	seed := a.UDPAddr().String()
+	b, stopB := startMember(t, "b", seed)
+	c, stopC := startMember(t, "c", seed)
+	defer func() {
+		stopA()
+		stopB()
+		stopC()
+	}()
+
+	for _, srv := range []*server.Server{a, b, c} {
+		for _, id := range []string{"a", "b", "c"} {
+			waitForState(t, srv.Members, id, membership.Alive)
+		}
+	}
+
+	conn, err := net.Dial("tcp", a.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	want := "a@" + seed + "=alive b@" + b.UDPAddr().String() + "=alive c@" + c.UDPAddr().String() + "=alive"
+	if reply := roundTrip(t, conn, reader, "CLUSTER MEMBERS"); reply != want {
+		t.Fatalf("CLUSTER MEMBERS replied %q, want %q", reply, want)
+	}
+
+	// the clients of the UDP port are still answered
+	udp, err := net.Dial("udp", seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.Write([]byte("GET missing"))
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	if n, err := udp.Read(buf); err != nil || string(buf[:n]) != "Data not found" {
+		t.Fatalf("UDP GET replied %q, %v", buf[:n], err)
+	}
+
+	// x drops the packets of a, which only reaches it through the others
+	members, err := membership.New(membership.Config{
+		ID:               "x",
+		Seeds:            []string{b.UDPAddr().String()},
+		ProbeInterval:    100,
+		ProbeTimeout:     40,
+		SuspicionTimeout: 500,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	xConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	members.Start(xConn)
+	go func() {
+		buf := make([]byte, server.DefaultUDPBufferSize)
+		for {
+			n, addr, err := xConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if addr.String() != seed {
+				members.HandlePacket(append([]byte(nil), buf[:n]...), addr)
+			}
+		}
+	}()
+
+	waitForState(t, a.Members, "x", membership.Alive)
+	time.Sleep(time.Second)
+	if x := waitForState(t, a.Members, "x", membership.Alive); x.Incarnation != 0 {
+		t.Fatalf("x was suspected by a: %v", x)
+	}
+	members.Close()
+	xConn.Close()
+	waitForState(t, a.Members, "x", membership.Dead)
+
+	// a failed node is suspected, then declared dead
+	stopC()
+	for _, srv := range []*server.Server{a, b} {
+		waitForState(t, srv.Members, "c", membership.Dead)
+	}
+	if reply := roundTrip(t, conn, reader, "CLUSTER MEMBERS"); !strings.Contains(reply, "c@"+c.UDPAddr().String()+"=dead") {
+		t.Fatalf("CLUSTER MEMBERS replied %q", reply)
+	}
+
+	// and refutes it when it comes back
+	c, stopC = startMember(t, "c", seed)
+	if m := waitForState(t, a.Members, "c", membership.Alive); m.Addr != c.UDPAddr().String() || m.Incarnation == 0 {
+		t.Fatalf("a lists %v", m)
+	}
+	waitForState(t, c.Members, "b", membership.Alive)
+
+	srv := startServer(t)
+	plain, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if reply := roundTrip(t, plain, bufio.NewReader(plain), "CLUSTER MEMBERS"); reply != "Membership not supported" {
+		t.Fatalf("CLUSTER MEMBERS replied %q", reply)
+	}
+}
@@ -0,0 +1,346 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+func TestEnginesResolveMerges(t *testing.T) {
+	for _, kind := range []string{dbengine.EngineLSM, dbengine.EngineMemory, dbengine.EngineDiskStore} {
+		t.Run(kind, func(t *testing.T) {
+			engine := openEngine(t, kind)
+			defer engine.Close()
+
+			for i := 0; i < 10; i++ {
+				err := engine.Merge("counter", lsmtree.AddOperator, "3")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := engine.Batch([]dbengine.Op{
+				{Key: "counter", Value: "-5", Merge: lsmtree.AddOperator},
+				{Key: "log", Value: "a", Merge: lsmtree.AppendOperator},
+				{Key: "log", Value: "b", Merge: lsmtree.AppendOperator},
+				{Key: "high", Value: "7"},
+				{Key: "high", Value: "4", Merge: lsmtree.MaxOperator},
+				{Key: "high", Value: "9", Merge: lsmtree.MaxOperator},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for key, want := range map[string]string{"counter": "25", "log": "ab", "high": "9"} {
+				val, exist, err := engine.Get(key)
+				if err != nil || !exist || val != want {
+					t.Fatalf("Get(%s) = %q, %v, %v, want %q", key, val, exist, err, want)
+				}
+			}
+
+			if err := engine.Merge("counter", lsmtree.AddOperator, "x"); err != lsmtree.ErrInvalidOperand {
+				t.Fatalf("Merge of a bad operand = %v, want ErrInvalidOperand", err)
+			}
+			if err := engine.Merge("counter", "nope", "1"); err != lsmtree.ErrUnknownOperator {
+				t.Fatalf("Merge with an unknown operator = %v, want ErrUnknownOperator", err)
+			}
+
+			// a counter that cannot take the operand is refused and kept
+			err = engine.Batch([]dbengine.Op{{Key: "name", Value: "bob"}, {Key: "big", Value: "9223372036854775807"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := engine.Merge("name", lsmtree.AddOperator, "1"); err != lsmtree.ErrNotInteger {
+				t.Fatalf("adding to a string = %v, want ErrNotInteger", err)
+			}
+			if err := engine.Merge("big", lsmtree.AddOperator, "1"); err != lsmtree.ErrOverflow {
+				t.Fatalf("adding past the largest int64 = %v, want ErrOverflow", err)
+			}
+			err = engine.Batch([]dbengine.Op{
+				{Key: "fresh", Value: "1"},
+				{Key: "fresh", Value: "9223372036854775807", Merge: lsmtree.AddOperator},
+			})
+			if err != lsmtree.ErrOverflow {
+				t.Fatalf("a batch overflowing its own write = %v, want ErrOverflow", err)
+			}
+			for key, want := range map[string]string{"name": "bob", "big": "9223372036854775807"} {
+				if val, _, _ := engine.Get(key); val != want {
+					t.Fatalf("Get(%s) = %q after a refused merge, want %q", key, val, want)
+				}
+			}
+			// the disk store engine applies a batch op by op
+			if _, exist, _ := engine.Get("fresh"); exist && kind != dbengine.EngineDiskStore {
+				t.Fatal("a refused batch was partly applied")
+			}
+		})
+	}
+}
+
+func TestMergesSurviveFlushCompactionAndReopen(t *testing.T) {
+	fs := vfs.NewMem()
+	open := func() *dbengine.DBEngine {
+		engine, err := dbengine.Open(dbengine.Options{
+			LSMTree: lsmtree.LSMTreeOptions{
+				MaximumElement:   4,
+				CompactionPeriod: 5,
+				Directory:        "lsm",
+				BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+					Capacity:  1000,
+					ErrorRate: lsmtree.BloomErrorRate,
+				},
+			},
+			Store: diskstore.DiskStoreOpts{
+				Directory:       "data",
+				NumOfPartitions: 2,
+			},
+			WalPath: "wal.aof",
+			FS:      fs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return engine
+	}
+
+	db := open()
+	for i := 0; i < 200; i++ {
+		err := db.Merge("counter", lsmtree.AddOperator, "1")
+		if err == nil {
+			// other keys fill the memtable so the operands get flushed
+			err = db.Put(fmt.Sprintf("key%d", i%20), "value")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.Delete("key0")
+	if err == nil {
+		err = db.Merge("key0", lsmtree.AppendOperator, "new")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// give the background compaction a few rounds
+	time.Sleep(50 * time.Millisecond)
+
+	check := func(db *dbengine.DBEngine) {
+		for key, want := range map[string]string{"counter": "200", "key0": "new"} {
+			val, exist, err := db.Get(key)
+			if err != nil || !exist || val != want {
+				t.Fatalf("Get(%s) = %q, %v, %v, want %q", key, val, exist, err, want)
+			}
+		}
+
+		var counter string
+		db.Iterate("counter", func(key string, value string) bool {
+			counter = value
+			return false
+		})
+		if counter != "200" {
+			t.Fatalf("Iterate saw counter = %q, want 200", counter)
+		}
+	}
+	check(db)
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = open()
+	check(db)
+
+	// the store already holds the operands, the next cycle must not add
+	// them again
+	err = db.Merge("counter", lsmtree.AddOperator, "1")
+	if err == nil {
+		err = db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = open()
+	defer db.Close()
+	if val, _, _ := db.Get("counter"); val != "201" {
+		t.Fatalf("counter after a second reopen = %q, want 201", val)
+	}
+}
+
+func TestReopenKeepsTablesOfCleanClose(t *testing.T) {
+	fs := vfs.NewMem()
+	open := func() *dbengine.DBEngine {
+		engine, err := dbengine.Open(dbengine.Options{
+			LSMTree: lsmtree.LSMTreeOptions{
+				MaximumElement:   4,
+				CompactionPeriod: 60 * 60 * 1000,
+				Directory:        "lsm",
+				BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+					Capacity:  1000,
+					ErrorRate: lsmtree.BloomErrorRate,
+				},
+			},
+			Store: diskstore.DiskStoreOpts{
+				Directory:       "data",
+				NumOfPartitions: 2,
+			},
+			WalPath: "wal.aof",
+			FS:      fs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return engine
+	}
+	tables := func() int {
+		names, err := fs.ReadDir("lsm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for _, name := range names {
+			if strings.HasSuffix(name, ".sst") {
+				count++
+			}
+		}
+		return count
+	}
+
+	db := open()
+	for i := 0; i < 20; i++ {
+		err := db.Put(fmt.Sprintf("key%02d", i), "value")
+		if err == nil {
+			err = db.Merge("counter", lsmtree.AddOperator, "1")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := tables()
+
+	// reopening does not write the store into new tables again
+	for i := 0; i < 3; i++ {
+		db = open()
+		if val, _, _ := db.Get("counter"); val != "20" {
+			t.Fatalf("counter after reopen %d = %q, want 20", i, val)
+		}
+		if val, _, _ := db.Get("key19"); val != "value" {
+			t.Fatalf("key19 after reopen %d = %q", i, val)
+		}
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tables(); got != want {
+			t.Fatalf("reopen %d left %d tables, want %d", i, got, want)
+		}
+	}
+
+	// the writes made after a reopen are kept as well
+	db = open()
+	err = db.Merge("counter", lsmtree.AddOperator, "1")
+	if err == nil {
+		err = db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = open()
+	defer db.Close()
+	if val, _, _ := db.Get("counter"); val != "21" {
+		t.Fatalf("counter after another reopen = %q, want 21", val)
+	}
+}
+
+func TestMergesReplayOnceAfterCrash(t *testing.T) {
+	fs := vfs.NewFault()
+	opts := diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: 1}
+
+	disk, err := diskstore.NewDisk(diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: 1, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := wal.InitWal(fs, "wal.aof")
+	w.Write([]byte("&"), []byte("counter"), []byte(lsmtree.AddOperator), []byte("2"))
+	w.Write([]byte("&"), []byte("counter"), []byte(lsmtree.AddOperator), []byte("3"))
+	err = w.Persist()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the partition is applied and synced, rewriting the WAL fails
+	fs.FailWrite(2)
+	err = disk.Close(w)
+	if err == nil {
+		t.Fatal("expected the injected write fault")
+	}
+	fs.Crash()
+
+	db, err := dbengine.Open(dbengine.Options{
+		LSMTree: lsmtree.LSMTreeOptions{
+			MaximumElement:   lsmtree.MaximumElement,
+			CompactionPeriod: lsmtree.CompactionFrequency,
+			BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+				Capacity:  1000,
+				ErrorRate: lsmtree.BloomErrorRate,
+			},
+		},
+		Store:   opts,
+		WalPath: "wal.aof",
+		FS:      fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if val, _, _ := db.Get("counter"); val != "5" {
+		t.Fatalf("counter after replaying the WAL = %q, want 5", val)
+	}
+}
+
+func TestServerMergeCommands(t *testing.T) {
+	srv := startServer(t)
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for _, step := range []struct{ command, reply string }{
+		{"INCR hits", "OK"},
+		{"INCRBY hits 10", "OK"},
+		{"DECR hits", "OK"},
+		{"DECRBY hits 3", "OK"},
+		{"GET hits", "7"},
+		{"INCRBY hits many", "Invalid operand"},
+		{"PUT name bob", "OK"},
+		{"INCR name", "Value is not an integer"},
+		{"GET name", "bob"},
+		{"APPEND greeting hello", "OK"},
+		{"APPEND greeting -world", "OK"},
+		{"GET greeting", "hello-world"},
+		{"MAX peak 3", "OK"},
+		{"MAX peak 2", "OK"},
+		{"GET peak", "3"},
+		{"INCR", "Invalid command"},
+	} {
+		if reply := roundTrip(t, conn, reader, step.command); reply != step.reply {
+			t.Fatalf("%s replied %q, want %q", step.command, reply, step.reply)
+		}
+	}
+}
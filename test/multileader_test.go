@@ -0,0 +1,205 @@
+package test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/multileader"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// startMultiLeader starts node id of nodes on an engine stored in fs.
+func startMultiLeader(t *testing.T, fs vfs.FS, id string, nodes map[string]string) *multileader.Node {
+	node, err := multileader.Start(openFamilies(t, fs), multileader.Config{
+		ID:                 id,
+		Nodes:              nodes,
+		FS:                 fs,
+		TombstoneRetention: 100,
+		RetryPeriod:        20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// waitForPurge waits until the node on fs stored a purged tombstone.
+func waitForPurge(t *testing.T, fs vfs.FS) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := vfs.ReadFile(fs, "multileader/MULTILEADER")
+		if err == nil && strings.Contains(string(data), `"purged":{"`) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no tombstone was purged: %s, %v", data, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMultiLeaderConverges(t *testing.T) {
+	aSrv, bSrv := listenOn(t, "0"), listenOn(t, "0")
+	_, aPort, _ := net.SplitHostPort(aSrv.Addr().String())
+	_, bPort, _ := net.SplitHostPort(bSrv.Addr().String())
+	nodes := map[string]string{"a": aSrv.Addr().String(), "b": bSrv.Addr().String()}
+
+	aFS, bFS := vfs.NewMem(), vfs.NewMem()
+	a := startMultiLeader(t, aFS, "a", nodes)
+	b := startMultiLeader(t, bFS, "b", nodes)
+	defer func() {
+		a.Close()
+		b.Close()
+	}()
+
+	aSrv.Engine, bSrv.Engine = a, b
+	stopA, stopB := serveListening(t, aSrv), serveListening(t, bSrv)
+	a.Put("only-a", "1")
+	b.Put("only-b", "1")
+	waitFor(t, a, "only-b", "1")
+	waitFor(t, b, "only-a", "1")
+
+	// while the nodes cannot reach each other, both write x without seeing
+	// the other write, and a deletes y after b wrote it
+	stopA()
+	stopB()
+	a.Put("x", "from a")
+	b.Put("x", "from b")
+	b.Put("y", "old")
+	b.Put("never-deleted", "1")
+	time.Sleep(2 * time.Millisecond)
+	a.Delete("y")
+	// once the tombstone of y is purged, the older write cannot bring y back,
+	// while the older write of another key still reaches a
+	waitForPurge(t, aFS)
+	a.Put("after-a", "1")
+	b.Put("after-b", "1")
+
+	aSrv, bSrv = listenOn(t, aPort), listenOn(t, bPort)
+	aSrv.Engine, bSrv.Engine = a, b
+	stopA, stopB = serveListening(t, aSrv), serveListening(t, bSrv)
+	defer func() {
+		stopA()
+		stopB()
+	}()
+
+	waitFor(t, a, "after-b", "1")
+	waitFor(t, b, "after-a", "1")
+	waitFor(t, a, "never-deleted", "1")
+	for _, node := range []*multileader.Node{a, b} {
+		waitFor(t, node, "x", "from b")
+		waitFor(t, node, "y", "")
+		if count := node.Conflicts("x"); count != 1 {
+			t.Fatalf("Conflicts(x) = %d, want 1", count)
+		}
+	}
+
+	conn, err := net.Dial("tcp", aSrv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	if reply := roundTrip(t, conn, reader, "MULTILEADER CONFLICTS"); reply != "x=1" {
+		t.Fatalf("MULTILEADER CONFLICTS replied %q", reply)
+	}
+	if reply := roundTrip(t, conn, reader, "MULTILEADER CONFLICTS x"); reply != "1" {
+		t.Fatalf("MULTILEADER CONFLICTS x replied %q", reply)
+	}
+	if reply := roundTrip(t, conn, reader, "MULTILEADER STATUS"); !strings.HasPrefix(reply, "id=a hlc=") || !strings.Contains(reply, "conflicts=1 applied=b:") {
+		t.Fatalf("MULTILEADER STATUS replied %q", reply)
+	}
+	if reply := roundTrip(t, conn, reader, "PUT z 1"); reply != "OK" {
+		t.Fatalf("PUT replied %q", reply)
+	}
+	conn.Close()
+	waitFor(t, b, "z", "1")
+
+	// a write made after seeing the other one is no conflict
+	b.Put("x", "again")
+	waitFor(t, a, "x", "again")
+	if count := a.Conflicts("x"); count != 1 {
+		t.Fatalf("Conflicts(x) = %d, want 1", count)
+	}
+
+	plain := startServer(t)
+	conn, err = net.Dial("tcp", plain.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if reply := roundTrip(t, conn, bufio.NewReader(conn), "MULTILEADER STATUS"); reply != "Multi-leader not supported" {
+		t.Fatalf("MULTILEADER STATUS replied %q", reply)
+	}
+}
+
+func TestMultiLeaderClockSurvivesRestart(t *testing.T) {
+	fs := vfs.NewMem()
+	future := uint64(time.Now().Add(time.Hour).UnixNano()/int64(time.Millisecond)) << 16
+
+	// a write stamped ahead of the wall clock, as one from a node whose
+	// clock runs fast
+	db := openFamilies(t, fs)
+	err := db.Batch([]dbengine.Op{{Key: "x", Value: "fast", Version: lsmtree.Version{Time: future, Node: "b"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	nodes := map[string]string{"a": "127.0.0.1:0"}
+	node := startMultiLeader(t, fs, "a", nodes)
+	if clock := uint64(node.Status().Clock); clock < future {
+		t.Fatalf("clock %d is behind the stored timestamp %d", clock, future)
+	}
+	node.Put("x", "slow")
+	clock := node.Status().Clock
+	if uint64(clock) <= future {
+		t.Fatalf("a write was stamped %d, not after %d", clock, future)
+	}
+	node.Close()
+
+	node = startMultiLeader(t, fs, "a", nodes)
+	defer node.Close()
+	if restarted := node.Status().Clock; restarted < clock {
+		t.Fatalf("clock went back from %d to %d", clock, restarted)
+	}
+	if val, _, _ := node.Get("x"); val != "slow" {
+		t.Fatalf("Get(x) = %q", val)
+	}
+}
+
+func TestMultiLeaderKeepsVersionsOutOfValues(t *testing.T) {
+	fs := vfs.NewMem()
+	nodes := map[string]string{"a": "127.0.0.1:0"}
+
+	// a value that looks like an encoded record is stored as it is
+	const looksEncoded = `{"v":"other","d":true,"h":1}`
+	node, err := multileader.Start(openFamilies(t, fs), multileader.Config{ID: "a", Nodes: nodes, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Put("j", looksEncoded)
+	node.Put("gone", "1")
+	node.Delete("gone")
+	if val, found, _ := node.Get("j"); !found || val != looksEncoded {
+		t.Fatalf("Get(j) = %q, %v", val, found)
+	}
+	node.Close()
+
+	db := openFamilies(t, fs)
+	defer db.Close()
+	if val, _, _ := db.Get("j"); val != looksEncoded {
+		t.Fatalf("the engine holds %q for j", val)
+	}
+	if _, found, _ := db.Get("gone"); found {
+		t.Fatal("the deleted key is still live")
+	}
+	record, found, err := db.Record("gone")
+	if err != nil || !found || !record.Tombstone || record.Version.Node != "a" || record.Version.Time == 0 {
+		t.Fatalf("Record(gone) = %+v, %v, %v", record, found, err)
+	}
+}
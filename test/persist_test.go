@@ -0,0 +1,204 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+func TestPersistCollapsesRepeatedWrites(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: 2, FS: fs}
+
+	disk, err := diskstore.NewDisk(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := wal.InitWal(fs, "wal.aof")
+
+	for i := 0; i < 500; i++ {
+		w.Write([]byte("+"), []byte("a"), []byte(fmt.Sprint(i)))
+	}
+	w.Write([]byte("+"), []byte("b"), []byte("1"))
+	w.Write([]byte("-"), []byte("b"))
+	w.Write([]byte("+"), []byte("c"), []byte("1"))
+
+	err = disk.Close(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disk, err = diskstore.NewDisk(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close(nil)
+
+	var entries []wal.Entry
+	size := int64(0)
+	for i := 0; i < 2; i++ {
+		entries = append(entries, disk.GetFileContents(i)...)
+
+		dir := fmt.Sprintf("data/partitions/%d", i)
+		names, _ := fs.ReadDir(dir)
+		for _, name := range names {
+			info, err := fs.Stat(dir + "/" + name)
+			if err == nil {
+				size += info.Size()
+			}
+		}
+	}
+
+	if len(entries) != 2 || fmt.Sprint(entries) != "[{a 499 false 0   {0  0}} {c 1 false 0   {0  0}}]" && fmt.Sprint(entries) != "[{c 1 false 0   {0  0}} {a 499 false 0   {0  0}}]" {
+		t.Fatalf("persisted entries = %+v, want a=499 and c=1", entries)
+	}
+	if size > 100 {
+		t.Fatalf("partitions hold %d bytes, the repeated writes were not collapsed", size)
+	}
+}
+
+func TestPersistTriggersOnWALSize(t *testing.T) {
+	fs := vfs.NewMem()
+	disk, err := diskstore.NewDisk(diskstore.DiskStoreOpts{
+		Directory:       "data",
+		NumOfPartitions: 2,
+		PersistInterval: int(time.Hour / time.Millisecond),
+		WALSizeTrigger:  64,
+		FS:              fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := wal.InitWal(fs, "wal.aof")
+	defer disk.Close(w)
+
+	start := make(chan bool, 1)
+	start <- true
+	go disk.PersistToDisk(w, start)
+
+	for i := 0; i < 10; i++ {
+		w.Write([]byte("+"), []byte(fmt.Sprintf("key%d", i)), []byte("value"))
+	}
+
+	key := "key9"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := disk.ReadValue(key, disk.PartitionOf(key))
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the WAL was not persisted once it outgrew the size trigger")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWALKeepsRecordsAfterCheckpoint(t *testing.T) {
+	fs := vfs.NewMem()
+
+	w := wal.InitWal(fs, "wal.aof")
+	w.Write([]byte("+"), []byte("a"), []byte("1"))
+	w.Write([]byte("+"), []byte("b"), []byte("2"))
+	err := w.Persist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := w.ReadEntries()
+
+	// logged while the entries read above were being applied
+	w.Write([]byte("+"), []byte("c"), []byte("3"))
+
+	err = w.DiscardThrough(entries[len(entries)-1].LSN)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = wal.InitWal(fs, "wal.aof")
+	entries = w.ReadEntries()
+	if fmt.Sprint(entries) != "[{c 3 false 3   {0  0}}]" {
+		t.Fatalf("entries after the checkpoint = %+v, want only c at LSN 3", entries)
+	}
+
+	err = w.DiscardThrough(3)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = wal.InitWal(fs, "wal.aof")
+	if lsn := w.LastLSN(); lsn != 3 {
+		t.Fatalf("LastLSN of an emptied log = %d, want 3", lsn)
+	}
+}
+
+func TestPersistAppliesEntriesOnce(t *testing.T) {
+	fs := vfs.NewFault()
+	opts := diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: 1, FS: fs}
+
+	disk, err := diskstore.NewDisk(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := wal.InitWal(fs, "wal.aof")
+	w.Write([]byte("+"), []byte("a"), []byte("1"))
+	w.Write([]byte("+"), []byte("b"), []byte("2"))
+	err = w.Persist()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the partition is applied and synced, rewriting the WAL fails
+	fs.FailWrite(2)
+	err = disk.Close(w)
+	if err == nil {
+		t.Fatal("expected the injected write fault")
+	}
+	fs.Crash()
+
+	partitionSize := func() int64 {
+		size := int64(0)
+		names, _ := fs.ReadDir("data/partitions/0")
+		for _, name := range names {
+			info, err := fs.Stat("data/partitions/0/" + name)
+			if err == nil {
+				size += info.Size()
+			}
+		}
+		return size
+	}
+
+	disk, err = diskstore.NewDisk(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = wal.InitWal(fs, "wal.aof")
+	if len(w.ReadEntries()) != 2 {
+		t.Fatalf("WAL after crash = %+v, want both entries", w.ReadEntries())
+	}
+	if lsn := disk.AppliedLSN(); lsn != 2 {
+		t.Fatalf("AppliedLSN after crash = %d, want 2", lsn)
+	}
+	before := partitionSize()
+
+	err = disk.Close(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after := partitionSize(); after != before {
+		t.Fatalf("replaying the WAL grew the partition from %d to %d bytes", before, after)
+	}
+	if entries := w.ReadEntries(); len(entries) != 0 {
+		t.Fatalf("WAL after replay = %+v, want it empty", entries)
+	}
+}
@@ -0,0 +1,306 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/raft"
+	"github.com/jiteshchawla1511/KryptonDB/server"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// raftSecret is the secret the nodes of the test groups share.
+const raftSecret = "raft secret"
+
+// raftMember is one node of a test group and the server it answers on.
+type raftMember struct {
+	id   string
+	fs   vfs.FS
+	srv  *server.Server
+	node *raft.Node
+	stop func()
+}
+
+func (m *raftMember) addr() string {
+	return m.srv.Addr().String()
+}
+
+// start opens the node of m and serves it on m.srv.
+func (m *raftMember) start(t *testing.T, peers map[string]string, join bool) {
+	node, err := raft.Start(raft.Config{
+		ID:                m.id,
+		Peers:             peers,
+		Join:              join,
+		Secret:            raftSecret,
+		Dir:               "raft",
+		Engine:            raftEngineOptions(m.fs),
+		ElectionTimeout:   150,
+		HeartbeatInterval: 30,
+		SnapshotThreshold: 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.node = node
+	m.srv.Engine = node
+
+	stopServer := serveListening(t, m.srv)
+	m.stop = func() {
+		stopServer()
+		m.node.Close()
+	}
+}
+
+// raftEngineOptions returns the options of the engine of a test node
+// keeping its files in fs.
+func raftEngineOptions(fs vfs.FS) dbengine.Options {
+	return dbengine.Options{
+		LSMTree: lsmtree.LSMTreeOptions{
+			MaximumElement:   8,
+			CompactionPeriod: lsmtree.CompactionFrequency,
+			Directory:        "lsm",
+			BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+				Capacity:  1000,
+				ErrorRate: lsmtree.BloomErrorRate,
+			},
+		},
+		Store: diskstore.DiskStoreOpts{
+			Directory:       "data",
+			NumOfPartitions: 2,
+		},
+		WalPath: "wal.aof",
+		FS:      fs,
+	}
+}
+
+// waitForLeader returns the member the others follow.
+func waitForLeader(t *testing.T, members []*raftMember) *raftMember {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, m := range members {
+			status := m.node.Status()
+			if status.Role != "leader" {
+				continue
+			}
+			followed := true
+			for _, other := range members {
+				if other.node.Status().Leader != m.id {
+					followed = false
+				}
+			}
+			if followed {
+				return m
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader was elected")
+	return nil
+}
+
+// waitForApplied waits until every member holds key with want.
+func waitForApplied(t *testing.T, members []*raftMember, key string, want string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for _, m := range members {
+		for {
+			val, _, err := m.node.LocalGet(key)
+			if err == nil && val == want {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: LocalGet(%s) = %q, %v, want %q", m.id, key, val, err, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func without(members []*raftMember, gone *raftMember) []*raftMember {
+	var rest []*raftMember
+	for _, m := range members {
+		if m != gone {
+			rest = append(rest, m)
+		}
+	}
+	return rest
+}
+
+func TestRaftClusterReplicatesAndFailsOver(t *testing.T) {
+	peers := make(map[string]string)
+	var members []*raftMember
+	for _, id := range []string{"a", "b", "c"} {
+		m := &raftMember{id: id, fs: vfs.NewMem(), srv: listenOn(t, "0")}
+		peers[id] = m.addr()
+		members = append(members, m)
+	}
+	for _, m := range members {
+		m.start(t, peers, false)
+	}
+	defer func() {
+		for _, m := range members {
+			m.stop()
+		}
+	}()
+
+	leader := waitForLeader(t, members)
+	for i := 0; i < 30; i++ {
+		if err := leader.node.Put(fmt.Sprintf("k%02d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leader.node.Merge("n", lsmtree.AddOperator, "3"); err != nil {
+		t.Fatal(err)
+	}
+	waitForApplied(t, members, "k29", "v")
+	waitForApplied(t, members, "n", "3")
+
+	follower := without(members, leader)[0]
+	conn, err := net.Dial("tcp", follower.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	for _, command := range []string{"PUT x 1", "GET x"} {
+		if reply := roundTrip(t, conn, reader, command); reply != "REDIRECT "+leader.addr() {
+			t.Fatalf("%s on a follower replied %q", command, reply)
+		}
+	}
+	conn.Close()
+
+	conn, err = net.Dial("tcp", leader.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = bufio.NewReader(conn)
+	for _, step := range []struct{ command, reply string }{
+		{"PUT x 1", "OK"},
+		{"GET x", "1"},
+		{"RAFT ADD a 127.0.0.1:1", "Member already exists"},
+		{"RAFT REMOVE z", "Member not found"},
+	} {
+		if reply := roundTrip(t, conn, reader, step.command); reply != step.reply {
+			t.Fatalf("%s replied %q, want %q", step.command, reply, step.reply)
+		}
+	}
+	if reply := roundTrip(t, conn, reader, "RAFT STATUS"); !strings.Contains(reply, "role=leader") || !strings.Contains(reply, "members=a,b,c") {
+		t.Fatalf("RAFT STATUS replied %q", reply)
+	}
+	conn.Close()
+
+	// only connections that sent the secret may send the requests of a node
+	conn, err = net.Dial("tcp", leader.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = bufio.NewReader(conn)
+	for _, step := range []struct{ command, reply string }{
+		{`RAFT VOTE {"term":99,"candidate":"x"}`, "Not a peer"},
+		{"RAFT AUTH wrong", "Not a peer"},
+		{`RAFT VOTE {"term":99,"candidate":"x"}`, "Not a peer"},
+		{"RAFT AUTH " + raftSecret, "OK"},
+	} {
+		if reply := roundTrip(t, conn, reader, step.command); reply != step.reply {
+			t.Fatalf("%s replied %q, want %q", step.command, reply, step.reply)
+		}
+	}
+	if reply := roundTrip(t, conn, reader, `RAFT VOTE {"term":0,"candidate":"x"}`); !strings.Contains(reply, `"granted":false`) {
+		t.Fatalf("stale RAFT VOTE of a peer replied %q", reply)
+	}
+	if reply := roundTrip(t, conn, reader, "RAFT STATUS"); !strings.Contains(reply, "role=leader") {
+		t.Fatalf("RAFT STATUS replied %q", reply)
+	}
+	conn.Close()
+
+	// the other two take over and compact their logs past the old leader
+	old := leader
+	_, port, _ := net.SplitHostPort(old.addr())
+	last := old.node.Status().Last
+	old.stop()
+	rest := without(members, old)
+	leader = waitForLeader(t, rest)
+	for i := 0; i < 30; i++ {
+		if err := leader.node.Put(fmt.Sprintf("after%02d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leader.node.Delete("k00"); err != nil {
+		t.Fatal(err)
+	}
+
+	old.srv = listenOn(t, port)
+	old.start(t, peers, false)
+	waitForApplied(t, members, "after29", "v")
+	waitForApplied(t, members, "k00", "")
+	if status := old.node.Status(); status.Snapshot <= last {
+		t.Fatalf("restarted node stopped at %d did not install a snapshot: %s", last, status)
+	}
+
+	// a new node joins, then one of the original ones leaves
+	d := &raftMember{id: "d", fs: vfs.NewMem(), srv: listenOn(t, "0")}
+	d.start(t, peers, true)
+	members = append(members, d)
+	leader = waitForLeader(t, members[:3])
+	if err := leader.node.AddMember("d", d.addr()); err != nil {
+		t.Fatal(err)
+	}
+	waitForApplied(t, members, "after29", "v")
+
+	leaving := without(members, leader)[0]
+	if err := leader.node.RemoveMember(leaving.id); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.node.Put("last", "1"); err != nil {
+		t.Fatal(err)
+	}
+	rest = without(members, leaving)
+	waitForApplied(t, rest, "last", "1")
+	for _, m := range rest {
+		if members := m.node.Status().Members; len(members) != 3 || strings.Contains(strings.Join(members, ","), leaving.id) {
+			t.Fatalf("%s sees members %v after removing %s", m.id, members, leaving.id)
+		}
+	}
+}
+
+func TestRaftAuthenticatesPeers(t *testing.T) {
+	peers := map[string]string{"a": "127.0.0.1:1", "b": "127.0.0.1:2"}
+	_, err := raft.Start(raft.Config{ID: "a", Peers: peers, Dir: "raft", Engine: raftEngineOptions(vfs.NewMem())})
+	if err == nil {
+		t.Fatal("a group without a secret started")
+	}
+
+	// a node waiting to be added answers the nodes of the group it joins,
+	// and nobody while it knows none
+	for _, tc := range []struct {
+		peers map[string]string
+		want  bool
+	}{
+		{nil, false},
+		{peers, true},
+	} {
+		node, err := raft.Start(raft.Config{
+			ID:     "c",
+			Peers:  tc.peers,
+			Join:   true,
+			Secret: raftSecret,
+			Dir:    "raft",
+			Engine: raftEngineOptions(vfs.NewMem()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := node.Authenticate(raftSecret); got != tc.want {
+			t.Fatalf("joining node with peers %v authenticated the secret: %v, want %v", tc.peers, got, tc.want)
+		}
+		if node.Authenticate("wrong") {
+			t.Fatal("joining node authenticated a wrong secret")
+		}
+		node.Close()
+	}
+}
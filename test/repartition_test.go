@@ -0,0 +1,166 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+const repartitionKeys = 300
+
+// fillStore writes repartitionKeys keys to a store with the given number of
+// partitions and returns the partition each one landed in.
+func fillStore(t *testing.T, fs vfs.FS, partitions int) map[string]int {
+	disk, err := diskstore.NewDisk(diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: partitions, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	placed := make(map[string]int)
+	for i := 0; i < repartitionKeys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		placed[key] = disk.PartitionOf(key)
+		err = disk.WriteValue(key, []byte("v"+key), placed[key])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = disk.Close(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return placed
+}
+
+// checkStore reopens the store with the given number of partitions and
+// checks that every key is where PartitionOf says, returning how many keys
+// are not in the partition they had in before.
+func checkStore(t *testing.T, fs vfs.FS, partitions int, before map[string]int) int {
+	disk, err := diskstore.NewDisk(diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: partitions, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close(nil)
+
+	found := 0
+	for i := 0; i < partitions; i++ {
+		found += len(disk.GetFileContents(i))
+	}
+	if found != repartitionKeys {
+		t.Fatalf("%d keys across the partitions, want %d", found, repartitionKeys)
+	}
+
+	moved := 0
+	for key, old := range before {
+		partition := disk.PartitionOf(key)
+		value, err := disk.ReadValue(key, partition)
+		if err != nil || string(value) != "v"+key {
+			t.Fatalf("ReadValue(%s) = %q, %v", key, value, err)
+		}
+		if partition != old {
+			moved++
+		}
+	}
+	return moved
+}
+
+func TestRepartitionMovesAFractionOfKeys(t *testing.T) {
+	fs := vfs.NewMem()
+	before := fillStore(t, fs, 4)
+
+	moved := checkStore(t, fs, 6, before)
+	if moved == 0 || moved > repartitionKeys/2 {
+		t.Fatalf("growing from 4 to 6 partitions moved %d of %d keys", moved, repartitionKeys)
+	}
+
+	checkStore(t, fs, 3, before)
+	names, _ := fs.ReadDir("data/partitions")
+	if fmt.Sprint(names) != "[0 1 2]" {
+		t.Fatalf("partition directories after shrinking = %v", names)
+	}
+}
+
+func TestRepartitionResumesAfterCrash(t *testing.T) {
+	for _, failAt := range []int{5, 40, 120} {
+		fs := vfs.NewFault()
+		before := fillStore(t, fs, 4)
+
+		fs.FailWrite(failAt)
+		_, err := diskstore.NewDisk(diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: 2, FS: fs})
+		if err == nil {
+			t.Fatalf("write %d: expected the injected write fault", failAt)
+		}
+		fs.Crash()
+
+		checkStore(t, fs, 2, before)
+	}
+}
+
+func TestRepartitionKeepsMovedMergesApplied(t *testing.T) {
+	// a key that leaves partition 0 when going from 1 to 4 partitions
+	probe, err := diskstore.NewDisk(diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: 4, FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "counter"
+	for i := 0; probe.PartitionOf(key) == 0; i++ {
+		key = fmt.Sprintf("counter%d", i)
+	}
+	probe.Close(nil)
+
+	fs := vfs.NewFault()
+	disk, err := diskstore.NewDisk(diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: 1, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := wal.InitWal(fs, "wal.aof")
+	w.Write([]byte("&"), []byte(key), []byte(lsmtree.AddOperator), []byte("2"))
+	w.Write([]byte("&"), []byte(key), []byte(lsmtree.AddOperator), []byte("3"))
+	err = w.Persist()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the operands are applied and synced, rewriting the WAL fails
+	fs.FailWrite(2)
+	err = disk.Close(w)
+	if err == nil {
+		t.Fatal("expected the injected write fault")
+	}
+	fs.Crash()
+
+	// the key moves while the WAL still holds its operands, and the store
+	// crashes before a persist cycle discards them
+	_, err = diskstore.NewDisk(diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: 4, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Crash()
+
+	db, err := dbengine.Open(dbengine.Options{
+		LSMTree: lsmtree.LSMTreeOptions{
+			MaximumElement:   lsmtree.MaximumElement,
+			CompactionPeriod: lsmtree.CompactionFrequency,
+			BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+				Capacity:  1000,
+				ErrorRate: lsmtree.BloomErrorRate,
+			},
+		},
+		Store:   diskstore.DiskStoreOpts{Directory: "data", NumOfPartitions: 4},
+		WalPath: "wal.aof",
+		FS:      fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if val, _, _ := db.Get(key); val != "5" {
+		t.Fatalf("%s after repartitioning = %q, want 5", key, val)
+	}
+}
@@ -0,0 +1,304 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/replication"
+	"github.com/jiteshchawla1511/KryptonDB/server"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// listenOn binds a test server on port, "0" for an ephemeral one.
+func listenOn(t *testing.T, port string) *server.Server {
+	srv := &server.Server{
+		Host:          "127.0.0.1",
+		Port:          port,
+		UDPPort:       "0",
+		UDPBufferSize: server.DefaultUDPBufferSize,
+		Heartbeat:     20,
+	}
+	err := srv.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// serveListening serves srv and returns a func that shuts it down without
+// closing its engine.
+func serveListening(t *testing.T, srv *server.Server) func() {
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve()
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := <-served; err != server.ErrServerClosed {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+	}
+}
+
+// serveLeader serves engine on port, see listenOn and serveListening.
+func serveLeader(t *testing.T, engine dbengine.Engine, port string) (*server.Server, func()) {
+	srv := listenOn(t, port)
+	srv.Engine = engine
+	return srv, serveListening(t, srv)
+}
+
+// waitFor polls engine until key holds want, "" for a missing key.
+func waitFor(t *testing.T, engine dbengine.Engine, key string, want string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		val, exist, err := engine.Get(key)
+		if err == nil && val == want && exist == (want != "") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Get(%s) = %q, %v, %v, want %q", key, val, exist, err, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFollowerTailsLeader(t *testing.T) {
+	leaderFS := vfs.NewMem()
+	leader := openFamilies(t, leaderFS)
+	for _, key := range []string{"a1", "a2", "a3"} {
+		if err := leader.Put(key, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// reopening persists the WAL and drops it, so the follower needs a snapshot
+	leader.Close()
+	leader = openFamilies(t, leaderFS)
+	defer func() { leader.Close() }()
+
+	srv, stop := serveLeader(t, leader, "0")
+	addr := srv.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+
+	followerFS := vfs.NewMem()
+	opts := replication.FollowerOptions{Leader: addr, RetryPeriod: 20}
+	follower := replication.StartFollower(openFamilies(t, followerFS), opts)
+
+	waitFor(t, follower, "a3", "old")
+	leader.Delete("a1")
+	leader.Merge("n", lsmtree.AddOperator, "5")
+	leader.Batch([]dbengine.Op{{Key: "b", Value: "1"}, {Key: "n", Value: "2", Merge: lsmtree.AddOperator}})
+	waitFor(t, follower, "b", "1")
+	waitFor(t, follower, "a1", "")
+	waitFor(t, follower, "n", "7")
+
+	if err := follower.Put("b", "2"); err != replication.ErrReadOnly {
+		t.Fatalf("Put on a follower = %v, want ErrReadOnly", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for status := follower.Status(); !status.Connected || status.Lag() != 0 || status.Applied != leader.LastLSN(); status = follower.Status() {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower status %s, leader at %d", status, leader.LastLSN())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := roundTrip(t, conn, bufio.NewReader(conn), "REPLICATION")
+	conn.Close()
+	if !strings.HasPrefix(reply, "role=leader") || !strings.Contains(reply, "followers=1") {
+		t.Fatalf("REPLICATION on the leader replied %q", reply)
+	}
+
+	// a restarted follower resumes after the last LSN it logged
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+	leader.Put("c", "1")
+	follower = replication.StartFollower(openFamilies(t, followerFS), opts)
+	defer func() { follower.Close() }()
+	waitFor(t, follower, "c", "1")
+	waitFor(t, follower, "n", "7")
+
+	// the leader restarts without the records the follower is missing
+	stop()
+	leader.Delete("a2")
+	leader.Put("d", "1")
+	leader.Close()
+	leader = openFamilies(t, leaderFS)
+	_, stop = serveLeader(t, leader, port)
+	defer stop()
+
+	waitFor(t, follower, "d", "1")
+	waitFor(t, follower, "a2", "")
+	waitFor(t, follower, "a3", "old")
+	waitFor(t, follower, "n", "7")
+}
+
+// waitForFamily is waitFor for a column family of follower, which it looks
+// up again on every poll as the family may not be there yet or be replaced.
+func waitForFamily(t *testing.T, follower *replication.Follower, name string, key string, want string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		family, err := follower.Family(name)
+		var val string
+		var exist bool
+		if err == nil {
+			val, exist, err = family.Get(key)
+		}
+		if err == nil && val == want && exist == (want != "") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Get(%s) in %s = %q, %v, %v, want %q", key, name, val, exist, err, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFollowerReplicatesColumnFamilies(t *testing.T) {
+	leaderFS := vfs.NewMem()
+	leader := openFamilies(t, leaderFS)
+	if err := leader.CreateFamily("users", dbengine.FamilyOptions{MaximumElement: 8}); err != nil {
+		t.Fatal(err)
+	}
+	users, _ := leader.Family("users")
+	users.Put("u1", "ann")
+	leader.CreateFamily("gone", dbengine.FamilyOptions{})
+	leader.Put("k", "default")
+	// reopening drops the WAL, so the follower needs a snapshot
+	leader.Close()
+	leader = openFamilies(t, leaderFS)
+	defer func() { leader.Close() }()
+
+	srv, stop := serveLeader(t, leader, "0")
+	defer stop()
+
+	followerFS := vfs.NewMem()
+	opts := replication.FollowerOptions{Leader: srv.Addr().String(), RetryPeriod: 20}
+	followerDB := openFamilies(t, followerFS)
+	// a family the leader does not have is dropped by the snapshot
+	followerDB.CreateFamily("stale", dbengine.FamilyOptions{})
+	follower := replication.StartFollower(followerDB, opts)
+
+	waitForFamily(t, follower, "users", "u1", "ann")
+	waitFor(t, follower, "k", "default")
+	if _, err := follower.Family("stale"); err != dbengine.ErrFamilyNotFound {
+		t.Fatalf("Family(stale) on the follower = %v, want ErrFamilyNotFound", err)
+	}
+	if family, _ := follower.Family("users"); family.Put("u2", "bob") != replication.ErrReadOnly {
+		t.Fatal("Put on a family of a follower did not fail with ErrReadOnly")
+	}
+	if err := follower.CreateFamily("new", dbengine.FamilyOptions{}); err != replication.ErrReadOnly {
+		t.Fatalf("CreateFamily on a follower = %v, want ErrReadOnly", err)
+	}
+
+	// families created and dropped later are shipped with the writes
+	users, _ = leader.Family("users")
+	users.Put("u2", "bob")
+	leader.CreateFamily("orders", dbengine.FamilyOptions{})
+	orders, _ := leader.Family("orders")
+	orders.Batch([]dbengine.Op{{Key: "o1", Value: "1"}, {Key: "u3", Value: "cy", Family: "users"}})
+	leader.DropFamily("gone")
+	waitForFamily(t, follower, "orders", "o1", "1")
+	waitForFamily(t, follower, "users", "u3", "cy")
+	waitForFamily(t, follower, "users", "u2", "bob")
+	deadline := time.Now().Add(5 * time.Second)
+	for _, err := follower.Family("gone"); err != dbengine.ErrFamilyNotFound; _, err = follower.Family("gone") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Family(gone) on the follower = %v after the leader dropped it", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// a family dropped and created again holds none of the old writes
+	leader.DropFamily("orders")
+	leader.CreateFamily("orders", dbengine.FamilyOptions{})
+	orders, _ = leader.Family("orders")
+	orders.Put("o2", "2")
+	waitForFamily(t, follower, "orders", "o2", "2")
+	waitForFamily(t, follower, "orders", "o1", "")
+
+	// the families are there again once the follower restarts
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+	follower = replication.StartFollower(openFamilies(t, followerFS), opts)
+	defer func() { follower.Close() }()
+	waitForFamily(t, follower, "users", "u3", "cy")
+	waitForFamily(t, follower, "orders", "o2", "2")
+	waitForFamily(t, follower, "orders", "o1", "")
+}
+
+func TestReplayRefusesUnknownFamily(t *testing.T) {
+	db := openFamilies(t, vfs.NewMem())
+	defer db.Close()
+
+	if err := db.Replay("#5|*|1|~nope|+|k|v|"); err != dbengine.ErrFamilyNotFound {
+		t.Fatalf("Replay to a missing family = %v, want ErrFamilyNotFound", err)
+	}
+	if lsn := db.LastLSN(); lsn != 0 {
+		t.Fatalf("Replay logged a record it refused, last LSN %d", lsn)
+	}
+
+	// a record that creates the family first applies
+	if err := db.Replay("#5|*|2|!|+|nope|{}|~nope|+|k|v|"); err != nil {
+		t.Fatal(err)
+	}
+	family, err := db.Family("nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := family.Get("k"); val != "v" {
+		t.Fatalf("Get(k) = %q after the record created the family", val)
+	}
+}
+
+func TestServerRejectsWritesOnFollower(t *testing.T) {
+	leader := startServer(t)
+	follower := replication.StartFollower(openFamilies(t, vfs.NewMem()), replication.FollowerOptions{Leader: leader.Addr().String()})
+	defer follower.Close()
+
+	srv, stop := serveLeader(t, follower, "0")
+	defer stop()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for _, step := range []struct{ command, reply string }{
+		{"PUT k v", "Read only replica"},
+		{"DEL k", "Read only replica"},
+		{"INCR n", "Read only replica"},
+		{"GET k", "Data not found"},
+		{"REPLICATE 0", "Replication not supported"},
+		{"REPLICATE x", "Invalid command"},
+	} {
+		if reply := roundTrip(t, conn, reader, step.command); reply != step.reply {
+			t.Fatalf("%s replied %q, want %q", step.command, reply, step.reply)
+		}
+	}
+
+	if reply := roundTrip(t, conn, reader, "REPLICATION"); !strings.HasPrefix(reply, "role=follower leader="+leader.Addr().String()) {
+		t.Fatalf("REPLICATION on the follower replied %q", reply)
+	}
+}
@@ -0,0 +1,128 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+	"github.com/jiteshchawla1511/KryptonDB/wal"
+)
+
+func archivingOptions(fs vfs.FS, dir string) dbengine.Options {
+	return dbengine.Options{
+		LSMTree: lsmtree.LSMTreeOptions{
+			MaximumElement:   4,
+			CompactionPeriod: lsmtree.CompactionFrequency,
+			Directory:        dir + "/lsm",
+			BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+				Capacity:  1000,
+				ErrorRate: lsmtree.BloomErrorRate,
+			},
+		},
+		Store: diskstore.DiskStoreOpts{
+			Directory:       dir + "/data",
+			NumOfPartitions: 2,
+		},
+		WalPath:    dir + "/wal.aof",
+		WALArchive: "archive",
+		FS:         fs,
+	}
+}
+
+func TestRestoreReplaysArchiveToTarget(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := archivingOptions(fs, "live")
+
+	write := func(ops ...dbengine.Op) uint64 {
+		db, err := dbengine.Open(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Batch(ops)
+		lsn := db.WAL.LastLSN()
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lsn
+	}
+
+	write(dbengine.Op{Key: "a", Value: "1"})
+	db, err := dbengine.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Checkpoint("backup")
+	if err == nil {
+		err = db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := write(dbengine.Op{Key: "b", Value: "1"}, dbengine.Op{Key: "n", Value: "1", Merge: lsmtree.AddOperator})
+	time.Sleep(5 * time.Millisecond)
+	deployed := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	write(dbengine.Op{Key: "a", Delete: true}, dbengine.Op{Key: "garbage", Value: "x"})
+
+	check := func(dir string, want map[string]string) {
+		opts := archivingOptions(fs, dir)
+		opts.WALArchive = ""
+		restored, err := dbengine.Open(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+
+		for _, key := range []string{"a", "b", "n", "garbage"} {
+			val, exist, _ := restored.Get(key)
+			if want[key] != val || exist != (want[key] != "") {
+				t.Fatalf("%s: Get(%s) = %q, %v, want %q", dir, key, val, exist, want[key])
+			}
+		}
+	}
+
+	for _, step := range []struct {
+		dir    string
+		target wal.Target
+		want   map[string]string
+	}{
+		{"by-time", wal.Target{Time: deployed}, map[string]string{"a": "1", "b": "1", "n": "1"}},
+		{"by-lsn", wal.Target{LSN: good}, map[string]string{"a": "1", "b": "1", "n": "1"}},
+		{"all", wal.Target{}, map[string]string{"b": "1", "n": "1", "garbage": "x"}},
+	} {
+		lsn, err := dbengine.Restore(archivingOptions(fs, step.dir), "backup", step.target)
+		if err != nil {
+			t.Fatalf("%s: %v", step.dir, err)
+		}
+		if step.target.LSN != 0 && lsn != step.target.LSN {
+			t.Fatalf("%s: restored to LSN %d, want %d", step.dir, lsn, step.target.LSN)
+		}
+		check(step.dir, step.want)
+	}
+
+	if _, err := dbengine.Restore(archivingOptions(fs, "all"), "backup", wal.Target{}); err != dbengine.ErrRestoreExists {
+		t.Fatalf("Restore over a database = %v, want ErrRestoreExists", err)
+	}
+	if _, err := dbengine.Restore(archivingOptions(fs, "old"), "backup", wal.Target{Time: deployed.Add(-time.Hour)}); err != dbengine.ErrTargetBeforeCheckpoint {
+		t.Fatalf("Restore to before the checkpoint = %v, want ErrTargetBeforeCheckpoint", err)
+	}
+	if _, err := dbengine.Restore(archivingOptions(fs, "none"), "live", wal.Target{}); err != dbengine.ErrNotCheckpoint {
+		t.Fatalf("Restore from a database = %v, want ErrNotCheckpoint", err)
+	}
+
+	// without the segment that follows the checkpoint the archive has a gap
+	names, _ := fs.ReadDir("archive")
+	for _, name := range names[:2] {
+		fs.Remove("archive/" + name)
+	}
+	if _, err := dbengine.Restore(archivingOptions(fs, "gap"), "backup", wal.Target{}); err != wal.ErrArchiveGap {
+		t.Fatalf("Restore over a gap = %v, want ErrArchiveGap", err)
+	}
+}
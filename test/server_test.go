@@ -0,0 +1,152 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	diskstore "github.com/jiteshchawla1511/KryptonDB/diskStore"
+	"github.com/jiteshchawla1511/KryptonDB/server"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// startServer runs a server backed by an in-memory filesystem on ephemeral
+// ports and stops it when the test ends.
+func startServer(tb testing.TB) *server.Server {
+	engine, err := dbengine.Open(dbengine.Options{
+		LSMTree: lsmtree.LSMTreeOptions{
+			MaximumElement:   lsmtree.MaximumElement,
+			CompactionPeriod: lsmtree.CompactionFrequency,
+			BloomFilterOptions: lsmtree.CustomBloomFilterOptions{
+				Capacity:  1000,
+				ErrorRate: lsmtree.BloomErrorRate,
+			},
+		},
+		Store: diskstore.DiskStoreOpts{
+			Directory:       "data",
+			NumOfPartitions: diskstore.DefaultNumOfPartitions,
+		},
+		WalPath: "wal.aof",
+		FS:      vfs.NewMem(),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	srv := &server.Server{
+		Host:          "127.0.0.1",
+		Port:          "0",
+		UDPPort:       "0",
+		UDPBufferSize: server.DefaultUDPBufferSize,
+		Engine:        engine,
+	}
+
+	err = srv.Listen()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve()
+	}()
+
+	tb.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			tb.Error(err)
+		}
+		if err := <-served; err != server.ErrServerClosed {
+			tb.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+		engine.Close()
+	})
+
+	return srv
+}
+
+func roundTrip(t *testing.T, conn net.Conn, reader *bufio.Reader, command string) string {
+	_, err := conn.Write([]byte(command + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply[:len(reply)-1]
+}
+
+func TestServersOnEphemeralPorts(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		srv := startServer(t)
+
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		if reply := roundTrip(t, conn, reader, "PUT key value"); reply != "OK" {
+			t.Fatalf("PUT replied %q", reply)
+		}
+		if reply := roundTrip(t, conn, reader, "GET key"); reply != "value" {
+			t.Fatalf("GET replied %q", reply)
+		}
+
+		udp, err := net.Dial("udp", srv.UDPAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer udp.Close()
+
+		udp.Write([]byte("GET key\n"))
+		buf := make([]byte, 64)
+		udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := udp.Read(buf)
+		if err != nil || string(buf[:n]) != "value" {
+			t.Fatalf("UDP GET replied %q, %v", buf[:n], err)
+		}
+	}
+}
+
+func TestShutdownDrainsIdleConnections(t *testing.T) {
+	srv := startServer(t)
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	roundTrip(t, conn, reader, "PUT key value")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server closes the idle connection once it is drained
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = reader.ReadString('\n')
+	if err == nil {
+		t.Fatal("connection still open after Shutdown")
+	}
+
+	_, err = net.Dial("tcp", srv.Addr().String())
+	if err == nil {
+		t.Fatal("server still accepting after Shutdown")
+	}
+}
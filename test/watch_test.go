@@ -0,0 +1,251 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	dbengine "github.com/jiteshchawla1511/KryptonDB/dbEngine"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// watch sends command to addr and returns the connection once it replied
+// want.
+func watch(t *testing.T, addr string, command string, want string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	if reply := roundTrip(t, conn, reader, command); reply != want {
+		conn.Close()
+		t.Fatalf("%s replied %q, want %q", command, reply, want)
+	}
+	return conn, reader
+}
+
+// expectLines reads the next lines of a watch and compares them to want.
+func expectLines(t *testing.T, conn net.Conn, reader *bufio.Reader, want ...string) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, line := range want {
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading %q: %v", line, err)
+		}
+		if got[:len(got)-1] != line {
+			t.Fatalf("watch sent %q, want %q", got[:len(got)-1], line)
+		}
+	}
+}
+
+func TestWatchStreamsCommittedWrites(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := archivingOptions(fs, "live")
+
+	// closing persists the WAL, so the first writes are only archived
+	db, err := dbengine.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("user:1", "ann")
+	db.Put("other", "1")
+	db.Put("user:2", "bob")
+	db.Close()
+
+	db, err = dbengine.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	srv, stop := serveLeader(t, db, "0")
+	defer stop()
+	addr := srv.Addr().String()
+
+	conn, reader := watch(t, addr, "WATCH user: FROM 0", "OK 0")
+	defer conn.Close()
+	expectLines(t, conn, reader, "1 PUT user:1 ann", "3 PUT user:2 bob")
+
+	// without a prefix every key is watched
+	all, allReader := watch(t, addr, "WATCH FROM 1", "OK 1")
+	expectLines(t, all, allReader, "2 PUT other 1", "3 PUT user:2 bob")
+	all.Close()
+
+	live, liveReader := watch(t, addr, "WATCH user:", fmt.Sprintf("OK %d", db.LastLSN()))
+	defer live.Close()
+
+	db.Delete("user:1")
+	deleted := db.LastLSN()
+	db.Put("other", "2")
+	db.Batch([]dbengine.Op{{Key: "user:3", Value: "cy"}, {Key: "other", Value: "3"}, {Key: "user:4", Value: "dee"}})
+	batch := db.LastLSN()
+	db.Merge("user:n", lsmtree.AddOperator, "5")
+	merged := db.LastLSN()
+	// only synced writes are streamed, reading syncs the WAL
+	db.Get("user:n")
+
+	want := []string{
+		fmt.Sprintf("%d DEL user:1", deleted),
+		fmt.Sprintf("%d PUT user:3 cy", batch),
+		fmt.Sprintf("%d PUT user:4 dee", batch),
+		fmt.Sprintf("%d MERGE user:n %s 5", merged, lsmtree.AddOperator),
+	}
+	expectLines(t, conn, reader, want...)
+	expectLines(t, live, liveReader, want...)
+
+	// a client that saw the delete resumes after it
+	resumed, resumedReader := watch(t, addr, fmt.Sprintf("WATCH user:4 FROM %d", deleted), fmt.Sprintf("OK %d", deleted))
+	defer resumed.Close()
+	expectLines(t, resumed, resumedReader, want[2])
+
+	for command, reply := range map[string]string{
+		"WATCH user: FROM x":     "Invalid command",
+		"WATCH user: SINCE 1":    "Invalid command",
+		"WATCH user: FROM":       "Invalid command",
+		"WATCH user: FROM 99999": "Sequence not retained",
+	} {
+		c, _ := watch(t, addr, command, reply)
+		c.Close()
+	}
+
+	// without an archive the records discarded from the WAL are gone
+	opts = archivingOptions(vfs.NewMem(), "live")
+	opts.WALArchive = ""
+	plain, err := dbengine.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Put("user:1", "ann")
+	plain.Close()
+	plain, err = dbengine.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainSrv, stopPlain := serveLeader(t, plain, "0")
+	defer func() {
+		stopPlain()
+		plain.Close()
+	}()
+	c, _ := watch(t, plainSrv.Addr().String(), "WATCH user: FROM 0", "Sequence not retained")
+	c.Close()
+
+	memSrv, stopMem := serveLeader(t, dbengine.NewMemory(), "0")
+	defer stopMem()
+	c, _ = watch(t, memSrv.Addr().String(), "WATCH user:", "Watch not supported")
+	c.Close()
+}
+
+func TestWatchStreamsOnlySyncedWrites(t *testing.T) {
+	opts := archivingOptions(vfs.NewMem(), "live")
+	opts.Store.PersistInterval = int(time.Hour / time.Millisecond)
+	db, err := dbengine.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("user:1", "ann")
+	feed, err := db.Changes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+	if len(feed.Backlog) != 0 {
+		t.Fatalf("backlog holds %q before the WAL was synced", feed.Backlog)
+	}
+
+	db.Put("user:2", "bob")
+	select {
+	case record := <-feed.Records():
+		t.Fatalf("feed got %q before the WAL was synced", record)
+	default:
+	}
+
+	db.Get("user:2")
+	var got []string
+	for len(got) < 2 {
+		select {
+		case record := <-feed.Records():
+			got = append(got, record)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("feed got %q once the WAL was synced, want both writes", got)
+		}
+	}
+	if got[0] != "#1|+|user:1|ann|" || got[1] != "#2|+|user:2|bob|" {
+		t.Fatalf("feed got %q", got)
+	}
+}
+
+func TestWatchKeepsUpWithoutBlockingWriters(t *testing.T) {
+	// the memory file system copies a file on every write, which would make
+	// a large WAL slow
+	dir := t.TempDir()
+	opts := archivingOptions(vfs.Default, dir)
+	opts.LSMTree.MaximumElement = lsmtree.MaximumElement
+	opts.WALArchive = filepath.Join(dir, "archive")
+	db, err := dbengine.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	srv, stop := serveLeader(t, db, "0")
+	defer stop()
+
+	conn, reader := watch(t, srv.Addr().String(), "WATCH k FROM 0", "OK 0")
+	defer conn.Close()
+
+	// the client reads nothing until every write is made: the large values
+	// fill the socket buffers, the writes after them the feed
+	const writes = 5000
+	value := func(i int) string {
+		if i < 200 {
+			return strings.Repeat("v", 64*1024)
+		}
+		return "v"
+	}
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < writes; i++ {
+			err := db.Put(fmt.Sprintf("k%05d", i), value(i))
+			if err == nil && i%10 == 0 {
+				err = db.Put("skipped", "v")
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("writes are held back by the watch")
+	}
+
+	var last uint64
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	for i := 0; i < writes; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 4)
+		var seq uint64
+		if len(fields) == 4 {
+			seq, err = strconv.ParseUint(fields[0], 10, 64)
+		}
+		if len(fields) != 4 || err != nil || seq <= last || fields[1] != "PUT" || fields[2] != fmt.Sprintf("k%05d", i) || fields[3] != value(i) {
+			t.Fatalf("watch sent %.40q after %d, want k%05d", line, last, i)
+		}
+		last = seq
+	}
+}
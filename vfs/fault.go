@@ -0,0 +1,166 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// FaultFS is a MemFS that can be told to fail. After FailWrite(n) the nth
+// write from then on is torn, only half of it reaching the file, and every
+// write, sync, rename and removal after it fails as if the disk had gone
+// away. Crash drops whatever was not synced and clears the fault.
+type FaultFS struct {
+	*MemFS
+	lock   sync.Mutex
+	writes int
+	failAt int
+	failed bool
+}
+
+func NewFault() *FaultFS {
+	return &FaultFS{MemFS: NewMem()}
+}
+
+// FailWrite arms the fault for the nth write counted from now, n >= 1.
+func (fs *FaultFS) FailWrite(n int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.writes = 0
+	fs.failAt = n
+}
+
+// Failed reports whether the armed fault has fired.
+func (fs *FaultFS) Failed() bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.failed
+}
+
+func (fs *FaultFS) Crash() {
+	fs.lock.Lock()
+	fs.writes = 0
+	fs.failAt = 0
+	fs.failed = false
+	fs.lock.Unlock()
+
+	fs.MemFS.Crash()
+}
+
+// nextWrite counts a write and reports how much of it may go through: all
+// of it, half of it for the faulty write, or none once the fault fired.
+func (fs *FaultFS) nextWrite(size int) (int, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.failed {
+		return 0, ErrInjected
+	}
+	if fs.failAt == 0 {
+		return size, nil
+	}
+
+	fs.writes++
+	if fs.writes < fs.failAt {
+		return size, nil
+	}
+	fs.failed = true
+	return size / 2, ErrInjected
+}
+
+func (fs *FaultFS) check() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.failed {
+		return ErrInjected
+	}
+	return nil
+}
+
+func (fs *FaultFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *FaultFS) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		if err := fs.check(); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: fs}, nil
+}
+
+func (fs *FaultFS) Rename(oldname string, newname string) error {
+	if err := fs.check(); err != nil {
+		return err
+	}
+	return fs.MemFS.Rename(oldname, newname)
+}
+
+func (fs *FaultFS) Link(oldname string, newname string) error {
+	if err := fs.check(); err != nil {
+		return err
+	}
+	return fs.MemFS.Link(oldname, newname)
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	if err := fs.check(); err != nil {
+		return err
+	}
+	return fs.MemFS.Remove(name)
+}
+
+func (fs *FaultFS) SyncDir(dir string) error {
+	if err := fs.check(); err != nil {
+		return err
+	}
+	return fs.MemFS.SyncDir(dir)
+}
+
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	return fs.MemFS.Lock(name)
+}
+
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	allowed, fault := f.fs.nextWrite(len(p))
+	if allowed == 0 && fault != nil {
+		return 0, fault
+	}
+
+	n, err := f.File.Write(p[:allowed])
+	if err != nil {
+		return n, err
+	}
+	return n, fault
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.check(); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.check(); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package vfs
+
+import "os"
+
+// lockFile is a no-op where flock is not available.
+func lockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,428 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemFS is an in-memory FS. Besides the live state it keeps what would
+// survive a power cut: the contents of each file as of its last Sync and the
+// entries of each directory as of its last SyncDir. Crash rolls back to it.
+type MemFS struct {
+	lock       sync.Mutex
+	files      map[string]*memNode
+	durable    map[string]*memNode
+	dirs       map[string]bool
+	locks      map[string]bool
+	generation int
+}
+
+type memNode struct {
+	data    []byte
+	synced  []byte
+	modTime time.Time
+}
+
+func NewMem() *MemFS {
+	return &MemFS{
+		files:   make(map[string]*memNode),
+		durable: make(map[string]*memNode),
+		dirs:    map[string]bool{".": true, "/": true},
+		locks:   make(map[string]bool),
+	}
+}
+
+// Crash discards everything that was not synced, as a power cut would.
+// Files opened before the crash stop working.
+func (fs *MemFS) Crash() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.generation++
+	fs.locks = make(map[string]bool)
+	fs.files = make(map[string]*memNode, len(fs.durable))
+
+	restored := make(map[*memNode]*memNode)
+	for name, node := range fs.durable {
+		if restored[node] == nil {
+			restored[node] = &memNode{
+				data:    append([]byte(nil), node.synced...),
+				synced:  append([]byte(nil), node.synced...),
+				modTime: node.modTime,
+			}
+		}
+		fs.files[name] = restored[node]
+	}
+
+	fs.durable = make(map[string]*memNode, len(fs.files))
+	for name, node := range fs.files {
+		fs.durable[name] = node
+	}
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *MemFS) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := fs.files[name]
+
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok:
+		if !fs.dirs[filepath.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		node = &memNode{modTime: time.Now()}
+		fs.files[name] = node
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+	}
+
+	return &memFile{fs: fs, node: node, name: name, flag: flag, generation: fs.generation}, nil
+}
+
+func (fs *MemFS) Rename(oldname string, newname string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	node, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+
+	delete(fs.files, oldname)
+	fs.files[newname] = node
+	return nil
+}
+
+// Link shares the node of oldname with newname, so that writes through one
+// name are seen through the other.
+func (fs *MemFS) Link(oldname string, newname string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	node, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := fs.files[newname]; ok || fs.dirs[newname] {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if !fs.dirs[filepath.Dir(newname)] {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+
+	fs.files[newname] = node
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+
+	if fs.dirs[name] {
+		for other := range fs.files {
+			if filepath.Dir(other) == name {
+				return &os.PathError{Op: "remove", Path: name, Err: os.ErrExist}
+			}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) MkdirAll(dir string, perm os.FileMode) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for dir = filepath.Clean(dir); !fs.dirs[dir]; dir = filepath.Dir(dir) {
+		if _, ok := fs.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: os.ErrExist}
+		}
+		fs.dirs[dir] = true
+	}
+	return nil
+}
+
+func (fs *MemFS) ReadDir(dir string) ([]string, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	dir = filepath.Clean(dir)
+	if !fs.dirs[dir] {
+		return nil, &os.PathError{Op: "readdir", Path: dir, Err: os.ErrNotExist}
+	}
+
+	var names []string
+	for name := range fs.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range fs.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if node, ok := fs.files[name]; ok {
+		return memFileInfo{name: filepath.Base(name), size: int64(len(node.data)), modTime: node.modTime}, nil
+	}
+	if fs.dirs[name] {
+		return memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) SyncDir(dir string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	dir = filepath.Clean(dir)
+	for name := range fs.durable {
+		if filepath.Dir(name) == dir {
+			delete(fs.durable, name)
+		}
+	}
+	for name, node := range fs.files {
+		if filepath.Dir(name) == dir {
+			fs.durable[name] = node
+		}
+	}
+	return nil
+}
+
+func (fs *MemFS) Lock(name string) (io.Closer, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if fs.locks[name] {
+		return nil, ErrLocked
+	}
+	fs.locks[name] = true
+	return &memLock{fs: fs, name: name, generation: fs.generation}, nil
+}
+
+type memLock struct {
+	fs         *MemFS
+	name       string
+	generation int
+}
+
+func (l *memLock) Close() error {
+	l.fs.lock.Lock()
+	defer l.fs.lock.Unlock()
+
+	if l.generation == l.fs.generation {
+		delete(l.fs.locks, l.name)
+	}
+	return nil
+}
+
+type memFile struct {
+	fs         *MemFS
+	node       *memNode
+	name       string
+	flag       int
+	offset     int64
+	generation int
+	closed     bool
+}
+
+// check must be called with fs.lock held.
+func (f *memFile) check() error {
+	if f.closed || f.generation != f.fs.generation {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	n, err := f.readAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, f.node.data[off:]), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return memFileInfo{name: filepath.Base(f.name), size: int64(len(f.node.data)), modTime: f.node.modTime}, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	f.node.synced = append([]byte(nil), f.node.data...)
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size:size]
+	} else {
+		data := make([]byte, size)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
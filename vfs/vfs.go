@@ -0,0 +1,237 @@
+// Package vfs is the filesystem used by the storage code. Going through FS
+// instead of the os package lets tests run against memory and inject faults.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// File is the subset of *os.File the storage code relies on.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+type FS interface {
+	// Open opens name read only.
+	Open(name string) (File, error)
+	// Create creates or truncates name and opens it read write.
+	Create(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldname string, newname string) error
+	// Link makes newname a hard link to oldname. newname must not exist.
+	Link(oldname string, newname string) error
+	Remove(name string) error
+	MkdirAll(dir string, perm os.FileMode) error
+	// ReadDir returns the sorted names of the entries in dir.
+	ReadDir(dir string) ([]string, error)
+	Stat(name string) (os.FileInfo, error)
+	// SyncDir makes creations, renames and removals in dir durable.
+	SyncDir(dir string) error
+	// Lock takes an exclusive lock on name, held until the closer is closed.
+	Lock(name string) (io.Closer, error)
+}
+
+var (
+	ErrLocked   = errors.New("vfs: file is locked")
+	ErrInjected = errors.New("vfs: injected fault")
+)
+
+// Default is the operating system filesystem.
+var Default FS = OS{}
+
+// OS implements FS on top of the os package.
+type OS struct{}
+
+func (OS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (OS) Create(name string) (File, error) {
+	return os.Create(name)
+}
+
+func (OS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (OS) Rename(oldname string, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (OS) Link(oldname string, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (OS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OS) MkdirAll(dir string, perm os.FileMode) error {
+	return os.MkdirAll(dir, perm)
+}
+
+func (OS) ReadDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
+}
+
+func (OS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OS) SyncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func (OS) Lock(name string) (io.Closer, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// ReadFile reads the whole of name.
+func ReadFile(fs FS, name string) ([]byte, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// WriteFileAtomic replaces name with data by writing a synced temporary file
+// and renaming it over the old one.
+func WriteFileAtomic(fs FS, name string, data []byte) error {
+	tmp := name + ".tmp"
+	file, err := fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+
+	err = fs.Rename(tmp, name)
+	if err != nil {
+		return err
+	}
+	return fs.SyncDir(filepath.Dir(name))
+}
+
+// RemoveAll removes dir and everything below it and syncs its parent. It
+// succeeds when dir does not exist.
+func RemoveAll(fs FS, dir string) error {
+	names, err := fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		info, err := fs.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			err = RemoveAll(fs, path)
+		} else {
+			err = fs.Remove(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = fs.Remove(dir)
+	if err != nil {
+		return err
+	}
+	return fs.SyncDir(filepath.Dir(dir))
+}
+
+// CopyFile writes the first size bytes of src, or all of it when size is
+// negative, to a new synced file dst.
+func CopyFile(fs FS, src string, dst string, size int64) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var reader io.Reader = in
+	if size >= 0 {
+		reader = io.LimitReader(in, size)
+	}
+
+	out, err := fs.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, reader)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fs.Remove(dst)
+	}
+	return err
+}
+
+// LinkOrCopy hard links src to dst and falls back to copying it when the
+// link cannot be made, as across filesystems.
+func LinkOrCopy(fs FS, src string, dst string) error {
+	err := fs.Link(src, dst)
+	if err == nil || errors.Is(err, os.ErrExist) || errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return CopyFile(fs, src, dst, -1)
+}
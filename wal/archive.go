@@ -0,0 +1,172 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+// archiveSuffix ends the name of an archive segment, which is the LSN it
+// was discarded through, zero padded so that the names sort in log order.
+const archiveSuffix = ".wal"
+
+var ErrArchiveGap = errors.New("wal archive does not continue from the restored LSN")
+
+// Target bounds a point-in-time restore. Records with an LSN above LSN, or
+// written after Time, are left out; a zero field does not bound it.
+type Target struct {
+	LSN  uint64
+	Time time.Time
+}
+
+// SetArchive makes DiscardThrough move the records it drops to a segment
+// file in dir instead of throwing them away, and makes the log record the
+// time its records are written, so that AppendArchived can replay them up
+// to a point in time.
+func (w *WAL) SetArchive(dir string) error {
+	err := w.fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.archive = dir
+	return nil
+}
+
+// mark writes a timeOp record ahead of the record with the given LSN when
+// the clock moved on since the last one. The caller must hold w.lock.
+func (w *WAL) mark(lsn uint64) {
+	if w.archive == "" {
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	if now == w.lastMark {
+		return
+	}
+	w.lastMark = now
+
+	n, _ := w.writer.WriteString(lsnPrefix + strconv.FormatUint(lsn, 10) + "|" + timeOp + "|" + strconv.FormatInt(now, 10) + "|\n")
+	w.grew(n)
+}
+
+// archiveThrough writes the records with an LSN at or below lsn to a new
+// archive segment. A crash before the log is rewritten archives them again
+// on the next discard, AppendArchived skips the repeats. The caller must
+// hold w.lock.
+func (w *WAL) archiveThrough(records []record, lsn uint64) error {
+	var archived strings.Builder
+	for _, r := range records {
+		if r.lsn <= lsn {
+			archived.WriteString(r.line + "\n")
+		}
+	}
+	if archived.Len() == 0 {
+		return nil
+	}
+
+	name := filepath.Join(w.archive, fmt.Sprintf("%020d%s", lsn, archiveSuffix))
+	return vfs.WriteFileAtomic(w.fs, name, []byte(archived.String()))
+}
+
+// AppendArchived appends the records archived in dir that come after the
+// LSN after and fall within target to the log at path, and returns the LSN
+// of the last record of the log. Records from before the first timeOp
+// record of the archive have no known time and are kept. It fails with
+// ErrArchiveGap when a segment the restore needs is missing.
+func AppendArchived(fs vfs.FS, dir string, path string, after uint64, target Target) (uint64, error) {
+	lines, last, err := ReadArchived(fs, dir, after, target)
+	if err != nil {
+		return 0, err
+	}
+
+	var replayed strings.Builder
+	for _, line := range lines {
+		replayed.WriteString(line + "\n")
+	}
+
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = file.Write([]byte(replayed.String()))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return last, fs.SyncDir(filepath.Dir(path))
+}
+
+// ReadArchived returns the records archived in dir that come after the LSN
+// after and fall within target, in LSN order, and the LSN of the last one,
+// after when there is none. It fails with ErrArchiveGap when a segment
+// holding some of them is missing.
+func ReadArchived(fs vfs.FS, dir string, after uint64, target Target) ([]string, uint64, error) {
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	last := after
+	var written int64
+	var lines []string
+
+segments:
+	for _, name := range names {
+		if !strings.HasSuffix(name, archiveSuffix) {
+			continue
+		}
+		through, err := strconv.ParseUint(strings.TrimSuffix(name, archiveSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		data, err := vfs.ReadFile(fs, filepath.Join(dir, name))
+		if err != nil {
+			return nil, 0, err
+		}
+		records := parseLog(string(data))
+
+		// a segment only holds the records after the base of the log it was
+		// discarded from
+		var base uint64
+		if len(records) > 0 && records[0].base {
+			base = records[0].lsn
+		}
+		if through > last && base > last {
+			return nil, 0, ErrArchiveGap
+		}
+
+		for _, r := range records {
+			switch {
+			case r.time != 0:
+				written = r.time
+				continue
+			case r.base || r.lsn <= last:
+				continue
+			case target.LSN != 0 && r.lsn > target.LSN:
+				break segments
+			case !target.Time.IsZero() && written > target.Time.UnixMilli():
+				break segments
+			}
+
+			lines = append(lines, r.line)
+			last = r.lsn
+		}
+	}
+	return lines, last, nil
+}
@@ -0,0 +1,171 @@
+package wal
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
+)
+
+var (
+	ErrInvalidRecord = errors.New("line is not a log record")
+	ErrStaleLSN      = errors.New("record LSN is not above the last one")
+)
+
+// SetRecordHook makes fn receive every record appended from now on, in LSN
+// order and without its newline. fn is called with the log locked, so it
+// must not block nor use the log.
+func (w *WAL) SetRecordHook(fn func(record string)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.hook = fn
+}
+
+// SetSyncHook makes fn receive every record appended from now on once
+// Persist has synced it to disk, in LSN order and without its newline. fn
+// is called with the log locked, so it must not block nor use the log.
+func (w *WAL) SetSyncHook(fn func(record string)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.syncHook = fn
+}
+
+// SyncedLSN returns the LSN up to which every record logged is on disk.
+func (w *WAL) SyncedLSN() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.dirty {
+		return w.lastLSN
+	}
+	return w.syncedLSN
+}
+
+// RecordsAfter returns the records with an LSN above lsn, and reports
+// whether the log still holds all of them: it does not once DiscardThrough
+// dropped some, or when lsn is ahead of the log.
+func (w *WAL) RecordsAfter(lsn uint64) ([]string, bool) {
+	return w.RecordsBetween(lsn, math.MaxUint64)
+}
+
+// RecordsBetween is RecordsAfter for the records up to the LSN through, for
+// a reader that gets the ones after it from the record hook.
+func (w *WAL) RecordsBetween(after uint64, through uint64) ([]string, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if after < w.floor || after > w.lastLSN || w.writer.Flush() != nil {
+		return nil, false
+	}
+
+	data, err := vfs.ReadFile(w.fs, w.filepath)
+	if err != nil {
+		return nil, false
+	}
+
+	var lines []string
+	for _, r := range parseLog(string(data)) {
+		if r.lsn > after && r.lsn <= through && r.entries != nil {
+			lines = append(lines, r.line)
+		}
+	}
+	return lines, true
+}
+
+// Retains reports whether RecordsAfter(lsn) would succeed at this point.
+func (w *WAL) Retains(lsn uint64) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return lsn >= w.floor && lsn <= w.lastLSN
+}
+
+// AppendRecord appends a record written by another log, keeping its LSN,
+// and returns its entries for the caller to apply. A record at or below
+// the last LSN is already there and is skipped, with no entries.
+func (w *WAL) AppendRecord(line string) ([]Entry, error) {
+	records := parseLog(line)
+	if len(records) != 1 || records[0].entries == nil || !strings.HasPrefix(line, lsnPrefix) {
+		return nil, ErrInvalidRecord
+	}
+	r := records[0]
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if r.lsn <= w.lastLSN {
+		return nil, nil
+	}
+
+	w.mark(r.lsn)
+	err := w.append(line)
+	if err != nil {
+		return nil, err
+	}
+	w.lastLSN = r.lsn
+	return r.entries, nil
+}
+
+// WriteBatchAt is WriteBatch for a record whose LSN was handed out by
+// another log, which makes changes before entries. It fails with
+// ErrStaleLSN unless lsn is above the last one.
+func (w *WAL) WriteBatchAt(lsn uint64, changes []FamilyChange, entries []Entry) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if lsn <= w.lastLSN {
+		return ErrStaleLSN
+	}
+
+	w.mark(lsn)
+	err := w.append(lsnPrefix + strconv.FormatUint(lsn, 10) + "|" + batchRecord(changes, entries))
+	if err != nil {
+		return err
+	}
+	w.lastLSN = lsn
+	return nil
+}
+
+// ParseRecord decodes a record shipped from another log into its LSN and
+// entries. Records that hold no ops, like the time marks of an archiving
+// log, have no entries.
+func ParseRecord(line string) (uint64, []Entry, error) {
+	records := parseLog(line)
+	if len(records) != 1 || !strings.HasPrefix(line, lsnPrefix) {
+		return 0, nil, ErrInvalidRecord
+	}
+	return records[0].lsn, records[0].entries, nil
+}
+
+// ParseFamilyChanges decodes the changes to the column families of a record
+// shipped from another log, they take effect before its entries.
+func ParseFamilyChanges(line string) []FamilyChange {
+	records := parseLog(line)
+	if len(records) != 1 {
+		return nil
+	}
+	return records[0].families
+}
+
+// FamilyChanges returns the changes to the column families the log holds,
+// in LSN order.
+func (w *WAL) FamilyChanges() ([]FamilyChange, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	err := w.writer.Flush()
+	if err != nil {
+		return nil, err
+	}
+	data, err := vfs.ReadFile(w.fs, w.filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []FamilyChange
+	for _, r := range parseLog(string(data)) {
+		changes = append(changes, r.families...)
+	}
+	return changes, nil
+}
@@ -5,52 +5,205 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 
 	lsmtree "github.com/jiteshchawla1511/KryptonDB/LSM_Tree"
+	"github.com/jiteshchawla1511/KryptonDB/vfs"
 )
 
+// Entry is one write read back from the log. LSN is the log sequence number
+// of the record holding it, the entries of a batch share one. Family names
+// the column family of the write, empty for the default one. Merge names
+// the merge operator of a merge, whose operand is Value. Version stamps
+// the writes of a multi-leader node, see lsmtree.KV.
 type Entry struct {
-	Key    string `json:"k"`
-	Value  string `json:"v"`
-	Delete bool   `json:"-"`
+	Key     string          `json:"k"`
+	Value   string          `json:"v"`
+	Delete  bool            `json:"-"`
+	LSN     uint64          `json:"-"`
+	Family  string          `json:"-"`
+	Merge   string          `json:"-"`
+	Version lsmtree.Version `json:"-"`
+}
+
+// FamilyChange creates or drops a column family. Logging it along with the
+// writes lets followers and recovery make it in order with them. Options
+// are kept for the caller as they are, they must not hold '|' nor a
+// newline.
+type FamilyChange struct {
+	Name    string
+	Drop    bool
+	Options string
+	LSN     uint64
 }
 
 const DefaultWalPath = "wal.aof"
 
+// Every record is one line starting with its LSN, "#12|+|key|value|". Logs
+// written before LSNs existed have no prefix and each of their records
+// takes the LSN after the one before it.
+const (
+	lsnPrefix = "#"
+	// batchOp starts a record holding several ops, see WriteBatch.
+	batchOp = "*"
+	// baseOp is the first record of a log rewritten by DiscardThrough, it
+	// holds no ops and only carries the LSN the log continues from.
+	baseOp = "@"
+	// familyPrefix starts the field naming the column family of an op in a
+	// batch, "~users|+|key|value|".
+	familyPrefix = "~"
+	// versionPrefix starts the field holding the version of an op in a
+	// batch, after its family, as time.prev.node: "^4096.0.n1|+|key|value|".
+	versionPrefix = "^"
+	// familyOp is a change to the column families in a batch, which takes
+	// effect before the ops of the batch: "!|+|users|options|" creates a
+	// family and "!|-|users|" drops one. See FamilyChange.
+	familyOp = "!"
+	// mergeOp records a merge operand, "#12|&|key|operator|operand|".
+	mergeOp = "&"
+	// timeOp holds no ops and carries the wall clock in milliseconds since
+	// the epoch, "#13|%|1700000000000|". The records after it, up to the
+	// next one, were written at or after that time. Its LSN is the one of the
+	// record it precedes. Only archiving logs write it, see SetArchive.
+	timeOp = "%"
+)
+
 type WAL struct {
+	fs       vfs.FS
 	filepath string
-	file     *os.File
+	file     vfs.File
 	writer   *bufio.Writer
 	lock     sync.Mutex
+
+	// size is the length of the log including the buffered records, full
+	// receives once it reaches sizeLimit.
+	size      int64
+	sizeLimit int64
+	full      chan struct{}
+
+	lastLSN uint64
+	// floor is the LSN the log starts after, the records at or below it
+	// were discarded or never logged here.
+	floor uint64
+
+	// archive is the directory DiscardThrough moves records to, lastMark
+	// the time of the newest timeOp record in milliseconds.
+	archive  string
+	lastMark int64
+
+	// hook is called with every record appended, see SetRecordHook.
+	hook func(record string)
+
+	// syncHook is called with every record once it is synced, see
+	// SetSyncHook. unsynced holds the records appended since the last sync
+	// for it, dirty is set while there are any and syncedLSN is the last
+	// LSN logged at that sync.
+	syncHook  func(record string)
+	unsynced  []string
+	dirty     bool
+	syncedLSN uint64
 }
 
-func InitWal(path string) *WAL {
-	var file *os.File
+func InitWal(fs vfs.FS, path string) *WAL {
+	var file vfs.File
 
-	_, err := os.Stat(path)
+	_, err := fs.Stat(path)
 	if os.IsNotExist(err) {
-		file, err = os.Create(path)
+		file, err = fs.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			panic(err)
+		}
+
+		err = fs.SyncDir(filepath.Dir(path))
 		if err != nil {
 			panic(err)
 		}
 	} else {
-		file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		file, err = fs.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
 		if err != nil {
 			panic(err)
 		}
 	}
 
+	data, err := vfs.ReadFile(fs, path)
+	if err != nil {
+		panic(err)
+	}
+
+	// a tail torn by a crash would swallow the next record appended to it
+	size := strings.LastIndex(string(data), "\n") + 1
+	if size < len(data) {
+		err = file.Truncate(int64(size))
+		if err == nil {
+			err = file.Sync()
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var lastLSN, floor uint64
+	records := parseLog(string(data[:size]))
+	if len(records) > 0 {
+		lastLSN = records[len(records)-1].lsn
+		if records[0].base {
+			floor = records[0].lsn
+		}
+	}
+
 	writer := bufio.NewWriter(file)
 	wal := &WAL{
-		filepath: path,
-		file:     file,
-		writer:   writer,
+		fs:        fs,
+		filepath:  path,
+		file:      file,
+		writer:    writer,
+		size:      int64(size),
+		full:      make(chan struct{}, 1),
+		lastLSN:   lastLSN,
+		floor:     floor,
+		syncedLSN: lastLSN,
 	}
 	return wal
 }
 
+// LastLSN returns the LSN of the newest record.
+func (w *WAL) LastLSN() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.lastLSN
+}
+
+// AdvanceLSN makes the next record get an LSN above lsn, so that numbers
+// already handed out and applied elsewhere are never reused.
+func (w *WAL) AdvanceLSN(lsn uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if lsn > w.lastLSN {
+		w.lastLSN = lsn
+		w.floor = lsn
+	}
+}
+
+// ReserveLSN hands out an LSN for writes that bypass the log, so that they
+// are ordered after every record logged so far and before the next one.
+func (w *WAL) ReserveLSN() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.lastLSN++
+	return w.lastLSN
+}
+
+// nextLSN hands out the LSN of a new record. The caller must hold w.lock.
+func (w *WAL) nextLSN() string {
+	w.lastLSN++
+	return lsnPrefix + strconv.FormatUint(w.lastLSN, 10) + "|"
+}
+
 func (w *WAL) Write(data ...[]byte) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
@@ -63,19 +216,130 @@ func (w *WAL) Write(data ...[]byte) error {
 		}
 	}
 
-	limit := []byte("|")
+	w.mark(w.lastLSN + 1)
 
+	var record strings.Builder
+	record.WriteString(w.nextLSN())
 	for _, d := range data {
-		d = append(d, limit...)
-		_, err := w.writer.Write(d)
-		if err != nil {
-			return err
+		record.Write(d)
+		record.WriteString("|")
+	}
+
+	return w.append(record.String())
+}
+
+// WriteBatch appends entries as one record, so that recovery applies either
+// all of them or, if the record was torn by a crash, none of them.
+func (w *WAL) WriteBatch(entries []Entry) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.mark(w.lastLSN + 1)
+	return w.append(w.nextLSN() + batchRecord(nil, entries))
+}
+
+// WriteFamilyChanges logs changes as one batch record without writes and
+// returns its LSN.
+func (w *WAL) WriteFamilyChanges(changes []FamilyChange) (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.mark(w.lastLSN + 1)
+	err := w.append(w.nextLSN() + batchRecord(changes, nil))
+	if err != nil {
+		return 0, err
+	}
+	return w.lastLSN, nil
+}
+
+// batchRecord encodes changes and entries as the fields of a batch record,
+// without its LSN.
+func batchRecord(changes []FamilyChange, entries []Entry) string {
+	var record strings.Builder
+	record.WriteString(batchOp + "|" + strconv.Itoa(len(changes)+len(entries)) + "|")
+	for _, change := range changes {
+		if change.Drop {
+			record.WriteString(familyOp + "|-|" + change.Name + "|")
+		} else {
+			record.WriteString(familyOp + "|+|" + change.Name + "|" + change.Options + "|")
+		}
+	}
+	for _, entry := range entries {
+		if entry.Family != "" {
+			record.WriteString(familyPrefix + entry.Family + "|")
+		}
+		if entry.Version.Time != 0 {
+			record.WriteString(versionPrefix + formatVersion(entry.Version) + "|")
+		}
+		if entry.Delete {
+			record.WriteString("-|" + entry.Key + "|")
+		} else if entry.Merge != "" {
+			record.WriteString(mergeOp + "|" + entry.Key + "|" + entry.Merge + "|" + entry.Value + "|")
+		} else {
+			record.WriteString("+|" + entry.Key + "|" + entry.Value + "|")
 		}
 	}
-	w.writer.WriteString("\n")
+	return record.String()
+}
+
+// append writes one record, given without its newline, and hands it to the
+// hook set with SetRecordHook. The caller must hold w.lock.
+func (w *WAL) append(record string) error {
+	n, err := w.writer.WriteString(record + "\n")
+	w.grew(n)
+	if err != nil {
+		return err
+	}
+
+	w.dirty = true
+	if w.syncHook != nil {
+		w.unsynced = append(w.unsynced, record)
+	}
+	if w.hook != nil {
+		w.hook(record)
+	}
 	return nil
 }
 
+// synced hands the records appended since the last sync to the hook set
+// with SetSyncHook, now that they are on disk. The caller must hold w.lock.
+func (w *WAL) synced() {
+	for _, record := range w.unsynced {
+		w.syncHook(record)
+	}
+	w.unsynced = nil
+	w.dirty = false
+	w.syncedLSN = w.lastLSN
+}
+
+// SetSizeLimit makes Full fire once the log holds limit bytes, 0 turns it
+// off.
+func (w *WAL) SetSizeLimit(limit int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.sizeLimit = limit
+	w.grew(0)
+}
+
+// Full receives when the log has grown past the limit given to SetSizeLimit.
+func (w *WAL) Full() <-chan struct{} {
+	return w.full
+}
+
+// grew accounts for n more bytes. The caller must hold w.lock.
+func (w *WAL) grew(n int) {
+	w.size += int64(n)
+	if w.sizeLimit <= 0 || w.size < w.sizeLimit {
+		return
+	}
+
+	select {
+	case w.full <- struct{}{}:
+	default:
+	}
+}
+
 func (w *WAL) Persist() error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
@@ -91,33 +355,111 @@ func (w *WAL) Persist() error {
 	}
 
 	w.writer.Reset(w.file)
+	w.synced()
 	return nil
 }
 
+// Close persists the buffered records and closes the log file.
+func (w *WAL) Close() error {
+	err := w.Persist()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 func (w *WAL) ReadEntries() []Entry {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	file, err := os.OpenFile(w.filepath, os.O_RDONLY, 0644)
+	file, err := w.fs.Open(w.filepath)
 	if err != nil {
 		panic(err)
 	}
+	defer file.Close()
 
-	reader := bufio.NewReader(file)
+	data, err := io.ReadAll(bufio.NewReader(file))
 
 	if err != nil {
 		panic(err)
 	}
 
-	data, err := io.ReadAll(reader)
+	return parseRecords(string(data))
+}
+
+func (w *WAL) InitDB(lsmTree *lsmtree.LSMTree) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	file, err := w.fs.Open(w.filepath)
 
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer file.Close()
 
-	cmds := strings.Split(string(data), "\n")
+	data, err := io.ReadAll(bufio.NewReader(file))
 
-	entries := make([]Entry, 0, len(cmds))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range parseRecords(string(data)) {
+		Apply(lsmTree, entry)
+	}
+
+	return nil
+}
+
+// Apply writes one entry read back from a log to lsmTree.
+func Apply(lsmTree *lsmtree.LSMTree, entry Entry) {
+	if entry.Version.Time != 0 {
+		if entry.Delete {
+			lsmTree.DelVersion(entry.Key, entry.Version)
+		} else {
+			lsmTree.PutVersion(entry.Key, entry.Value, entry.Version)
+		}
+	} else if entry.Delete {
+		lsmTree.Del(entry.Key)
+	} else if entry.Merge != "" {
+		lsmTree.Merge(entry.Key, entry.Merge, entry.Value)
+	} else {
+		lsmTree.Put(entry.Key, entry.Value)
+	}
+}
+
+// record is one line of a log and the entries it holds.
+type record struct {
+	lsn      uint64
+	line     string
+	entries  []Entry
+	families []FamilyChange
+	// base is set for a baseOp record and time for a timeOp record.
+	base bool
+	time int64
+}
+
+// parseRecords decodes the entries of a log.
+func parseRecords(data string) []Entry {
+	var entries []Entry
+	for _, r := range parseLog(data) {
+		entries = append(entries, r.entries...)
+	}
+	return entries
+}
+
+// parseLog decodes the records of a log. A torn tail left by a crash has
+// fewer fields than its op needs and is skipped, a torn batch is skipped as
+// a whole.
+func parseLog(data string) []record {
+	cmds := strings.Split(data, "\n")
+
+	records := make([]record, 0, len(cmds))
+	var lsn uint64
 
 	for _, cmd := range cmds {
 		if cmd == "" {
@@ -126,68 +468,248 @@ func (w *WAL) ReadEntries() []Entry {
 
 		args := strings.Split(cmd, "|")
 
+		if strings.HasPrefix(args[0], lsnPrefix) {
+			n, err := strconv.ParseUint(args[0][len(lsnPrefix):], 10, 64)
+			if err != nil || len(args) < 2 {
+				continue
+			}
+			lsn = n
+			args = args[1:]
+		} else {
+			lsn++
+		}
+
+		var entries []Entry
+		var families []FamilyChange
 		switch args[0] {
 		case "+":
 			if len(args) != 4 {
 				continue
 			}
-			entries = append(entries, Entry{Key: args[1], Value: args[2], Delete: false})
+			entries = []Entry{{Key: args[1], Value: args[2], Delete: false}}
 		case "-":
 			if len(args) != 3 {
 				continue
 			}
-			entries = append(entries, Entry{Key: args[1], Delete: true})
+			entries = []Entry{{Key: args[1], Delete: true}}
+		case mergeOp:
+			if len(args) != 5 {
+				continue
+			}
+			entries = []Entry{{Key: args[1], Value: args[3], Merge: args[2]}}
+		case batchOp:
+			batch, changes, ok := parseBatch(args)
+			if !ok {
+				continue
+			}
+			entries, families = batch, changes
+		case baseOp:
+			if len(args) != 2 {
+				continue
+			}
+		case timeOp:
+			if len(args) != 3 {
+				continue
+			}
+			ms, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			records = append(records, record{lsn: lsn, line: cmd, time: ms})
+			continue
+		default:
+			continue
+		}
+
+		for i := range entries {
+			entries[i].LSN = lsn
+		}
+		for i := range families {
+			families[i].LSN = lsn
 		}
+		records = append(records, record{lsn: lsn, line: cmd, entries: entries, families: families, base: args[0] == baseOp})
 	}
 
-	return entries
+	return records
 }
 
-func (w *WAL) InitDB(lsmTree *lsmtree.LSMTree) error {
+// parseBatch decodes the fields of a batch record and reports whether all
+// of its ops are there. A batch that only changes families has no entries,
+// but a non nil slice of them still.
+func parseBatch(args []string) ([]Entry, []FamilyChange, bool) {
+	if len(args) < 3 {
+		return nil, nil, false
+	}
+
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count < 0 {
+		return nil, nil, false
+	}
+
+	entries := make([]Entry, 0, count)
+	var changes []FamilyChange
+	fields := args[2:]
+	for len(fields) > 1 {
+		if fields[0] == familyOp {
+			switch {
+			case fields[1] == "+" && len(fields) >= 4:
+				changes = append(changes, FamilyChange{Name: fields[2], Options: fields[3]})
+				fields = fields[4:]
+			case fields[1] == "-" && len(fields) >= 3:
+				changes = append(changes, FamilyChange{Name: fields[2], Drop: true})
+				fields = fields[3:]
+			default:
+				return nil, nil, false
+			}
+			continue
+		}
+
+		var family string
+		if strings.HasPrefix(fields[0], familyPrefix) {
+			family = fields[0][len(familyPrefix):]
+			fields = fields[1:]
+			if len(fields) < 2 {
+				return nil, nil, false
+			}
+		}
+		var version lsmtree.Version
+		if strings.HasPrefix(fields[0], versionPrefix) {
+			var ok bool
+			version, ok = parseVersion(fields[0][len(versionPrefix):])
+			fields = fields[1:]
+			if !ok || len(fields) < 2 {
+				return nil, nil, false
+			}
+		}
+
+		switch fields[0] {
+		case "+":
+			if len(fields) < 4 {
+				return nil, nil, false
+			}
+			entries = append(entries, Entry{Key: fields[1], Value: fields[2], Family: family, Version: version})
+			fields = fields[3:]
+		case "-":
+			entries = append(entries, Entry{Key: fields[1], Delete: true, Family: family, Version: version})
+			fields = fields[2:]
+		case mergeOp:
+			if len(fields) < 5 {
+				return nil, nil, false
+			}
+			entries = append(entries, Entry{Key: fields[1], Value: fields[3], Merge: fields[2], Family: family})
+			fields = fields[4:]
+		default:
+			return nil, nil, false
+		}
+	}
+
+	// a complete record ends with the empty field after its last '|'
+	if len(entries)+len(changes) != count || len(fields) != 1 || fields[0] != "" {
+		return nil, nil, false
+	}
+	return entries, changes, true
+}
+
+func formatVersion(version lsmtree.Version) string {
+	return strconv.FormatUint(version.Time, 10) + "." + strconv.FormatUint(version.Prev, 10) + "." + version.Node
+}
+
+// parseVersion decodes the field of a versionPrefix, the node being last as
+// its ID can hold dots.
+func parseVersion(field string) (lsmtree.Version, bool) {
+	parts := strings.SplitN(field, ".", 3)
+	if len(parts) != 3 {
+		return lsmtree.Version{}, false
+	}
+	time, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return lsmtree.Version{}, false
+	}
+	prev, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return lsmtree.Version{}, false
+	}
+	return lsmtree.Version{Time: time, Prev: prev, Node: parts[2]}, true
+}
+
+// CopyThrough writes the records with an LSN at or below lsn to a new log at
+// path. It ends with a base record, so that the copy continues after lsn
+// even when the last LSNs were reserved rather than logged.
+func (w *WAL) CopyThrough(path string, lsn uint64) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	file, err := os.OpenFile(w.filepath, os.O_RDONLY, 0644)
-
+	err := w.writer.Flush()
 	if err != nil {
 		return err
 	}
 
-	reader := bufio.NewReader(file)
-
+	data, err := vfs.ReadFile(w.fs, w.filepath)
 	if err != nil {
 		return err
 	}
 
-	data, err := io.ReadAll(reader)
+	var kept strings.Builder
+	for _, r := range parseLog(string(data)) {
+		if r.lsn <= lsn {
+			kept.WriteString(r.line + "\n")
+		}
+	}
+	kept.WriteString(lsnPrefix + strconv.FormatUint(lsn, 10) + "|" + baseOp + "|\n")
 
+	return vfs.WriteFileAtomic(w.fs, path, []byte(kept.String()))
+}
+
+// DiscardThrough drops the records with an LSN at or below lsn, which the
+// caller has made durable elsewhere, and keeps everything logged after them.
+// The log is rewritten to a temporary file that replaces it atomically.
+func (w *WAL) DiscardThrough(lsn uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	err := w.writer.Flush()
 	if err != nil {
 		return err
 	}
 
-	cmds := strings.Split(string(data), "\n")
+	data, err := vfs.ReadFile(w.fs, w.filepath)
+	if err != nil {
+		return err
+	}
+	records := parseLog(string(data))
 
-	for _, cmd := range cmds {
-		if cmd == "" {
-			continue
+	if w.archive != "" {
+		err = w.archiveThrough(records, lsn)
+		if err != nil {
+			return err
 		}
+	}
 
-		args := strings.Split(cmd, "|")
-
-		switch args[0] {
-		case "+":
-			lsmTree.Put(args[1], args[2])
-		case "-":
-			lsmTree.Del(args[1])
+	var kept strings.Builder
+	kept.WriteString(lsnPrefix + strconv.FormatUint(lsn, 10) + "|" + baseOp + "|\n")
+	for _, r := range records {
+		if r.lsn > lsn {
+			kept.WriteString(r.line + "\n")
 		}
 	}
 
-	return nil
-}
+	err = vfs.WriteFileAtomic(w.fs, w.filepath, []byte(kept.String()))
+	if err != nil {
+		return err
+	}
 
-func (w *WAL) Truncate() {
-	w.lock.Lock()
-	defer w.lock.Unlock()
-	w.file.Truncate(0)
-	w.file.Seek(0, 0)
+	file, err := w.fs.OpenFile(w.filepath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.writer.Reset(file)
+	w.size = int64(kept.Len())
+	if lsn > w.floor {
+		w.floor = lsn
+	}
+	// the rewritten log is on disk, records kept in it included
+	w.synced()
+	return nil
 }